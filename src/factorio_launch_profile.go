@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LaunchProfile holds additional command line options used for a single run of the server
+type LaunchProfile struct {
+	Name               string   `json:"name"`
+	MapGenSettings     string   `json:"map_gen_settings,omitempty"`
+	MapSettings        string   `json:"map_settings,omitempty"`
+	UseServerWhitelist bool     `json:"use_server_whitelist"`
+	ServerWhitelist    string   `json:"server_whitelist,omitempty"`
+	ServerBanlist      string   `json:"server_banlist,omitempty"`
+	ModDirectory       string   `json:"mod_directory,omitempty"`
+	ConsoleLog         string   `json:"console_log,omitempty"`
+	CustomArgs         []string `json:"custom_args,omitempty"`
+}
+
+type LaunchProfileList struct {
+	Profiles    []LaunchProfile `json:"profiles"`
+	Destination string          `json:"-"`
+}
+
+// launchOptionMinVersion is the first factorio version knowing the command line option
+var launchOptionMinVersion = map[string]Version{
+	"--map-gen-settings":     {0, 13, 0},
+	"--map-settings":         {0, 15, 0},
+	"--mod-directory":        {0, 13, 0},
+	"--server-banlist":       {0, 15, 0},
+	"--use-server-whitelist": {0, 17, 0},
+	"--server-whitelist":     {0, 17, 0},
+	"--console-log":          {0, 16, 0},
+}
+
+// reservedLaunchOptions are managed by the server manager itself and may not be overwritten by profiles
+var reservedLaunchOptions = []string{
+	"--bind",
+	"--port",
+	"--server-settings",
+	"--rcon-port",
+	"--rcon-password",
+	"--rcon-bind",
+	"--server-adminlist",
+	"--start-server",
+	"--start-server-load-latest",
+	"--start-server-load-scenario",
+	"--executable-path",
+	"--create",
+}
+
+func newLaunchProfileList(destination string) (LaunchProfileList, error) {
+	var err error
+	profileList := LaunchProfileList{
+		Destination: destination,
+	}
+
+	err = profileList.load()
+	if err != nil {
+		log.Printf("error loading launch profiles: %s", err)
+		return profileList, err
+	}
+
+	return profileList, nil
+}
+
+func (profileList *LaunchProfileList) load() error {
+	file, err := ioutil.ReadFile(profileList.Destination)
+	if os.IsNotExist(err) {
+		profileList.Profiles = []LaunchProfile{}
+		return nil
+	}
+	if err != nil {
+		log.Printf("error reading launch profiles file: %s", err)
+		return err
+	}
+
+	err = json.Unmarshal(file, profileList)
+	if err != nil {
+		log.Printf("error decoding launch profiles file: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (profileList *LaunchProfileList) save() error {
+	newJson, err := json.MarshalIndent(profileList, "", "    ")
+	if err != nil {
+		log.Printf("error encoding launch profiles: %s", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(profileList.Destination, newJson, 0664)
+	if err != nil {
+		log.Printf("error writing launch profiles file: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+func (profileList *LaunchProfileList) find(name string) (*LaunchProfile, bool) {
+	for index := range profileList.Profiles {
+		if profileList.Profiles[index].Name == name {
+			return &profileList.Profiles[index], true
+		}
+	}
+
+	return nil, false
+}
+
+// saveProfile adds the profile or replaces the one with the same name
+func (profileList *LaunchProfileList) saveProfile(profile LaunchProfile) error {
+	if profile.Name == "" {
+		return errors.New("launch profile name cannot be blank")
+	}
+
+	if existing, found := profileList.find(profile.Name); found {
+		*existing = profile
+	} else {
+		profileList.Profiles = append(profileList.Profiles, profile)
+	}
+
+	return profileList.save()
+}
+
+func (profileList *LaunchProfileList) deleteProfile(name string) error {
+	for index, profile := range profileList.Profiles {
+		if profile.Name == name {
+			profileList.Profiles = append(profileList.Profiles[:index], profileList.Profiles[index+1:]...)
+			return profileList.save()
+		}
+	}
+
+	return fmt.Errorf("launch profile %s does not exist", name)
+}
+
+// resolveConfigPath makes relative paths relative to the factorio config directory
+func resolveConfigPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(config.FactorioConfigDir, path)
+}
+
+// Args returns the command line arguments defined by the profile
+func (profile *LaunchProfile) Args() []string {
+	var args []string
+
+	if profile.MapGenSettings != "" {
+		args = append(args, "--map-gen-settings", resolveConfigPath(profile.MapGenSettings))
+	}
+	if profile.MapSettings != "" {
+		args = append(args, "--map-settings", resolveConfigPath(profile.MapSettings))
+	}
+	if profile.UseServerWhitelist {
+		args = append(args, "--use-server-whitelist")
+	}
+	if profile.ServerWhitelist != "" {
+		args = append(args, "--server-whitelist", resolveConfigPath(profile.ServerWhitelist))
+	}
+	if profile.ServerBanlist != "" {
+		args = append(args, "--server-banlist", resolveConfigPath(profile.ServerBanlist))
+	}
+	if profile.ModDirectory != "" {
+		args = append(args, "--mod-directory", resolveConfigPath(profile.ModDirectory))
+	}
+	if profile.ConsoleLog != "" {
+		args = append(args, "--console-log", resolveConfigPath(profile.ConsoleLog))
+	}
+
+	return append(args, profile.CustomArgs...)
+}
+
+// Validate checks, that the profile can be used with the given factorio version
+func (profile *LaunchProfile) Validate(game Version) error {
+	files := map[string]string{
+		"--map-gen-settings": profile.MapGenSettings,
+		"--map-settings":     profile.MapSettings,
+		"--server-whitelist": profile.ServerWhitelist,
+		"--server-banlist":   profile.ServerBanlist,
+		"--mod-directory":    profile.ModDirectory,
+	}
+	for option, path := range files {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(resolveConfigPath(path)); err != nil {
+			return fmt.Errorf("file for %s not usable: %v", option, err)
+		}
+	}
+
+	for _, arg := range profile.Args() {
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		option := strings.SplitN(arg, "=", 2)[0]
+
+		for _, reserved := range reservedLaunchOptions {
+			if option == reserved {
+				return fmt.Errorf("option %s is managed by the server manager and cannot be set in a profile", option)
+			}
+		}
+
+		// versions without a detected factorio version are not checked
+		if minVersion, ok := launchOptionMinVersion[option]; ok && !game.Equals(NilVersion) && game.Less(minVersion) {
+			return fmt.Errorf("option %s requires factorio %s, installed is %s", option, minVersion, game)
+		}
+	}
+
+	for _, arg := range profile.CustomArgs {
+		if strings.TrimSpace(arg) == "" {
+			return errors.New("custom arguments cannot be blank")
+		}
+	}
+	if len(profile.CustomArgs) > 0 && !strings.HasPrefix(profile.CustomArgs[0], "--") {
+		return fmt.Errorf("custom arguments have to start with an option, got %s", profile.CustomArgs[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// withLaunchProfileConfigDir points the factorio config dir to a new temp dir with a map-gen-settings.json,
+// the returned func restores it
+func withLaunchProfileConfigDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "fsm-launch-profiles")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "map-gen-settings.json"), []byte("{}"), 0644); err != nil {
+		t.Fatalf("Error writing map-gen-settings: %s", err)
+	}
+
+	configDir := config.FactorioConfigDir
+	config.FactorioConfigDir = dir
+
+	return dir, func() {
+		config.FactorioConfigDir = configDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLaunchProfileArgs(t *testing.T) {
+	dir, restore := withLaunchProfileConfigDir(t)
+	defer restore()
+
+	tests := []struct {
+		name    string
+		profile LaunchProfile
+		args    []string
+	}{
+		{"empty", LaunchProfile{Name: "empty"}, nil},
+		{
+			"relative paths",
+			LaunchProfile{MapGenSettings: "map-gen-settings.json", ServerBanlist: "banlist.json", UseServerWhitelist: true},
+			[]string{
+				"--map-gen-settings", filepath.Join(dir, "map-gen-settings.json"),
+				"--use-server-whitelist",
+				"--server-banlist", filepath.Join(dir, "banlist.json"),
+			},
+		},
+		{
+			"absolute paths",
+			LaunchProfile{ModDirectory: "/opt/mods", ConsoleLog: "/var/log/console.log"},
+			[]string{"--mod-directory", "/opt/mods", "--console-log", "/var/log/console.log"},
+		},
+		{
+			"custom args last",
+			LaunchProfile{MapSettings: "map-settings.json", CustomArgs: []string{"--no-auto-pause", "--verbose"}},
+			[]string{"--map-settings", filepath.Join(dir, "map-settings.json"), "--no-auto-pause", "--verbose"},
+		},
+	}
+
+	for _, test := range tests {
+		if args := test.profile.Args(); !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: args not equal: %v --- %v", test.name, args, test.args)
+		}
+	}
+}
+
+func TestLaunchProfileValidate(t *testing.T) {
+	_, restore := withLaunchProfileConfigDir(t)
+	defer restore()
+
+	tests := []struct {
+		name    string
+		profile LaunchProfile
+		game    Version
+		valid   bool
+	}{
+		{"empty", LaunchProfile{}, Version{1, 1, 110}, true},
+		{"existing file", LaunchProfile{MapGenSettings: "map-gen-settings.json"}, Version{1, 1, 110}, true},
+		{"missing file", LaunchProfile{MapSettings: "missing.json"}, Version{1, 1, 110}, false},
+		{"custom option", LaunchProfile{CustomArgs: []string{"--no-auto-pause"}}, Version{1, 1, 110}, true},
+		{"custom option with value", LaunchProfile{CustomArgs: []string{"--max-upload-slots", "5"}}, Version{1, 1, 110}, true},
+		{"reserved option", LaunchProfile{CustomArgs: []string{"--port", "34197"}}, Version{1, 1, 110}, false},
+		{"reserved option with value", LaunchProfile{CustomArgs: []string{"--rcon-password=secret"}}, Version{1, 1, 110}, false},
+		{"blank custom arg", LaunchProfile{CustomArgs: []string{"--verbose", " "}}, Version{1, 1, 110}, false},
+		{"custom args without option", LaunchProfile{CustomArgs: []string{"5"}}, Version{1, 1, 110}, false},
+		{"option too new", LaunchProfile{UseServerWhitelist: true}, Version{0, 16, 51}, false},
+		{"option new enough", LaunchProfile{UseServerWhitelist: true}, Version{0, 17, 0}, true},
+		{"unknown version", LaunchProfile{UseServerWhitelist: true}, NilVersion, true},
+	}
+
+	for _, test := range tests {
+		err := test.profile.Validate(test.game)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: valid not equal: %v --- %v (%v)", test.name, err == nil, test.valid, err)
+		}
+	}
+}
+
+func TestLaunchProfileList(t *testing.T) {
+	dir, restore := withLaunchProfileConfigDir(t)
+	defer restore()
+
+	path := filepath.Join(dir, "launch-profiles.json")
+	profileList, err := newLaunchProfileList(path)
+	if err != nil {
+		t.Fatalf("Error loading missing launch profiles: %s", err)
+	}
+
+	if err := profileList.saveProfile(LaunchProfile{}); err == nil {
+		t.Errorf("Expected error saving profile without name")
+	}
+	if err := profileList.saveProfile(LaunchProfile{Name: "pvp", CustomArgs: []string{"--verbose"}}); err != nil {
+		t.Fatalf("Error saving profile: %s", err)
+	}
+	if err := profileList.saveProfile(LaunchProfile{Name: "pvp", UseServerWhitelist: true}); err != nil {
+		t.Fatalf("Error replacing profile: %s", err)
+	}
+
+	profileList, err = newLaunchProfileList(path)
+	if err != nil {
+		t.Fatalf("Error loading launch profiles: %s", err)
+	}
+	expected := []LaunchProfile{{Name: "pvp", UseServerWhitelist: true}}
+	if !reflect.DeepEqual(profileList.Profiles, expected) {
+		t.Errorf("Profiles not equal: %+v --- %+v", profileList.Profiles, expected)
+	}
+
+	if err := profileList.deleteProfile("missing"); err == nil {
+		t.Errorf("Expected error deleting missing profile")
+	}
+	if err := profileList.deleteProfile("pvp"); err != nil {
+		t.Errorf("Error deleting profile: %s", err)
+	}
+	if _, found := profileList.find("pvp"); found {
+		t.Errorf("Deleted profile still found")
+	}
+}
@@ -2,12 +2,29 @@ package main
 
 import (
 	"archive/zip"
-	"encoding/binary"
+	"bufio"
+	"compress/zlib"
 	"errors"
 	"fmt"
 	"io"
 )
 
+// ErrUnsupportedSaveFormat is returned for saves written by factorio versions, whose header format is unknown
+var ErrUnsupportedSaveFormat = errors.New("unsupported save format")
+
+// oldest and newest factorio version, whose save header can be read.
+// The layout is only checked against the test saves up to 0.17, so newer headers are refused instead of guessed.
+// 0.17.79 is the last release of 0.17.
+var (
+	minSaveVersion = Version{0, 12, 0, 0}
+	maxSaveVersion = Version{0, 17, 79, 65535}
+)
+
+// saveHeaderFiles are the files inside the save, which start with the save header.
+// Older saves contain an uncompressed level.dat, newer ones split it into zlib compressed level.dat0..N chunks
+// and may compress level-init.dat as well.
+var saveHeaderFiles = []string{"level.dat", "level-init.dat", "level.dat0"}
+
 type archiveFile struct {
 	io.ReadCloser
 	archive io.Closer
@@ -50,11 +67,59 @@ func OpenArchiveFile(path string, name string) (r io.ReadCloser, err error) {
 	return nil, errors.New("file not found")
 }
 
+// saveHeaderFile is a (possibly decompressed) level file inside a save archive
+type saveHeaderFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (sf *saveHeaderFile) Close() error {
+	var err error
+	for _, closer := range sf.closers {
+		if err2 := closer.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// OpenSaveHeaderFile opens the first file of the save containing the header and decompresses it, if needed
+func OpenSaveHeaderFile(path string) (io.ReadCloser, error) {
+	for _, name := range saveHeaderFiles {
+		f, err := OpenArchiveFile(path, name)
+		if err != nil {
+			continue
+		}
+
+		buffered := bufio.NewReader(f)
+		magic, err := buffered.Peek(2)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("read %s: %v", name, err)
+		}
+
+		// uncompressed headers start with the little endian major version, so they never look like a zlib header
+		if magic[0] == 0x78 && (uint16(magic[0])<<8|uint16(magic[1]))%31 == 0 {
+			zr, err := zlib.NewReader(buffered)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("decompress %s: %v", name, err)
+			}
+			return &saveHeaderFile{Reader: zr, closers: []io.Closer{zr, f}}, nil
+		}
+
+		return &saveHeaderFile{Reader: buffered, closers: []io.Closer{f}}, nil
+	}
+
+	return nil, errors.New("no level file found in save")
+}
+
 type SaveHeader struct {
 	FactorioVersion           Version                      `json:"factorio_version"`
 	Campaign                  string                       `json:"campaign"`
 	Name                      string                       `json:"name"`
 	BaseMod                   string                       `json:"base_mod"`
+	QualityVersion            uint8                        `json:"quality_version"`
 	Difficulty                uint8                        `json:"difficulty"`
 	Finished                  bool                         `json:"finished"`
 	PlayerWon                 bool                         `json:"player_won"`
@@ -77,112 +142,55 @@ type Mod struct {
 }
 
 func (h *SaveHeader) ReadFrom(r io.Reader) (err error) {
-	var scratch [8]byte
-
-	var fv version64
-	_, err = r.Read(scratch[:8])
-	if err != nil {
-		return err
-	}
-	if err := fv.UnmarshalBinary(scratch[:8]); err != nil {
-		return fmt.Errorf("read FactorioVersion: %v", err)
-	}
-	h.FactorioVersion = Version(fv)
-
-	atLeast016 := !h.FactorioVersion.Less(Version{0, 16, 0, 0})
-
-	if h.FactorioVersion.Greater(Version{0, 17, 0, 0}) {
-		//FIXME correct naming
-		_, err = r.Read(scratch[:1])
-		if err != nil {
-			return fmt.Errorf("read first random 0.17 byte: %v", err)
-		}
-	}
-
-	h.Campaign, err = readString(r, Version(h.FactorioVersion), false)
-	if err != nil {
-		return fmt.Errorf("read Campaign: %v", err)
-	}
+	_, err = h.readFrom(r)
+	return err
+}
 
-	h.Name, err = readString(r, Version(h.FactorioVersion), false)
-	if err != nil {
-		return fmt.Errorf("read Name: %v", err)
-	}
+// readFrom reads the header from the beginning of a level file, n is the number of bytes consumed
+func (h *SaveHeader) readFrom(r io.Reader) (n int64, err error) {
+	d := newSaveDecoder(r)
+	defer func() { n = d.n }()
 
-	h.BaseMod, err = readString(r, Version(h.FactorioVersion), false)
-	if err != nil {
-		return fmt.Errorf("read BaseMod: %v", err)
+	h.FactorioVersion = d.readVersion64("FactorioVersion")
+	if d.Err() != nil {
+		return 0, d.Err()
 	}
+	d.game = h.FactorioVersion
 
-	_, err = r.Read(scratch[:1])
-	if err != nil {
-		return fmt.Errorf("read Difficulty: %v", err)
+	if h.FactorioVersion.Less(minSaveVersion) || h.FactorioVersion.Greater(maxSaveVersion) {
+		return 0, fmt.Errorf("%w: factorio %s", ErrUnsupportedSaveFormat, h.FactorioVersion)
 	}
-	h.Difficulty = scratch[0]
 
-	_, err = r.Read(scratch[:1])
-	if err != nil {
-		return fmt.Errorf("read Finished: %v", err)
-	}
-	h.Finished = scratch[0] != 0
+	atLeast016 := !h.FactorioVersion.Less(Version{0, 16, 0, 0})
 
-	_, err = r.Read(scratch[:1])
-	if err != nil {
-		return fmt.Errorf("read PlayerWon: %v", err)
+	// since 0.17 the map version is followed by its quality version
+	if h.FactorioVersion.Greater(Version{0, 17, 0, 0}) {
+		h.QualityVersion = d.readUint8("QualityVersion")
 	}
-	h.PlayerWon = scratch[0] != 0
 
-	h.NextLevel, err = readString(r, Version(h.FactorioVersion), false)
-	if err != nil {
-		return fmt.Errorf("read NextLevel: %v", err)
-	}
+	h.Campaign = d.readString("Campaign", false)
+	h.Name = d.readString("Name", false)
+	h.BaseMod = d.readString("BaseMod", false)
+	h.Difficulty = d.readUint8("Difficulty")
+	h.Finished = d.readBool("Finished")
+	h.PlayerWon = d.readBool("PlayerWon")
+	h.NextLevel = d.readString("NextLevel", false)
 
 	if !h.FactorioVersion.Less(Version{0, 12, 0, 0}) {
-		_, err = r.Read(scratch[:1])
-		if err != nil {
-			return fmt.Errorf("read CanContinue: %v", err)
-		}
-		h.CanContinue = scratch[0] != 0
-
-		_, err = r.Read(scratch[:1])
-		if err != nil {
-			return fmt.Errorf("read FinishedButContinuing: %v", err)
-		}
-		h.FinishedButContinuing = scratch[0] != 0
+		h.CanContinue = d.readBool("CanContinue")
+		h.FinishedButContinuing = d.readBool("FinishedButContinuing")
 	}
 
-	_, err = r.Read(scratch[:1])
-	if err != nil {
-		return fmt.Errorf("read SavingReplay: %v", err)
-	}
-	h.SavingReplay = scratch[0] != 0
+	h.SavingReplay = d.readBool("SavingReplay")
 
 	if atLeast016 {
-		_, err = r.Read(scratch[:1])
-		if err != nil {
-			return fmt.Errorf("read AllowNonAdminDebugOptions: %v", err)
-		}
-		h.AllowNonAdminDebugOptions = scratch[0] != 0
-	}
-
-	var loadedFrom version48
-	err = loadedFrom.ReadFrom(r, Version(h.FactorioVersion))
-	if err != nil {
-		return fmt.Errorf("read LoadedFrom: %v", err)
+		h.AllowNonAdminDebugOptions = d.readBool("AllowNonAdminDebugOptions")
 	}
-	h.LoadedFrom = Version(loadedFrom)
 
-	_, err = r.Read(scratch[:2])
-	if err != nil {
-		return fmt.Errorf("read LoadedFromBuild: %v", err)
-	}
-	h.LoadedFromBuild = binary.LittleEndian.Uint16(scratch[:2])
+	h.LoadedFrom = d.readVersion48("LoadedFrom")
+	h.LoadedFromBuild = d.readUint16("LoadedFromBuild")
 
-	_, err = r.Read(scratch[:1])
-	if err != nil {
-		return fmt.Errorf("read AllowedCommands: %v", err)
-	}
-	h.AllowedCommands = scratch[0]
+	h.AllowedCommands = d.readUint8("AllowedCommands")
 	if h.FactorioVersion.Less(Version{0, 13, 0, 87}) {
 		if h.AllowedCommands == 0 {
 			h.AllowedCommands = 2
@@ -192,157 +200,52 @@ func (h *SaveHeader) ReadFrom(r io.Reader) (err error) {
 	}
 
 	if h.FactorioVersion.Less(Version{0, 13, 0, 42}) {
-		h.Stats, err = h.readStats(r)
-		if err != nil {
-			return fmt.Errorf("read Stats: %v", err)
-		}
+		h.Stats = h.readStats(d)
 	}
 
-	var n uint32
-	if atLeast016 {
-		n, err = readOptimUint(r, Version(h.FactorioVersion), 32)
-		if err != nil {
-			return fmt.Errorf("read num mods: %v", err)
-		}
-	} else {
-		_, err = r.Read(scratch[:4])
-		if err != nil {
-			return fmt.Errorf("read num mods: %v", err)
-		}
-		n = binary.LittleEndian.Uint32(scratch[:4])
+	numMods := d.readCount("num mods", atLeast016, maxSaveModCount)
+	if d.Err() != nil {
+		return 0, d.Err()
 	}
 
-	for i := uint32(0); i < n; i++ {
+	h.Mods = make([]Mod, 0, numMods)
+	for i := uint32(0); i < numMods; i++ {
 		var m Mod
-		if err = (&m).ReadFrom(r, Version(h.FactorioVersion)); err != nil {
-			return fmt.Errorf("read mod: %v", err)
+		m.decode(d)
+		if d.Err() != nil {
+			return 0, fmt.Errorf("read mod %d: %w", i, d.Err())
 		}
 		h.Mods = append(h.Mods, m)
 	}
 
-	return nil
-}
-
-func readOptimUint(r io.Reader, v Version, bitSize int) (uint32, error) {
-	var b [4]byte
-	if !v.Less(Version{0, 14, 14, 0}) {
-		_, err := r.Read(b[:1])
-		if err != nil {
-			return 0, err
-		}
-		if b[0] != 0xFF {
-			return uint32(b[0]), nil
-		}
-	}
-
-	if bitSize < 0 || bitSize > 64 || (bitSize%8 != 0) {
-		panic("invalid bit size")
-	}
-
-	_, err := r.Read(b[:bitSize/8])
-	if err != nil {
-		return 0, err
-	}
-
-	switch bitSize {
-	case 16:
-		return uint32(binary.LittleEndian.Uint16(b[:2])), nil
-	case 32:
-		return binary.LittleEndian.Uint32(b[:4]), nil
-	default:
-		panic("invalid bit size")
-	}
-}
-
-func readString(r io.Reader, game Version, forceOptimized bool) (s string, err error) {
-	var n uint32
-
-	if !game.Less(Version{0, 16, 0, 0}) || forceOptimized {
-		n, err = readOptimUint(r, game, 32)
-		if err != nil {
-			return "", err
-		}
-	} else {
-		var b [4]byte
-		_, err := r.Read(b[:])
-		if err != nil {
-			return "", fmt.Errorf("failed to read string length: %v", err)
-		}
-		n = uint32(binary.LittleEndian.Uint32(b[:]))
-	}
-
-	d := make([]byte, n)
-	_, err = r.Read(d)
-	if err != nil {
-		return "", fmt.Errorf("failed to read string: %v", err)
-	}
-
-	return string(d), nil
+	return 0, nil
 }
 
-func (h SaveHeader) readStats(r io.Reader) (stats map[byte][]map[uint16]uint32, err error) {
-	var scratch [4]byte
-	stats = make(map[byte][]map[uint16]uint32)
+func (h SaveHeader) readStats(d *saveDecoder) map[byte][]map[uint16]uint32 {
+	stats := make(map[byte][]map[uint16]uint32)
 
-	_, err = r.Read(scratch[:4])
-	if err != nil {
-		return nil, err
-	}
-	n := binary.LittleEndian.Uint32(scratch[:4])
-	for i := uint32(0); i < n; i++ {
-		_, err := r.Read(scratch[:1])
-		if err != nil {
-			return nil, fmt.Errorf("read stat %d force id: %v", i, err)
-		}
-		id := scratch[1]
+	n := d.readCount("Stats count", false, maxSaveStatsCount)
+	for i := uint32(0); i < n && d.Err() == nil; i++ {
+		id := d.readUint8(fmt.Sprintf("stat %d force id", i))
 		for j := 0; j < 3; j++ {
 			st := make(map[uint16]uint32)
-			_, err = r.Read(scratch[:4])
-			if err != nil {
-				return nil, fmt.Errorf("read stat %d (id %d) length: %v", i, id, err)
-			}
-			length := binary.LittleEndian.Uint32(scratch[:4])
-			for k := uint32(0); k < length; k++ {
-				_, err = r.Read(scratch[:2])
-				if err != nil {
-					return nil, fmt.Errorf("read stat %d (id %d; index %d) key: %v", i, id, k, err)
-				}
-				key := binary.LittleEndian.Uint16(scratch[:2])
-				_, err = r.Read(scratch[:4])
-				if err != nil {
-					return nil, fmt.Errorf("read stat %d (id %d; index %d) val: %v", i, id, k, err)
-				}
-				val := binary.LittleEndian.Uint32(scratch[:4])
-				st[key] = val
+			length := d.readCount(fmt.Sprintf("stat %d (id %d) length", i, id), false, maxSaveStatsCount)
+			for k := uint32(0); k < length && d.Err() == nil; k++ {
+				key := d.readUint16(fmt.Sprintf("stat %d (id %d; index %d) key", i, id, k))
+				st[key] = d.readUint32(fmt.Sprintf("stat %d (id %d; index %d) val", i, id, k))
 			}
 			stats[id] = append(stats[id], st)
 		}
 	}
 
-	return stats, nil
+	return stats
 }
 
-func (m *Mod) ReadFrom(r io.Reader, game Version) (err error) {
-	m.Name, err = readString(r, game, true)
-	if err != nil {
-		return fmt.Errorf("read Name: %v", err)
-	}
-
-	var version version48
-	err = version.ReadFrom(r, game)
-	if err != nil {
-		return err
-	}
-	m.Version = Version(version)
+func (m *Mod) decode(d *saveDecoder) {
+	m.Name = d.readString("Name", true)
+	m.Version = d.readVersion48("Version")
 
-	var scratch [4]byte
-	if game.Greater(Version{0, 15, 0, 91}) {
-		_, err = r.Read(scratch[:4])
-		if err != nil {
-			return err
-		}
-		m.CRC = binary.LittleEndian.Uint32(scratch[:4])
+	if d.game.Greater(Version{0, 15, 0, 91}) {
+		m.CRC = d.readUint32("CRC")
 	}
-
-	return nil
 }
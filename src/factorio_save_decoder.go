@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// limits protecting the manager from malformed or malicious saves
+const (
+	maxSaveHeaderSize   = 8 << 20
+	maxSaveStringLength = 4096
+	maxSaveModCount     = 65535
+	maxSaveStatsCount   = 65535
+)
+
+// saveDecoder reads the binary structures of factorio saves.
+// All reads are done with io.ReadFull semantics. The first error is kept and all following reads
+// are skipped, so the caller only has to check Err after reading a group of fields.
+type saveDecoder struct {
+	r       io.Reader
+	game    Version
+	n       int64
+	err     error
+	scratch [8]byte
+}
+
+func newSaveDecoder(r io.Reader) *saveDecoder {
+	return &saveDecoder{r: io.LimitReader(r, maxSaveHeaderSize)}
+}
+
+// Err returns the first error, that occurred while decoding
+func (d *saveDecoder) Err() error {
+	return d.err
+}
+
+func (d *saveDecoder) fail(field string, err error) {
+	if d.err == nil {
+		d.err = fmt.Errorf("read %s: %w", field, err)
+	}
+}
+
+func (d *saveDecoder) read(field string, size int) []byte {
+	if d.err != nil {
+		return d.scratch[:size]
+	}
+
+	n, err := io.ReadFull(d.r, d.scratch[:size])
+	d.n += int64(n)
+	if err != nil {
+		d.fail(field, err)
+	}
+
+	return d.scratch[:size]
+}
+
+func (d *saveDecoder) readUint8(field string) uint8 {
+	return d.read(field, 1)[0]
+}
+
+func (d *saveDecoder) readBool(field string) bool {
+	return d.readUint8(field) != 0
+}
+
+func (d *saveDecoder) readUint16(field string) uint16 {
+	return binary.LittleEndian.Uint16(d.read(field, 2))
+}
+
+func (d *saveDecoder) readUint32(field string) uint32 {
+	return binary.LittleEndian.Uint32(d.read(field, 4))
+}
+
+func (d *saveDecoder) readUint64(field string) uint64 {
+	return binary.LittleEndian.Uint64(d.read(field, 8))
+}
+
+// readOptimUint reads a space optimized unsigned integer, that uses one byte for values below 255
+func (d *saveDecoder) readOptimUint(field string, bitSize int) uint32 {
+	if !d.game.Less(Version{0, 14, 14, 0}) {
+		b := d.readUint8(field)
+		if b != 0xFF {
+			return uint32(b)
+		}
+	}
+
+	switch bitSize {
+	case 16:
+		return uint32(d.readUint16(field))
+	case 32:
+		return d.readUint32(field)
+	default:
+		panic("invalid bit size")
+	}
+}
+
+// readCount reads the number of following elements and makes sure it is not bigger than max
+func (d *saveDecoder) readCount(field string, optimized bool, max uint32) uint32 {
+	var n uint32
+	if optimized {
+		n = d.readOptimUint(field, 32)
+	} else {
+		n = d.readUint32(field)
+	}
+
+	if d.err == nil && n > max {
+		d.fail(field, fmt.Errorf("count %d exceeds the maximum of %d", n, max))
+		return 0
+	}
+
+	return n
+}
+
+func (d *saveDecoder) readString(field string, forceOptimized bool) string {
+	optimized := !d.game.Less(Version{0, 16, 0, 0}) || forceOptimized
+	n := d.readCount(field+" length", optimized, maxSaveStringLength)
+	if d.err != nil {
+		return ""
+	}
+
+	buf := make([]byte, n)
+	read, err := io.ReadFull(d.r, buf)
+	d.n += int64(read)
+	if err != nil {
+		d.fail(field, err)
+		return ""
+	}
+
+	return string(buf)
+}
+
+func (d *saveDecoder) readVersion48(field string) Version {
+	var v Version
+	for i := 0; i < 3; i++ {
+		v[i] = uint(d.readOptimUint(fmt.Sprintf("%s part %d", field, i), 16))
+	}
+	return v
+}
+
+func (d *saveDecoder) readVersion64(field string) Version {
+	var v version64
+	_ = v.UnmarshalBinary(d.read(field, 8))
+	return Version(v)
+}
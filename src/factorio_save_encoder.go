@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// saveEncoder writes the binary structures read by saveDecoder.
+// The first error is kept and all following writes are skipped, so the caller only has to check Err
+// after writing a group of fields.
+type saveEncoder struct {
+	w       io.Writer
+	game    Version
+	n       int64
+	err     error
+	scratch [8]byte
+}
+
+func newSaveEncoder(w io.Writer) *saveEncoder {
+	return &saveEncoder{w: w}
+}
+
+// Err returns the first error, that occurred while encoding
+func (e *saveEncoder) Err() error {
+	return e.err
+}
+
+func (e *saveEncoder) fail(field string, err error) {
+	if e.err == nil {
+		e.err = fmt.Errorf("write %s: %w", field, err)
+	}
+}
+
+func (e *saveEncoder) write(field string, data []byte) {
+	if e.err != nil {
+		return
+	}
+
+	n, err := e.w.Write(data)
+	e.n += int64(n)
+	if err != nil {
+		e.fail(field, err)
+	}
+}
+
+func (e *saveEncoder) writeUint8(field string, v uint8) {
+	e.scratch[0] = v
+	e.write(field, e.scratch[:1])
+}
+
+func (e *saveEncoder) writeBool(field string, v bool) {
+	if v {
+		e.writeUint8(field, 1)
+	} else {
+		e.writeUint8(field, 0)
+	}
+}
+
+func (e *saveEncoder) writeUint16(field string, v uint16) {
+	binary.LittleEndian.PutUint16(e.scratch[:2], v)
+	e.write(field, e.scratch[:2])
+}
+
+func (e *saveEncoder) writeUint32(field string, v uint32) {
+	binary.LittleEndian.PutUint32(e.scratch[:4], v)
+	e.write(field, e.scratch[:4])
+}
+
+func (e *saveEncoder) writeUint64(field string, v uint64) {
+	binary.LittleEndian.PutUint64(e.scratch[:8], v)
+	e.write(field, e.scratch[:8])
+}
+
+// writeOptimUint writes a space optimized unsigned integer, that uses one byte for values below 255
+func (e *saveEncoder) writeOptimUint(field string, bitSize int, v uint32) {
+	if !e.game.Less(Version{0, 14, 14, 0}) {
+		if v < 0xFF {
+			e.writeUint8(field, uint8(v))
+			return
+		}
+		e.writeUint8(field, 0xFF)
+	}
+
+	switch bitSize {
+	case 16:
+		e.writeUint16(field, uint16(v))
+	case 32:
+		e.writeUint32(field, v)
+	default:
+		panic("invalid bit size")
+	}
+}
+
+func (e *saveEncoder) writeString(field string, s string, forceOptimized bool) {
+	// longer strings couldn't be read again by saveDecoder
+	if len(s) > maxSaveStringLength {
+		e.fail(field, fmt.Errorf("length %d exceeds the maximum of %d", len(s), maxSaveStringLength))
+		return
+	}
+
+	optimized := !e.game.Less(Version{0, 16, 0, 0}) || forceOptimized
+	if optimized {
+		e.writeOptimUint(field+" length", 32, uint32(len(s)))
+	} else {
+		e.writeUint32(field+" length", uint32(len(s)))
+	}
+	e.write(field, []byte(s))
+}
+
+func (e *saveEncoder) writeVersion64(field string, v Version) {
+	data, _ := version64(v).MarshalBinary()
+	e.write(field, data)
+}
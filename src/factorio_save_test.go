@@ -1,9 +1,254 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+func TestUnsupportedVersion(t *testing.T) {
+	// header of a save written by factorio 1.1.110, whose layout isn't covered by the test saves
+	data := []byte{1, 0, 1, 0, 110, 0, 0, 0, 0}
+
+	var header SaveHeader
+	err := header.ReadFrom(bytes.NewReader(data))
+	if !errors.Is(err, ErrUnsupportedSaveFormat) {
+		t.Fatalf("Expected unsupported save format error, got: %v", err)
+	}
+}
+
+func TestCompressedLevelFile(t *testing.T) {
+	file, err := OpenArchiveFile("factorio_save_testfiles/test_0_17.zip", "level.dat")
+	if err != nil {
+		t.Fatalf("Error opening level.dat: %s", err)
+	}
+	level, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("Error reading level.dat: %s", err)
+	}
+
+	// store the level the way newer releases do, as zlib compressed level.dat0
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, err := zw.Create("test_0_17/level.dat0")
+	if err != nil {
+		t.Fatalf("Error creating level.dat0: %s", err)
+	}
+	zlw := zlib.NewWriter(w)
+	zlw.Write(level)
+	zlw.Close()
+	zw.Close()
+
+	dir, err := ioutil.TempDir("", "factorio_save")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savePath := filepath.Join(dir, "compressed.zip")
+	err = ioutil.WriteFile(savePath, archive.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("Error writing save: %s", err)
+	}
+
+	var expected SaveHeader
+	err = expected.ReadFrom(bytes.NewReader(level))
+	if err != nil {
+		t.Fatalf("Error reading header: %s", err)
+	}
+
+	compressed, err := OpenSaveHeaderFile(savePath)
+	if err != nil {
+		t.Fatalf("Error opening level.dat0: %s", err)
+	}
+	defer compressed.Close()
+
+	var header SaveHeader
+	err = header.ReadFrom(compressed)
+	if err != nil {
+		t.Fatalf("Error reading compressed header: %s", err)
+	}
+
+	header.Equals(expected, t)
+}
+
+func TestOversizedString(t *testing.T) {
+	// factorio 0.17 header with a campaign name claiming to be 4 GiB long
+	data := []byte{0, 0, 17, 0, 1, 0, 1, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+	var header SaveHeader
+	err := header.ReadFrom(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("Expected oversized string to be rejected, got: %v", err)
+	}
+}
+
+func TestTruncatedHeader(t *testing.T) {
+	for _, data := range saveHeaderCorpus(t) {
+		for i := 0; i < len(data); i++ {
+			var header SaveHeader
+			err := header.ReadFrom(bytes.NewReader(data[:i]))
+			if err == nil {
+				t.Fatalf("Expected error on header truncated to %d of %d bytes", i, len(data))
+			}
+		}
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// repeatReader endlessly repeats data
+type repeatReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.data[r.pos%len(r.data)]
+		r.pos++
+	}
+	return len(p), nil
+}
+
+// saveLengthValues are written over the data by mutateSaveData, they are the edge cases of
+// optimized and plain counts and string lengths
+var saveLengthValues = [][]byte{
+	{0x00},
+	{0xFE},
+	{0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+	{0xFF, 0x00, 0x00, 0x01, 0x00},
+	{0x00, 0x00, 0x00, 0x00},
+	{0xFF, 0xFF, 0x00, 0x00},
+	{0x00, 0x10, 0x00, 0x00},
+}
+
+// mutateSaveData returns a copy of the data with flipped bytes, a changed length field or a random tail
+func mutateSaveData(rng *rand.Rand, data []byte) []byte {
+	mutated := append([]byte(nil), data...)
+
+	switch rng.Intn(3) {
+	case 0:
+		for i := rng.Intn(4); i >= 0; i-- {
+			mutated[rng.Intn(len(mutated))] ^= byte(1 + rng.Intn(255))
+		}
+	case 1:
+		copy(mutated[rng.Intn(len(mutated)):], saveLengthValues[rng.Intn(len(saveLengthValues))])
+	case 2:
+		tail := make([]byte, rng.Intn(64))
+		rng.Read(tail)
+		mutated = append(mutated[:rng.Intn(len(mutated)+1)], tail...)
+	}
+
+	return mutated
+}
+
+// checkSaveDecoding decodes the data as save header and property tree, it fails on panics
+// and on reads past the end of the data or past the limit of the decoder
+func checkSaveDecoding(t *testing.T, data []byte, endless bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Decoding panicked: %v, data: %x", r, data)
+		}
+	}()
+
+	source := &countingReader{r: bytes.NewReader(data)}
+	limit := int64(len(data))
+	if endless {
+		source.r = &repeatReader{data: data}
+		limit = maxSaveHeaderSize
+	}
+
+	var header SaveHeader
+	n, _ := header.readFrom(source)
+	if n > source.n || source.n > limit {
+		t.Fatalf("Header decoder read %d bytes (reported %d) with a limit of %d, data: %x", source.n, n, limit, data)
+	}
+
+	source.n = 0
+	if endless {
+		source.r = &repeatReader{data: data}
+	} else {
+		source.r = bytes.NewReader(data)
+	}
+	d := newSaveDecoder(source)
+	d.game = Version{0, 17, 1, 1}
+	d.readPropertyTree("tree")
+	if d.n > source.n || source.n > limit {
+		t.Fatalf("Property tree decoder read %d bytes (reported %d) with a limit of %d, data: %x", source.n, d.n, limit, data)
+	}
+}
+
+// TestSaveDecoderMutations feeds mutated test saves and property trees to the decoders.
+// The seed is fixed, so a failure can be reproduced.
+func TestSaveDecoderMutations(t *testing.T) {
+	var tree bytes.Buffer
+	e := newSaveEncoder(&tree)
+	e.writePropertyTree("tree", map[string]interface{}{
+		"startup": map[string]interface{}{
+			"enabled": map[string]interface{}{"value": true},
+			"network": map[string]interface{}{"value": int64(-1)},
+			"color":   map[string]interface{}{"value": map[string]interface{}{"r": 1.0, "g": 0.5}},
+			"list":    map[string]interface{}{"value": []interface{}{uint64(1), nil, "level"}},
+		},
+	})
+	if e.Err() != nil {
+		t.Fatalf("Error writing property tree: %s", e.Err())
+	}
+
+	corpus := append(saveHeaderCorpus(t), tree.Bytes())
+	rng := rand.New(rand.NewSource(1))
+	for _, data := range corpus {
+		for i := 0; i < 2000; i++ {
+			checkSaveDecoding(t, mutateSaveData(rng, data), i%10 == 0)
+		}
+	}
+}
+
+// saveHeaderCorpus returns the headers of all supported test saves
+func saveHeaderCorpus(t *testing.T) [][]byte {
+	var corpus [][]byte
+	for _, name := range []string{"0_13", "0_14", "0_15", "0_16", "0_17"} {
+		file, err := OpenSaveHeaderFile("factorio_save_testfiles/test_" + name + ".zip")
+		if err != nil {
+			t.Fatalf("Error opening test save %s: %s", name, err)
+		}
+
+		var header SaveHeader
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("Error reading test save %s: %s", name, err)
+		}
+
+		n, err := header.readFrom(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error reading header of test save %s: %s", name, err)
+		}
+		corpus = append(corpus, data[:n])
+	}
+	return corpus
+}
+
 func Test0_17(t *testing.T) {
 	file, err := OpenArchiveFile("factorio_save_testfiles/test_0_17.zip", "level.dat")
 	if err != nil {
@@ -225,6 +470,9 @@ func (h *SaveHeader) Equals(other SaveHeader, t *testing.T) {
 	if h.FactorioVersion != other.FactorioVersion {
 		t.Errorf("FactorioVersion not equal: %s --- %s", h.FactorioVersion, other.FactorioVersion)
 	}
+	if h.QualityVersion != other.QualityVersion {
+		t.Errorf("QualityVersion not equal: %d --- %d", h.QualityVersion, other.QualityVersion)
+	}
 	if h.Campaign != other.Campaign {
 		t.Errorf("Campaign not equal: %s --- %s", h.Campaign, other.Campaign)
 	}
@@ -267,6 +515,9 @@ func (h *SaveHeader) Equals(other SaveHeader, t *testing.T) {
 	if h.AllowedCommands != other.AllowedCommands {
 		t.Errorf("AllowedCommands not equal: %d --- %d", h.AllowedCommands, other.AllowedCommands)
 	}
+	if len(h.Mods) != len(other.Mods) {
+		t.Fatalf("Number of mods not equal: %d --- %d", len(h.Mods), len(other.Mods))
+	}
 	for k := range h.Mods {
 		if h.Mods[k].Name != other.Mods[k].Name {
 			t.Errorf("ModNames not equal: %s --- %s", h.Mods[k].Name, other.Mods[k].Name)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -27,7 +28,6 @@ type FactorioServer struct {
 	Latency        int                    `json:"latency"`
 	BindIP         string                 `json:"bindip"`
 	Port           int                    `json:"port"`
-	Running        bool                   `json:"running"`
 	Version        Version                `json:"fac_version"`
 	BaseModVersion string                 `json:"base_mod_version"`
 	StdOut         io.ReadCloser          `json:"-"`
@@ -36,6 +36,22 @@ type FactorioServer struct {
 	Settings       map[string]interface{} `json:"-"`
 	Rcon           *rcon.RemoteConsole    `json:"-"`
 	LogChan        chan []string          `json:"-"`
+	Profile        *LaunchProfile         `json:"-"`
+	// loadedSave is the save loaded by the server, "Load Latest" is resolved to the newest save on start.
+	// It is guarded by saveFilesLock.
+	loadedSave string
+	serverStateMachine
+}
+
+// ServerStartOptions are the settings a client can choose when starting the server
+type ServerStartOptions struct {
+	Savefile string `json:"savefile"`
+	Latency  int    `json:"latency"`
+	BindIP   string `json:"bindip"`
+	Port     int    `json:"port"`
+	Profile  string `json:"profile"`
+	// Preflight is one of "warn" (default), "block", "fix" or "skip"
+	Preflight string `json:"preflight"`
 }
 
 func randomPort() int {
@@ -101,13 +117,8 @@ func initFactorio() (f *FactorioServer, err error) {
 
 	log.Printf("Loaded Factorio settings from %s\n", settingsPath)
 
-	out := []byte{}
 	//Load factorio version
-	if config.glibcCustom == "true" {
-		out, err = exec.Command(config.glibcLocation, "--library-path", config.glibcLibLoc, config.FactorioBinary, "--version").Output()
-	} else {
-		out, err = exec.Command(config.FactorioBinary, "--version").Output()
-	}
+	out, err := factorioCommand("--version").Output()
 
 	if err != nil {
 		log.Printf("error on loading factorio version: %s", err)
@@ -164,6 +175,95 @@ func initFactorio() (f *FactorioServer, err error) {
 	return
 }
 
+// Start moves the server into the starting state and launches it in the background.
+// It fails, if the server is not stopped or crashed, so concurrent start requests can't race.
+// The mods dir lock is held up to the starting state, so no job can change the mods between the state check,
+// the preflight check and the start. If a job holds the lock, ErrModsChanging is returned.
+func (f *FactorioServer) Start(options ServerStartOptions) error {
+	if !tryLockModsDir() {
+		return ErrModsChanging
+	}
+	defer unlockModsDir()
+
+	return f.start(options)
+}
+
+// start does the work of Start, the caller has to hold the mods dir lock
+func (f *FactorioServer) start(options ServerStartOptions) error {
+	var profile *LaunchProfile
+	if options.Profile != "" {
+		profileList, err := newLaunchProfileList(filepath.Join(config.FactorioConfigDir, config.LaunchProfilesFile))
+		if err != nil {
+			return err
+		}
+
+		found := false
+		profile, found = profileList.find(options.Profile)
+		if !found {
+			return fmt.Errorf("launch profile %s does not exist", options.Profile)
+		}
+
+		err = profile.Validate(f.Version)
+		if err != nil {
+			return fmt.Errorf("launch profile %s is invalid: %v", options.Profile, err)
+		}
+	}
+
+	// the mods must not be changed by the preflight check, while the server is running
+	if state := f.State(); state != ServerStopped && state != ServerCrashed {
+		return &InvalidTransitionError{From: state, To: ServerStarting}
+	}
+
+	err := runSavePreflight(options.Savefile, options.Preflight)
+	if err != nil {
+		return err
+	}
+
+	err = f.loadSave(options.Savefile)
+	if err != nil {
+		return err
+	}
+
+	f.Profile = profile
+
+	f.Savefile = options.Savefile
+	f.Latency = options.Latency
+	f.BindIP = options.BindIP
+	f.Port = options.Port
+
+	go func() {
+		err := f.Run()
+		if err != nil {
+			log.Printf("Error running Factorio server: %+v", err)
+		}
+	}()
+
+	return nil
+}
+
+// loadSave puts the server into the starting state with the save, "Load Latest" is resolved to the newest save.
+// The saves can't be changed meanwhile, so the save is known to saveInUse, once the server is starting.
+func (f *FactorioServer) loadSave(savefile string) error {
+	saveFilesLock.Lock()
+	defer saveFilesLock.Unlock()
+
+	loadedSave, err := resolveSaveName(savefile)
+	if err != nil {
+		// factorio reports the missing save itself
+		loadedSave = savefile
+	}
+
+	err = f.transition(ServerStarting, nil)
+	if err != nil {
+		return err
+	}
+	f.loadedSave = loadedSave
+
+	return nil
+}
+
+// Run executes the factorio binary and blocks until it exits.
+// The server has to be put into the starting state by Start before.
 func (f *FactorioServer) Run() error {
 	var err error
 
@@ -176,13 +276,6 @@ func (f *FactorioServer) Run() error {
 
 	args := []string{}
 
-	//The factorio server refenences its executable-path, since we execute the ld.so file and pass the factorio binary as a parameter
-	//the game would use the path to the ld.so file as it's executable path and crash, to prevent this the parameter "--executable-path" is added
-	if config.glibcCustom == "true" {
-		log.Println("Custom glibc selected, glibc.so location:", config.glibcLocation, " lib location:", config.glibcLibLoc)
-		args = append(args, "--library-path", config.glibcLibLoc, config.FactorioBinary, "--executable-path", config.FactorioBinary)
-	}
-
 	args = append(args,
 		"--bind", (f.BindIP),
 		"--port", strconv.Itoa(f.Port),
@@ -194,35 +287,38 @@ func (f *FactorioServer) Run() error {
 		args = append(args, "--server-adminlist", filepath.Join(config.FactorioConfigDir, config.FactorioAdminFile))
 	}
 
-	if f.Savefile == "Load Latest" {
+	if f.Profile != nil {
+		log.Printf("Using launch profile: %s", f.Profile.Name)
+		args = append(args, f.Profile.Args()...)
+	}
+
+	if f.Savefile == loadLatestSave {
 		args = append(args, "--start-server-load-latest")
 	} else {
 		args = append(args, "--start-server", filepath.Join(config.FactorioSavesDir, f.Savefile))
 	}
 
-	if config.glibcCustom == "true" {
-		log.Println("Starting server with command: ", config.glibcLocation, args)
-		f.Cmd = exec.Command(config.glibcLocation, args...)
-	} else {
-		log.Println("Starting server with command: ", config.FactorioBinary, args)
-		f.Cmd = exec.Command(config.FactorioBinary, args...)
-	}
+	f.Cmd = factorioCommand(args...)
+	log.Println("Starting server with command: ", f.Cmd.Args)
 
 	f.StdOut, err = f.Cmd.StdoutPipe()
 	if err != nil {
 		log.Printf("Error opening stdout pipe: %s", err)
+		f.transition(ServerCrashed, err)
 		return err
 	}
 
 	f.StdIn, err = f.Cmd.StdinPipe()
 	if err != nil {
 		log.Printf("Error opening stdin pipe: %s", err)
+		f.transition(ServerCrashed, err)
 		return err
 	}
 
 	f.StdErr, err = f.Cmd.StderrPipe()
 	if err != nil {
 		log.Printf("Error opening stderr pipe: %s", err)
+		f.transition(ServerCrashed, err)
 		return err
 	}
 
@@ -232,20 +328,49 @@ func (f *FactorioServer) Run() error {
 	err = f.Cmd.Start()
 	if err != nil {
 		log.Printf("Factorio process failed to start: %s", err)
+		f.transition(ServerCrashed, err)
 		return err
 	}
-	f.Running = true
+	f.transition(ServerRunning, nil)
 
 	err = f.Cmd.Wait()
+
+	// exiting after Stop or Kill is expected, no matter what exit code the process returns
+	if f.transition(ServerStopped, nil, ServerStopping) == nil {
+		return nil
+	}
+
 	if err != nil {
 		log.Printf("Factorio process exited with error: %s", err)
-		f.Running = false
+		f.transition(ServerCrashed, err)
 		return err
 	}
 
+	f.transition(ServerStopped, nil)
+
 	return nil
 }
 
+// factorioCommand prepares a command running the factorio binary with the given arguments.
+// If a custom glibc is configured, the binary is launched through its ld.so.
+func factorioCommand(args ...string) *exec.Cmd {
+	return factorioCommandContext(context.Background(), args...)
+}
+
+// factorioCommandContext creates a factorio command, which is killed when the context is done
+func factorioCommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	if config.glibcCustom == "true" {
+		log.Println("Custom glibc selected, glibc.so location:", config.glibcLocation, " lib location:", config.glibcLibLoc)
+
+		//The factorio server refenences its executable-path, since we execute the ld.so file and pass the factorio binary as a parameter
+		//the game would use the path to the ld.so file as it's executable path and crash, to prevent this the parameter "--executable-path" is added
+		glibcArgs := []string{"--library-path", config.glibcLibLoc, config.FactorioBinary, "--executable-path", config.FactorioBinary}
+		return exec.CommandContext(ctx, config.glibcLocation, append(glibcArgs, args...)...)
+	}
+
+	return exec.CommandContext(ctx, config.FactorioBinary, args...)
+}
+
 func (f *FactorioServer) parseRunningCommand(std io.ReadCloser) (err error) {
 	stdScanner := bufio.NewScanner(std)
 	for stdScanner.Scan() {
@@ -313,6 +438,11 @@ func (f *FactorioServer) checkLogError(logline []string) error {
 }
 
 func (f *FactorioServer) Stop() error {
+	err := f.transition(ServerStopping, nil, ServerRunning)
+	if err != nil {
+		return err
+	}
+
 	if runtime.GOOS == "windows" {
 
 		// Disable our own handling of CTRL+C, so we don't close when we send it to the console.
@@ -333,64 +463,58 @@ func (f *FactorioServer) Stop() error {
 		// Re-enable handling of CTRL+C after we're sure that the factrio server is shut down.
 		setCtrlHandlingIsDisabledForThisProcess(false)
 
-		f.Running = false
 		return nil
 	}
 
-	err := f.Cmd.Process.Signal(os.Interrupt)
+	err = f.Cmd.Process.Signal(os.Interrupt)
 	if err != nil {
 		if err.Error() == "os: process already finished" {
-			f.Running = false
 			return err
 		}
 		log.Printf("Error sending SIGINT to Factorio process: %s", err)
 		return err
 	}
-	f.Running = false
 	log.Printf("Sent SIGINT to Factorio process. Factorio shutting down...")
 
-	err = f.Rcon.Close()
-	if err != nil {
-		log.Printf("Error close rcon connection: %s", err)
-	}
+	f.closeRcon()
 
 	return nil
 }
 
 func (f *FactorioServer) Kill() error {
-	if runtime.GOOS == "windows" {
-
-		err := f.Cmd.Process.Signal(os.Kill)
-		if err != nil {
-			if err.Error() == "os: process already finished" {
-				f.Running = false
-				return err
-			}
-			log.Printf("Error sending SIGKILL to Factorio process: %s", err)
-			return err
-		}
-		f.Running = false
-		log.Println("Sent SIGKILL to Factorio process. Factorio forced to exit.")
-
-		return nil
+	err := f.transition(ServerStopping, nil, ServerRunning)
+	if transitionErr, ok := err.(*InvalidTransitionError); ok && transitionErr.From == ServerStopping {
+		// a server hanging in shutdown may still be killed
+		err = nil
+	}
+	if err != nil {
+		return err
 	}
 
-	err := f.Cmd.Process.Signal(os.Kill)
+	err = f.Cmd.Process.Signal(os.Kill)
 	if err != nil {
 		if err.Error() == "os: process already finished" {
-			f.Running = false
 			return err
 		}
 		log.Printf("Error sending SIGKILL to Factorio process: %s", err)
 		return err
 	}
-	f.Running = false
 	log.Printf("Sent SIGKILL to Factorio process. Factorio forced to exit.")
 
-	err = f.Rcon.Close()
-	if err != nil {
-		log.Printf("Error close rcon connection: %s", err)
+	if runtime.GOOS != "windows" {
+		f.closeRcon()
 	}
 
 	return nil
 }
+
+func (f *FactorioServer) closeRcon() {
+	if f.Rcon == nil {
+		return
+	}
+
+	err := f.Rcon.Close()
+	if err != nil {
+		log.Printf("Error close rcon connection: %s", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ServerState is the lifecycle state of the managed Factorio server process
+type ServerState string
+
+const (
+	ServerStopped  ServerState = "stopped"
+	ServerStarting ServerState = "starting"
+	ServerRunning  ServerState = "running"
+	ServerStopping ServerState = "stopping"
+	ServerCrashed  ServerState = "crashed"
+)
+
+// serverTransitions lists the states that may follow each state
+var serverTransitions = map[ServerState][]ServerState{
+	ServerStopped:  {ServerStarting},
+	ServerCrashed:  {ServerStarting},
+	ServerStarting: {ServerRunning, ServerCrashed},
+	ServerRunning:  {ServerStopping, ServerStopped, ServerCrashed},
+	ServerStopping: {ServerStopped},
+}
+
+// ServerStateChange is sent to all subscribers whenever the server state changes
+type ServerStateChange struct {
+	From  ServerState `json:"from"`
+	To    ServerState `json:"to"`
+	Time  time.Time   `json:"time"`
+	Error string      `json:"error,omitempty"`
+}
+
+// InvalidTransitionError is returned, when a requested state change is not allowed from the current state
+type InvalidTransitionError struct {
+	From ServerState
+	To   ServerState
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot change server state from %s to %s", e.From, e.To)
+}
+
+// serverStateMachine guards the state of a FactorioServer and notifies subscribers about changes
+type serverStateMachine struct {
+	mu          sync.Mutex
+	state       ServerState
+	lastError   string
+	subscribers map[int]chan ServerStateChange
+	nextId      int
+}
+
+func (sm *serverStateMachine) State() ServerState {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.state == "" {
+		return ServerStopped
+	}
+	return sm.state
+}
+
+// LastError returns the error of the last transition into the crashed state
+func (sm *serverStateMachine) LastError() string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.lastError
+}
+
+// transition changes the state to `to`, if this is allowed from the current state.
+// The change is only done, if the current state is one of `from`, when `from` is not empty.
+func (sm *serverStateMachine) transition(to ServerState, cause error, from ...ServerState) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	current := sm.state
+	if current == "" {
+		current = ServerStopped
+	}
+
+	if len(from) > 0 && !containsState(from, current) {
+		return &InvalidTransitionError{From: current, To: to}
+	}
+	if !containsState(serverTransitions[current], to) {
+		return &InvalidTransitionError{From: current, To: to}
+	}
+
+	sm.state = to
+
+	change := ServerStateChange{
+		From: current,
+		To:   to,
+		Time: time.Now(),
+	}
+	if cause != nil {
+		change.Error = cause.Error()
+	}
+	if to == ServerCrashed {
+		sm.lastError = change.Error
+	}
+
+	log.Printf("Factorio server state changed from %s to %s", current, to)
+
+	for _, subscriber := range sm.subscribers {
+		// never block on slow subscribers, they can always ask for the current state
+		select {
+		case subscriber <- change:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Subscribe returns a channel receiving all future state changes and a function to cancel the subscription
+func (sm *serverStateMachine) Subscribe() (<-chan ServerStateChange, func()) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.subscribers == nil {
+		sm.subscribers = make(map[int]chan ServerStateChange)
+	}
+
+	id := sm.nextId
+	sm.nextId++
+
+	ch := make(chan ServerStateChange, 8)
+	sm.subscribers[id] = ch
+
+	return ch, func() {
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+
+		if _, ok := sm.subscribers[id]; ok {
+			delete(sm.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+func containsState(states []ServerState, state ServerState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
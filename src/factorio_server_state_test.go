@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestServerStateTransitions(t *testing.T) {
+	states := []ServerState{ServerStopped, ServerStarting, ServerRunning, ServerStopping, ServerCrashed}
+	allowed := map[ServerState][]ServerState{
+		ServerStopped:  {ServerStarting},
+		ServerCrashed:  {ServerStarting},
+		ServerStarting: {ServerRunning, ServerCrashed},
+		ServerRunning:  {ServerStopping, ServerStopped, ServerCrashed},
+		ServerStopping: {ServerStopped},
+	}
+
+	for _, from := range states {
+		for _, to := range states {
+			sm := &serverStateMachine{state: from}
+			err := sm.transition(to, nil)
+
+			if containsState(allowed[from], to) {
+				if err != nil {
+					t.Errorf("Transition from %s to %s not allowed: %s", from, to, err)
+				} else if sm.State() != to {
+					t.Errorf("State after transition from %s not equal: %s --- %s", from, sm.State(), to)
+				}
+				continue
+			}
+
+			var transitionErr *InvalidTransitionError
+			if !errors.As(err, &transitionErr) || transitionErr.From != from || transitionErr.To != to {
+				t.Errorf("Expected InvalidTransitionError from %s to %s, got: %v", from, to, err)
+			}
+			if sm.State() != from {
+				t.Errorf("State changed by forbidden transition from %s to %s", from, to)
+			}
+		}
+	}
+
+	// the zero value is stopped
+	sm := &serverStateMachine{}
+	if sm.State() != ServerStopped {
+		t.Errorf("Initial state not equal: %s --- %s", sm.State(), ServerStopped)
+	}
+
+	// a transition can be limited to the expected current states
+	sm = &serverStateMachine{state: ServerRunning}
+	if err := sm.transition(ServerStopped, nil, ServerStopping); err == nil {
+		t.Errorf("Expected error on transition from unexpected state")
+	}
+	if err := sm.transition(ServerCrashed, errors.New("segfault"), ServerRunning); err != nil {
+		t.Fatalf("Error on transition from expected state: %s", err)
+	}
+	if sm.LastError() != "segfault" {
+		t.Errorf("Last error not equal: %s --- segfault", sm.LastError())
+	}
+}
+
+func TestServerStateSubscribe(t *testing.T) {
+	sm := &serverStateMachine{}
+
+	changes, unsubscribe := sm.Subscribe()
+	other, unsubscribeOther := sm.Subscribe()
+	defer unsubscribeOther()
+
+	if err := sm.transition(ServerStarting, nil); err != nil {
+		t.Fatalf("Error on transition: %s", err)
+	}
+	for _, ch := range []<-chan ServerStateChange{changes, other} {
+		change := <-ch
+		if change.From != ServerStopped || change.To != ServerStarting {
+			t.Errorf("State change not equal: %s -> %s --- %s -> %s", change.From, change.To, ServerStopped, ServerStarting)
+		}
+	}
+
+	unsubscribe()
+	if _, ok := <-changes; ok {
+		t.Errorf("Channel not closed on unsubscribe")
+	}
+	// unsubscribing twice is harmless
+	unsubscribe()
+
+	if err := sm.transition(ServerCrashed, errors.New("exit status 1")); err != nil {
+		t.Fatalf("Error on transition: %s", err)
+	}
+	if change := <-other; change.To != ServerCrashed || change.Error != "exit status 1" {
+		t.Errorf("State change not equal: %+v", change)
+	}
+
+	// a full subscriber doesn't block the transitions
+	for i := 0; i < 20; i++ {
+		if err := sm.transition(ServerStarting, nil); err != nil {
+			t.Fatalf("Error on transition: %s", err)
+		}
+		if err := sm.transition(ServerCrashed, nil); err != nil {
+			t.Fatalf("Error on transition: %s", err)
+		}
+	}
+}
+
+func TestServerConcurrentStartStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-saves")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savesDir := config.FactorioSavesDir
+	defer func() { config.FactorioSavesDir = savesDir }()
+	config.FactorioSavesDir = dir
+
+	server := &FactorioServer{}
+	const requests = 20
+
+	// only one of the concurrent starts moves the server into the starting state
+	var wg sync.WaitGroup
+	started := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started <- server.loadSave("save.zip")
+		}()
+	}
+	wg.Wait()
+	close(started)
+
+	succeeded := 0
+	for err := range started {
+		var transitionErr *InvalidTransitionError
+		if err == nil {
+			succeeded++
+		} else if !errors.As(err, &transitionErr) {
+			t.Errorf("Expected InvalidTransitionError, got: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Successful starts not equal: %d --- 1", succeeded)
+	}
+
+	// only one of the concurrent stops moves the server into the stopping state, as Stop does
+	if err := server.transition(ServerRunning, nil); err != nil {
+		t.Fatalf("Error on transition: %s", err)
+	}
+	stopped := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopped <- server.transition(ServerStopping, nil, ServerRunning)
+		}()
+	}
+	wg.Wait()
+	close(stopped)
+
+	succeeded = 0
+	for err := range stopped {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Successful stops not equal: %d --- 1", succeeded)
+	}
+
+	// a start can't race with a job changing the mods
+	server = &FactorioServer{}
+	if !tryLockModsDir() {
+		t.Fatalf("Mods dir locked by another test")
+	}
+	err = server.Start(ServerStartOptions{Savefile: "save.zip"})
+	unlockModsDir()
+	if err != ErrModsChanging {
+		t.Errorf("Expected ErrModsChanging, got: %v", err)
+	}
+	if server.State() != ServerStopped {
+		t.Errorf("State not equal: %s --- %s", server.State(), ServerStopped)
+	}
+}
@@ -2,14 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -45,7 +46,28 @@ func ListSaves(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	loadLatest := Save{Name: "Load Latest"}
+	filter := SaveFilter{
+		Version:    r.FormValue("version"),
+		Mod:        r.FormValue("mod"),
+		ModVersion: r.FormValue("mod_version"),
+	}
+	err = filter.validate()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error filtering save files: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error listing saves: %s", err)
+		}
+		return
+	}
+
+	// header data is only needed, if it is requested or the saves are filtered by it
+	if r.FormValue("details") == "true" || !filter.isEmpty() {
+		loadHeaders(config.FactorioSavesDir, savesList)
+		savesList = filterSaves(savesList, filter)
+	}
+
+	loadLatest := Save{Name: loadLatestSave}
 	savesList = append(savesList, loadLatest)
 
 	resp.Data = savesList
@@ -70,137 +92,1000 @@ func DLSave(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, saveName)
 }
 
-func UploadSave(w http.ResponseWriter, r *http.Request) {
-	var err error
+func UploadSave(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	switch r.Method {
+	case "GET":
+		resp.Data = "Unsupported method"
+		resp.Success = false
+		if err = json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error listing mods: %s", err)
+		}
+	case "POST":
+		log.Println("Uploading save file")
+
+		err = r.ParseMultipartForm(32 << 20)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Data = fmt.Sprintf("Error parsing upload: %s", err)
+			json.NewEncoder(w).Encode(resp)
+			log.Printf("Error parsing save upload: %s", err)
+			return
+		}
+
+		// on_conflict is one of "error", "overwrite" or "rename"
+		onConflict := r.FormValue("on_conflict")
+
+		var uploaded []string
+		for _, saveFile := range r.MultipartForm.File["savefile"] {
+			file, err := saveFile.Open()
+			if err != nil {
+				resp.Success = false
+				resp.Data = err.Error()
+				json.NewEncoder(w).Encode(resp)
+				log.Printf("Error in upload save formfile: %s", err.Error())
+				return
+			}
+
+			name, err := uploadSave(file, saveFile.Filename, onConflict)
+			file.Close()
+			if err != nil {
+				switch {
+				case errors.Is(err, ErrSaveExists), errors.Is(err, ErrSaveInUse):
+					w.WriteHeader(http.StatusConflict)
+				default:
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				resp.Success = false
+				resp.Data = fmt.Sprintf("Error uploading save '%s': %s", saveFile.Filename, err)
+				json.NewEncoder(w).Encode(resp)
+				log.Printf("Error uploading save %s: %s", saveFile.Filename, err)
+				return
+			}
+
+			log.Printf("Uploaded save file: %s", name)
+			uploaded = append(uploaded, name)
+		}
+
+		if len(uploaded) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Data = "No save file uploaded"
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		resp.Data = fmt.Sprintf("File '%s' uploaded successfully", strings.Join(uploaded, "', '"))
+		resp.Success = true
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// CreateUploadRequest is the JSON body to start a chunked upload
+type CreateUploadRequest struct {
+	Kind       string `json:"kind"`
+	Filename   string `json:"filename"`
+	Size       int64  `json:"size"`
+	OnConflict string `json:"on_conflict"`
+}
+
+// CreateUploadSession starts a resumable upload of a save or a mod
+func CreateUploadSession(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	var request CreateUploadRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+
+	var session UploadSession
+	if err == nil {
+		session, err = newUploadSession(request.Kind, request.Filename, request.Size, request.OnConflict)
+	}
+
+	if err != nil {
+		log.Printf("Error creating upload session: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error creating upload session: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding upload session response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = session
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding upload session response: %s", err)
+	}
+}
+
+// UploadSessionStatus returns the session, its received size is the offset of the next chunk
+func UploadSessionStatus(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	id := mux.Vars(r)["id"]
+
+	var session UploadSession
+	unlock, err := lockUploadSession(id)
+	if err == nil {
+		session, err = loadUploadSession(id)
+		unlock()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		resp.Data = fmt.Sprintf("Error loading upload session %s: %s", id, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding upload session response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = session
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding upload session response: %s", err)
+	}
+}
+
+// UploadChunk appends the request body to the upload, the offset query parameter has to match the received size
+func UploadChunk(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	id := mux.Vars(r)["id"]
+
+	var session UploadSession
+	unlock, err := lockUploadSession(id)
+	if err == nil {
+		defer unlock()
+		session, err = loadUploadSession(id)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		resp.Data = fmt.Sprintf("Error loading upload session %s: %s", id, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding upload chunk response: %s", err)
+		}
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err == nil {
+		err = session.writeChunk(offset, http.MaxBytesReader(w, r.Body, config.MaxUploadSize))
+	}
+
+	if err != nil {
+		log.Printf("Error writing chunk of upload %s: %s", id, err)
+		if errors.Is(err, ErrUploadOffset) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		resp.Data = fmt.Sprintf("Error writing chunk: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding upload chunk response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = session
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding upload chunk response: %s", err)
+	}
+}
+
+// FinalizeUploadRequest is the JSON body to complete a chunked upload
+type FinalizeUploadRequest struct {
+	Sha256 string `json:"sha256"`
+}
+
+// FinalizeUploadSession verifies the checksum of the uploaded file and installs it
+func FinalizeUploadSession(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	id := mux.Vars(r)["id"]
+
+	var session UploadSession
+	unlock, err := lockUploadSession(id)
+	if err == nil {
+		defer unlock()
+		session, err = loadUploadSession(id)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		resp.Data = fmt.Sprintf("Error loading upload session %s: %s", id, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding finalize upload response: %s", err)
+		}
+		return
+	}
+
+	var request FinalizeUploadRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+
+	var name string
+	if err == nil {
+		name, err = session.finalize(r.Context(), request.Sha256)
+	}
+
+	if err != nil {
+		log.Printf("Error finalizing upload %s of %s: %s", id, session.Filename, err)
+		switch {
+		case errors.Is(err, ErrSaveExists), errors.Is(err, ErrSaveInUse):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		resp.Data = fmt.Sprintf("Error finalizing upload: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding finalize upload response: %s", err)
+		}
+		return
+	}
+
+	log.Printf("Uploaded %s file in chunks: %s", session.Kind, name)
+	resp.Data = fmt.Sprintf("File '%s' uploaded successfully", name)
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding finalize upload response: %s", err)
+	}
+}
+
+// CancelUploadSession removes the session and all data received so far
+func CancelUploadSession(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	id := mux.Vars(r)["id"]
+
+	var session UploadSession
+	unlock, err := lockUploadSession(id)
+	if err == nil {
+		defer unlock()
+		session, err = loadUploadSession(id)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		resp.Data = fmt.Sprintf("Error loading upload session %s: %s", id, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding cancel upload response: %s", err)
+		}
+		return
+	}
+
+	session.remove()
+
+	resp.Data = fmt.Sprintf("Upload of %s cancelled", session.Filename)
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding cancel upload response: %s", err)
+	}
+}
+
+// Deletes provided save
+func RemoveSave(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	vars := mux.Vars(r)
+	name := vars["save"]
+
+	save, err := findSave(name)
+	if err != nil {
+		resp.Data = fmt.Sprintf("Error removing save: %s", err)
+		w.WriteHeader(http.StatusNotFound)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error removing save %s", err)
+		}
+		return
+	}
+
+	err = save.remove()
+	if err == nil {
+		// save was removed
+		resp.Data = fmt.Sprintf("Removed save: %s", save.Name)
+		resp.Success = true
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error removing save %s", err)
+		}
+	} else {
+		log.Printf("Error in remove save handler: %s", err)
+		resp.Data = fmt.Sprintf("Error in remove save handler: %s", err)
+		w.WriteHeader(saveOperationStatus(err))
+
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error removing save: %s", err)
+		}
+	}
+}
+
+// saveOperationStatus returns the http status for errors of operations on saves
+func saveOperationStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSaveExists), errors.Is(err, ErrSaveInUse):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// RenameSave gives the save in the form value "save" the name in "new_name"
+func RenameSave(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.FormValue("save")
+
+	save, err := findSave(name)
+	var newName string
+	if err == nil {
+		newName, err = save.rename(r.FormValue("new_name"))
+	}
+
+	if err != nil {
+		log.Printf("Error renaming save %s: %s", name, err)
+		w.WriteHeader(saveOperationStatus(err))
+		resp.Data = fmt.Sprintf("Error renaming save %s: %s", name, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding rename save response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = fmt.Sprintf("Renamed save %s to %s", name, newName)
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding rename save response: %s", err)
+	}
+}
+
+// CopySave duplicates the save in the form value "save" to the name in "new_name"
+func CopySave(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.FormValue("save")
+
+	save, err := findSave(name)
+	var newName string
+	if err == nil {
+		newName, err = save.duplicate(r.FormValue("new_name"))
+	}
+
+	if err != nil {
+		log.Printf("Error copying save %s: %s", name, err)
+		w.WriteHeader(saveOperationStatus(err))
+		resp.Data = fmt.Sprintf("Error copying save %s: %s", name, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding copy save response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = fmt.Sprintf("Copied save %s to %s", name, newName)
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding copy save response: %s", err)
+	}
+}
+
+// ArchiveSave moves the save in the form value "save" into the archive
+func ArchiveSave(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.FormValue("save")
+
+	save, err := findSave(name)
+	if err == nil {
+		err = save.archive()
+	}
+
+	if err != nil {
+		log.Printf("Error archiving save %s: %s", name, err)
+		w.WriteHeader(saveOperationStatus(err))
+		resp.Data = fmt.Sprintf("Error archiving save %s: %s", name, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding archive save response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = fmt.Sprintf("Archived save %s", name)
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding archive save response: %s", err)
+	}
+}
+
+// RestoreArchivedSave moves the save in the form value "save" from the archive back to the saves
+func RestoreArchivedSave(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.FormValue("save")
+
+	err := restoreArchivedSave(name)
+	if err != nil {
+		log.Printf("Error restoring archived save %s: %s", name, err)
+		w.WriteHeader(saveOperationStatus(err))
+		resp.Data = fmt.Sprintf("Error restoring archived save %s: %s", name, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding restore save response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = fmt.Sprintf("Restored save %s", name)
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding restore save response: %s", err)
+	}
+}
+
+// ListArchivedSaves lists the saves in the archive
+func ListArchivedSaves(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	saves, err := listSaves(saveArchiveDir())
+	if os.IsNotExist(err) {
+		saves, err = []Save{}, nil
+	}
+
+	if err != nil {
+		log.Printf("Error listing archived saves: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error listing archived saves: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding archived saves response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = saves
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding archived saves response: %s", err)
+	}
+}
+
+// SavePreflightHandler compares the mods and the version of the save with the installed ones
+func SavePreflightHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := mux.Vars(r)["save"]
+
+	preflight, _, err := checkSavePreflight(name)
+	if err != nil {
+		log.Printf("Error checking save %s: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error checking save %s: %s", name, err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding save preflight response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = preflight
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding save preflight response: %s", err)
+	}
+}
+
+// Launches Factorio server binary with --create flag to create save
+// Url must include save name for creation of savefile
+func CreateSaveHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	vars := mux.Vars(r)
+	saveName := vars["save"]
+
+	if saveName == "" {
+		log.Printf("Error creating save, no name provided: %s", err)
+		resp.Data = "No save name provided."
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding save handler response: %s", err)
+		}
+		return
+	}
+
+	saveFile := filepath.Join(config.FactorioSavesDir, saveName)
+	err = checkNewSavePath(saveFile)
+	if err != nil {
+		log.Printf("Error creating save: %s", err)
+		w.WriteHeader(saveOperationStatus(err))
+		resp.Data = fmt.Sprintf("Error creating savefile: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding save handler response: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "create-save", fmt.Sprintf("Create save %s", saveName), func(jc *JobContext) (interface{}, error) {
+		jc.Logf("creating save %s", saveName)
+		return createSave(jc, saveFile, nil)
+	})
+	if !ok {
+		return
+	}
+	if job.Status != jobDone {
+		log.Printf("Error creating save: %s", job.Error)
+		resp.Data = "Error creating savefile."
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding save handler response: %s", err)
+		}
+		return
+	}
+
+	resp.Success = true
+	resp.Data = fmt.Sprintf("Save %s created successfully. Command output: \n%s", saveName, job.Result)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding save response: %s", err)
+	}
+}
+
+// CreateMapRequest is the JSON body to create a new map with custom settings
+type CreateMapRequest struct {
+	Name           string          `json:"name"`
+	Preset         string          `json:"preset"`
+	Seed           *uint32         `json:"seed"`
+	MapGenSettings *MapGenSettings `json:"map_gen_settings"`
+	MapSettings    *MapSettings    `json:"map_settings"`
+}
+
+// CreateMapHandler creates a new save from a preset and/or the given map settings
+func CreateMapHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	var request CreateMapRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err == nil && (request.Name == "" || filepath.Base(request.Name) != request.Name) {
+		err = fmt.Errorf("invalid save name: %s", request.Name)
+	}
+
+	var settings SaveMapSettings
+	if err == nil {
+		settings, err = resolveMapSettings(request.Preset, request.MapGenSettings, request.MapSettings, request.Seed)
+	}
+
+	if err != nil {
+		log.Printf("Error creating map: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error creating map: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding create map response: %s", err)
+		}
+		return
+	}
+
+	saveName := request.Name
+	if filepath.Ext(saveName) != ".zip" {
+		saveName += ".zip"
+	}
+
+	err = checkNewSavePath(filepath.Join(config.FactorioSavesDir, saveName))
+	if err != nil {
+		log.Printf("Error creating map: %s", err)
+		w.WriteHeader(saveOperationStatus(err))
+		resp.Data = fmt.Sprintf("Error creating map: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding create map response: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "create-map", fmt.Sprintf("Create map %s", saveName), func(jc *JobContext) (interface{}, error) {
+		jc.Logf("creating map %s with seed %d", saveName, *settings.MapGenSettings.Seed)
+		cmdOut, err := createSave(jc, filepath.Join(config.FactorioSavesDir, saveName), &settings)
+		if err != nil {
+			return nil, err
+		}
+		jc.Logf("created map %s. Command output: %s", saveName, cmdOut)
+		return settings, nil
+	})
+	if !ok {
+		return
+	}
+	if job.Status != jobDone {
+		log.Printf("Error creating map: %s", job.Error)
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error creating map: %s", job.Error)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding create map response: %s", err)
+		}
+		return
+	}
+
+	resp.Success = true
+	resp.Data = job.Result
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding create map response: %s", err)
+	}
+}
+
+// GetSaveMapSettings returns the map settings recorded on creation of the save
+func GetSaveMapSettings(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	save := mux.Vars(r)["save"]
+
+	settings, err := loadSaveMapSettings(filepath.Join(config.FactorioSavesDir, filepath.Base(save)))
+	if err != nil {
+		log.Printf("Error loading map settings of save %s: %s", save, err)
+		w.WriteHeader(http.StatusNotFound)
+		resp.Data = fmt.Sprintf("No map settings recorded for save %s", save)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding map settings response: %s", err)
+		}
+		return
+	}
+
+	resp.Data = settings
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding map settings response: %s", err)
+	}
+}
+
+// MapPreviewHandler renders a png preview of the map-gen settings, a preset or both
+func MapPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	var request MapPreviewRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	request.normalize()
+
+	var settings SaveMapSettings
+	if err == nil {
+		settings, err = resolveMapSettings(request.Preset, request.MapGenSettings, nil, request.Seed)
+	}
+
+	if err != nil {
+		log.Printf("Error generating map preview: %s", err)
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error generating map preview: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding map preview response: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "map-preview", "Render map preview", func(jc *JobContext) (interface{}, error) {
+		return renderMapPreview(jc, settings.MapGenSettings, request.Size, request.Scale)
+	})
+	if ok {
+		serveMapPreviewJob(w, r, job)
+	}
+}
+
+// serveMapPreviewJob responds with the png rendered by the map preview job
+func serveMapPreviewJob(w http.ResponseWriter, r *http.Request, job Job) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	result, ok := job.Result.(MapPreviewResult)
+	if job.Status != jobDone || !ok {
+		log.Printf("Error generating map preview: %s", job.Error)
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error generating map preview: %s", job.Error)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding map preview response: %s", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Map-Seed", strconv.FormatUint(uint64(result.Seed), 10))
+	http.ServeFile(w, r, filepath.Join(config.FactorioMapPreviewDir, result.Preview+".png"))
+}
+
+// MapPreviewImageHandler serves a rendered map preview, the url is the result of a map preview job
+func MapPreviewImageHandler(w http.ResponseWriter, r *http.Request) {
+	previewPath, err := mapPreviewPath(mux.Vars(r)["preview"])
+	if err == nil {
+		_, err = os.Stat(previewPath)
+	}
+	if err != nil {
+		log.Printf("Error serving map preview: %s", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeFile(w, r, previewPath)
+}
+
+// SaveMapPreviewHandler renders a png preview of the map settings recorded for a save
+func SaveMapPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	save := mux.Vars(r)["save"]
+
+	request := MapPreviewRequest{}
+	request.Size, _ = strconv.Atoi(r.FormValue("size"))
+	request.Scale, _ = strconv.ParseFloat(r.FormValue("scale"), 64)
+	request.normalize()
+
+	settings, err := loadSaveMapSettings(filepath.Join(config.FactorioSavesDir, filepath.Base(save)))
+	if err != nil {
+		log.Printf("Error generating map preview of save %s: %s", save, err)
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusNotFound)
+		resp.Data = fmt.Sprintf("Error generating map preview: no map settings recorded for save %s", save)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding map preview response: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "map-preview", fmt.Sprintf("Render map preview of save %s", save), func(jc *JobContext) (interface{}, error) {
+		return renderMapPreview(jc, settings.MapGenSettings, request.Size, request.Scale)
+	})
+	if ok {
+		serveMapPreviewJob(w, r, job)
+	}
+}
+
+// submitJob runs fn as background job. The job is returned at once with status 202,
+// its progress and result can be followed on /api/jobs/{id} or over the websocket.
+// With wait=true the job is awaited, so the handler can respond with its result.
+// If false is returned, the response has already been written.
+func submitJob(w http.ResponseWriter, r *http.Request, jobType string, description string, fn JobFunc) (Job, bool) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	job, err := jobs.submit(jobType, description, fn)
+	if err != nil {
+		log.Printf("Error queueing job %s: %s", description, err)
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error queueing job: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding job response: %s", err)
+		}
+		return job, false
+	}
+
+	if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); !wait {
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusAccepted)
+		resp.Success = true
+		resp.Data = job
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding job response: %s", err)
+		}
+		return job, false
+	}
+
+	job, _ = jobs.wait(job.ID)
+	return job, true
+}
+
+// ListJobs returns all jobs, the newest first
+func ListJobs(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	resp.Data = jobs.list()
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding list jobs response: %s", err)
+	}
+}
+
+// GetJob returns the state, progress and log of a job
+func GetJob(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
-	switch r.Method {
-	case "GET":
-		resp.Data = "Unsupported method"
-		resp.Success = false
-		if err = json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error listing mods: %s", err)
-		}
-	case "POST":
-		log.Println("Uploading save file")
-
-		r.ParseMultipartForm(32 << 20)
-
-		for _, saveFile := range r.MultipartForm.File["savefile"] {
-			file, err := saveFile.Open()
-			if err != nil {
-				resp.Success = false
-				resp.Data = err.Error()
-				json.NewEncoder(w).Encode(resp)
-				log.Printf("Error in upload save formfile: %s", err.Error())
-				return
-			}
-			defer file.Close()
-
-			out, err := os.Create(filepath.Join(config.FactorioSavesDir, saveFile.Filename))
-			if err != nil {
-				resp.Success = false
-				resp.Data = err.Error()
-				json.NewEncoder(w).Encode(resp)
-				log.Printf("Error in out: %s", err)
-				return
-			}
-			defer out.Close()
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-			_, err = io.Copy(out, file)
-			if err != nil {
-				resp.Success = false
-				resp.Data = err.Error()
-				json.NewEncoder(w).Encode(resp)
-				log.Printf("Error in io copy: %s", err)
-				return
-			}
+	id := mux.Vars(r)["id"]
 
-			log.Printf("Uploaded save file: %s", saveFile.Filename)
-			resp.Data = "File '" + saveFile.Filename + "' uploaded successfully"
-			resp.Success = true
-			json.NewEncoder(w).Encode(resp)
+	job, ok := jobs.get(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		resp.Data = fmt.Sprintf("Job %s not found", id)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding job response: %s", err)
 		}
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp.Data = job
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding job response: %s", err)
 	}
 }
 
-// Deletes provided save
-func RemoveSave(w http.ResponseWriter, r *http.Request) {
-	var err error
+// CancelJob cancels a queued or running job
+func CancelJob(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	vars := mux.Vars(r)
-	name := vars["save"]
+	id := mux.Vars(r)["id"]
 
-	save, err := findSave(name)
+	job, err := jobs.cancel(id)
 	if err != nil {
-		resp.Data = fmt.Sprintf("Error removing save: %s", err)
+		log.Printf("Error cancelling job %s: %s", id, err)
+		switch {
+		case errors.Is(err, ErrJobNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, ErrJobFinished):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		resp.Data = fmt.Sprintf("Error cancelling job: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error removing save %s", err)
+			log.Printf("Error encoding cancel job response: %s", err)
 		}
+		return
 	}
 
-	err = save.remove()
-	if err == nil {
-		// save was removed
-		resp.Data = fmt.Sprintf("Removed save: %s", save.Name)
-		resp.Success = true
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error removing save %s", err)
-		}
-	} else {
-		log.Printf("Error in remove save handler: %s", err)
-		resp.Data = fmt.Sprintf("Error in remove save handler: %s", err)
+	resp.Data = job
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding cancel job response: %s", err)
+	}
+}
 
+// ListMapPresets returns all stored map presets
+func ListMapPresets(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	presets, err := listMapPresets()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error listing map presets: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error removing save: %s", err)
+			log.Printf("Error listing map presets: %s", err)
 		}
+		return
+	}
+
+	resp.Data = presets
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error listing map presets: %s", err)
 	}
 }
 
-// Launches Factorio server binary with --create flag to create save
-// Url must include save name for creation of savefile
-func CreateSaveHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// SaveMapPreset validates and stores the map preset sent as JSON body
+func SaveMapPreset(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
-	vars := mux.Vars(r)
-	saveName := vars["save"]
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	if saveName == "" {
-		log.Printf("Error creating save, no name provided: %s", err)
-		resp.Data = "No save name provided."
+	var preset MapPreset
+	err := json.NewDecoder(r.Body).Decode(&preset)
+	if err == nil {
+		err = preset.save()
+	}
+
+	if err != nil {
+		log.Printf("Error saving map preset: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error saving map preset: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error encoding save handler response: %s", err)
+			log.Printf("Error saving map preset: %s", err)
 		}
 		return
 	}
 
-	saveFile := filepath.Join(config.FactorioSavesDir, saveName)
-	cmdOut, err := createSave(saveFile)
+	resp.Data = preset
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error saving map preset: %s", err)
+	}
+}
+
+// DeleteMapPreset removes the map preset with the given name
+func DeleteMapPreset(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.FormValue("name")
+
+	err := deleteMapPreset(name)
 	if err != nil {
-		log.Printf("Error creating save: %s", err)
-		resp.Data = "Error creating savefile."
+		log.Printf("Error deleting map preset: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error deleting map preset: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error encoding save handler response: %s", err)
+			log.Printf("Error deleting map preset: %s", err)
 		}
 		return
 	}
 
+	resp.Data = name
 	resp.Success = true
-	resp.Data = fmt.Sprintf("Save %s created successfully. Command output: \n%s", saveName, cmdOut)
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error encoding save response: %s", err)
+		log.Printf("Error deleting map preset: %s", err)
 	}
 }
 
@@ -265,14 +1150,6 @@ func StartServer(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	if FactorioServ.Running {
-		resp.Data = "Factorio server is already running"
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error encoding JSON response: %s", err)
-		}
-		return
-	}
-
 	switch r.Method {
 	case "GET":
 		log.Printf("GET not supported for startserver handler")
@@ -292,14 +1169,19 @@ func StartServer(w http.ResponseWriter, r *http.Request) {
 
 		log.Printf("Starting Factorio server with settings: %v", string(body))
 
-		err = json.Unmarshal(body, &FactorioServ)
+		var options ServerStartOptions
+		err = json.Unmarshal(body, &options)
 		if err != nil {
 			log.Printf("Error unmarshaling server settings JSON: %s", err)
+			resp.Data = fmt.Sprintf("Error starting Factorio server: %s", err)
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				log.Printf("Error encoding start server JSON response: %s", err)
+			}
 			return
 		}
 
 		// Check if savefile was submitted with request to start server.
-		if FactorioServ.Savefile == "" {
+		if options.Savefile == "" {
 			log.Printf("Error starting Factorio server: no save file provided")
 			resp.Success = false
 			resp.Data = fmt.Sprintf("Error starting Factorio server: %s", "No save file provided")
@@ -309,37 +1191,63 @@ func StartServer(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		go func() {
-			err = FactorioServ.Run()
-			if err != nil {
-				log.Printf("Error starting Factorio server: %+v", err)
-				return
-			}
-		}()
-
-		timeout := 0
-		for timeout <= 3 {
-			time.Sleep(1 * time.Second)
-			if FactorioServ.Running {
-				resp.Data = fmt.Sprintf("Factorio server with save: %s started on port: %d", FactorioServ.Savefile, FactorioServ.Port)
-				resp.Success = true
-				log.Printf("Factorio server started on port: %v", FactorioServ.Port)
-				if err := json.NewEncoder(w).Encode(resp); err != nil {
-					log.Printf("Error encoding config file JSON reponse: %s", err)
-				}
-				break
+		// subscribe before starting, so no state change can be missed
+		changes, unsubscribe := FactorioServ.Subscribe()
+		defer unsubscribe()
+
+		err = FactorioServ.Start(options)
+		if err != nil {
+			log.Printf("Error starting Factorio server: %s", err)
+			if _, ok := err.(*InvalidTransitionError); ok {
+				resp.Data = fmt.Sprintf("Factorio server is already %s", FactorioServ.State())
+			} else if preflightErr, ok := err.(*PreflightError); ok {
+				w.WriteHeader(http.StatusConflict)
+				resp.Data = preflightErr.Preflight
+			} else if err == ErrModsChanging {
+				w.WriteHeader(http.StatusConflict)
+				resp.Data = fmt.Sprintf("Error starting Factorio server: %s", err)
 			} else {
-				log.Printf("Did not detect running Factorio server attempt: %+v", timeout)
+				resp.Data = fmt.Sprintf("Error starting Factorio server: %s", err)
+			}
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				log.Printf("Error encoding start server JSON response: %s", err)
 			}
+			return
+		}
 
-			timeout++
+		timeout := time.After(4 * time.Second)
+		state := FactorioServ.State()
+		for state == ServerStarting {
+			select {
+			case change := <-changes:
+				state = change.To
+			case <-timeout:
+				state = FactorioServ.State()
+				if state == ServerStarting {
+					log.Printf("Did not detect running Factorio server in time")
+					resp.Data = "Factorio server is still starting"
+					if err := json.NewEncoder(w).Encode(resp); err != nil {
+						log.Printf("Error encoding start server JSON response: %s", err)
+					}
+					return
+				}
+			}
 		}
-		if FactorioServ.Running == false {
-			log.Printf("Error starting Factorio server: %s", err)
-			resp.Data = fmt.Sprintf("Error starting Factorio server: %s", err)
+
+		if state == ServerCrashed {
+			log.Printf("Error starting Factorio server: %s", FactorioServ.LastError())
+			resp.Data = fmt.Sprintf("Error starting Factorio server: %s", FactorioServ.LastError())
 			if err := json.NewEncoder(w).Encode(resp); err != nil {
 				log.Printf("Error encoding start server JSON response: %s", err)
 			}
+			return
+		}
+
+		resp.Data = fmt.Sprintf("Factorio server with save: %s started on port: %d", FactorioServ.Savefile, FactorioServ.Port)
+		resp.Success = true
+		log.Printf("Factorio server started on port: %v", FactorioServ.Port)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error encoding config file JSON reponse: %s", err)
 		}
 	}
 }
@@ -351,28 +1259,24 @@ func StopServer(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	if FactorioServ.Running {
-		err := FactorioServ.Stop()
-		if err != nil {
-			log.Printf("Error in stop server handler: %s", err)
+	err := FactorioServ.Stop()
+	if err != nil {
+		log.Printf("Error in stop server handler: %s", err)
+		if _, ok := err.(*InvalidTransitionError); ok {
+			resp.Data = fmt.Sprintf("Factorio server is %s", FactorioServ.State())
+		} else {
 			resp.Data = fmt.Sprintf("Error in stop server handler: %s", err)
-			if err := json.NewEncoder(w).Encode(resp); err != nil {
-				log.Printf("Error encoding config file JSON reponse: %s", err)
-			}
-			return
 		}
-
-		log.Printf("Stopped Factorio server.")
-		resp.Success = true
-		resp.Data = fmt.Sprintf("Factorio server stopped")
-	} else {
-		resp.Data = "Factorio server is not running"
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			log.Printf("Error encoding config file JSON reponse: %s", err)
 		}
 		return
 	}
 
+	log.Printf("Stopped Factorio server.")
+	resp.Success = true
+	resp.Data = fmt.Sprintf("Factorio server stopped")
+
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("Error encoding config file JSON reponse: %s", err)
 	}
@@ -385,28 +1289,24 @@ func KillServer(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	if FactorioServ.Running {
-		err := FactorioServ.Kill()
-		if err != nil {
-			log.Printf("Error in kill server handler: %s", err)
+	err := FactorioServ.Kill()
+	if err != nil {
+		log.Printf("Error in kill server handler: %s", err)
+		if _, ok := err.(*InvalidTransitionError); ok {
+			resp.Data = fmt.Sprintf("Factorio server is %s", FactorioServ.State())
+		} else {
 			resp.Data = fmt.Sprintf("Error in kill server handler: %s", err)
-			if err := json.NewEncoder(w).Encode(resp); err != nil {
-				log.Printf("Error encoding config file JSON reponse: %s", err)
-			}
-			return
 		}
-
-		log.Printf("Killed Factorio server.")
-		resp.Success = true
-		resp.Data = fmt.Sprintf("Factorio server killed")
-	} else {
-		resp.Data = "Factorio server is not running"
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			log.Printf("Error encoding config file JSON reponse: %s", err)
 		}
 		return
 	}
 
+	log.Printf("Killed Factorio server.")
+	resp.Success = true
+	resp.Data = fmt.Sprintf("Factorio server killed")
+
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("Error encoding config file JSON reponse: %s", err)
 	}
@@ -414,30 +1314,30 @@ func KillServer(w http.ResponseWriter, r *http.Request) {
 
 func CheckServer(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
-		Success: false,
+		Success: true,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	if FactorioServ.Running {
-		resp.Success = true
-		status := map[string]string{}
-		status["status"] = "running"
+	state := FactorioServ.State()
+
+	status := map[string]string{}
+	status["status"] = string(state)
+	switch state {
+	case ServerRunning, ServerStarting, ServerStopping:
 		status["port"] = strconv.Itoa(FactorioServ.Port)
 		status["savefile"] = FactorioServ.Savefile
 		status["address"] = FactorioServ.BindIP
-		resp.Data = status
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error encoding config file JSON reponse: %s", err)
-		}
-	} else {
-		resp.Success = true
-		status := map[string]string{}
-		status["status"] = "stopped"
-		resp.Data = status
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error encoding config file JSON reponse: %s", err)
+		if FactorioServ.Profile != nil {
+			status["profile"] = FactorioServ.Profile.Name
 		}
+	case ServerCrashed:
+		status["error"] = FactorioServ.LastError()
+	}
+	resp.Data = status
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding config file JSON reponse: %s", err)
 	}
 }
 
@@ -789,3 +1689,102 @@ func UpdateServerSettings(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// ListLaunchProfiles returns all stored launch profiles
+func ListLaunchProfiles(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	profileList, err := newLaunchProfileList(filepath.Join(config.FactorioConfigDir, config.LaunchProfilesFile))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error listing launch profiles: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error listing launch profiles: %s", err)
+		}
+		return
+	}
+
+	resp.Data = profileList.Profiles
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error listing launch profiles: %s", err)
+	}
+}
+
+// SaveLaunchProfile creates or replaces the launch profile sent as JSON body
+func SaveLaunchProfile(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	var profile LaunchProfile
+	err := json.NewDecoder(r.Body).Decode(&profile)
+	if err == nil {
+		err = profile.Validate(FactorioServ.Version)
+	}
+
+	var profileList LaunchProfileList
+	if err == nil {
+		profileList, err = newLaunchProfileList(filepath.Join(config.FactorioConfigDir, config.LaunchProfilesFile))
+	}
+	if err == nil {
+		err = profileList.saveProfile(profile)
+	}
+
+	if err != nil {
+		log.Printf("Error saving launch profile: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error saving launch profile: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error saving launch profile: %s", err)
+		}
+		return
+	}
+
+	resp.Data = profileList.Profiles
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error saving launch profile: %s", err)
+	}
+}
+
+// DeleteLaunchProfile removes the launch profile with the given name
+func DeleteLaunchProfile(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.FormValue("name")
+
+	profileList, err := newLaunchProfileList(filepath.Join(config.FactorioConfigDir, config.LaunchProfilesFile))
+	if err == nil {
+		err = profileList.deleteProfile(name)
+	}
+
+	if err != nil {
+		log.Printf("Error deleting launch profile: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error deleting launch profile: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error deleting launch profile: %s", err)
+		}
+		return
+	}
+
+	resp.Data = profileList.Profiles
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error deleting launch profile: %s", err)
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// states of a job
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// maxJobLogLines limits the log kept per job, older lines are dropped
+const maxJobLogLines = 500
+
+// jobRetention is the time finished jobs are kept
+const jobRetention = 7 * 24 * time.Hour
+
+// jobPersistInterval limits how often the record of a running job is written on progress and log lines,
+// changes of the status are always written at once
+const jobPersistInterval = time.Second
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job already finished")
+)
+
+// JobLogLine is a single line of the output of a job
+type JobLogLine struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Job is a long running operation, which is run in the background by the job workers.
+// Its record is stored in the jobs dir, so it survives restarts of the manager.
+type Job struct {
+	ID          string       `json:"id"`
+	Type        string       `json:"type"`
+	Description string       `json:"description"`
+	Status      string       `json:"status"`
+	Progress    float64      `json:"progress"`
+	Log         []JobLogLine `json:"log"`
+	Error       string       `json:"error,omitempty"`
+	Result      interface{}  `json:"result,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+	StartedAt   *time.Time   `json:"started_at,omitempty"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+}
+
+func (job *Job) finished() bool {
+	return job.Status == jobDone || job.Status == jobFailed || job.Status == jobCancelled
+}
+
+// copy returns a copy of the job, which can be used without holding the lock of the queue
+func (job *Job) copy() Job {
+	result := *job
+	result.Log = append([]JobLogLine(nil), job.Log...)
+	return result
+}
+
+func (job *Job) path() string {
+	return filepath.Join(config.JobsDir, job.ID+".json")
+}
+
+// JobFunc does the work of a job. It has to return, when the context is cancelled.
+// The returned value is stored as result of the job.
+type JobFunc func(jc *JobContext) (interface{}, error)
+
+// JobContext is passed to a running job to report its progress and to check for cancellation
+type JobContext struct {
+	context.Context
+	id    string
+	queue *jobQueue
+}
+
+// SetProgress sets the progress of the job in percent
+func (jc *JobContext) SetProgress(percent float64) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	jc.queue.update(jc.id, func(job *Job) {
+		job.Progress = percent
+	})
+}
+
+// Logf appends a line to the log of the job
+func (jc *JobContext) Logf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("job %s: %s", jc.id, message)
+
+	jc.queue.update(jc.id, func(job *Job) {
+		job.Log = append(job.Log, JobLogLine{Time: time.Now(), Message: message})
+		if len(job.Log) > maxJobLogLines {
+			job.Log = job.Log[len(job.Log)-maxJobLogLines:]
+		}
+	})
+}
+
+// SetResult publishes an intermediate result, the value must not be changed afterwards
+func (jc *JobContext) SetResult(result interface{}) {
+	jc.queue.update(jc.id, func(job *Job) {
+		job.Result = result
+	})
+}
+
+type queuedJob struct {
+	id string
+	fn JobFunc
+}
+
+// jobRecord is a copy of a job to be written, the revision orders the records of the same job
+type jobRecord struct {
+	job      Job
+	revision int
+}
+
+// jobQueue holds all known jobs and runs the queued ones on a fixed number of workers
+type jobQueue struct {
+	mu             sync.Mutex
+	wake           *sync.Cond
+	jobs           map[string]*Job
+	pending        []queuedJob
+	cancels        map[string]context.CancelFunc
+	done           map[string]chan struct{}
+	subscribers    map[int]chan Job
+	nextSubscriber int
+
+	// the records are written without holding mu, writeMu serializes the writes
+	persistInterval time.Duration
+	revisions       map[string]int
+	persisted       map[string]time.Time
+	flushes         map[string]*time.Timer
+	writeMu         sync.Mutex
+	written         map[string]int
+}
+
+var jobs = newJobQueue()
+
+func newJobQueue() *jobQueue {
+	queue := &jobQueue{
+		jobs:        make(map[string]*Job),
+		cancels:     make(map[string]context.CancelFunc),
+		done:        make(map[string]chan struct{}),
+		subscribers: make(map[int]chan Job),
+
+		persistInterval: jobPersistInterval,
+		revisions:       make(map[string]int),
+		persisted:       make(map[string]time.Time),
+		flushes:         make(map[string]*time.Timer),
+		written:         make(map[string]int),
+	}
+	queue.wake = sync.NewCond(&queue.mu)
+	return queue
+}
+
+// startJobWorkers loads the stored jobs and starts the workers.
+// Jobs, which were queued or running while the manager was stopped, are marked as failed.
+func startJobWorkers(workers int) {
+	err := jobs.load()
+	if err != nil {
+		log.Printf("error loading jobs: %s", err)
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go jobs.work()
+	}
+
+	go jobs.clean()
+}
+
+func (queue *jobQueue) load() error {
+	files, err := filepath.Glob(filepath.Join(config.JobsDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	var records []jobRecord
+	defer func() {
+		for _, record := range records {
+			queue.persist(record)
+		}
+	}()
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Printf("error reading job %s: %s", file, err)
+			continue
+		}
+
+		job := &Job{}
+		err = json.Unmarshal(data, job)
+		if err != nil || job.ID != strings.TrimSuffix(filepath.Base(file), ".json") {
+			log.Printf("error decoding job %s, removing it: %v", file, err)
+			os.Remove(file)
+			continue
+		}
+
+		if !job.finished() {
+			now := time.Now()
+			job.Status = jobFailed
+			job.Error = "interrupted by a restart of the manager"
+			job.FinishedAt = &now
+			records = append(records, queue.snapshot(job))
+		}
+		queue.jobs[job.ID] = job
+	}
+
+	return nil
+}
+
+// snapshot copies the job to be written by persist, the lock has to be held
+func (queue *jobQueue) snapshot(job *Job) jobRecord {
+	queue.revisions[job.ID]++
+	queue.persisted[job.ID] = time.Now()
+	if flush, ok := queue.flushes[job.ID]; ok {
+		flush.Stop()
+		delete(queue.flushes, job.ID)
+	}
+
+	return jobRecord{job: job.copy(), revision: queue.revisions[job.ID]}
+}
+
+// throttledSnapshot copies the job to be written, if its record wasn't written within the persist interval.
+// Otherwise it is written by flush after the interval.
+func (queue *jobQueue) throttledSnapshot(job *Job) (jobRecord, bool) {
+	wait := queue.persistInterval - time.Since(queue.persisted[job.ID])
+	if wait <= 0 {
+		return queue.snapshot(job), true
+	}
+
+	if _, ok := queue.flushes[job.ID]; !ok {
+		id := job.ID
+		queue.flushes[id] = time.AfterFunc(wait, func() {
+			queue.flush(id)
+		})
+	}
+	return jobRecord{}, false
+}
+
+// flush writes the changes of the job, which were held back by throttledSnapshot
+func (queue *jobQueue) flush(id string) {
+	queue.mu.Lock()
+	delete(queue.flushes, id)
+	job, ok := queue.jobs[id]
+	if !ok {
+		queue.mu.Unlock()
+		return
+	}
+	record := queue.snapshot(job)
+	queue.mu.Unlock()
+
+	queue.persist(record)
+}
+
+// persist writes the job record, the lock must not be held.
+// A record older than the one already written is dropped.
+func (queue *jobQueue) persist(record jobRecord) {
+	queue.writeMu.Lock()
+	defer queue.writeMu.Unlock()
+
+	job := &record.job
+	if record.revision <= queue.written[job.ID] {
+		return
+	}
+	queue.written[job.ID] = record.revision
+
+	data, err := json.MarshalIndent(job, "", "    ")
+	if err != nil {
+		log.Printf("error encoding job %s: %s", job.ID, err)
+		return
+	}
+
+	err = os.MkdirAll(config.JobsDir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(job.path(), data, 0644)
+	}
+	if err != nil {
+		log.Printf("error writing job %s: %s", job.ID, err)
+	}
+}
+
+// notify sends the job to all subscribers, the lock has to be held
+func (queue *jobQueue) notify(job Job) {
+	for _, subscriber := range queue.subscribers {
+		// never block on slow subscribers, they can always ask for the current state
+		select {
+		case subscriber <- job:
+		default:
+		}
+	}
+}
+
+// update changes the job, notifies the subscribers and stores it, at most once per persist interval
+func (queue *jobQueue) update(id string, change func(job *Job)) {
+	queue.mu.Lock()
+	job, ok := queue.jobs[id]
+	if !ok {
+		queue.mu.Unlock()
+		return
+	}
+
+	change(job)
+	queue.notify(job.copy())
+	record, write := queue.throttledSnapshot(job)
+	queue.mu.Unlock()
+
+	if write {
+		queue.persist(record)
+	}
+}
+
+// submit queues a new job and returns its initial state
+func (queue *jobQueue) submit(jobType string, description string, fn JobFunc) (Job, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job := &Job{
+		ID:          hex.EncodeToString(id),
+		Type:        jobType,
+		Description: description,
+		Status:      jobQueued,
+		Log:         []JobLogLine{},
+		CreatedAt:   time.Now(),
+	}
+
+	queue.mu.Lock()
+	queue.jobs[job.ID] = job
+	queue.done[job.ID] = make(chan struct{})
+	queue.pending = append(queue.pending, queuedJob{id: job.ID, fn: fn})
+	record := queue.snapshot(job)
+	queue.notify(job.copy())
+	queue.wake.Signal()
+	queue.mu.Unlock()
+
+	queue.persist(record)
+	return record.job.copy(), nil
+}
+
+func (queue *jobQueue) work() {
+	for {
+		queue.mu.Lock()
+		for len(queue.pending) == 0 {
+			queue.wake.Wait()
+		}
+		next := queue.pending[0]
+		queue.pending = queue.pending[1:]
+		queue.mu.Unlock()
+
+		queue.run(next)
+	}
+}
+
+func (queue *jobQueue) run(next queuedJob) {
+	queue.mu.Lock()
+	job, ok := queue.jobs[next.id]
+	if !ok || job.Status != jobQueued {
+		// cancelled while waiting for a worker
+		queue.mu.Unlock()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	job.Status = jobRunning
+	job.StartedAt = &now
+	queue.cancels[job.ID] = cancel
+	record := queue.snapshot(job)
+	queue.notify(job.copy())
+	queue.mu.Unlock()
+
+	queue.persist(record)
+
+	jc := &JobContext{Context: ctx, id: next.id, queue: queue}
+	result, err := queue.call(jc, next.fn)
+
+	queue.finish(next.id, result, err, ctx.Err())
+}
+
+// call runs the job function, a panic only fails the job instead of the whole manager
+func (queue *jobQueue) call(jc *JobContext, fn JobFunc) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("job %s panicked: %v", jc.id, r)
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return fn(jc)
+}
+
+func (queue *jobQueue) finish(id string, result interface{}, err error, cancelled error) {
+	queue.mu.Lock()
+	job, ok := queue.jobs[id]
+	if !ok {
+		queue.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	job.FinishedAt = &now
+	if result != nil {
+		job.Result = result
+	}
+
+	switch {
+	case cancelled != nil:
+		job.Status = jobCancelled
+		job.Error = "cancelled"
+	case err != nil:
+		job.Status = jobFailed
+		job.Error = err.Error()
+		log.Printf("job %s (%s) failed: %s", job.ID, job.Description, err)
+	default:
+		job.Status = jobDone
+		job.Progress = 100
+	}
+
+	delete(queue.cancels, id)
+	done, waiting := queue.done[id]
+	delete(queue.done, id)
+	record := queue.snapshot(job)
+	queue.notify(job.copy())
+	queue.mu.Unlock()
+
+	// the waiting requests find the final record written
+	queue.persist(record)
+	if waiting {
+		close(done)
+	}
+}
+
+// get returns a copy of the current state of the job
+func (queue *jobQueue) get(id string) (Job, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	job, ok := queue.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.copy(), true
+}
+
+// list returns all jobs, the newest first
+func (queue *jobQueue) list() []Job {
+	queue.mu.Lock()
+	result := make([]Job, 0, len(queue.jobs))
+	for _, job := range queue.jobs {
+		result = append(result, job.copy())
+	}
+	queue.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+// cancel cancels a queued job at once, running jobs are stopped by cancelling their context
+func (queue *jobQueue) cancel(id string) (Job, error) {
+	queue.mu.Lock()
+	job, ok := queue.jobs[id]
+	if !ok {
+		queue.mu.Unlock()
+		return Job{}, ErrJobNotFound
+	}
+	if job.finished() {
+		queue.mu.Unlock()
+		return job.copy(), ErrJobFinished
+	}
+
+	if job.Status != jobQueued {
+		if cancel, ok := queue.cancels[id]; ok {
+			cancel()
+		}
+		result := job.copy()
+		queue.mu.Unlock()
+		return result, nil
+	}
+
+	now := time.Now()
+	job.Status = jobCancelled
+	job.Error = "cancelled"
+	job.FinishedAt = &now
+	done, waiting := queue.done[id]
+	delete(queue.done, id)
+	record := queue.snapshot(job)
+	queue.notify(job.copy())
+	queue.mu.Unlock()
+
+	queue.persist(record)
+	if waiting {
+		close(done)
+	}
+	return record.job.copy(), nil
+}
+
+// wait blocks until the job is finished and returns its final state
+func (queue *jobQueue) wait(id string) (Job, bool) {
+	queue.mu.Lock()
+	done, ok := queue.done[id]
+	queue.mu.Unlock()
+
+	if ok {
+		<-done
+	}
+	return queue.get(id)
+}
+
+// subscribe returns a channel receiving every change of a job and a function to cancel the subscription
+func (queue *jobQueue) subscribe() (<-chan Job, func()) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	id := queue.nextSubscriber
+	queue.nextSubscriber++
+
+	ch := make(chan Job, 32)
+	queue.subscribers[id] = ch
+
+	return ch, func() {
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+
+		if _, ok := queue.subscribers[id]; ok {
+			delete(queue.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// removeOldJobs removes the finished jobs, which are older than the retention
+func (queue *jobQueue) removeOldJobs() {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	for id, job := range queue.jobs {
+		if !job.finished() || job.FinishedAt == nil || time.Since(*job.FinishedAt) < jobRetention {
+			continue
+		}
+
+		delete(queue.jobs, id)
+		delete(queue.revisions, id)
+		delete(queue.persisted, id)
+		queue.writeMu.Lock()
+		delete(queue.written, id)
+		queue.writeMu.Unlock()
+		if err := os.Remove(job.path()); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing job %s: %s", id, err)
+		}
+	}
+}
+
+// clean periodically removes old jobs
+func (queue *jobQueue) clean() {
+	for {
+		queue.removeOldJobs()
+		time.Sleep(time.Hour)
+	}
+}
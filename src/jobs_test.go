@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJobQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-jobs")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.JobsDir = dir
+	queue := newJobQueue()
+	go queue.work()
+
+	job, err := queue.submit("test", "Finished job", func(jc *JobContext) (interface{}, error) {
+		jc.SetProgress(50)
+		jc.Logf("half done")
+		return "result", nil
+	})
+	if err != nil {
+		t.Fatalf("Error submitting job: %s", err)
+	}
+	job, _ = queue.wait(job.ID)
+	if job.Status != jobDone || job.Progress != 100 || job.Result != "result" {
+		t.Errorf("Unexpected state of finished job: %+v", job)
+	}
+	if len(job.Log) != 1 || job.Log[0].Message != "half done" {
+		t.Errorf("Unexpected log of finished job: %+v", job.Log)
+	}
+
+	started := make(chan bool)
+	running, err := queue.submit("test", "Cancelled job", func(jc *JobContext) (interface{}, error) {
+		close(started)
+		<-jc.Done()
+		return nil, jc.Err()
+	})
+	if err != nil {
+		t.Fatalf("Error submitting job: %s", err)
+	}
+	// the single worker is busy, so this job stays queued
+	queued, err := queue.submit("test", "Queued job", func(jc *JobContext) (interface{}, error) {
+		t.Errorf("Cancelled job was run")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Error submitting job: %s", err)
+	}
+
+	<-started
+	if _, err := queue.cancel(queued.ID); err != nil {
+		t.Errorf("Error cancelling queued job: %s", err)
+	}
+	if _, err := queue.cancel(running.ID); err != nil {
+		t.Errorf("Error cancelling running job: %s", err)
+	}
+	running, _ = queue.wait(running.ID)
+	if running.Status != jobCancelled {
+		t.Errorf("Status of cancelled job not equal: %s --- %s", running.Status, jobCancelled)
+	}
+	if _, err := queue.cancel(running.ID); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("Expected error cancelling finished job, got: %v", err)
+	}
+
+	// the records are loaded again after a restart
+	restarted := newJobQueue()
+	if err := restarted.load(); err != nil {
+		t.Fatalf("Error loading jobs: %s", err)
+	}
+	if len(restarted.list()) != 3 {
+		t.Errorf("Expected 3 stored jobs, got: %+v", restarted.list())
+	}
+	if loaded, ok := restarted.get(job.ID); !ok || loaded.Status != jobDone || loaded.Result != "result" {
+		t.Errorf("Unexpected state of loaded job: %+v", loaded)
+	}
+}
+
+// readJobRecord returns the stored record of the job
+func readJobRecord(t *testing.T, job Job) Job {
+	data, err := ioutil.ReadFile(job.path())
+	if err != nil {
+		t.Fatalf("Error reading job record: %s", err)
+	}
+
+	var record Job
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Error decoding job record: %s", err)
+	}
+	return record
+}
+
+func TestJobPersistThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-jobs")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.JobsDir = dir
+	queue := newJobQueue()
+	queue.persistInterval = time.Hour
+	go queue.work()
+
+	logged := make(chan bool)
+	release := make(chan bool)
+	job, err := queue.submit("test", "Chatty job", func(jc *JobContext) (interface{}, error) {
+		for i := 0; i < 100; i++ {
+			jc.SetProgress(float64(i))
+			jc.Logf("line %d", i)
+		}
+		close(logged)
+		<-release
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Error submitting job: %s", err)
+	}
+	<-logged
+
+	// only the start of the job was written, the progress is held back
+	if record := readJobRecord(t, job); record.Status != jobRunning || len(record.Log) != 0 {
+		t.Errorf("Unexpected record of running job: %+v", record)
+	}
+	if current, _ := queue.get(job.ID); len(current.Log) != 100 {
+		t.Errorf("Log lines of running job not equal: %d --- 100", len(current.Log))
+	}
+
+	// the final state is written at once
+	close(release)
+	queue.wait(job.ID)
+	if record := readJobRecord(t, job); record.Status != jobDone || len(record.Log) != 100 {
+		t.Errorf("Unexpected record of finished job: %+v", record)
+	}
+
+	// with an elapsed interval the held back changes are written by a timer
+	queue.persistInterval = 10 * time.Millisecond
+	job, err = queue.submit("test", "Slow job", func(jc *JobContext) (interface{}, error) {
+		jc.Logf("first")
+		jc.Logf("second")
+		<-jc.Done()
+		return nil, jc.Err()
+	})
+	if err != nil {
+		t.Fatalf("Error submitting job: %s", err)
+	}
+	for i := 0; ; i++ {
+		if record := readJobRecord(t, job); len(record.Log) == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Held back log lines not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	queue.cancel(job.ID)
+	queue.wait(job.ID)
+}
+
+func TestModsDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-jobs")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.JobsDir = dir
+	queue := newJobQueue()
+	go queue.work()
+	go queue.work()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	first, err := queue.submit("test", "First mods job", withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		close(started)
+		<-release
+		return nil, nil
+	}))
+	if err != nil {
+		t.Fatalf("Error submitting job: %s", err)
+	}
+	<-started
+
+	// the second worker is free, but the job has to wait for the mods dir
+	second, err := queue.submit("test", "Second mods job", withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		select {
+		case <-release:
+		default:
+			t.Errorf("Second job ran while the first one held the mods dir")
+		}
+		return nil, nil
+	}))
+	if err != nil {
+		t.Fatalf("Error submitting job: %s", err)
+	}
+
+	close(release)
+	if job, _ := queue.wait(first.ID); job.Status != jobDone {
+		t.Errorf("Status of first job not equal: %s --- %s", job.Status, jobDone)
+	}
+	if job, _ := queue.wait(second.ID); job.Status != jobDone {
+		t.Errorf("Status of second job not equal: %s --- %s", job.Status, jobDone)
+	}
+
+	// a cancelled job stops waiting for the lock
+	modsDirLock <- struct{}{}
+	waiting, err := queue.submit("test", "Waiting mods job", withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		t.Errorf("Job ran without the mods dir lock")
+		return nil, nil
+	}))
+	if err != nil {
+		t.Fatalf("Error submitting job: %s", err)
+	}
+	for job, _ := queue.get(waiting.ID); job.Status != jobRunning; job, _ = queue.get(waiting.ID) {
+		time.Sleep(time.Millisecond)
+	}
+	queue.cancel(waiting.ID)
+	if job, _ := queue.wait(waiting.ID); job.Status != jobCancelled {
+		t.Errorf("Status of waiting job not equal: %s --- %s", job.Status, jobCancelled)
+	}
+
+	// a handler stops waiting for the lock, when its request is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := lockModsDir(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	<-modsDirLock
+}
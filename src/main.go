@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 )
 
 type Config struct {
@@ -16,8 +17,14 @@ type Config struct {
 	FactorioSavesDir        string `json:"saves_dir"`
 	FactorioModsDir         string `json:"mods_dir"`
 	FactorioModPackDir      string `json:"mod_pack_dir"`
+	FactorioModCacheDir     string `json:"mod_cache_dir"`
 	FactorioConfigFile      string `json:"config_file"`
 	FactorioConfigDir       string `json:"config_directory"`
+	FactorioMapPresetsDir   string `json:"map_presets_dir"`
+	FactorioMapPreviewDir   string `json:"map_preview_dir"`
+	UploadSessionDir        string `json:"upload_session_dir"`
+	JobsDir                 string `json:"jobs_dir"`
+	ModSettingsBackupDir    string `json:"mod_settings_backup_dir"`
 	FactorioLog             string `json:"logfile"`
 	FactorioBinary          string `json:"factorio_binary"`
 	FactorioRconPort        int    `json:"rcon_port"`
@@ -25,9 +32,17 @@ type Config struct {
 	FactorioCredentialsFile string `json:"factorio_credentials_file"`
 	FactorioIP              string `json:"factorio_ip"`
 	FactorioAdminFile       string `json:"-"`
+	LaunchProfilesFile      string `json:"-"`
 	ServerIP                string `json:"server_ip"`
 	ServerPort              string `json:"server_port"`
 	MaxUploadSize           int64  `json:"max_upload_size"`
+	MaxChunkedUploadSize    int64  `json:"max_chunked_upload_size"`
+	JobWorkers              int    `json:"job_workers"`
+	ModUpdateInterval       int    `json:"mod_update_interval"`
+	ModSource               string `json:"mod_source"`
+	ModSourceURL            string `json:"mod_source_url"`
+	ModSourceAuthURL        string `json:"mod_source_auth_url"`
+	ModSourceDir            string `json:"mod_source_dir"`
 	Username                string `json:"username"`
 	Password                string `json:"password"`
 	DatabaseFile            string `json:"database_file"`
@@ -75,6 +90,13 @@ func parseFlags() {
 	factorioPort := flag.String("port", "8080", "Specify a port for the server.")
 	factorioConfigFile := flag.String("config", "config/config.ini", "Specify location of Factorio config.ini file")
 	factorioMaxUpload := flag.Int64("max-upload", 1024*1024*20, "Maximum filesize for uploaded files (default 20MB).")
+	factorioMaxChunkedUpload := flag.Int64("max-chunked-upload", 1024*1024*1024*4, "Maximum filesize for files uploaded in chunks, chunks are limited by max-upload (default 4GB).")
+	jobWorkers := flag.Int("job-workers", 2, "Number of background jobs, like mod installs or map creations, run at the same time.")
+	modUpdateInterval := flag.Int("mod-update-interval", 360, "Minutes between checks of the mod portal for updates of the installed mods, 0 disables the checks.")
+	modSource := flag.String("mod-source", "portal", "Where mods are installed from: portal (mods.factorio.com), mirror (a server implementing the mod portal API) or directory (a local directory with an index.json).")
+	modSourceURL := flag.String("mod-source-url", "", "URL of the mirror used by the mod source mirror.")
+	modSourceAuthURL := flag.String("mod-source-auth-url", "", "URL of the login server of the mirror, the mirror is used without login if it's empty.")
+	modSourceDir := flag.String("mod-source-dir", "", "Directory used by the mod source directory.")
 	factorioBinary := flag.String("bin", "bin/x64/factorio", "Location of Factorio Server binary file")
 	glibcCustom := flag.String("glibc-custom", "false", "By default false, if custom glibc is required set this to true and add glibc-loc and glibc-lib-loc parameters")
 	glibcLocation := flag.String("glibc-loc", "/opt/glibc-2.18/lib/ld-2.18.so", "Location glibc ld.so file if needed (ex. /opt/glibc-2.18/lib/ld-2.18.so)")
@@ -92,12 +114,27 @@ func parseFlags() {
 	config.FactorioSavesDir = filepath.Join(config.FactorioDir, "saves")
 	config.FactorioModsDir = filepath.Join(config.FactorioDir, "mods")
 	config.FactorioModPackDir = "./mod_packs"
+	// next to the mods dir, so the cached mod files can be linked into it
+	config.FactorioModCacheDir = filepath.Join(config.FactorioDir, "mod_cache")
+	config.FactorioMapPreviewDir = "./map_previews"
+	config.UploadSessionDir = "./uploads"
+	config.JobsDir = "./jobs"
+	config.ModSettingsBackupDir = "./mod_settings_backups"
 	config.FactorioConfigDir = filepath.Join(config.FactorioDir, "config")
+	config.FactorioMapPresetsDir = filepath.Join(config.FactorioConfigDir, "map-presets")
 	config.FactorioConfigFile = filepath.Join(config.FactorioDir, *factorioConfigFile)
 	config.FactorioBinary = filepath.Join(config.FactorioDir, *factorioBinary)
 	config.FactorioCredentialsFile = "./factorio.auth"
 	config.FactorioAdminFile = "server-adminlist.json"
+	config.LaunchProfilesFile = "launch-profiles.json"
 	config.MaxUploadSize = *factorioMaxUpload
+	config.MaxChunkedUploadSize = *factorioMaxChunkedUpload
+	config.JobWorkers = *jobWorkers
+	config.ModUpdateInterval = *modUpdateInterval
+	config.ModSource = *modSource
+	config.ModSourceURL = *modSourceURL
+	config.ModSourceAuthURL = *modSourceAuthURL
+	config.ModSourceDir = *modSourceDir
 
 	if runtime.GOOS == "windows" {
 		appdata := os.Getenv("APPDATA")
@@ -114,8 +151,17 @@ func main() {
 	parseFlags()
 	// Load server config from file
 	loadServerConfig(config.ConfFile)
+	// check the configured mod source
+	_, err = newModSource()
+	failOnError(err, "Error configuring the mod source.")
 	// create mod-stuff
 	modStartUp()
+	// mod files are copied instead of linked, if the mod cache is on another file system
+	checkModCacheLinks()
+	// remove uploads, which were abandoned
+	go cleanUploadSessions()
+	// run long operations in the background
+	startJobWorkers(config.JobWorkers)
 
 	// Initialize Factorio Server struct
 	FactorioServ, err = initFactorio()
@@ -123,6 +169,8 @@ func main() {
 		log.Printf("Error occurred during FactorioServer initializaion: %v\n", err)
 		return
 	}
+	// the updates depend on the version of factorio
+	go scheduleModUpdateChecks(time.Duration(config.ModUpdateInterval) * time.Minute)
 
 	// Initialize authentication system
 	Auth = initAuth()
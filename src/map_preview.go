@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MapPreviewRequest is the JSON body to render a preview of map-gen settings
+type MapPreviewRequest struct {
+	Preset         string          `json:"preset"`
+	Seed           *uint32         `json:"seed"`
+	MapGenSettings *MapGenSettings `json:"map_gen_settings"`
+	Size           int             `json:"size"`
+	Scale          float64         `json:"scale"`
+}
+
+// MapPreviewResult is the result of a map preview job, the png can be fetched from the url
+type MapPreviewResult struct {
+	Seed    uint32 `json:"seed"`
+	Preview string `json:"preview"`
+	URL     string `json:"url"`
+}
+
+const (
+	defaultMapPreviewSize  = 1024
+	minMapPreviewSize      = 64
+	maxMapPreviewSize      = 4096
+	defaultMapPreviewScale = 1
+)
+
+// the cached previews are removed, once they weren't used for mapPreviewMaxAge
+// or the cache grows beyond mapPreviewCacheSize, least recently used first
+const (
+	mapPreviewMaxAge    = 30 * 24 * time.Hour
+	mapPreviewCacheSize = 256 << 20
+)
+
+// factorio can't render more than one preview at once in a reasonable time,
+// so all generations are serialized
+var mapPreviewLock sync.Mutex
+
+// normalize applies the defaults and limits to the requested size and scale
+func (request *MapPreviewRequest) normalize() {
+	if request.Size == 0 {
+		request.Size = defaultMapPreviewSize
+	}
+	if request.Size < minMapPreviewSize {
+		request.Size = minMapPreviewSize
+	}
+	if request.Size > maxMapPreviewSize {
+		request.Size = maxMapPreviewSize
+	}
+	if request.Scale <= 0 {
+		request.Scale = defaultMapPreviewScale
+	}
+}
+
+// mapPreviewKey hashes everything that has an influence on the rendered image
+func mapPreviewKey(settings MapGenSettings, size int, scale float64) (string, error) {
+	data, err := json.Marshal(struct {
+		Version        Version        `json:"version"`
+		MapGenSettings MapGenSettings `json:"map_gen_settings"`
+		Size           int            `json:"size"`
+		Scale          float64        `json:"scale"`
+	}{FactorioServ.Version, settings, size, scale})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// generateMapPreview renders the preview of the map-gen settings and returns the path of the png.
+// Previews are cached by the hash of their settings, so they are only rendered once.
+func generateMapPreview(ctx context.Context, settings MapGenSettings, size int, scale float64) (string, error) {
+	if settings.Seed == nil {
+		return "", fmt.Errorf("a seed is required to render a map preview")
+	}
+
+	key, err := mapPreviewKey(settings, size, scale)
+	if err != nil {
+		log.Printf("error hashing map preview settings: %s", err)
+		return "", err
+	}
+
+	previewPath := filepath.Join(config.FactorioMapPreviewDir, key+".png")
+
+	mapPreviewLock.Lock()
+	defer mapPreviewLock.Unlock()
+
+	if _, err := os.Stat(previewPath); err == nil {
+		// mark the preview as used, so it is kept in the cache
+		now := time.Now()
+		os.Chtimes(previewPath, now, now)
+		return previewPath, nil
+	}
+
+	err = os.MkdirAll(config.FactorioMapPreviewDir, 0755)
+	if err != nil {
+		log.Printf("error creating map preview dir: %s", err)
+		return "", err
+	}
+
+	mapGenFile, err := writeTempJson("map-gen-settings-*.json", settings)
+	if err != nil {
+		log.Printf("error writing map-gen-settings: %s", err)
+		return "", err
+	}
+	defer os.Remove(mapGenFile)
+
+	// render into a temporary file first, so no half written previews end up in the cache
+	tmpPath := filepath.Join(config.FactorioMapPreviewDir, key+".tmp.png")
+	defer os.Remove(tmpPath)
+
+	cmd := factorioCommandContext(ctx,
+		"--generate-map-preview", tmpPath,
+		"--map-gen-settings", mapGenFile,
+		"--map-gen-seed", strconv.FormatUint(uint64(*settings.Seed), 10),
+		"--map-preview-size", strconv.Itoa(size),
+		"--map-preview-scale", strconv.FormatFloat(scale, 'f', -1, 64),
+	)
+	log.Println("Generating map preview with command: ", cmd.Args)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("error generating map preview: %s\n%s", err, output)
+		return "", fmt.Errorf("factorio failed to generate the map preview: %v", err)
+	}
+
+	err = os.Rename(tmpPath, previewPath)
+	if err != nil {
+		log.Printf("error moving map preview into the cache: %s", err)
+		return "", err
+	}
+
+	err = pruneMapPreviews(time.Now(), key)
+	if err != nil {
+		log.Printf("error pruning the map preview cache: %s", err)
+	}
+
+	return previewPath, nil
+}
+
+// pruneMapPreviews removes the cached previews, which are too old or exceed the size of the cache.
+// The preview with the key is kept. The caller has to hold mapPreviewLock.
+func pruneMapPreviews(now time.Time, keep string) error {
+	files, err := ioutil.ReadDir(config.FactorioMapPreviewDir)
+	if err != nil {
+		return err
+	}
+
+	// least recently used first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+
+	var size int64
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".png" {
+			size += file.Size()
+		}
+	}
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".png" || file.Name() == keep+".png" {
+			continue
+		}
+		if size <= mapPreviewCacheSize && now.Sub(file.ModTime()) <= mapPreviewMaxAge {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(config.FactorioMapPreviewDir, file.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= file.Size()
+	}
+
+	return nil
+}
+
+// mapPreviewPath returns the path of a cached preview, the key has to be the hex hash of mapPreviewKey
+func mapPreviewPath(key string) (string, error) {
+	if _, err := hex.DecodeString(key); err != nil || len(key) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid map preview: %s", key)
+	}
+	return filepath.Join(config.FactorioMapPreviewDir, key+".png"), nil
+}
+
+// renderMapPreview is run as job to generate the preview of the map-gen settings
+func renderMapPreview(jc *JobContext, settings MapGenSettings, size int, scale float64) (MapPreviewResult, error) {
+	jc.Logf("rendering map preview with size %d and scale %g", size, scale)
+
+	previewPath, err := generateMapPreview(jc, settings, size, scale)
+	if err != nil {
+		return MapPreviewResult{}, err
+	}
+
+	key := strings.TrimSuffix(filepath.Base(previewPath), ".png")
+	return MapPreviewResult{
+		Seed:    *settings.Seed,
+		Preview: key,
+		URL:     "/api/saves/preview/cache/" + key,
+	}, nil
+}
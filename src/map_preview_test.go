@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// withMapPreviewDir points the map preview cache to a new temp dir, the returned func restores it
+func withMapPreviewDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "fsm-map-previews")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+
+	previewDir := config.FactorioMapPreviewDir
+	config.FactorioMapPreviewDir = dir
+
+	return dir, func() {
+		config.FactorioMapPreviewDir = previewDir
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPruneMapPreviews(t *testing.T) {
+	dir, restore := withMapPreviewDir(t)
+	defer restore()
+
+	now := time.Now()
+	previews := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"expired.png", 1, mapPreviewMaxAge + time.Hour},
+		{"kept-expired.png", 1, mapPreviewMaxAge + time.Hour},
+		{"oldest.png", mapPreviewCacheSize / 2, 3 * time.Hour},
+		{"older.png", mapPreviewCacheSize / 2, 2 * time.Hour},
+		{"new.png", mapPreviewCacheSize / 4, time.Hour},
+		{"notes.txt", 1, mapPreviewMaxAge + time.Hour},
+	}
+	for _, preview := range previews {
+		path := filepath.Join(dir, preview.name)
+		// sparse files, so the cache size can be exceeded without writing it
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("Error writing %s: %s", preview.name, err)
+		}
+		if err := os.Truncate(path, int64(preview.size)); err != nil {
+			t.Fatalf("Error resizing %s: %s", preview.name, err)
+		}
+		if err := os.Chtimes(path, now.Add(-preview.age), now.Add(-preview.age)); err != nil {
+			t.Fatalf("Error changing time of %s: %s", preview.name, err)
+		}
+	}
+
+	if err := pruneMapPreviews(now, "kept-expired"); err != nil {
+		t.Fatalf("Error pruning map previews: %s", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	sort.Strings(files)
+	expected := []string{"kept-expired.png", "new.png", "notes.txt", "older.png"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Cached previews not equal: %v --- %v", files, expected)
+	}
+}
+
+func TestMapPreviewKey(t *testing.T) {
+	server := FactorioServ
+	defer func() { FactorioServ = server }()
+	FactorioServ = &FactorioServer{Version: Version{1, 1, 110}}
+
+	seed, otherSeed := uint32(1), uint32(2)
+	water := 2.0
+	settings := MapGenSettings{Seed: &seed}
+
+	base, err := mapPreviewKey(settings, 1024, 1)
+	if err != nil {
+		t.Fatalf("Error hashing map preview settings: %s", err)
+	}
+	if _, err := mapPreviewPath(base); err != nil {
+		t.Errorf("Key not accepted as map preview: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		version  Version
+		settings MapGenSettings
+		size     int
+		scale    float64
+		same     bool
+	}{
+		{"same settings", Version{1, 1, 110}, MapGenSettings{Seed: &seed}, 1024, 1, true},
+		{"other seed", Version{1, 1, 110}, MapGenSettings{Seed: &otherSeed}, 1024, 1, false},
+		{"other settings", Version{1, 1, 110}, MapGenSettings{Seed: &seed, Water: &water}, 1024, 1, false},
+		{"other size", Version{1, 1, 110}, MapGenSettings{Seed: &seed}, 512, 1, false},
+		{"other scale", Version{1, 1, 110}, MapGenSettings{Seed: &seed}, 1024, 2, false},
+		{"other version", Version{1, 1, 100}, MapGenSettings{Seed: &seed}, 1024, 1, false},
+	}
+	for _, test := range tests {
+		FactorioServ.Version = test.version
+		key, err := mapPreviewKey(test.settings, test.size, test.scale)
+		if err != nil {
+			t.Errorf("%s: error hashing map preview settings: %s", test.name, err)
+			continue
+		}
+		if (key == base) != test.same {
+			t.Errorf("%s: key equal to base not equal: %v --- %v", test.name, key == base, test.same)
+		}
+	}
+
+	for _, key := range []string{"", "../" + base[3:], base[1:], base + "00"} {
+		if _, err := mapPreviewPath(key); err == nil {
+			t.Errorf("Expected error for map preview %q", key)
+		}
+	}
+}
+
+func TestMapPreviewCache(t *testing.T) {
+	dir, restore := withMapPreviewDir(t)
+	defer restore()
+
+	server := FactorioServ
+	defer func() { FactorioServ = server }()
+	// without factorio binary a preview can only be served from the cache
+	FactorioServ = &FactorioServer{Version: Version{1, 1, 110}}
+
+	seed := uint32(1)
+	settings := MapGenSettings{Seed: &seed}
+	if _, err := generateMapPreview(context.Background(), MapGenSettings{}, 1024, 1); err == nil {
+		t.Errorf("Expected error rendering a preview without seed")
+	}
+
+	key, err := mapPreviewKey(settings, 1024, 1)
+	if err != nil {
+		t.Fatalf("Error hashing map preview settings: %s", err)
+	}
+	cachedPath := filepath.Join(dir, key+".png")
+	if err := ioutil.WriteFile(cachedPath, []byte("png"), 0644); err != nil {
+		t.Fatalf("Error writing cached preview: %s", err)
+	}
+	used := time.Now().Add(-time.Hour)
+	os.Chtimes(cachedPath, used, used)
+
+	previewPath, err := generateMapPreview(context.Background(), settings, 1024, 1)
+	if err != nil {
+		t.Fatalf("Error serving cached preview: %s", err)
+	}
+	if previewPath != cachedPath {
+		t.Errorf("Preview path not equal: %s --- %s", previewPath, cachedPath)
+	}
+	if info, err := os.Stat(cachedPath); err != nil || !info.ModTime().After(used) {
+		t.Errorf("Cached preview not marked as used: %v", err)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AutoplaceSetting controls a single resource, terrain or enemy base autoplace control
+type AutoplaceSetting struct {
+	Frequency *float64 `json:"frequency,omitempty"`
+	Size      *float64 `json:"size,omitempty"`
+	Richness  *float64 `json:"richness,omitempty"`
+}
+
+type CliffSettings struct {
+	Name                   string   `json:"name,omitempty"`
+	CliffElevation0        *float64 `json:"cliff_elevation_0,omitempty"`
+	CliffElevationInterval *float64 `json:"cliff_elevation_interval,omitempty"`
+	Richness               *float64 `json:"richness,omitempty"`
+}
+
+// MapGenSettings is the content of a map-gen-settings.json file.
+// Fields left empty are not written, so factorio uses its defaults for them.
+type MapGenSettings struct {
+	TerrainSegmentation     *float64                    `json:"terrain_segmentation,omitempty"`
+	Water                   *float64                    `json:"water,omitempty"`
+	Width                   *uint32                     `json:"width,omitempty"`
+	Height                  *uint32                     `json:"height,omitempty"`
+	StartingArea            *float64                    `json:"starting_area,omitempty"`
+	PeacefulMode            *bool                       `json:"peaceful_mode,omitempty"`
+	AutoplaceControls       map[string]AutoplaceSetting `json:"autoplace_controls,omitempty"`
+	CliffSettings           *CliffSettings              `json:"cliff_settings,omitempty"`
+	PropertyExpressionNames map[string]string           `json:"property_expression_names,omitempty"`
+	Seed                    *uint32                     `json:"seed,omitempty"`
+}
+
+type PollutionSettings struct {
+	Enabled                                 *bool    `json:"enabled,omitempty"`
+	DiffusionRatio                          *float64 `json:"diffusion_ratio,omitempty"`
+	MinToDiffuse                            *float64 `json:"min_to_diffuse,omitempty"`
+	Ageing                                  *float64 `json:"ageing,omitempty"`
+	MinPollutionToDamageTrees               *float64 `json:"min_pollution_to_damage_trees,omitempty"`
+	PollutionRestoredPerTreeDamage          *float64 `json:"pollution_restored_per_tree_damage,omitempty"`
+	EnemyAttackPollutionConsumptionModifier *float64 `json:"enemy_attack_pollution_consumption_modifier,omitempty"`
+}
+
+type EnemyEvolutionSettings struct {
+	Enabled         *bool    `json:"enabled,omitempty"`
+	TimeFactor      *float64 `json:"time_factor,omitempty"`
+	DestroyFactor   *float64 `json:"destroy_factor,omitempty"`
+	PollutionFactor *float64 `json:"pollution_factor,omitempty"`
+}
+
+type EnemyExpansionSettings struct {
+	Enabled              *bool    `json:"enabled,omitempty"`
+	MaxExpansionDistance *uint32  `json:"max_expansion_distance,omitempty"`
+	SettlerGroupMinSize  *uint32  `json:"settler_group_min_size,omitempty"`
+	SettlerGroupMaxSize  *uint32  `json:"settler_group_max_size,omitempty"`
+	MinExpansionCooldown *uint32  `json:"min_expansion_cooldown,omitempty"`
+	MaxExpansionCooldown *uint32  `json:"max_expansion_cooldown,omitempty"`
+	BuildingCoefficient  *float64 `json:"building_coefficient,omitempty"`
+}
+
+// MapSettings is the content of a map-settings.json file
+type MapSettings struct {
+	Pollution      *PollutionSettings      `json:"pollution,omitempty"`
+	EnemyEvolution *EnemyEvolutionSettings `json:"enemy_evolution,omitempty"`
+	EnemyExpansion *EnemyExpansionSettings `json:"enemy_expansion,omitempty"`
+}
+
+// MapPreset is a reusable template for the creation of new maps
+type MapPreset struct {
+	Name           string          `json:"name"`
+	Description    string          `json:"description"`
+	MapGenSettings *MapGenSettings `json:"map_gen_settings,omitempty"`
+	MapSettings    *MapSettings    `json:"map_settings,omitempty"`
+}
+
+// SaveMapSettings are recorded next to a created save, so the map can be recreated
+type SaveMapSettings struct {
+	Preset          string         `json:"preset,omitempty"`
+	FactorioVersion Version        `json:"factorio_version"`
+	CreatedAt       time.Time      `json:"created_at"`
+	MapGenSettings  MapGenSettings `json:"map_gen_settings"`
+	MapSettings     MapSettings    `json:"map_settings"`
+}
+
+// the map settings json format used here was introduced with factorio 0.17
+var mapSettingsMinVersion = Version{0, 17, 0}
+
+// maximum value of all slider-like settings in the map generator gui
+const mapGenMaxMultiplier = 6
+
+const maxMapSize = 2000000
+
+func checkRange(name string, value *float64, min float64, max float64) error {
+	if value != nil && (*value < min || *value > max) {
+		return fmt.Errorf("%s has to be between %g and %g", name, min, max)
+	}
+	return nil
+}
+
+func (settings *MapGenSettings) Validate() error {
+	var err error
+	check := func(name string, value *float64, min float64, max float64) {
+		if err == nil {
+			err = checkRange(name, value, min, max)
+		}
+	}
+
+	check("terrain_segmentation", settings.TerrainSegmentation, 0, mapGenMaxMultiplier)
+	check("water", settings.Water, 0, mapGenMaxMultiplier)
+	check("starting_area", settings.StartingArea, 0, mapGenMaxMultiplier)
+
+	for name, control := range settings.AutoplaceControls {
+		if name == "" {
+			return errors.New("autoplace control name cannot be blank")
+		}
+		check(name+".frequency", control.Frequency, 0, mapGenMaxMultiplier)
+		check(name+".size", control.Size, 0, mapGenMaxMultiplier)
+		check(name+".richness", control.Richness, 0, mapGenMaxMultiplier)
+	}
+
+	if settings.CliffSettings != nil {
+		check("cliff_settings.cliff_elevation_0", settings.CliffSettings.CliffElevation0, 0, 1024)
+		check("cliff_settings.cliff_elevation_interval", settings.CliffSettings.CliffElevationInterval, 0, 1024)
+		check("cliff_settings.richness", settings.CliffSettings.Richness, 0, mapGenMaxMultiplier)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if settings.Width != nil && *settings.Width > maxMapSize {
+		return fmt.Errorf("width cannot be bigger than %d", maxMapSize)
+	}
+	if settings.Height != nil && *settings.Height > maxMapSize {
+		return fmt.Errorf("height cannot be bigger than %d", maxMapSize)
+	}
+
+	return nil
+}
+
+func (settings *MapSettings) Validate() error {
+	var err error
+	check := func(name string, value *float64, min float64, max float64) {
+		if err == nil {
+			err = checkRange(name, value, min, max)
+		}
+	}
+
+	if pollution := settings.Pollution; pollution != nil {
+		check("pollution.diffusion_ratio", pollution.DiffusionRatio, 0, 0.25)
+		check("pollution.min_to_diffuse", pollution.MinToDiffuse, 0, 1000000)
+		check("pollution.ageing", pollution.Ageing, 0.01, 4)
+		check("pollution.min_pollution_to_damage_trees", pollution.MinPollutionToDamageTrees, 0, 1000000)
+		check("pollution.pollution_restored_per_tree_damage", pollution.PollutionRestoredPerTreeDamage, 0, 1000000)
+		check("pollution.enemy_attack_pollution_consumption_modifier", pollution.EnemyAttackPollutionConsumptionModifier, 0.1, 4)
+	}
+
+	if evolution := settings.EnemyEvolution; evolution != nil {
+		check("enemy_evolution.time_factor", evolution.TimeFactor, 0, 0.0001)
+		check("enemy_evolution.destroy_factor", evolution.DestroyFactor, 0, 0.01)
+		check("enemy_evolution.pollution_factor", evolution.PollutionFactor, 0, 0.0001)
+	}
+
+	if expansion := settings.EnemyExpansion; expansion != nil {
+		check("enemy_expansion.building_coefficient", expansion.BuildingCoefficient, 0, 1)
+
+		if expansion.MaxExpansionDistance != nil && (*expansion.MaxExpansionDistance < 2 || *expansion.MaxExpansionDistance > 20) {
+			return errors.New("enemy_expansion.max_expansion_distance has to be between 2 and 20")
+		}
+		if expansion.SettlerGroupMinSize != nil && expansion.SettlerGroupMaxSize != nil &&
+			*expansion.SettlerGroupMinSize > *expansion.SettlerGroupMaxSize {
+			return errors.New("enemy_expansion.settler_group_min_size cannot be bigger than settler_group_max_size")
+		}
+		if expansion.MinExpansionCooldown != nil && expansion.MaxExpansionCooldown != nil &&
+			*expansion.MinExpansionCooldown > *expansion.MaxExpansionCooldown {
+			return errors.New("enemy_expansion.min_expansion_cooldown cannot be bigger than max_expansion_cooldown")
+		}
+	}
+
+	return err
+}
+
+func (preset *MapPreset) Validate() error {
+	if preset.Name == "" || filepath.Base(preset.Name) != preset.Name || strings.HasPrefix(preset.Name, ".") {
+		return fmt.Errorf("invalid preset name: %s", preset.Name)
+	}
+	if preset.MapGenSettings != nil {
+		if err := preset.MapGenSettings.Validate(); err != nil {
+			return fmt.Errorf("invalid map-gen-settings: %v", err)
+		}
+	}
+	if preset.MapSettings != nil {
+		if err := preset.MapSettings.Validate(); err != nil {
+			return fmt.Errorf("invalid map-settings: %v", err)
+		}
+	}
+	return nil
+}
+
+func mapPresetPath(name string) string {
+	return filepath.Join(config.FactorioMapPresetsDir, name+".json")
+}
+
+// listMapPresets reads all presets stored in the map preset directory
+func listMapPresets() ([]MapPreset, error) {
+	presets := []MapPreset{}
+
+	files, err := ioutil.ReadDir(config.FactorioMapPresetsDir)
+	if os.IsNotExist(err) {
+		return presets, nil
+	}
+	if err != nil {
+		log.Printf("error reading map preset dir: %s", err)
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		preset, err := loadMapPreset(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			log.Printf("skipping map preset %s: %s", file.Name(), err)
+			continue
+		}
+		presets = append(presets, preset)
+	}
+
+	return presets, nil
+}
+
+func loadMapPreset(name string) (MapPreset, error) {
+	var preset MapPreset
+
+	if filepath.Base(name) != name {
+		return preset, fmt.Errorf("invalid preset name: %s", name)
+	}
+
+	data, err := ioutil.ReadFile(mapPresetPath(name))
+	if err != nil {
+		return preset, err
+	}
+
+	err = json.Unmarshal(data, &preset)
+	if err != nil {
+		return preset, fmt.Errorf("error decoding map preset %s: %v", name, err)
+	}
+	preset.Name = name
+
+	return preset, nil
+}
+
+func (preset *MapPreset) save() error {
+	err := preset.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(config.FactorioMapPresetsDir, 0755)
+	if err != nil {
+		log.Printf("error creating map preset dir: %s", err)
+		return err
+	}
+
+	data, err := json.MarshalIndent(preset, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(mapPresetPath(preset.Name), data, 0664)
+}
+
+func deleteMapPreset(name string) error {
+	if filepath.Base(name) != name {
+		return fmt.Errorf("invalid preset name: %s", name)
+	}
+
+	return os.Remove(mapPresetPath(name))
+}
+
+// mapSettingsPath returns the path of the settings file recorded next to the save
+func mapSettingsPath(savePath string) string {
+	return strings.TrimSuffix(savePath, ".zip") + ".settings.json"
+}
+
+// loadSaveMapSettings reads the map settings recorded on creation of the save
+func loadSaveMapSettings(savePath string) (SaveMapSettings, error) {
+	var settings SaveMapSettings
+
+	data, err := ioutil.ReadFile(mapSettingsPath(savePath))
+	if err != nil {
+		return settings, err
+	}
+
+	err = json.Unmarshal(data, &settings)
+	return settings, err
+}
+
+func (settings *SaveMapSettings) save(savePath string) error {
+	data, err := json.MarshalIndent(settings, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(mapSettingsPath(savePath), data, 0664)
+}
+
+// resolveMapSettings merges the preset with the explicitly given settings and seed.
+// Explicitly given settings replace the ones of the preset.
+func resolveMapSettings(presetName string, mapGenSettings *MapGenSettings, mapSettings *MapSettings, seed *uint32) (SaveMapSettings, error) {
+	result := SaveMapSettings{
+		Preset:          presetName,
+		FactorioVersion: FactorioServ.Version,
+		CreatedAt:       time.Now(),
+	}
+
+	if presetName != "" {
+		preset, err := loadMapPreset(presetName)
+		if err != nil {
+			return result, fmt.Errorf("error loading map preset %s: %v", presetName, err)
+		}
+		if preset.MapGenSettings != nil {
+			result.MapGenSettings = *preset.MapGenSettings
+		}
+		if preset.MapSettings != nil {
+			result.MapSettings = *preset.MapSettings
+		}
+	}
+
+	if mapGenSettings != nil {
+		result.MapGenSettings = *mapGenSettings
+	}
+	if mapSettings != nil {
+		result.MapSettings = *mapSettings
+	}
+
+	if seed != nil {
+		result.MapGenSettings.Seed = seed
+	}
+	if result.MapGenSettings.Seed == nil {
+		// choose the seed ourselves, so it can be recorded
+		randomSeed := rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+		result.MapGenSettings.Seed = &randomSeed
+	}
+
+	if err := result.MapGenSettings.Validate(); err != nil {
+		return result, fmt.Errorf("invalid map-gen-settings: %v", err)
+	}
+	if err := result.MapSettings.Validate(); err != nil {
+		return result, fmt.Errorf("invalid map-settings: %v", err)
+	}
+
+	// the version is unknown until the server binary was found, factorio rejects the settings itself then
+	if !FactorioServ.Version.Equals(NilVersion) && FactorioServ.Version.Less(mapSettingsMinVersion) {
+		return result, fmt.Errorf("map settings require factorio %s or newer", mapSettingsMinVersion)
+	}
+
+	return result, nil
+}
+
+// writeTempJson writes the value into a new temporary file and returns its path
+func writeTempJson(pattern string, value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), file.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestResolveMapSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-map-presets")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	presetsDir := config.FactorioMapPresetsDir
+	server := FactorioServ
+	defer func() {
+		config.FactorioMapPresetsDir = presetsDir
+		FactorioServ = server
+	}()
+	config.FactorioMapPresetsDir = dir
+
+	water := 2.0
+	presetSeed := uint32(42)
+	preset := MapPreset{
+		Name:           "islands",
+		MapGenSettings: &MapGenSettings{Water: &water, Seed: &presetSeed},
+	}
+	if err := preset.save(); err != nil {
+		t.Fatalf("Error saving preset: %s", err)
+	}
+
+	seed := uint32(7)
+	tooMuchWater := 7.0
+	tests := []struct {
+		name           string
+		version        Version
+		preset         string
+		mapGenSettings *MapGenSettings
+		seed           *uint32
+		expectedSeed   uint32
+		expectedWater  float64
+		fails          bool
+	}{
+		{name: "seed", version: Version{1, 1, 110}, seed: &seed, expectedSeed: 7},
+		{name: "preset", version: Version{1, 1, 110}, preset: "islands", expectedSeed: 42, expectedWater: 2},
+		{name: "preset with seed", version: Version{1, 1, 110}, preset: "islands", seed: &seed, expectedSeed: 7, expectedWater: 2},
+		{name: "unknown server version", version: NilVersion, seed: &seed, expectedSeed: 7},
+		{name: "missing preset", version: Version{1, 1, 110}, preset: "desert", fails: true},
+		{name: "invalid settings", version: Version{1, 1, 110}, mapGenSettings: &MapGenSettings{Water: &tooMuchWater}, fails: true},
+		{name: "old server", version: Version{0, 16, 51}, seed: &seed, fails: true},
+	}
+
+	for _, test := range tests {
+		FactorioServ = &FactorioServer{Version: test.version}
+
+		settings, err := resolveMapSettings(test.preset, test.mapGenSettings, nil, test.seed)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error resolving map settings: %s", test.name, err)
+			continue
+		}
+
+		if settings.MapGenSettings.Seed == nil || *settings.MapGenSettings.Seed != test.expectedSeed {
+			t.Errorf("%s: seed not equal: %v --- %d", test.name, settings.MapGenSettings.Seed, test.expectedSeed)
+		}
+		if test.expectedWater != 0 && (settings.MapGenSettings.Water == nil || *settings.MapGenSettings.Water != test.expectedWater) {
+			t.Errorf("%s: water not equal: %v --- %g", test.name, settings.MapGenSettings.Water, test.expectedWater)
+		}
+		if settings.Preset != test.preset || settings.FactorioVersion != test.version {
+			t.Errorf("%s: unexpected preset or version: %s %s", test.name, settings.Preset, settings.FactorioVersion)
+		}
+	}
+
+	// without any seed a random one is chosen, so it can be recorded
+	FactorioServ = &FactorioServer{Version: Version{1, 1, 110}}
+	settings, err := resolveMapSettings("", nil, nil, nil)
+	if err != nil || settings.MapGenSettings.Seed == nil {
+		t.Errorf("Expected a random seed, got: %v %v", settings.MapGenSettings.Seed, err)
+	}
+}
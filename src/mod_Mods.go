@@ -3,6 +3,9 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/mroote/factorio-server-manager/lockfile"
@@ -10,24 +13,75 @@ import (
 	"io/ioutil"
 	"log"
 	"mime/multipart"
-	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Mods struct {
 	ModSimpleList ModSimpleList `json:"mod_simple_list"`
 	ModInfoList   ModInfoList   `json:"mod_info_list"`
+	ModPinList    ModPinList    `json:"mod_pin_list"`
 }
 type ModsResult struct {
 	ModInfo
-	Enabled bool `json:"enabled"`
+	Enabled bool    `json:"enabled"`
+	Pin     *ModPin `json:"pin,omitempty"`
 }
 type ModsResultList struct {
 	ModsResult []ModsResult `json:"mods"`
+	Corrupt    []CorruptMod `json:"corrupt,omitempty"`
 }
 
 var fileLock lockfile.FileLock = lockfile.NewLock()
 
+// modsDirLock is held by every job and handler writing the mods directory, mod-list.json or the mod cache, so they never run at the same time.
+// A server start holds it as well, until the server is starting, so its preflight can't race with these jobs.
+var modsDirLock = make(chan struct{}, 1)
+
+// ErrModsChanging is returned by a server start, while a job changes the mods
+var ErrModsChanging = errors.New("the mods are being changed by a running job")
+
+// tryLockModsDir takes the mods dir lock without waiting, it returns false if the lock is held
+func tryLockModsDir() bool {
+	select {
+	case modsDirLock <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// lockModsDir waits for the mods dir lock, until the context is done
+func lockModsDir(ctx context.Context) error {
+	select {
+	case modsDirLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func unlockModsDir() {
+	<-modsDirLock
+}
+
+// withModsDirLock makes the job wait until no other job changes the mods, before fn is run
+func withModsDirLock(fn JobFunc) JobFunc {
+	return func(jc *JobContext) (interface{}, error) {
+		if !tryLockModsDir() {
+			jc.Logf("waiting for other changes of the mods to finish")
+			if err := lockModsDir(jc); err != nil {
+				return nil, err
+			}
+		}
+		defer unlockModsDir()
+
+		return fn(jc)
+	}
+}
+
 func newMods(destination string) (Mods, error) {
 	var err error
 	var mods Mods
@@ -44,6 +98,12 @@ func newMods(destination string) (Mods, error) {
 		return mods, err
 	}
 
+	mods.ModPinList, err = newModPinList(destination)
+	if err != nil {
+		log.Printf("error on creating newModPinList: %s", err)
+		return mods, err
+	}
+
 	return mods, nil
 }
 
@@ -67,8 +127,13 @@ func (mods *Mods) listInstalledMods() ModsResultList {
 			}
 		}
 
+		if pin, ok := mods.ModPinList.find(modInfo.Name); ok {
+			modsResult.Pin = &pin
+		}
+
 		result.ModsResult = append(result.ModsResult, modsResult)
 	}
+	result.Corrupt = mods.ModInfoList.Corrupt
 
 	return result
 }
@@ -91,7 +156,8 @@ func (mods *Mods) deleteMod(modName string) error {
 	return nil
 }
 
-func (mods *Mods) createMod(modName string, fileName string, fileRc io.Reader) error {
+// removeExistingMod deletes the mod before another version is installed
+func (mods *Mods) removeExistingMod(modName string) error {
 	var err error
 
 	//check if mod already exists and delete it
@@ -109,6 +175,17 @@ func (mods *Mods) createMod(modName string, fileName string, fileRc io.Reader) e
 		}
 	}
 
+	return nil
+}
+
+func (mods *Mods) createMod(modName string, fileName string, fileRc io.Reader) error {
+	var err error
+
+	err = mods.removeExistingMod(modName)
+	if err != nil {
+		return err
+	}
+
 	//create new mod
 	err = mods.ModInfoList.createMod(modName, fileName, fileRc)
 	if err != nil {
@@ -124,52 +201,193 @@ func (mods *Mods) createMod(modName string, fileName string, fileRc io.Reader) e
 	return nil
 }
 
-func (mods *Mods) downloadMod(url string, filename string, modId string) error {
+// linkMod installs the mod from the mod cache
+func (mods *Mods) linkMod(modName string, fileName string, cacheEntry string) error {
 	var err error
 
-	var credentials FactorioCredentials
-	status, err := credentials.load()
+	// the new file is linked next to the old one and moved over it, so the mod is never missing
+	err = mods.ModInfoList.linkMod(fileName, cacheEntry)
 	if err != nil {
-		log.Printf("error loading credentials: %s", err)
+		log.Printf("error on linking mod-file: %s", err)
 		return err
 	}
-	if status == false {
-		log.Printf("error: credentials are invalid")
-		return errors.New("error: credentials are invalid")
+	err = mods.ModInfoList.deleteOtherModFiles(modName, fileName)
+	if err != nil {
+		log.Printf("error on removing the replaced mod-file: %s", err)
+		return err
 	}
 
-	//download the mod from the mod portal api
-	completeUrl := "https://mods.factorio.com" + url + "?username=" + credentials.Username + "&token=" + credentials.Userkey
+	if mods.ModSimpleList.checkModExists(modName) {
+		err = mods.ModSimpleList.deleteMod(modName)
+		if err != nil {
+			log.Printf("error when deleting mod: %s", err)
+			return err
+		}
+	}
+	err = mods.ModSimpleList.createMod(modName)
+	if err != nil {
+		log.Printf("error on adding mod to the mod-list.json: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// modDownloadAttempts is how often a failed download is tried before giving up
+const modDownloadAttempts = 3
 
-	response, err := http.Get(completeUrl)
+// downloadMod downloads the mod from the mod source and installs it, the download is aborted when the context is cancelled.
+// The download is verified against the SHA1 of the release, it is looked up on the mod source, if it is not given.
+func (mods *Mods) downloadMod(ctx context.Context, url string, filename string, modId string, sha1Sum string) error {
+	var err error
+
+	source, err := newModSource()
 	if err != nil {
-		log.Printf("error on downloading mod: %s", err)
+		log.Printf("error getting the mod source: %s", err)
 		return err
 	}
 
-	log.Printf("download complete\n StatusCode: %d\n Status: %s", response.StatusCode, response.Status)
+	var credentials FactorioCredentials
+	if source.RequiresLogin() {
+		status, err := credentials.load()
+		if err != nil {
+			log.Printf("error loading credentials: %s", err)
+			return err
+		}
+		if status == false {
+			log.Printf("error: credentials are invalid")
+			return errors.New("error: credentials are invalid")
+		}
+	}
 
-	defer response.Body.Close()
+	if sha1Sum == "" {
+		sha1Sum, err = modReleaseSha1(modId, filename)
+		if err != nil {
+			log.Printf("error looking up the checksum of %s: %s", filename, err)
+			return err
+		}
+	}
 
-	if response.StatusCode != 200 {
-		log.Printf("StatusCode: %d", response.StatusCode)
+	modCache, err := newModCache(config.FactorioModCacheDir)
+	if err != nil {
+		return err
+	}
+	if cacheEntry, ok := modCache.lookup(sha1Sum, filename); ok {
+		log.Printf("installing %s from the mod cache", filename)
+		return mods.linkMod(modId, filename, cacheEntry)
+	}
+
+	var file *os.File
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		file, retry, err = fetchModFile(ctx, source, url, credentials, sha1Sum)
+		if err == nil {
+			break
+		}
+		log.Printf("error downloading %s (attempt %d of %d): %s", filename, attempt, modDownloadAttempts, err)
+		if !retry || attempt == modDownloadAttempts {
+			return fmt.Errorf("download of %s failed after %d attempts: %v", filename, attempt, err)
+		}
 
-		return errors.New("Statuscode not 200: " + fmt.Sprint(response.StatusCode))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		}
 	}
+	defer os.Remove(file.Name())
+	defer file.Close()
 
-	err = mods.createMod(modId, filename, response.Body)
+	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
-		log.Printf("error when creating Mod: %s", err)
+		log.Printf("error on reading the downloaded file: %s", err)
 		return err
 	}
 
-	log.Printf("completed copying the response.Body")
+	cacheEntry, err := modCache.store(file, sha1Sum, filename)
+	if err != nil {
+		log.Printf("error adding %s to the mod cache: %s", filename, err)
+		return err
+	}
 
-	//done everything is made inside the createMod
+	err = mods.linkMod(modId, filename, cacheEntry)
+	if err != nil {
+		log.Printf("error when creating Mod: %s", err)
+		return err
+	}
 
 	return nil
 }
 
+// fetchModFile downloads the mod into a temporary file and verifies its checksum and that it is a mod.
+// retry is true, if the download may succeed, when it's tried again.
+func fetchModFile(ctx context.Context, source ModSource, url string, credentials FactorioCredentials, sha1Sum string) (file *os.File, retry bool, err error) {
+	body, err := source.Download(ctx, url, credentials)
+	if err != nil {
+		// only errors of the mod source itself are temporary
+		var statusErr *ModSourceStatusError
+		if errors.As(err, &statusErr) {
+			return nil, statusErr.StatusCode >= 500, err
+		}
+		return nil, ctx.Err() == nil && !os.IsNotExist(err), err
+	}
+	defer body.Close()
+
+	tmpFile, err := ioutil.TempFile("", "fsm-mod-*.zip")
+	if err != nil {
+		log.Printf("error on creating temporary file: %s", err)
+		return nil, false, err
+	}
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	hash := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), body)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, sha1Sum) {
+		err = fmt.Errorf("checksum mismatch, expected sha1 %s, got %s (%d bytes)", sha1Sum, sum, size)
+		return nil, true, err
+	}
+
+	zipReader, err := zip.NewReader(tmpFile, size)
+	if err != nil {
+		return nil, false, fmt.Errorf("downloaded file is not a zip-file: %v", err)
+	}
+	var modInfo ModInfo
+	err = modInfo.getModInfo(zipReader)
+	if err != nil {
+		return nil, false, fmt.Errorf("downloaded file is not a mod: %v", err)
+	}
+
+	return tmpFile, false, nil
+}
+
+// modReleaseSha1 returns the checksum of the release with the file name from the mod source
+func modReleaseSha1(modId string, filename string) (string, error) {
+	details, err := getModPortalDetails(modId)
+	if err != nil {
+		return "", err
+	}
+
+	for _, release := range details.Releases {
+		if release.FileName == filename {
+			if release.Sha1 == "" {
+				return "", fmt.Errorf("release %s of mod %s has no sha1 on the mod source", filename, modId)
+			}
+			return release.Sha1, nil
+		}
+	}
+
+	return "", fmt.Errorf("mod %s has no release %s on the mod portal", modId, filename)
+}
+
 func (mods *Mods) uploadMod(header *multipart.FileHeader) error {
 	var err error
 
@@ -191,7 +409,14 @@ func (mods *Mods) uploadMod(header *multipart.FileHeader) error {
 		return err
 	}
 
-	zipReader, err := zip.NewReader(bytes.NewReader(fileByteArray), int64(len(fileByteArray)))
+	return mods.installModFile(header.Filename, bytes.NewReader(fileByteArray), int64(len(fileByteArray)))
+}
+
+// installModFile checks, that the file is a mod and stores it in the mods directory
+func (mods *Mods) installModFile(filename string, file io.ReaderAt, size int64) error {
+	var err error
+
+	zipReader, err := zip.NewReader(file, size)
 	if err != nil {
 		log.Printf("Uploaded file could not put into zip.Reader: %s", err)
 		return err
@@ -204,7 +429,7 @@ func (mods *Mods) uploadMod(header *multipart.FileHeader) error {
 		return err
 	}
 
-	err = mods.createMod(modInfo.Name, header.Filename, bytes.NewReader(fileByteArray))
+	err = mods.createMod(modInfo.Name, filepath.Base(filename), io.NewSectionReader(file, 0, size))
 	if err != nil {
 		log.Printf("error on creating Mod: %s", err)
 		return err
@@ -216,7 +441,7 @@ func (mods *Mods) uploadMod(header *multipart.FileHeader) error {
 func (mods *Mods) updateMod(modName string, url string, filename string) error {
 	var err error
 
-	err = mods.downloadMod(url, filename, modName)
+	err = mods.downloadMod(context.Background(), url, filename, modName, "")
 	if err != nil {
 		log.Printf("updateMod ... error when downloading the new Mod: %s", err)
 		return err
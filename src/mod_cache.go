@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The mod cache stores every mod file once as "<sha1>/<file name>".
+// The mods directory and the modpacks reference the entries by hardlinks, so the same file isn't stored multiple times.
+type ModCache struct {
+	Destination string `json:"-"`
+}
+
+// ModCacheEntry is a single mod file in the cache
+type ModCacheEntry struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Sha1     string `json:"sha1"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+}
+
+// modCacheLock keeps the garbage collection from removing entries, which are just stored
+var modCacheLock sync.Mutex
+
+func newModCache(destination string) (ModCache, error) {
+	modCache := ModCache{
+		Destination: destination,
+	}
+
+	err := os.MkdirAll(destination, 0755)
+	if err != nil {
+		log.Printf("ModCache ... error creating cache dir: %s", err)
+		return modCache, err
+	}
+
+	return modCache, nil
+}
+
+func (modCache *ModCache) entryPath(sha1Sum string, fileName string) string {
+	return filepath.Join(modCache.Destination, strings.ToLower(sha1Sum), filepath.Base(fileName))
+}
+
+// lookup returns the path of the cached file with the checksum
+func (modCache *ModCache) lookup(sha1Sum string, fileName string) (string, bool) {
+	if sha1Sum == "" {
+		return "", false
+	}
+
+	path := modCache.entryPath(sha1Sum, fileName)
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+	return path, true
+}
+
+// store adds the file with the already verified checksum to the cache and returns the path of the entry
+func (modCache *ModCache) store(modFile io.Reader, sha1Sum string, fileName string) (string, error) {
+	modCacheLock.Lock()
+	defer modCacheLock.Unlock()
+
+	if path, ok := modCache.lookup(sha1Sum, fileName); ok {
+		return path, nil
+	}
+
+	path := modCache.entryPath(sha1Sum, fileName)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		log.Printf("error on creating cache entry dir: %s", err)
+		return "", err
+	}
+
+	err = writeFileAtomic(path, modFile)
+	if err != nil {
+		log.Printf("error on storing %s in the mod cache: %s", fileName, err)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// find returns the path of the cached file with the checksum, whatever its file name is
+func (modCache *ModCache) find(sha1Sum string) (string, bool) {
+	if sha1Sum == "" {
+		return "", false
+	}
+
+	files, err := filepath.Glob(filepath.Join(modCache.Destination, strings.ToLower(sha1Sum), "*.zip"))
+	if err != nil || len(files) == 0 {
+		return "", false
+	}
+	return files[0], true
+}
+
+// add stores the mod file at the path in the cache, if it isn't already cached, and returns the path of the entry
+func (modCache *ModCache) add(path string) (string, error) {
+	sha1Sum, err := fileSha1(path)
+	if err != nil {
+		return "", err
+	}
+
+	if entry, ok := modCache.lookup(sha1Sum, path); ok {
+		return entry, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("error on opening mod file: %s", err)
+		return "", err
+	}
+	defer file.Close()
+
+	return modCache.store(file, sha1Sum, filepath.Base(path))
+}
+
+// fileSha1 returns the hex encoded SHA1 of the file
+func fileSha1(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("error on opening file: %s", err)
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha1.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		log.Printf("error on hashing file: %s", err)
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// list returns all cached mod files
+func (modCache *ModCache) list() ([]ModCacheEntry, error) {
+	entries := []ModCacheEntry{}
+
+	dirs, err := ioutil.ReadDir(modCache.Destination)
+	if err != nil {
+		log.Printf("error on reading the mod cache: %s", err)
+		return entries, err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(modCache.Destination, dir.Name()))
+		if err != nil {
+			log.Printf("error on reading the mod cache: %s", err)
+			return entries, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() || filepath.Ext(file.Name()) != ".zip" {
+				continue
+			}
+
+			entry := ModCacheEntry{
+				Name:     strings.TrimSuffix(file.Name(), ".zip"),
+				Sha1:     dir.Name(),
+				FileName: file.Name(),
+				Size:     file.Size(),
+			}
+			if index := strings.LastIndex(entry.Name, "_"); index >= 0 {
+				entry.Name, entry.Version = entry.Name[:index], entry.Name[index+1:]
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// collectGarbage removes all entries, which are not linked into one of the directories
+func (modCache *ModCache) collectGarbage(dirs []string) ([]ModCacheEntry, error) {
+	modCacheLock.Lock()
+	defer modCacheLock.Unlock()
+
+	entries, err := modCache.list()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []ModCacheEntry{}
+	for _, entry := range entries {
+		path := modCache.entryPath(entry.Sha1, entry.FileName)
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("error on reading cache entry: %s", err)
+			return removed, err
+		}
+
+		referenced := false
+		for _, dir := range dirs {
+			for _, name := range modFileNames(entry.FileName) {
+				linked, err := os.Stat(filepath.Join(dir, name))
+				if err == nil && os.SameFile(info, linked) {
+					referenced = true
+				}
+			}
+		}
+		if referenced {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			log.Printf("error on removing cache entry: %s", err)
+			return removed, err
+		}
+		removed = append(removed, entry)
+
+		// the directory of the checksum may still hold the same file under another name
+		err = os.Remove(filepath.Dir(path))
+		if err != nil && !isDirNotEmpty(err) {
+			log.Printf("error on removing cache entry directory: %s", err)
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// isDirNotEmpty returns true, if the error is caused by removing a directory, which isn't empty
+func isDirNotEmpty(err error) bool {
+	return errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST)
+}
+
+// modCacheReferences returns the directories, which may link to the mod cache
+func modCacheReferences() ([]string, error) {
+	dirs := []string{config.FactorioModsDir}
+
+	modPacks, err := ioutil.ReadDir(config.FactorioModPackDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error on reading the modpack dir: %s", err)
+		return nil, err
+	}
+	for _, modPack := range modPacks {
+		if modPack.IsDir() {
+			dirs = append(dirs, filepath.Join(config.FactorioModPackDir, modPack.Name()))
+		}
+	}
+
+	return dirs, nil
+}
+
+// checkModCacheLinks warns, if the mod files can't be linked from the mod cache into the mods directory.
+// This happens, if they are on different file systems, e.g. when the mods directory is a docker volume.
+func checkModCacheLinks() {
+	modCache, err := newModCache(config.FactorioModCacheDir)
+	if err != nil {
+		return
+	}
+
+	probe, err := ioutil.TempFile(modCache.Destination, ".link-check-")
+	if err != nil {
+		log.Printf("error on checking the mod cache: %s", err)
+		return
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	linkPath := filepath.Join(config.FactorioModsDir, filepath.Base(probe.Name()))
+	err = os.Link(probe.Name(), linkPath)
+	if err != nil {
+		log.Printf("warning: the mod cache %s can't be linked into the mods dir %s, mod files are copied instead. "+
+			"Set mod_cache_dir to a directory on the file system of the mods dir: %s", modCache.Destination, config.FactorioModsDir, err)
+		return
+	}
+	os.Remove(linkPath)
+}
+
+// linkFile replaces the destination with a hardlink to the source, the file is copied, if it can't be linked
+func linkFile(source string, destination string) error {
+	tmpPath := destination + ".link"
+	os.Remove(tmpPath)
+
+	err := os.Link(source, tmpPath)
+	if err != nil {
+		// e.g. the directories are on different file systems
+		log.Printf("warning: %s can't be linked, it is copied and takes space twice: %s", filepath.Base(source), err)
+		sourceFile, err := os.Open(source)
+		if err != nil {
+			log.Printf("error on opening source file: %s", err)
+			return err
+		}
+		defer sourceFile.Close()
+
+		return writeFileAtomic(destination, sourceFile)
+	}
+
+	err = os.Rename(tmpPath, destination)
+	if err != nil {
+		os.Remove(tmpPath)
+		log.Printf("error on moving link into place: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes the file next to the destination and moves it into place, once it is complete
+func writeFileAtomic(destination string, content io.Reader) error {
+	newFile, err := ioutil.TempFile(filepath.Dir(destination), "."+filepath.Base(destination)+".*.part")
+	if err != nil {
+		log.Printf("error on creating new file - %s: %s", destination, err)
+		return err
+	}
+	defer os.Remove(newFile.Name())
+	defer newFile.Close()
+
+	_, err = io.Copy(newFile, content)
+	if err != nil {
+		log.Printf("error on copying file to disk: %s", err)
+		return err
+	}
+
+	err = newFile.Close()
+	if err != nil {
+		log.Printf("error on closing new file: %s", err)
+		return err
+	}
+
+	err = os.Chmod(newFile.Name(), 0664)
+	if err != nil {
+		log.Printf("error on setting permissions of new file: %s", err)
+		return err
+	}
+
+	return os.Rename(newFile.Name(), destination)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// kinds of dependencies in the info.json of a mod
+const (
+	modDependencyRequired       = "required"
+	modDependencyOptional       = "optional"
+	modDependencyHiddenOptional = "hidden_optional"
+	modDependencyIncompatible   = "incompatible"
+	// required, but without influence on the load order
+	modDependencyNoLoadOrder = "no_load_order"
+)
+
+// maxModResolveSteps limits the work of the resolver, if releases keep changing each other
+const maxModResolveSteps = 1000
+
+// modDependencyPattern matches "[prefix] name [op version]", names may contain spaces
+var modDependencyPattern = regexp.MustCompile(`^(!|\?|\(\?\)|~)?\s*([a-zA-Z0-9_\-. ]*?[a-zA-Z0-9_\-.])\s*(?:(<=|>=|<|>|=)\s*(\d+(?:\.\d+){1,2}))?$`)
+
+// ModDependency is a single parsed dependency of a mod
+type ModDependency struct {
+	Kind    string  `json:"kind"`
+	Name    string  `json:"name"`
+	Op      string  `json:"op,omitempty"`
+	Version Version `json:"version"`
+}
+
+func parseModDependency(text string) (ModDependency, error) {
+	match := modDependencyPattern.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return ModDependency{}, fmt.Errorf("invalid dependency: %q", text)
+	}
+
+	dep := ModDependency{Name: match[2], Op: match[3]}
+	switch match[1] {
+	case "!":
+		dep.Kind = modDependencyIncompatible
+	case "?":
+		dep.Kind = modDependencyOptional
+	case "(?)":
+		dep.Kind = modDependencyHiddenOptional
+	case "~":
+		dep.Kind = modDependencyNoLoadOrder
+	default:
+		dep.Kind = modDependencyRequired
+	}
+
+	if dep.Op != "" {
+		if dep.Kind == modDependencyIncompatible {
+			return ModDependency{}, fmt.Errorf("incompatible dependency can't have a version: %q", text)
+		}
+		if err := dep.Version.UnmarshalText([]byte(match[4])); err != nil {
+			return ModDependency{}, err
+		}
+	}
+
+	return dep, nil
+}
+
+// parseModDependencies parses the dependencies of a mod, invalid ones are skipped
+func parseModDependencies(modName string, dependencies []string) []ModDependency {
+	var result []ModDependency
+	for _, text := range dependencies {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		dep, err := parseModDependency(text)
+		if err != nil {
+			log.Printf("skipping dependency of %s: %s", modName, err)
+			continue
+		}
+		result = append(result, dep)
+	}
+	return result
+}
+
+// required returns true, if the dependency has to be installed
+func (dep ModDependency) required() bool {
+	return dep.Kind == modDependencyRequired || dep.Kind == modDependencyNoLoadOrder
+}
+
+// matches returns true, if the version satisfies the version constraint of the dependency
+func (dep ModDependency) matches(version Version) bool {
+	switch dep.Op {
+	case "":
+		return true
+	case "=":
+		return version.Equals(dep.Version)
+	default:
+		return version.Compare(dep.Version, dep.Op)
+	}
+}
+
+func (dep ModDependency) String() string {
+	if dep.Op == "" {
+		return dep.Name
+	}
+	return fmt.Sprintf("%s %s %d.%d.%d", dep.Name, dep.Op, dep.Version[0], dep.Version[1], dep.Version[2])
+}
+
+// modReleaseLookup returns all releases of a mod, it is the mod portal outside of tests
+type modReleaseLookup func(name string) ([]ModPortalRelease, error)
+
+func modPortalReleases(name string) ([]ModPortalRelease, error) {
+	details, err := getModPortalDetails(name)
+	return details.Releases, err
+}
+
+// factorioVersionCompatible returns true, if a mod made for the factorio version (major.minor) can be loaded by the server
+func factorioVersionCompatible(server Version, factorioVersion string) bool {
+	if server.Equals(NilVersion) {
+		return true
+	}
+
+	var version Version
+	if err := version.UnmarshalText([]byte(factorioVersion)); err != nil {
+		return false
+	}
+
+	if version[0] == server[0] && version[1] == server[1] {
+		return true
+	}
+	// factorio 1.0 also loads mods made for 0.18
+	return server[0] == 1 && server[1] == 0 && version[0] == 0 && version[1] == 18
+}
+
+// ModRequest is a mod to install, without version the newest compatible release is used
+type ModRequest struct {
+	Name    string   `json:"name"`
+	Version *Version `json:"version"`
+}
+
+// ModInstallRequest is the JSON body to install mods with their dependencies
+type ModInstallRequest struct {
+	Mods []ModRequest `json:"mods"`
+}
+
+// PlannedMod is a mod, which has to be installed or enabled for the requested mods
+type PlannedMod struct {
+	Name        string   `json:"name"`
+	Version     Version  `json:"version"`
+	FileName    string   `json:"file_name,omitempty"`
+	DownloadURL string   `json:"download_url,omitempty"`
+	Sha1        string   `json:"sha1,omitempty"`
+	RequiredBy  []string `json:"required_by"`
+}
+
+// ModConflict is a reason, why the requested mods can't be installed
+type ModConflict struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// ModInstallPlan lists the mods to download and the installed mods to enable
+type ModInstallPlan struct {
+	Install   []PlannedMod  `json:"install"`
+	Enable    []PlannedMod  `json:"enable"`
+	Conflicts []ModConflict `json:"conflicts"`
+}
+
+// modConstraint is a dependency on a mod and the mod declaring it, which is empty for requested mods
+type modConstraint struct {
+	dep  ModDependency
+	from string
+}
+
+// modSelection is the version of a mod chosen by the resolver
+type modSelection struct {
+	version      Version
+	installed    bool
+	release      ModPortalRelease
+	dependencies []ModDependency
+}
+
+type modResolver struct {
+	mods            *Mods
+	lookup          modReleaseLookup
+	factorioVersion Version
+	releases        map[string][]ModPortalRelease
+	constraints     map[string][]modConstraint
+	selected        map[string]modSelection
+	conflicts       map[string]string
+	queue           []string
+}
+
+// resolveModInstall computes which mods have to be downloaded and enabled to use the requested mods.
+// Installed mods are preferred, if they satisfy all version constraints.
+func resolveModInstall(requests []ModRequest, mods *Mods, lookup modReleaseLookup, factorioVersion Version) ModInstallPlan {
+	resolver := &modResolver{
+		mods:            mods,
+		lookup:          lookup,
+		factorioVersion: factorioVersion,
+		releases:        make(map[string][]ModPortalRelease),
+		constraints:     make(map[string][]modConstraint),
+		selected:        make(map[string]modSelection),
+		conflicts:       make(map[string]string),
+	}
+
+	for _, request := range requests {
+		dep := ModDependency{Kind: modDependencyRequired, Name: request.Name}
+		if request.Version != nil {
+			dep.Op = "="
+			dep.Version = *request.Version
+		}
+		resolver.constraints[request.Name] = append(resolver.constraints[request.Name], modConstraint{dep: dep})
+		resolver.queue = append(resolver.queue, request.Name)
+	}
+
+	for steps := 0; len(resolver.queue) > 0; steps++ {
+		if steps >= maxModResolveSteps {
+			resolver.conflicts[resolver.queue[0]] = "dependencies could not be resolved, the releases keep changing each other"
+			break
+		}
+
+		name := resolver.queue[0]
+		resolver.queue = resolver.queue[1:]
+		resolver.resolve(name)
+	}
+
+	return resolver.plan()
+}
+
+// satisfies returns true, if the version matches all constraints and the pin of the mod
+func (resolver *modResolver) satisfies(name string, version Version) bool {
+	if !resolver.mods.ModPinList.allows(name, version) {
+		return false
+	}
+	for _, constraint := range resolver.constraints[name] {
+		if !constraint.dep.matches(version) {
+			return false
+		}
+	}
+	return true
+}
+
+// describe lists the constraints on the mod for error messages
+func (resolver *modResolver) describe(name string) string {
+	var parts []string
+	for _, constraint := range resolver.constraints[name] {
+		from := constraint.from
+		if from == "" {
+			from = "request"
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", constraint.dep, from))
+	}
+	if pin, ok := resolver.mods.ModPinList.find(name); ok {
+		parts = append(parts, fmt.Sprintf("%s (pin)", pin.Version))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// needed returns true, if the mod has to be present: it is required or an enabled mod, which is an optional dependency
+func (resolver *modResolver) needed(name string) bool {
+	for _, constraint := range resolver.constraints[name] {
+		if constraint.dep.required() {
+			return true
+		}
+	}
+
+	_, installed := findInstalledMod(resolver.mods, name, NilVersion)
+	return installed && isModEnabled(resolver.mods, name) && len(resolver.constraints[name]) > 0
+}
+
+func (resolver *modResolver) resolve(name string) {
+	delete(resolver.conflicts, name)
+
+	if builtinMods[name] {
+		if !resolver.factorioVersion.Equals(NilVersion) && !resolver.satisfies(name, resolver.factorioVersion) {
+			resolver.conflicts[name] = fmt.Sprintf("factorio %s doesn't satisfy %s", resolver.factorioVersion, resolver.describe(name))
+		}
+		return
+	}
+
+	if !resolver.needed(name) {
+		resolver.unselect(name)
+		return
+	}
+
+	if selection, ok := resolver.selected[name]; ok && resolver.satisfies(name, selection.version) {
+		return
+	}
+
+	selection, err := resolver.choose(name)
+	if err != nil {
+		resolver.unselect(name)
+		resolver.conflicts[name] = err.Error()
+		return
+	}
+
+	resolver.unselect(name)
+	resolver.selected[name] = selection
+
+	for _, dep := range selection.dependencies {
+		if dep.Kind == modDependencyIncompatible {
+			continue
+		}
+		resolver.constraints[dep.Name] = append(resolver.constraints[dep.Name], modConstraint{dep: dep, from: name})
+		resolver.queue = append(resolver.queue, dep.Name)
+	}
+}
+
+// unselect drops the chosen version and the constraints it put on other mods
+func (resolver *modResolver) unselect(name string) {
+	selection, ok := resolver.selected[name]
+	if !ok {
+		return
+	}
+	delete(resolver.selected, name)
+
+	for _, dep := range selection.dependencies {
+		var kept []modConstraint
+		for _, constraint := range resolver.constraints[dep.Name] {
+			if constraint.from != name {
+				kept = append(kept, constraint)
+			}
+		}
+		resolver.constraints[dep.Name] = kept
+		resolver.queue = append(resolver.queue, dep.Name)
+	}
+}
+
+// choose picks the installed version or the newest compatible release, which satisfies all constraints
+func (resolver *modResolver) choose(name string) (modSelection, error) {
+	var best *ModInfo
+	var bestVersion Version
+	for i, modInfo := range resolver.mods.ModInfoList.Mods {
+		if modInfo.Name != name {
+			continue
+		}
+		var version Version
+		if err := version.UnmarshalText([]byte(modInfo.Version)); err != nil {
+			continue
+		}
+		if resolver.satisfies(name, version) && (best == nil || version.Greater(bestVersion)) {
+			best = &resolver.mods.ModInfoList.Mods[i]
+			bestVersion = version
+		}
+	}
+	if best != nil {
+		return modSelection{
+			version:      bestVersion,
+			installed:    true,
+			dependencies: parseModDependencies(name, best.Dependencies),
+		}, nil
+	}
+
+	releases, ok := resolver.releases[name]
+	if !ok {
+		var err error
+		releases, err = resolver.lookup(name)
+		if err != nil {
+			return modSelection{}, fmt.Errorf("error looking up releases: %v", err)
+		}
+		resolver.releases[name] = releases
+	}
+
+	var release *ModPortalRelease
+	for i, candidate := range releases {
+		if !factorioVersionCompatible(resolver.factorioVersion, candidate.InfoJSON.FactorioVersion) || !resolver.satisfies(name, candidate.Version) {
+			continue
+		}
+		if release == nil || candidate.Version.Greater(release.Version) {
+			release = &releases[i]
+		}
+	}
+	if release == nil {
+		return modSelection{}, fmt.Errorf("no release compatible with factorio %s matches %s", resolver.factorioVersion, resolver.describe(name))
+	}
+
+	return modSelection{
+		version:      release.Version,
+		release:      *release,
+		dependencies: parseModDependencies(name, release.InfoJSON.Dependencies),
+	}, nil
+}
+
+// present returns true, if the mod will be enabled after the plan is executed
+func (resolver *modResolver) present(name string) bool {
+	if _, ok := resolver.selected[name]; ok {
+		return true
+	}
+	_, installed := findInstalledMod(resolver.mods, name, NilVersion)
+	return installed && isModEnabled(resolver.mods, name)
+}
+
+func (resolver *modResolver) plan() ModInstallPlan {
+	plan := ModInstallPlan{
+		Install:   []PlannedMod{},
+		Enable:    []PlannedMod{},
+		Conflicts: []ModConflict{},
+	}
+
+	// incompatibilities of the selected mods and of the enabled mods with the selected ones
+	for name, selection := range resolver.selected {
+		for _, dep := range selection.dependencies {
+			if dep.Kind == modDependencyIncompatible && resolver.present(dep.Name) {
+				resolver.conflicts[name] = fmt.Sprintf("incompatible with %s", dep.Name)
+			}
+		}
+	}
+	for _, modInfo := range resolver.mods.ModInfoList.Mods {
+		if _, ok := resolver.selected[modInfo.Name]; ok || !isModEnabled(resolver.mods, modInfo.Name) {
+			continue
+		}
+		for _, dep := range parseModDependencies(modInfo.Name, modInfo.Dependencies) {
+			if _, ok := resolver.selected[dep.Name]; ok && dep.Kind == modDependencyIncompatible {
+				resolver.conflicts[dep.Name] = fmt.Sprintf("the enabled mod %s is incompatible with it", modInfo.Name)
+			}
+		}
+	}
+
+	for name, reason := range resolver.conflicts {
+		plan.Conflicts = append(plan.Conflicts, ModConflict{Name: name, Reason: reason})
+	}
+	sort.Slice(plan.Conflicts, func(i, j int) bool { return plan.Conflicts[i].Name < plan.Conflicts[j].Name })
+
+	names := make([]string, 0, len(resolver.selected))
+	for name := range resolver.selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		selection := resolver.selected[name]
+
+		planned := PlannedMod{Name: name, Version: selection.version, RequiredBy: []string{}}
+		for _, constraint := range resolver.constraints[name] {
+			if constraint.from != "" {
+				planned.RequiredBy = append(planned.RequiredBy, constraint.from)
+			}
+		}
+
+		switch {
+		case !selection.installed:
+			planned.FileName = selection.release.FileName
+			planned.DownloadURL = selection.release.DownloadURL
+			planned.Sha1 = selection.release.Sha1
+			plan.Install = append(plan.Install, planned)
+		case !isModEnabled(resolver.mods, name):
+			plan.Enable = append(plan.Enable, planned)
+		}
+	}
+
+	return plan
+}
+
+// installModPlan downloads and enables the planned mods, it is run as job
+func installModPlan(jc *JobContext, plan ModInstallPlan, mods *Mods) error {
+	if len(plan.Conflicts) > 0 {
+		var reasons []string
+		for _, conflict := range plan.Conflicts {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", conflict.Name, conflict.Reason))
+		}
+		return fmt.Errorf("mods can't be installed: %s", strings.Join(reasons, "; "))
+	}
+
+	enabled := make(map[string]bool)
+	for index, planned := range plan.Install {
+		if jc.Err() != nil {
+			return jc.Err()
+		}
+
+		jc.Logf("downloading %s %s", planned.Name, planned.Version)
+		err := mods.downloadMod(jc, planned.DownloadURL, planned.FileName, planned.Name, planned.Sha1)
+		if err != nil {
+			return fmt.Errorf("error installing %s: %v", planned.Name, err)
+		}
+		enabled[planned.Name] = true
+
+		jc.SetProgress(float64(index+1) * 100 / float64(len(plan.Install)+1))
+	}
+
+	for _, planned := range plan.Enable {
+		enabled[planned.Name] = true
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	jc.Logf("enabling %d mods", len(enabled))
+	return mods.ModSimpleList.setModsEnabled(enabled)
+}
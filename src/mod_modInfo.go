@@ -14,8 +14,16 @@ import (
 )
 
 type ModInfoList struct {
-	Mods        []ModInfo `json:"mods"`
-	Destination string    `json:"-"`
+	Mods []ModInfo `json:"mods"`
+	// Corrupt are the zip-files in the mods directory, which couldn't be read
+	Corrupt     []CorruptMod `json:"corrupt"`
+	Destination string       `json:"-"`
+}
+
+// CorruptMod is a file in the mods directory, which is not a valid mod
+type CorruptMod struct {
+	FileName string `json:"file_name"`
+	Error    string `json:"error"`
 }
 type ModInfo struct {
 	Name            string   `json:"name"`
@@ -46,6 +54,7 @@ func newModInfoList(destination string) (ModInfoList, error) {
 func (modInfoList *ModInfoList) listInstalledMods() error {
 	var err error
 	modInfoList.Mods = nil
+	modInfoList.Corrupt = nil
 
 	err = filepath.Walk(modInfoList.Destination, func(path string, info os.FileInfo, err error) error {
 		if !info.IsDir() && filepath.Ext(path) == ".zip" {
@@ -60,58 +69,32 @@ func (modInfoList *ModInfoList) listInstalledMods() error {
 			}
 			defer fileLock.RUnlock(path)
 
+			// a broken mod must not hide the other mods, it is reported instead
 			zipFile, err := zip.OpenReader(path)
 			if err != nil {
-				log.Fatalln(err)
-				return err
+				log.Printf("error opening mod %s: %s", info.Name(), err)
+				modInfoList.Corrupt = append(modInfoList.Corrupt, CorruptMod{FileName: info.Name(), Error: err.Error()})
+				return nil
 			}
 			defer zipFile.Close()
 
 			var modInfo ModInfo
 			err = modInfo.getModInfo(&zipFile.Reader)
 			if err != nil {
-				log.Fatalf("Error in getModInfo: %s", err)
+				log.Printf("error reading info.json of mod %s: %s", info.Name(), err)
+				modInfoList.Corrupt = append(modInfoList.Corrupt, CorruptMod{FileName: info.Name(), Error: err.Error()})
+				return nil
 			}
 
 			modInfo.FileName = info.Name()
 
-			var base Version
-			var op string
-			for _, dep := range modInfo.Dependencies {
-				dep = strings.TrimSpace(dep)
-				if dep == "" {
-					continue
-				}
-
-				parts := strings.Split(dep, " ")
-				if len(parts) > 3 {
-					log.Printf("skipping dependency '%s' in '%s': invalid format\n", dep, modInfo.Name)
-					continue
-				}
-				if parts[0] != "base" {
-					continue
-				}
-				if len(parts) == 1 {
-					base = modInfo.FactorioVersion
-					op = ">="
-					continue
-				}
-
-				op = parts[1]
-
-				if err := base.UnmarshalText([]byte(parts[2])); err != nil {
-					log.Printf("skipping dependency '%s' in '%s': %v\n", dep, modInfo.Name, err)
-					continue
+			// mods without a version constraint on base are compatible with newer factorio versions
+			modInfo.Compatibility = !FactorioServ.Version.Less(modInfo.FactorioVersion)
+			for _, dep := range parseModDependencies(modInfo.Name, modInfo.Dependencies) {
+				if dep.Name == "base" && dep.Op != "" {
+					modInfo.Compatibility = dep.matches(FactorioServ.Version)
+					break
 				}
-
-				break
-			}
-
-			if !base.Equals(NilVersion) {
-				modInfo.Compatibility = FactorioServ.Version.Compare(base, op)
-			} else {
-				log.Println("error finding basemodDependency. Using FactorioVersion...")
-				modInfo.Compatibility = !FactorioServ.Version.Less(modInfo.FactorioVersion)
 			}
 
 			modInfoList.Mods = append(modInfoList.Mods, modInfo)
@@ -167,13 +150,14 @@ func (modInfo *ModInfo) getModInfo(reader *zip.Reader) error {
 			rc, err := singleFile.Open()
 
 			if err != nil {
-				log.Fatal(err)
+				log.Printf("error opening info.json: %s", err)
 				return err
 			}
 
 			byteArray, err := ioutil.ReadAll(rc)
 			if err != nil {
-				log.Fatal(err)
+				rc.Close()
+				log.Printf("error reading info.json: %s", err)
 				return err
 			}
 			err = rc.Close()
@@ -184,7 +168,7 @@ func (modInfo *ModInfo) getModInfo(reader *zip.Reader) error {
 
 			err = json.Unmarshal(byteArray, modInfo)
 			if err != nil {
-				log.Fatalln(err)
+				log.Printf("error decoding info.json: %s", err)
 				return err
 			}
 
@@ -198,30 +182,60 @@ func (modInfo *ModInfo) getModInfo(reader *zip.Reader) error {
 func (modInfoList *ModInfoList) createMod(modName string, fileName string, modFile io.Reader) error {
 	var err error
 
-	//save uploaded file
+	//save uploaded file next to the mod first, so no partly written mod is ever listed
 	filePath := filepath.Join(modInfoList.Destination, fileName)
-	newFile, err := os.Create(filePath)
+	fileLock.LockW(filePath)
+	err = writeFileAtomic(filePath, modFile)
+	fileLock.Unlock(filePath)
 	if err != nil {
-		log.Printf("error on creating new file - %s: %s", fileName, err)
+		log.Printf("error on writing zip-file: %s", err)
 		return err
 	}
-	defer newFile.Close()
-
-	fileLock.LockW(filePath)
 
-	_, err = io.Copy(newFile, modFile)
+	//reload the list
+	err = modInfoList.listInstalledMods()
 	if err != nil {
-		log.Printf("error on copying file to disk: %s", err)
+		log.Printf("error on listing mod-infos: %s", err)
 		return err
 	}
 
-	err = newFile.Close()
-	if err != nil {
-		log.Printf("error on closing new created zip-file: %s", err)
-		return err
+	return nil
+}
+
+// deleteOtherModFiles removes the files of the mod except the one named keep, e.g. the old versions after an update
+func (modInfoList *ModInfoList) deleteOtherModFiles(modName string, keep string) error {
+	var err error
+
+	for _, mod := range modInfoList.Mods {
+		if mod.Name != modName || mod.FileName == keep {
+			continue
+		}
+
+		filePath := filepath.Join(modInfoList.Destination, mod.FileName)
+		fileLock.LockW(filePath)
+		err = os.Remove(filePath)
+		fileLock.Unlock(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("ModInfoList ... error when deleting mod: %s", err)
+			return err
+		}
 	}
 
+	return modInfoList.listInstalledMods()
+}
+
+// linkMod installs the mod by linking it to the file in the mod cache
+func (modInfoList *ModInfoList) linkMod(fileName string, source string) error {
+	var err error
+
+	filePath := filepath.Join(modInfoList.Destination, fileName)
+	fileLock.LockW(filePath)
+	err = linkFile(source, filePath)
 	fileLock.Unlock(filePath)
+	if err != nil {
+		log.Printf("error on linking zip-file: %s", err)
+		return err
+	}
 
 	//reload the list
 	err = modInfoList.listInstalledMods()
@@ -232,3 +246,18 @@ func (modInfoList *ModInfoList) createMod(modName string, fileName string, modFi
 
 	return nil
 }
+
+// modFileVersion returns the version in the file name of a mod, which is named "<name>_<version>.zip"
+func modFileVersion(fileName string) (Version, bool) {
+	base := strings.TrimSuffix(filepath.Base(fileName), ".zip")
+	index := strings.LastIndex(base, "_")
+	if index < 0 {
+		return Version{}, false
+	}
+
+	var version Version
+	if err := version.UnmarshalText([]byte(base[index+1:])); err != nil {
+		return Version{}, false
+	}
+	return version, true
+}
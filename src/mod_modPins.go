@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// modPinsFile is stored next to the mod-list.json
+const modPinsFile = "mod-pins.json"
+
+// modPinConditionPattern matches a single condition of a pin, a version without operator is an exact version
+var modPinConditionPattern = regexp.MustCompile(`^(<=|>=|<|>|=)?\s*(\d+(?:\.\d+){1,2})$`)
+
+// ModPin keeps a mod on an exact version like "1.2.3" or in a range like ">= 1.1.0, < 1.2.0"
+type ModPin struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type ModPinList struct {
+	Pins        []ModPin `json:"pins"`
+	Destination string   `json:"-"`
+}
+
+// ModPinConflict is a mod, whose version is not allowed by its pin
+type ModPinConflict struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Pin     string `json:"pin"`
+}
+
+// PinConflictError is returned, when an operation would install versions not allowed by the pins
+type PinConflictError struct {
+	Conflicts []ModPinConflict
+}
+
+func (e *PinConflictError) Error() string {
+	var conflicts []string
+	for _, conflict := range e.Conflicts {
+		conflicts = append(conflicts, fmt.Sprintf("%s %s (pinned to %s)", conflict.Name, conflict.Version, conflict.Pin))
+	}
+	return "mods not allowed by their pins: " + strings.Join(conflicts, ", ")
+}
+
+// conditions parses the pinned version or range
+func (pin ModPin) conditions() ([]ModDependency, error) {
+	var conditions []ModDependency
+	for _, part := range strings.Split(pin.Version, ",") {
+		match := modPinConditionPattern.FindStringSubmatch(strings.TrimSpace(part))
+		if match == nil {
+			return nil, fmt.Errorf("invalid pin of %s: %q", pin.Name, pin.Version)
+		}
+
+		condition := ModDependency{Kind: modDependencyRequired, Name: pin.Name, Op: match[1]}
+		if condition.Op == "" {
+			condition.Op = "="
+		}
+		if err := condition.Version.UnmarshalText([]byte(match[2])); err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// allows returns true, if the version is within the pinned version or range
+func (pin ModPin) allows(version Version) bool {
+	conditions, err := pin.conditions()
+	if err != nil {
+		return false
+	}
+	for _, condition := range conditions {
+		if !condition.matches(version) {
+			return false
+		}
+	}
+	return true
+}
+
+func newModPinList(destination string) (ModPinList, error) {
+	var err error
+	modPinList := ModPinList{
+		Destination: destination,
+	}
+
+	err = modPinList.listPins()
+	if err != nil {
+		log.Printf("ModPinList ... error listing pins: %s", err)
+		return modPinList, err
+	}
+
+	return modPinList, nil
+}
+
+func (modPinList *ModPinList) listPins() error {
+	modPinList.Pins = nil
+
+	data, err := ioutil.ReadFile(filepath.Join(modPinList.Destination, modPinsFile))
+	if os.IsNotExist(err) {
+		// no mod is pinned
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, modPinList)
+}
+
+func (modPinList *ModPinList) savePins() error {
+	data, err := json.MarshalIndent(modPinList, "", "    ")
+	if err != nil {
+		log.Printf("error encoding mod pins: %s", err)
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(modPinList.Destination, modPinsFile), data, 0664)
+	if err != nil {
+		log.Printf("error writing mod pins: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// find returns the pin of the mod
+func (modPinList *ModPinList) find(modName string) (ModPin, bool) {
+	for _, pin := range modPinList.Pins {
+		if pin.Name == modName {
+			return pin, true
+		}
+	}
+	return ModPin{}, false
+}
+
+// allows returns true, if the mod isn't pinned or the version is allowed by its pin
+func (modPinList *ModPinList) allows(modName string, version Version) bool {
+	pin, ok := modPinList.find(modName)
+	return !ok || pin.allows(version)
+}
+
+// setPin adds the pin or replaces the existing pin of the mod
+func (modPinList *ModPinList) setPin(pin ModPin) error {
+	if pin.Name == "" {
+		return fmt.Errorf("mod name missing")
+	}
+	if _, err := pin.conditions(); err != nil {
+		return err
+	}
+
+	replaced := false
+	for index := range modPinList.Pins {
+		if modPinList.Pins[index].Name == pin.Name {
+			modPinList.Pins[index] = pin
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		modPinList.Pins = append(modPinList.Pins, pin)
+	}
+
+	return modPinList.savePins()
+}
+
+func (modPinList *ModPinList) removePin(modName string) error {
+	var pins []ModPin
+	for _, pin := range modPinList.Pins {
+		if pin.Name != modName {
+			pins = append(pins, pin)
+		}
+	}
+	modPinList.Pins = pins
+
+	return modPinList.savePins()
+}
+
+// checkMods returns the mods, whose version is not allowed by their pin
+func (modPinList *ModPinList) checkMods(modInfos []ModInfo) []ModPinConflict {
+	var conflicts []ModPinConflict
+	for _, modInfo := range modInfos {
+		pin, ok := modPinList.find(modInfo.Name)
+		if !ok {
+			continue
+		}
+
+		var version Version
+		if err := version.UnmarshalText([]byte(modInfo.Version)); err != nil || !pin.allows(version) {
+			conflicts = append(conflicts, ModPinConflict{Name: modInfo.Name, Version: modInfo.Version, Pin: pin.Version})
+		}
+	}
+	return conflicts
+}
@@ -160,3 +160,31 @@ func (modSimpleList *ModSimpleList) toggleMod(modName string) (error, bool) {
 
 	return nil, newEnabled
 }
+
+// setModsEnabled sets the enabled state of all given mods and saves the mod-list.json once.
+// Mods not in the list yet are added.
+func (modSimpleList *ModSimpleList) setModsEnabled(enabled map[string]bool) error {
+	var err error
+
+	for modName, modEnabled := range enabled {
+		found := false
+		for index, mod := range modSimpleList.Mods {
+			if mod.Name == modName {
+				modSimpleList.Mods[index].Enabled = modEnabled
+				found = true
+				break
+			}
+		}
+		if !found {
+			modSimpleList.Mods = append(modSimpleList.Mods, ModSimple{Name: modName, Enabled: modEnabled})
+		}
+	}
+
+	err = modSimpleList.saveModInfoJson()
+	if err != nil {
+		log.Printf("error on saving new ModSimpleList: %s", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A modpack reference names the mods compared by the diff: "installed" are the mods in the mods directory,
+// "save:<name>" the mods used by a save and "pack:<name>" or just "<name>" a modpack.
+const (
+	modPackRefInstalled = "installed"
+	modPackRefSave      = "save:"
+	modPackRefPack      = "pack:"
+)
+
+// ModPackDiff lists the changes from the base to the target
+type ModPackDiff struct {
+	Base           string               `json:"base"`
+	Target         string               `json:"target"`
+	Added          []ModPackManifestMod `json:"added"`
+	Removed        []ModPackManifestMod `json:"removed"`
+	VersionChanged []ModPackModChange   `json:"version_changed"`
+	EnabledChanged []ModPackModChange   `json:"enabled_changed"`
+}
+
+// ModPackModChange is a mod, which is part of both sides of the diff
+type ModPackModChange struct {
+	Name          string `json:"name"`
+	BaseVersion   string `json:"base_version,omitempty"`
+	TargetVersion string `json:"target_version,omitempty"`
+	BaseEnabled   bool   `json:"base_enabled"`
+	TargetEnabled bool   `json:"target_enabled"`
+}
+
+// ModPackMergeRequest creates the modpack Name from Base, the changes of the selected mods are taken from Target
+type ModPackMergeRequest struct {
+	Name   string   `json:"name"`
+	Base   string   `json:"base"`
+	Target string   `json:"target"`
+	Mods   []string `json:"mods"`
+}
+
+// loadModPackRef returns the manifest of the referenced mods and the directory of the mod files,
+// which is empty for saves
+func loadModPackRef(ref string) (ModPackManifest, string, error) {
+	switch {
+	case ref == modPackRefInstalled:
+		mods, err := newMods(config.FactorioModsDir)
+		if err != nil {
+			return ModPackManifest{}, "", err
+		}
+		manifest, err := createModPackManifest(ref, &mods)
+		return manifest, config.FactorioModsDir, err
+	case strings.HasPrefix(ref, modPackRefSave):
+		saveName := strings.TrimPrefix(ref, modPackRefSave)
+		header, err := readSaveHeader(filepath.Join(config.FactorioSavesDir, filepath.Base(saveName)))
+		if err != nil {
+			return ModPackManifest{}, "", err
+		}
+
+		// the save only lists the mods, which were enabled
+		manifest := ModPackManifest{Name: ref, Mods: []ModPackManifestMod{}}
+		for _, mod := range header.Mods {
+			manifest.Mods = append(manifest.Mods, ModPackManifestMod{
+				Name:    mod.Name,
+				Version: fmt.Sprintf("%d.%d.%d", mod.Version[0], mod.Version[1], mod.Version[2]),
+				Enabled: true,
+			})
+		}
+		return manifest, "", nil
+	}
+
+	modPackName := strings.TrimPrefix(ref, modPackRefPack)
+	err := checkModPackName(modPackName)
+	if err != nil {
+		return ModPackManifest{}, "", err
+	}
+	modPackDir := filepath.Join(config.FactorioModPackDir, modPackName)
+	if info, err := os.Stat(modPackDir); err != nil || !info.IsDir() {
+		return ModPackManifest{}, "", fmt.Errorf("modpack %s does not exist", modPackName)
+	}
+
+	mods, err := newMods(modPackDir)
+	if err != nil {
+		return ModPackManifest{}, "", err
+	}
+	manifest, err := createModPackManifest(ref, &mods)
+	return manifest, modPackDir, err
+}
+
+// diffModPacks compares the mods of the manifests, versions are only compared if both sides know them
+func diffModPacks(base ModPackManifest, target ModPackManifest) ModPackDiff {
+	diff := ModPackDiff{
+		Base:           base.Name,
+		Target:         target.Name,
+		Added:          []ModPackManifestMod{},
+		Removed:        []ModPackManifestMod{},
+		VersionChanged: []ModPackModChange{},
+		EnabledChanged: []ModPackModChange{},
+	}
+
+	baseMods := make(map[string]ModPackManifestMod)
+	for _, mod := range base.Mods {
+		baseMods[mod.Name] = mod
+	}
+	targetMods := make(map[string]bool)
+
+	for _, mod := range target.Mods {
+		targetMods[mod.Name] = true
+		baseMod, ok := baseMods[mod.Name]
+		if !ok {
+			diff.Added = append(diff.Added, mod)
+			continue
+		}
+
+		change := ModPackModChange{
+			Name:          mod.Name,
+			BaseVersion:   baseMod.Version,
+			TargetVersion: mod.Version,
+			BaseEnabled:   baseMod.Enabled,
+			TargetEnabled: mod.Enabled,
+		}
+		if baseMod.Version != "" && mod.Version != "" && baseMod.Version != mod.Version {
+			diff.VersionChanged = append(diff.VersionChanged, change)
+		}
+		if baseMod.Enabled != mod.Enabled {
+			diff.EnabledChanged = append(diff.EnabledChanged, change)
+		}
+	}
+
+	for _, mod := range base.Mods {
+		if !targetMods[mod.Name] {
+			diff.Removed = append(diff.Removed, mod)
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Name < diff.Added[j].Name })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Name < diff.Removed[j].Name })
+	sort.Slice(diff.VersionChanged, func(i, j int) bool { return diff.VersionChanged[i].Name < diff.VersionChanged[j].Name })
+	sort.Slice(diff.EnabledChanged, func(i, j int) bool { return diff.EnabledChanged[i].Name < diff.EnabledChanged[j].Name })
+
+	return diff
+}
+
+// mergeModPacks applies the changes of the selected mods from the target to the base.
+// Selected mods missing in the target are removed, all others get the version and state of the target.
+func mergeModPacks(name string, base ModPackManifest, target ModPackManifest, selected []string) (ModPackManifest, error) {
+	merged := ModPackManifest{
+		Name:            name,
+		FactorioVersion: base.FactorioVersion,
+		Mods:            []ModPackManifestMod{},
+		ModSettings:     base.ModSettings,
+	}
+
+	mods := make(map[string]ModPackManifestMod)
+	for _, mod := range base.Mods {
+		mods[mod.Name] = mod
+	}
+	targetMods := make(map[string]ModPackManifestMod)
+	for _, mod := range target.Mods {
+		targetMods[mod.Name] = mod
+	}
+
+	for _, modName := range selected {
+		mod, inTarget := targetMods[modName]
+		_, inBase := mods[modName]
+		switch {
+		case inTarget:
+			mods[modName] = mod
+		case inBase:
+			delete(mods, modName)
+		default:
+			return merged, fmt.Errorf("mod %s is neither in %s nor in %s", modName, base.Name, target.Name)
+		}
+	}
+
+	for _, mod := range mods {
+		merged.Mods = append(merged.Mods, mod)
+	}
+	sort.Slice(merged.Mods, func(i, j int) bool { return merged.Mods[i].Name < merged.Mods[j].Name })
+
+	return merged, nil
+}
+
+// cacheModPackMods adds the mod files of the directory to the mod cache, so a merged modpack can link them
+func cacheModPackMods(manifest ModPackManifest, dir string, modCache *ModCache) error {
+	if dir == "" {
+		return nil
+	}
+
+	for _, mod := range manifest.Mods {
+		if mod.FileName == "" {
+			continue
+		}
+		_, err := modCache.add(filepath.Join(dir, mod.FileName))
+		if err != nil {
+			log.Printf("error on adding %s to the mod cache: %s", mod.FileName, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeModPackRefs creates the modpack from the referenced base and the selected changes of the target
+func mergeModPackRefs(jc *JobContext, request ModPackMergeRequest) error {
+	modCache, err := newModCache(config.FactorioModCacheDir)
+	if err != nil {
+		return err
+	}
+
+	base, baseDir, err := loadModPackRef(request.Base)
+	if err != nil {
+		return err
+	}
+	target, targetDir, err := loadModPackRef(request.Target)
+	if err != nil {
+		return err
+	}
+
+	merged, err := mergeModPacks(request.Name, base, target, request.Mods)
+	if err != nil {
+		return err
+	}
+
+	err = cacheModPackMods(base, baseDir, &modCache)
+	if err == nil {
+		err = cacheModPackMods(target, targetDir, &modCache)
+	}
+	if err != nil {
+		return err
+	}
+
+	jc.Logf("creating modpack %s from %s with %d changes of %s", request.Name, request.Base, len(request.Mods), request.Target)
+	return importModPack(jc, request.Name, merged, &modCache, modPortalReleases)
+}
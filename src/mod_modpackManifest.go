@@ -0,0 +1,450 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// modPackManifestFile is the manifest in the zip of an exported modpack bundle
+const modPackManifestFile = "manifest.json"
+
+// ModPackManifest describes a modpack without its mod files, the mods are resolved from the mod cache or the mod source on import
+type ModPackManifest struct {
+	Name            string               `json:"name"`
+	FactorioVersion string               `json:"factorio_version,omitempty"`
+	Mods            []ModPackManifestMod `json:"mods"`
+	// ModSettings is the content of the mod-settings.dat, it is base64 encoded in json
+	ModSettings []byte `json:"mod_settings,omitempty"`
+}
+
+// ModPackManifestMod is a mod of the manifest, mods without version are installed in the newest compatible version
+type ModPackManifestMod struct {
+	Name     string `json:"name"`
+	Version  string `json:"version,omitempty"`
+	Enabled  bool   `json:"enabled"`
+	Sha1     string `json:"sha1,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+}
+
+// createModPackManifest lists the mods of the mods directory or modpack
+func createModPackManifest(name string, mods *Mods) (ModPackManifest, error) {
+	manifest := ModPackManifest{
+		Name: name,
+		Mods: []ModPackManifestMod{},
+	}
+	if !FactorioServ.Version.Equals(NilVersion) {
+		manifest.FactorioVersion = fmt.Sprintf("%d.%d.%d", FactorioServ.Version[0], FactorioServ.Version[1], FactorioServ.Version[2])
+	}
+
+	for _, modInfo := range mods.ModInfoList.Mods {
+		sha1Sum, err := fileSha1(filepath.Join(mods.ModInfoList.Destination, modInfo.FileName))
+		if err != nil {
+			return manifest, err
+		}
+
+		manifest.Mods = append(manifest.Mods, ModPackManifestMod{
+			Name:     modInfo.Name,
+			Version:  modInfo.Version,
+			Enabled:  isModEnabled(mods, modInfo.Name),
+			Sha1:     sha1Sum,
+			FileName: modInfo.FileName,
+		})
+	}
+	for _, mod := range mods.ModSimpleList.Mods {
+		if builtinMods[mod.Name] {
+			manifest.Mods = append(manifest.Mods, ModPackManifestMod{Name: mod.Name, Enabled: mod.Enabled})
+		}
+	}
+	sort.Slice(manifest.Mods, func(i, j int) bool {
+		return manifest.Mods[i].Name < manifest.Mods[j].Name
+	})
+
+	modSettings, err := ioutil.ReadFile(filepath.Join(mods.ModInfoList.Destination, modSettingsFile))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error on reading the mod settings: %s", err)
+		return manifest, err
+	}
+	manifest.ModSettings = modSettings
+
+	return manifest, nil
+}
+
+// parseModPackManifest reads a manifest. Lists of other tools are accepted as well:
+// a plain array of mods, mods given by name only and the mod-list.json of factorio.
+func parseModPackManifest(data []byte) (ModPackManifest, error) {
+	var manifest ModPackManifest
+	var modsData json.RawMessage
+
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		modsData = data
+	} else {
+		var raw struct {
+			Name            string          `json:"name"`
+			FactorioVersion string          `json:"factorio_version"`
+			Mods            json.RawMessage `json:"mods"`
+			ModSettings     []byte          `json:"mod_settings"`
+		}
+		err := json.Unmarshal(data, &raw)
+		if err != nil {
+			return manifest, fmt.Errorf("invalid manifest: %v", err)
+		}
+		manifest.Name, manifest.FactorioVersion, manifest.ModSettings = raw.Name, raw.FactorioVersion, raw.ModSettings
+		modsData = raw.Mods
+	}
+
+	var items []json.RawMessage
+	if len(modsData) > 0 {
+		err := json.Unmarshal(modsData, &items)
+		if err != nil {
+			return manifest, fmt.Errorf("invalid mod list in manifest: %v", err)
+		}
+	}
+
+	listed := make(map[string]bool)
+	for _, item := range items {
+		mod := ModPackManifestMod{Enabled: true}
+
+		var name string
+		if err := json.Unmarshal(item, &name); err == nil {
+			mod.Name = name
+		} else {
+			var entry struct {
+				Name     string `json:"name"`
+				Version  string `json:"version"`
+				Enabled  *bool  `json:"enabled"`
+				Sha1     string `json:"sha1"`
+				FileName string `json:"file_name"`
+			}
+			err := json.Unmarshal(item, &entry)
+			if err != nil {
+				return manifest, fmt.Errorf("invalid mod in manifest: %v", err)
+			}
+			mod.Name, mod.Version, mod.Sha1, mod.FileName = entry.Name, entry.Version, strings.ToLower(entry.Sha1), entry.FileName
+			if entry.Enabled != nil {
+				mod.Enabled = *entry.Enabled
+			}
+		}
+
+		if mod.Name == "" {
+			return manifest, errors.New("mod without name in manifest")
+		}
+		if listed[mod.Name] {
+			return manifest, fmt.Errorf("mod %s is listed twice in the manifest", mod.Name)
+		}
+		listed[mod.Name] = true
+
+		if mod.Version == "latest" {
+			mod.Version = ""
+		}
+		if mod.Version != "" {
+			var version Version
+			if err := version.UnmarshalText([]byte(mod.Version)); err != nil {
+				return manifest, fmt.Errorf("invalid version %q of mod %s in manifest", mod.Version, mod.Name)
+			}
+		}
+		if mod.FileName != "" && (mod.FileName != path.Base(mod.FileName) || filepath.Ext(mod.FileName) != ".zip") {
+			return manifest, fmt.Errorf("invalid file name %q of mod %s in manifest", mod.FileName, mod.Name)
+		}
+
+		manifest.Mods = append(manifest.Mods, mod)
+	}
+
+	return manifest, nil
+}
+
+// writeModPackBundle writes the manifest and all files of the modpack into a zip.
+// The files are stored flat like in the download of a modpack, so older versions can still read the bundle.
+func writeModPackBundle(w io.Writer, modPackDir string, manifest ModPackManifest) error {
+	zipWriter := zip.NewWriter(w)
+
+	writer, err := zipWriter.Create(modPackManifestFile)
+	if err != nil {
+		log.Printf("error on creating manifest inside zip: %s", err)
+		return err
+	}
+	err = json.NewEncoder(writer).Encode(manifest)
+	if err != nil {
+		log.Printf("error on encoding the manifest: %s", err)
+		return err
+	}
+
+	files, err := ioutil.ReadDir(modPackDir)
+	if err != nil {
+		log.Printf("error on reading the modpack: %s", err)
+		return err
+	}
+	for _, info := range files {
+		if info.IsDir() || info.Name() == modPackManifestFile {
+			continue
+		}
+
+		writer, err := zipWriter.Create(info.Name())
+		if err != nil {
+			log.Printf("error on creating new file inside zip: %s", err)
+			return err
+		}
+
+		file, err := os.Open(filepath.Join(modPackDir, info.Name()))
+		if err != nil {
+			log.Printf("error on opening modfile: %s", err)
+			return err
+		}
+		_, err = io.Copy(writer, file)
+		file.Close()
+		if err != nil {
+			log.Printf("error on copying file into zip: %s", err)
+			return err
+		}
+	}
+
+	return zipWriter.Close()
+}
+
+// readModPackBundle stores the mods of the bundle in the mod cache and returns its manifest.
+// Bundles without manifest, like the downloads of modpacks, get one built from the mod files and the mod-list.json.
+func readModPackBundle(bundle *zip.Reader, modCache *ModCache) (ModPackManifest, error) {
+	var manifest ModPackManifest
+	var manifestData, modListData []byte
+	var modSettings []byte
+	var cached []string
+
+	for _, file := range bundle.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		fileName := path.Base(file.Name)
+		var err error
+		switch {
+		case fileName == modPackManifestFile:
+			manifestData, err = readZipFile(file)
+		case fileName == "mod-list.json":
+			modListData, err = readZipFile(file)
+		case fileName == modSettingsFile:
+			modSettings, err = readZipFile(file)
+		case path.Ext(fileName) == ".zip":
+			var cacheEntry string
+			cacheEntry, err = cacheZipFile(file, modCache)
+			cached = append(cached, cacheEntry)
+		}
+		if err != nil {
+			log.Printf("error on reading %s from the bundle: %s", file.Name, err)
+			return manifest, err
+		}
+	}
+
+	if manifestData != nil {
+		return parseModPackManifest(manifestData)
+	}
+
+	enabled := make(map[string]bool)
+	if modListData != nil {
+		modList, err := parseModPackManifest(modListData)
+		if err != nil {
+			return manifest, err
+		}
+		for _, mod := range modList.Mods {
+			enabled[mod.Name] = mod.Enabled
+			if builtinMods[mod.Name] {
+				manifest.Mods = append(manifest.Mods, mod)
+			}
+		}
+	}
+
+	for _, cacheEntry := range cached {
+		var modInfo ModInfo
+		zipFile, err := zip.OpenReader(cacheEntry)
+		if err == nil {
+			err = modInfo.getModInfo(&zipFile.Reader)
+			zipFile.Close()
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("invalid mod %s in bundle: %v", filepath.Base(cacheEntry), err)
+		}
+
+		mod := ModPackManifestMod{
+			Name:     modInfo.Name,
+			Version:  modInfo.Version,
+			Enabled:  true,
+			Sha1:     filepath.Base(filepath.Dir(cacheEntry)),
+			FileName: filepath.Base(cacheEntry),
+		}
+		if modEnabled, ok := enabled[mod.Name]; ok {
+			mod.Enabled = modEnabled
+		}
+		manifest.Mods = append(manifest.Mods, mod)
+	}
+	manifest.ModSettings = modSettings
+
+	return manifest, nil
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// cacheZipFile stores the mod file of the bundle in the mod cache and returns the path of the entry
+func cacheZipFile(file *zip.File, modCache *ModCache) (string, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	tmpFile, err := ioutil.TempFile("", "fsm-mod-*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hash := sha1.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), rc)
+	if err != nil {
+		return "", err
+	}
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return modCache.store(tmpFile, hex.EncodeToString(hash.Sum(nil)), path.Base(file.Name))
+}
+
+// importModPack creates the modpack from the manifest. The mods are taken from the mod cache, which holds the mods
+// of an imported bundle as well, and are downloaded from the mod source otherwise.
+func importModPack(jc *JobContext, name string, manifest ModPackManifest, modCache *ModCache, lookup modReleaseLookup) (err error) {
+	err = checkModPackName(name)
+	if err != nil {
+		return err
+	}
+
+	modPackDir := filepath.Join(config.FactorioModPackDir, name)
+	if _, err := os.Stat(modPackDir); err == nil {
+		return fmt.Errorf("modpack %s already exists, please choose a different name", name)
+	}
+	err = os.MkdirAll(modPackDir, 0755)
+	if err != nil {
+		log.Printf("error on creating the modpack directory: %s", err)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(modPackDir)
+		}
+	}()
+
+	mods, err := newMods(modPackDir)
+	if err != nil {
+		return err
+	}
+
+	enabled := make(map[string]bool)
+	for index, mod := range manifest.Mods {
+		if jc.Err() != nil {
+			return jc.Err()
+		}
+		enabled[mod.Name] = mod.Enabled
+		if builtinMods[mod.Name] {
+			continue
+		}
+
+		err = importModPackMod(jc, &mods, mod, modCache, lookup)
+		if err != nil {
+			return fmt.Errorf("error importing %s: %v", mod.Name, err)
+		}
+
+		jc.SetProgress(float64(index+1) * 100 / float64(len(manifest.Mods)+1))
+	}
+
+	err = mods.ModSimpleList.setModsEnabled(enabled)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.ModSettings) > 0 {
+		var modSettings ModSettings
+		_, err = modSettings.ReadFrom(bytes.NewReader(manifest.ModSettings))
+		if err != nil {
+			return fmt.Errorf("invalid mod settings in manifest: %v", err)
+		}
+		err = writeFileAtomic(filepath.Join(modPackDir, modSettingsFile), bytes.NewReader(manifest.ModSettings))
+		if err != nil {
+			log.Printf("error on writing the mod settings: %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importModPackMod installs a single mod of the manifest into the modpack
+func importModPackMod(jc *JobContext, mods *Mods, mod ModPackManifestMod, modCache *ModCache, lookup modReleaseLookup) error {
+	if cacheEntry, ok := modCache.find(mod.Sha1); ok {
+		fileName := mod.FileName
+		if fileName == "" {
+			fileName = filepath.Base(cacheEntry)
+		}
+		jc.Logf("installing %s %s from the mod cache", mod.Name, mod.Version)
+		return mods.linkMod(mod.Name, fileName, cacheEntry)
+	}
+
+	releases, err := lookup(mod.Name)
+	if err != nil {
+		return err
+	}
+
+	var version Version
+	if mod.Version != "" {
+		version.UnmarshalText([]byte(mod.Version))
+	}
+
+	var selected *ModPortalRelease
+	for i, release := range releases {
+		if mod.Version != "" {
+			if release.Version.Equals(version) {
+				selected = &releases[i]
+				break
+			}
+			continue
+		}
+		if !factorioVersionCompatible(FactorioServ.Version, release.InfoJSON.FactorioVersion) {
+			continue
+		}
+		if selected == nil || release.Version.Greater(selected.Version) {
+			selected = &releases[i]
+		}
+	}
+	if selected == nil && mod.Version != "" {
+		return fmt.Errorf("release %s not found on the mod source", mod.Version)
+	}
+	if selected == nil {
+		return fmt.Errorf("no release compatible with factorio %s found on the mod source", FactorioServ.Version)
+	}
+	if mod.Sha1 != "" && !strings.EqualFold(selected.Sha1, mod.Sha1) {
+		return fmt.Errorf("release %s on the mod source doesn't match the sha1 of the manifest", selected.Version)
+	}
+
+	jc.Logf("downloading %s %s", mod.Name, selected.Version)
+	return mods.downloadMod(jc, selected.DownloadURL, selected.FileName, mod.Name, selected.Sha1)
+}
@@ -1,27 +1,48 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// modPackInfoFile stores the description and notes of a modpack in its folder
+const modPackInfoFile = "modpack.json"
+
 type ModPackMap map[string]*ModPack
 type ModPack struct {
 	Mods Mods
+	Info ModPackInfo
+}
+
+// ModPackInfo describes a modpack
+type ModPackInfo struct {
+	Description string `json:"description"`
+	Notes       string `json:"notes"`
 }
 
 type ModPackResult struct {
-	Name string         `json:"name"`
-	Mods ModsResultList `json:"mods"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Notes       string         `json:"notes"`
+	Mods        ModsResultList `json:"mods"`
 }
 type ModPackResultList struct {
 	ModPacks []ModPackResult `json:"mod_packs"`
 }
 
+// ModPackInstallRequest installs mods with their dependencies into a modpack instead of the mods directory
+type ModPackInstallRequest struct {
+	ModPack string       `json:"mod_pack"`
+	Mods    []ModRequest `json:"mods"`
+}
+
 func newModPackMap() (ModPackMap, error) {
 	var err error
 	modPackMap := make(ModPackMap)
@@ -45,6 +66,12 @@ func newModPack(modPackFolder string) (*ModPack, error) {
 		return &modPack, err
 	}
 
+	modPack.Info, err = readModPackInfo(modPackFolder)
+	if err != nil {
+		log.Printf("error on loading the modpack info: %s", err)
+		return &modPack, err
+	}
+
 	return &modPack, err
 }
 
@@ -83,6 +110,8 @@ func (modPackMap *ModPackMap) listInstalledModPacks() ModPackResultList {
 	for modPackName, modPack := range *modPackMap {
 		var modPackResult ModPackResult
 		modPackResult.Name = modPackName
+		modPackResult.Description = modPack.Info.Description
+		modPackResult.Notes = modPack.Info.Notes
 		modPackResult.Mods = modPack.Mods.listInstalledMods()
 
 		modPackResultList.ModPacks = append(modPackResultList.ModPacks, modPackResult)
@@ -96,6 +125,11 @@ func (modPackMap *ModPackMap) createModPack(modPackName string) error {
 
 	modPackFolder := filepath.Join(config.FactorioModPackDir, modPackName)
 
+	err = checkModPackName(modPackName)
+	if err != nil {
+		return err
+	}
+
 	if modPackMap.checkModPackExists(modPackName) == true {
 		log.Printf("ModPack %s already existis", modPackName)
 		return errors.New("ModPack " + modPackName + " already exists, please choose a different name")
@@ -114,52 +148,179 @@ func (modPackMap *ModPackMap) createModPack(modPackName string) error {
 		return err
 	}
 
-	files, err := ioutil.ReadDir(config.FactorioModsDir)
+	err = copyModFiles(config.FactorioModsDir, modPackFolder)
+	if err != nil {
+		return err
+	}
+
+	//reload the ModPackList
+	err = modPackMap.reload()
+	if err != nil {
+		log.Printf("error on reloading ModPack: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// checkModPackName returns an error, if the name can't be used as folder of a modpack
+func checkModPackName(modPackName string) error {
+	if modPackName == "" || modPackName == "." || modPackName == ".." || strings.ContainsAny(modPackName, `/\`) {
+		return fmt.Errorf("invalid modpack name %q", modPackName)
+	}
+	return nil
+}
+
+// copyModFiles copies the files of the source directory into the destination, the mods are linked through the mod cache.
+// Files with one of the skipped names and the files of a mods swap are not copied.
+func copyModFiles(sourceDir string, destinationDir string, skip ...string) error {
+	return copyModFilesAs(sourceDir, destinationDir, "", skip...)
+}
+
+// copyModFilesAs copies the files like copyModFiles, the suffix is appended to the names of the copies
+func copyModFilesAs(sourceDir string, destinationDir string, suffix string, skip ...string) error {
+	files, err := ioutil.ReadDir(sourceDir)
+	if err != nil {
+		log.Printf("error on reading the mods dir: %s", err)
+		return err
+	}
+
+	modCache, err := newModCache(config.FactorioModCacheDir)
 	if err != nil {
-		log.Printf("error on reading the dactorio mods dir: %s", err)
+		log.Printf("error on opening the mod cache: %s", err)
 		return err
 	}
 
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
 	for _, file := range files {
-		if file.IsDir() == false {
-			sourceFilepath := filepath.Join(config.FactorioModsDir, file.Name())
-			destinationFilepath := filepath.Join(modPackFolder, file.Name())
+		if file.IsDir() || skipped[file.Name()] || isModSwapFile(file.Name()) {
+			continue
+		}
+		sourceFilepath := filepath.Join(sourceDir, file.Name())
+		destinationFilepath := filepath.Join(destinationDir, file.Name()+suffix)
 
-			sourceFile, err := os.Open(sourceFilepath)
+		// mods are shared with the mods directory through the mod cache
+		if filepath.Ext(file.Name()) == ".zip" {
+			err = linkCachedMod(&modCache, sourceFilepath, destinationFilepath)
 			if err != nil {
-				log.Printf("error on opening sourceFilepath: %s", err)
+				log.Printf("error on adding mod to the ModPack: %s", err)
 				return err
 			}
-			defer sourceFile.Close()
+			continue
+		}
 
-			destinationFile, err := os.Create(destinationFilepath)
-			if err != nil {
-				log.Printf("error on creating destinationFilepath: %s", err)
-				return err
-			}
-			defer destinationFile.Close()
+		sourceFile, err := os.Open(sourceFilepath)
+		if err != nil {
+			log.Printf("error on opening sourceFilepath: %s", err)
+			return err
+		}
+		err = writeFileAtomic(destinationFilepath, sourceFile)
+		sourceFile.Close()
+		if err != nil {
+			log.Printf("error on copying data from source to destination: %s", err)
+			return err
+		}
+	}
 
-			_, err = io.Copy(destinationFile, sourceFile)
-			if err != nil {
-				log.Printf("error on copying data from source to destination: %s", err)
-				return err
-			}
+	return nil
+}
+
+// cloneModPack copies the modpack with its description and notes to a new modpack
+func (modPackMap *ModPackMap) cloneModPack(modPackName string, newName string) (err error) {
+	if !modPackMap.checkModPackExists(modPackName) {
+		return fmt.Errorf("modpack %s does not exist", modPackName)
+	}
+	err = checkModPackName(newName)
+	if err != nil {
+		return err
+	}
+	if modPackMap.checkModPackExists(newName) {
+		return fmt.Errorf("modpack %s already exists, please choose a different name", newName)
+	}
 
-			sourceFile.Close()
-			destinationFile.Close()
+	newFolder := filepath.Join(config.FactorioModPackDir, newName)
+	err = os.MkdirAll(newFolder, 0755)
+	if err != nil {
+		log.Printf("error on creating the new ModPack directory: %s", err)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(newFolder)
 		}
+	}()
+
+	err = copyModFiles(filepath.Join(config.FactorioModPackDir, modPackName), newFolder)
+	if err != nil {
+		return err
 	}
 
-	//reload the ModPackList
-	err = modPackMap.reload()
+	return modPackMap.reload()
+}
+
+// renameModPack moves the modpack to the folder of the new name
+func (modPackMap *ModPackMap) renameModPack(modPackName string, newName string) error {
+	if !modPackMap.checkModPackExists(modPackName) {
+		return fmt.Errorf("modpack %s does not exist", modPackName)
+	}
+	err := checkModPackName(newName)
 	if err != nil {
-		log.Printf("error on reloading ModPack: %s", err)
 		return err
 	}
+	if modPackMap.checkModPackExists(newName) {
+		return fmt.Errorf("modpack %s already exists, please choose a different name", newName)
+	}
+
+	err = os.Rename(filepath.Join(config.FactorioModPackDir, modPackName), filepath.Join(config.FactorioModPackDir, newName))
+	if err != nil {
+		log.Printf("error on renaming the ModPack: %s", err)
+		return err
+	}
+
+	return modPackMap.reload()
+}
+
+// setModPackInfo changes the description and notes of the modpack
+func (modPackMap *ModPackMap) setModPackInfo(modPackName string, info ModPackInfo) error {
+	modPack, ok := (*modPackMap)[modPackName]
+	if !ok {
+		return fmt.Errorf("modpack %s does not exist", modPackName)
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filepath.Join(config.FactorioModPackDir, modPackName, modPackInfoFile), bytes.NewReader(data))
+	if err != nil {
+		log.Printf("error on saving the modpack info: %s", err)
+		return err
+	}
+	modPack.Info = info
 
 	return nil
 }
 
+// readModPackInfo reads the description and notes of the modpack, modpacks without them have empty ones
+func readModPackInfo(modPackFolder string) (ModPackInfo, error) {
+	var info ModPackInfo
+
+	data, err := ioutil.ReadFile(filepath.Join(modPackFolder, modPackInfoFile))
+	if os.IsNotExist(err) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
 func (modPackMap *ModPackMap) checkModPackExists(modPackName string) bool {
 	for modPackId := range *modPackMap {
 		if modPackId == modPackName {
@@ -190,61 +351,65 @@ func (modPackMap *ModPackMap) deleteModPack(modPackName string) error {
 	return nil
 }
 
+// loadModPack replaces the installed mods with the mods of the modpack, the replaced mods are kept as previous mods.
+// The pins of the installed mods are kept and have to allow the versions of the modpack.
 func (modPack *ModPack) loadModPack() error {
 	var err error
 
-	//get filemode, so it can be restored
-	fileInfo, err := os.Stat(config.FactorioModsDir)
+	pins, err := newModPinList(config.FactorioModsDir)
 	if err != nil {
-		log.Printf("error on trying to save folder infos: %s", err)
+		log.Printf("error on reading the mod pins: %s", err)
 		return err
 	}
-	folderMode := fileInfo.Mode()
+	if conflicts := pins.checkMods(modPack.Mods.ModInfoList.Mods); len(conflicts) > 0 {
+		return &PinConflictError{Conflicts: conflicts}
+	}
 
-	//clean factorio mod directory
-	err = os.RemoveAll(config.FactorioModsDir)
+	// the modpack is staged in the mods directory first, so a failed copy leaves the installed mods untouched
+	err = removeModFiles(stagedModSuffix)
 	if err != nil {
-		log.Printf("error on removing the factorio mods dir: %s", err)
 		return err
 	}
+	defer removeModFiles(stagedModSuffix)
 
-	err = os.Mkdir(config.FactorioModsDir, folderMode)
+	err = copyModFilesAs(modPack.Mods.ModInfoList.Destination, config.FactorioModsDir, stagedModSuffix, modPinsFile, modPackInfoFile)
 	if err != nil {
-		log.Printf("error on recreating mod dir: %s", err)
+		log.Printf("error on copying the mod pack: %s", err)
 		return err
 	}
 
-	//copy the modpack folder to the normal mods directory
-	err = filepath.Walk(modPack.Mods.ModInfoList.Destination, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
-		newFile, err := os.Create(filepath.Join(config.FactorioModsDir, info.Name()))
+	if len(pins.Pins) > 0 {
+		pinsPath := filepath.Join(config.FactorioModsDir, modPinsFile)
+		err = copyFile(pinsPath, pinsPath+stagedModSuffix)
 		if err != nil {
-			log.Printf("error on creting mod file: %s", err)
+			log.Printf("error on restoring the mod pins: %s", err)
 			return err
 		}
-		defer newFile.Close()
+	}
 
-		oldFile, err := os.Open(path)
-		if err != nil {
-			log.Printf("error on opening modFile: %s", err)
-			return err
-		}
-		defer oldFile.Close()
+	err = swapModFiles()
+	if err != nil {
+		log.Printf("error on replacing the installed mods: %s", err)
+		return err
+	}
 
-		_, err = io.Copy(newFile, oldFile)
-		if err != nil {
-			log.Printf("error on copying data to the new file: %s", err)
-			return err
-		}
+	return nil
+}
 
-		return nil
-	})
+// linkCachedMod adds the mod file to the mod cache and links it to the destination.
+// The source is replaced with a link as well, so it doesn't take space twice.
+func linkCachedMod(modCache *ModCache, source string, destination string) error {
+	cacheEntry, err := modCache.add(source)
 	if err != nil {
-		log.Printf("error on copying the mod pack: %s", err)
 		return err
 	}
 
-	return nil
+	fileLock.LockW(source)
+	err = linkFile(cacheEntry, source)
+	fileLock.Unlock(source)
+	if err != nil {
+		return err
+	}
+
+	return linkFile(cacheEntry, destination)
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// modsStopTimeout is how long a server stopped for a mods change may take to shut down
+const modsStopTimeout = 2 * time.Minute
+
+// ModsInUseError is returned, when the mods directory should be replaced while the server is running
+type ModsInUseError struct {
+	State ServerState
+}
+
+func (e *ModsInUseError) Error() string {
+	return fmt.Sprintf("the mods can't be replaced while the server is %s", e.State)
+}
+
+// The mods directory is never renamed, it may be a mount point, e.g. the volume of the docker image.
+// A modpack load stages its files in the mods directory under stagedModSuffix and swaps them in by renaming the single files,
+// the replaced files are kept under previousModSuffix. Factorio only loads zip files and directories, so it ignores them.
+// Directories with unpacked mods are not managed by the manager and stay in place.
+const (
+	stagedModSuffix   = ".fsm-staged"
+	previousModSuffix = ".fsm-previous"
+	replacedModSuffix = ".fsm-replaced"
+)
+
+// renameModFile renames the files of a swap, tests replace it to simulate failing renames
+var renameModFile = os.Rename
+
+// isModSwapFile returns true, if the file in the mods directory belongs to a swap instead of the installed mods
+func isModSwapFile(name string) bool {
+	for _, suffix := range []string{stagedModSuffix, previousModSuffix, replacedModSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// modFileNames returns the names, a mod file may have in the mods directory
+func modFileNames(fileName string) []string {
+	return []string{fileName, fileName + previousModSuffix}
+}
+
+// listModFiles returns the names of the files in the mods directory with the suffix, the suffix is trimmed.
+// The empty suffix returns the installed files.
+func listModFiles(suffix string) ([]string, error) {
+	files, err := ioutil.ReadDir(config.FactorioModsDir)
+	if err != nil {
+		log.Printf("error on reading the mods dir: %s", err)
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if suffix == "" {
+			if !isModSwapFile(file.Name()) {
+				names = append(names, file.Name())
+			}
+		} else if strings.HasSuffix(file.Name(), suffix) {
+			names = append(names, strings.TrimSuffix(file.Name(), suffix))
+		}
+	}
+
+	return names, nil
+}
+
+// removeModFiles removes the files in the mods directory with the suffix
+func removeModFiles(suffix string) error {
+	names, err := listModFiles(suffix)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = os.Remove(filepath.Join(config.FactorioModsDir, name+suffix))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("error on removing %s: %s", name+suffix, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// modFileMove is a rename done by a swap, so it can be undone
+type modFileMove struct {
+	from string
+	to   string
+}
+
+// moveModFiles renames the files in the mods directory from one suffix to the other, the done renames are added to moves
+func moveModFiles(fromSuffix string, toSuffix string, moves *[]modFileMove) error {
+	names, err := listModFiles(fromSuffix)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		move := modFileMove{
+			from: filepath.Join(config.FactorioModsDir, name+fromSuffix),
+			to:   filepath.Join(config.FactorioModsDir, name+toSuffix),
+		}
+		err = renameModFile(move.from, move.to)
+		if err != nil {
+			log.Printf("error on moving %s: %s", name+fromSuffix, err)
+			return err
+		}
+		*moves = append(*moves, move)
+	}
+
+	return nil
+}
+
+// undoModFileMoves renames the moved files back in reverse order
+func undoModFileMoves(moves []modFileMove) {
+	for i := len(moves) - 1; i >= 0; i-- {
+		if err := renameModFile(moves[i].to, moves[i].from); err != nil {
+			log.Printf("error on restoring %s: %s", filepath.Base(moves[i].from), err)
+		}
+	}
+}
+
+// swapModFiles moves the staged files into the place of the installed files, which are kept as previous files.
+// The old previous files are only removed, once the staged files are in place.
+// If a file can't be moved, all moved files are renamed back, so the installed and the previous mods are restored.
+func swapModFiles() error {
+	err := removeModFiles(replacedModSuffix)
+	if err != nil {
+		return err
+	}
+
+	var moves []modFileMove
+	steps := []struct {
+		from string
+		to   string
+	}{
+		{previousModSuffix, replacedModSuffix},
+		{"", previousModSuffix},
+		{stagedModSuffix, ""},
+	}
+	for _, step := range steps {
+		err = moveModFiles(step.from, step.to, &moves)
+		if err != nil {
+			log.Printf("error on swapping the mod files: %s", err)
+			undoModFileMoves(moves)
+			return err
+		}
+	}
+
+	err = removeModFiles(replacedModSuffix)
+	if err != nil {
+		log.Printf("error on removing the old previous mods: %s", err)
+	}
+
+	return nil
+}
+
+// rollbackMods swaps the installed mods with the previous mods, so a second rollback restores the replaced mods again
+func rollbackMods() error {
+	previous, err := listModFiles(previousModSuffix)
+	if err != nil {
+		return err
+	}
+	if len(previous) == 0 {
+		return errors.New("there are no previous mods to roll back to")
+	}
+
+	err = removeModFiles(stagedModSuffix)
+	if err != nil {
+		return err
+	}
+
+	var moves []modFileMove
+	err = moveModFiles(previousModSuffix, stagedModSuffix, &moves)
+	if err == nil {
+		err = swapModFiles()
+	}
+	if err != nil {
+		undoModFileMoves(moves)
+		return err
+	}
+
+	return nil
+}
+
+// withServerStopped runs fn while the server is not running. A running server is stopped and started again
+// with the same options afterwards, if restart is set. Otherwise ModsInUseError is returned.
+// It has to be called from a job holding the mods dir lock, which Start takes as well,
+// so the server can't be started between the check of its state and fn.
+func withServerStopped(jc *JobContext, restart bool, fn func() error) error {
+	state := FactorioServ.State()
+	if state == ServerStopped || state == ServerCrashed {
+		return fn()
+	}
+	if !restart || state != ServerRunning {
+		return &ModsInUseError{State: state}
+	}
+
+	options := ServerStartOptions{
+		Savefile: FactorioServ.Savefile,
+		Latency:  FactorioServ.Latency,
+		BindIP:   FactorioServ.BindIP,
+		Port:     FactorioServ.Port,
+	}
+	if FactorioServ.Profile != nil {
+		options.Profile = FactorioServ.Profile.Name
+	}
+
+	// subscribe before stopping, so no state change can be missed
+	changes, unsubscribe := FactorioServ.Subscribe()
+	defer unsubscribe()
+
+	jc.Logf("stopping the server")
+	err := FactorioServ.Stop()
+	if err != nil {
+		return fmt.Errorf("error stopping the server: %v", err)
+	}
+
+	timeout := time.After(modsStopTimeout)
+	state = FactorioServ.State()
+	for state != ServerStopped && state != ServerCrashed {
+		select {
+		case change := <-changes:
+			state = change.To
+		case <-timeout:
+			return errors.New("the server didn't stop in time")
+		case <-jc.Done():
+			return jc.Err()
+		}
+	}
+
+	err = fn()
+
+	// the job running fn holds the mods dir lock, so Start would refuse to start the server
+	jc.Logf("starting the server with save %s", options.Savefile)
+	if startErr := FactorioServ.start(options); startErr != nil {
+		log.Printf("error restarting the server after changing the mods: %s", startErr)
+		if err == nil {
+			err = fmt.Errorf("the mods were changed, but the server couldn't be started: %v", startErr)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// modSettingsFile is stored in the mods directory
+const modSettingsFile = "mod-settings.dat"
+
+// scopes of the mod settings
+const (
+	modSettingStartup        = "startup"
+	modSettingRuntimeGlobal  = "runtime-global"
+	modSettingRuntimePerUser = "runtime-per-user"
+)
+
+var modSettingScopes = []string{modSettingStartup, modSettingRuntimeGlobal, modSettingRuntimePerUser}
+
+// maxModSettingsBackups is the number of backups kept of the mod-settings.dat
+const maxModSettingsBackups = 20
+
+// ModSettings is the content of the mod-settings.dat.
+// Settings holds a dictionary per scope, in which every setting is stored as {"value": ...}.
+type ModSettings struct {
+	Version     Version                `json:"version"`
+	Settings    map[string]interface{} `json:"settings"`
+	Destination string                 `json:"-"`
+}
+
+// ModSetting is a single setting with its prototype, if the prototype could be read from the mod
+type ModSetting struct {
+	Name      string               `json:"name"`
+	Scope     string               `json:"scope"`
+	Value     interface{}          `json:"value"`
+	Stored    bool                 `json:"stored"`
+	Prototype *ModSettingPrototype `json:"prototype,omitempty"`
+}
+
+// ModSettingsResult are the settings returned by the mod settings api
+type ModSettingsResult struct {
+	Version  Version      `json:"version"`
+	Settings []ModSetting `json:"settings"`
+}
+
+// ModSettingsRequest are the changes sent to the mod settings api
+type ModSettingsRequest struct {
+	Settings []ModSettingChange `json:"settings"`
+}
+
+// ModSettingChange sets the value of a setting, a null value removes the setting, so factorio uses the default
+type ModSettingChange struct {
+	Scope string      `json:"scope"`
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+func newModSettings(destination string) (ModSettings, error) {
+	var err error
+	modSettings := ModSettings{
+		Destination: destination,
+	}
+
+	err = modSettings.load()
+	if err != nil {
+		log.Printf("ModSettings ... error loading mod settings: %s", err)
+		return modSettings, err
+	}
+
+	return modSettings, nil
+}
+
+func (modSettings *ModSettings) load() error {
+	file, err := os.Open(filepath.Join(modSettings.Destination, modSettingsFile))
+	if os.IsNotExist(err) {
+		// the file is created by factorio or on the first change
+		modSettings.Version = FactorioServ.Version
+		if modSettings.Version.Equals(NilVersion) {
+			modSettings.Version = Version{1, 1, 0, 0}
+		}
+		modSettings.Settings = make(map[string]interface{})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = modSettings.ReadFrom(file)
+	return err
+}
+
+// ReadFrom reads the mod settings: the factorio version, a flag since 0.17 and the property tree
+func (modSettings *ModSettings) ReadFrom(r io.Reader) (int64, error) {
+	d := newSaveDecoder(r)
+	modSettings.Version = d.readVersion64("version")
+	d.game = modSettings.Version
+	if !modSettings.Version.Less(Version{0, 17, 0, 0}) {
+		d.readBool("header flag")
+	}
+	tree := d.readPropertyTree("settings")
+	if d.Err() != nil {
+		return d.n, d.Err()
+	}
+
+	settings, ok := tree.(map[string]interface{})
+	if !ok {
+		return d.n, errors.New("mod settings are not a dictionary")
+	}
+	modSettings.Settings = settings
+
+	return d.n, nil
+}
+
+// WriteTo writes the mod settings in the format read by ReadFrom
+func (modSettings *ModSettings) WriteTo(w io.Writer) (int64, error) {
+	e := newSaveEncoder(w)
+	e.game = modSettings.Version
+	e.writeVersion64("version", modSettings.Version)
+	if !modSettings.Version.Less(Version{0, 17, 0, 0}) {
+		e.writeBool("header flag", false)
+	}
+	e.writePropertyTree("settings", modSettings.Settings)
+
+	return e.n, e.Err()
+}
+
+// save writes the mod settings after taking a backup of the current file
+func (modSettings *ModSettings) save() error {
+	var buf bytes.Buffer
+	_, err := modSettings.WriteTo(&buf)
+	if err != nil {
+		log.Printf("error encoding mod settings: %s", err)
+		return err
+	}
+
+	err = backupModSettings(modSettings.Destination)
+	if err != nil {
+		log.Printf("error on backing up mod settings: %s", err)
+		return err
+	}
+
+	err = writeFileAtomic(filepath.Join(modSettings.Destination, modSettingsFile), &buf)
+	if err != nil {
+		log.Printf("error writing mod settings: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// backupModSettings copies the mod-settings.dat into the backup dir, only the newest backups are kept
+func backupModSettings(modsDir string) error {
+	current, err := os.Open(filepath.Join(modsDir, modSettingsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer current.Close()
+
+	err = os.MkdirAll(config.ModSettingsBackupDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	backupName := fmt.Sprintf("mod-settings-%s.dat", time.Now().Format("20060102-150405.000000000"))
+	err = writeFileAtomic(filepath.Join(config.ModSettingsBackupDir, backupName), current)
+	if err != nil {
+		return err
+	}
+
+	backups, err := filepath.Glob(filepath.Join(config.ModSettingsBackupDir, "mod-settings-*.dat"))
+	if err != nil {
+		return err
+	}
+	// the names sort by the time of the backup
+	sort.Strings(backups)
+	for len(backups) > maxModSettingsBackups {
+		err = os.Remove(backups[0])
+		if err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+func (modSettings *ModSettings) scope(scope string) map[string]interface{} {
+	dict, ok := modSettings.Settings[scope].(map[string]interface{})
+	if !ok {
+		dict = make(map[string]interface{})
+		modSettings.Settings[scope] = dict
+	}
+	return dict
+}
+
+// list returns the stored settings and the settings of the prototypes, which are not stored
+func (modSettings *ModSettings) list(prototypes map[string]ModSettingPrototype) []ModSetting {
+	settings := []ModSetting{}
+	stored := make(map[string]bool)
+
+	for _, scope := range modSettingScopes {
+		for name, setting := range modSettings.scope(scope) {
+			var value interface{}
+			if dict, ok := setting.(map[string]interface{}); ok {
+				value = dict["value"]
+			}
+
+			modSetting := ModSetting{Name: name, Scope: scope, Value: value, Stored: true}
+			if prototype, ok := prototypes[name]; ok {
+				modSetting.Prototype = &prototype
+			}
+			settings = append(settings, modSetting)
+			stored[name] = true
+		}
+	}
+
+	for name, prototype := range prototypes {
+		if stored[name] {
+			continue
+		}
+		prototype := prototype
+		settings = append(settings, ModSetting{Name: name, Scope: prototype.SettingType, Value: prototype.DefaultValue, Prototype: &prototype})
+	}
+
+	sort.Slice(settings, func(i, j int) bool {
+		if settings[i].Scope != settings[j].Scope {
+			return settings[i].Scope < settings[j].Scope
+		}
+		return settings[i].Name < settings[j].Name
+	})
+
+	return settings
+}
+
+// set changes the setting, the value is checked against the prototype and keeps the type of the stored value
+func (modSettings *ModSettings) set(change ModSettingChange, prototype *ModSettingPrototype) error {
+	validScope := false
+	for _, scope := range modSettingScopes {
+		validScope = validScope || change.Scope == scope
+	}
+	if !validScope {
+		return fmt.Errorf("invalid scope %q of setting %s", change.Scope, change.Name)
+	}
+	if change.Name == "" {
+		return errors.New("setting name missing")
+	}
+	if prototype != nil && prototype.SettingType != "" && prototype.SettingType != change.Scope {
+		return fmt.Errorf("setting %s is a %s setting", change.Name, prototype.SettingType)
+	}
+
+	scope := modSettings.scope(change.Scope)
+	if change.Value == nil {
+		delete(scope, change.Name)
+		return nil
+	}
+
+	var current interface{}
+	if dict, ok := scope[change.Name].(map[string]interface{}); ok {
+		current = dict["value"]
+	}
+
+	value, err := modSettingValue(change, current, prototype)
+	if err != nil {
+		return err
+	}
+
+	scope[change.Name] = map[string]interface{}{"value": value}
+	return nil
+}
+
+// modSettingValue converts the json value to the type of the setting
+func modSettingValue(change ModSettingChange, current interface{}, prototype *ModSettingPrototype) (interface{}, error) {
+	kind := ""
+	if prototype != nil {
+		kind = prototype.Type
+	} else {
+		switch current.(type) {
+		case bool:
+			kind = "bool-setting"
+		case int64, uint64:
+			kind = "int-setting"
+		case float64:
+			kind = "double-setting"
+		case string:
+			kind = "string-setting"
+		case map[string]interface{}:
+			kind = "color-setting"
+		}
+	}
+
+	invalid := func() (interface{}, error) {
+		return nil, fmt.Errorf("invalid value %v of %s setting %s", change.Value, strings.TrimSuffix(kind, "-setting"), change.Name)
+	}
+
+	allowed := func(value interface{}) bool {
+		if prototype == nil || len(prototype.AllowedValues) == 0 {
+			return true
+		}
+		for _, allowedValue := range prototype.AllowedValues {
+			if allowedValue == value {
+				return true
+			}
+		}
+		return false
+	}
+
+	inRange := func(number float64) bool {
+		return prototype == nil || (prototype.MinimumValue == nil || number >= *prototype.MinimumValue) &&
+			(prototype.MaximumValue == nil || number <= *prototype.MaximumValue)
+	}
+
+	switch kind {
+	case "bool-setting":
+		if value, ok := change.Value.(bool); ok {
+			return value, nil
+		}
+	case "int-setting":
+		number, ok := change.Value.(float64)
+		if !ok || number != math.Trunc(number) || !inRange(number) || !allowed(number) {
+			return invalid()
+		}
+		// older files store integers as numbers
+		if _, ok := current.(float64); ok {
+			return number, nil
+		}
+		return int64(number), nil
+	case "double-setting":
+		if number, ok := change.Value.(float64); ok && inRange(number) && allowed(number) {
+			return number, nil
+		}
+	case "string-setting":
+		text, ok := change.Value.(string)
+		if ok && allowed(text) && (text != "" || prototype == nil || prototype.AllowBlank) {
+			return text, nil
+		}
+	case "color-setting":
+		color, ok := change.Value.(map[string]interface{})
+		if !ok {
+			return invalid()
+		}
+		value := map[string]interface{}{"a": 1.0}
+		for _, key := range []string{"r", "g", "b", "a"} {
+			component, ok := color[key].(float64)
+			if !ok && key != "a" {
+				return invalid()
+			}
+			if ok {
+				value[key] = component
+			}
+		}
+		return value, nil
+	default:
+		// settings without prototype and stored value keep the json type
+		switch value := change.Value.(type) {
+		case bool, float64, string:
+			return value, nil
+		}
+	}
+
+	return invalid()
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ModSettingPrototype is the definition of a mod setting in the settings.lua of a mod
+type ModSettingPrototype struct {
+	Mod           string        `json:"mod"`
+	Name          string        `json:"name"`
+	Type          string        `json:"type"`
+	SettingType   string        `json:"setting_type"`
+	DefaultValue  interface{}   `json:"default_value,omitempty"`
+	MinimumValue  *float64      `json:"minimum_value,omitempty"`
+	MaximumValue  *float64      `json:"maximum_value,omitempty"`
+	AllowedValues []interface{} `json:"allowed_values,omitempty"`
+	AllowBlank    bool          `json:"allow_blank,omitempty"`
+	Hidden        bool          `json:"hidden,omitempty"`
+}
+
+// settings.lua is lua code, so only the setting tables written as literals can be read.
+// The tokens and tables of this scanner cover the table constructors used by data:extend.
+const (
+	luaTokenName = iota
+	luaTokenString
+	luaTokenNumber
+	luaTokenSymbol
+)
+
+type luaToken struct {
+	kind   int
+	text   string
+	number float64
+}
+
+// luaTable is a table constructor with the literal values of its fields and items
+type luaTable struct {
+	fields map[string]interface{}
+	items  []interface{}
+}
+
+// luaExpression is a value, which is not a literal
+type luaExpression struct{}
+
+func tokenizeLua(source string) []luaToken {
+	var tokens []luaToken
+
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case strings.HasPrefix(source[i:], "--"):
+			i += 2
+			if level, ok := luaLongBracket(source[i:]); ok {
+				i += luaLongBracketEnd(source[i:], level)
+			} else {
+				for i < len(source) && source[i] != '\n' {
+					i++
+				}
+			}
+		case c == '"' || c == '\'':
+			var text strings.Builder
+			for i++; i < len(source) && source[i] != c && source[i] != '\n'; i++ {
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+					switch source[i] {
+					case 'n':
+						text.WriteByte('\n')
+					case 't':
+						text.WriteByte('\t')
+					default:
+						text.WriteByte(source[i])
+					}
+					continue
+				}
+				text.WriteByte(source[i])
+			}
+			i++
+			tokens = append(tokens, luaToken{kind: luaTokenString, text: text.String()})
+		case c == '[':
+			if level, ok := luaLongBracket(source[i:]); ok {
+				end := luaLongBracketEnd(source[i:], level)
+				text := source[i+level+2 : i+end]
+				text = strings.TrimSuffix(text, "]"+strings.Repeat("=", level)+"]")
+				tokens = append(tokens, luaToken{kind: luaTokenString, text: strings.TrimPrefix(text, "\n")})
+				i += end
+			} else {
+				tokens = append(tokens, luaToken{kind: luaTokenSymbol, text: "["})
+				i++
+			}
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(source) && source[i+1] >= '0' && source[i+1] <= '9':
+			start := i
+			for i < len(source) && (strings.IndexByte("0123456789abcdefABCDEFxX.", source[i]) >= 0 ||
+				(source[i] == '-' || source[i] == '+') && strings.IndexByte("eEpP", source[i-1]) >= 0) {
+				i++
+			}
+			text := source[start:i]
+			var number float64
+			if value, err := strconv.ParseInt(text, 0, 64); err == nil {
+				number = float64(value)
+			} else {
+				number, _ = strconv.ParseFloat(text, 64)
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenNumber, text: text, number: number})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(source) && (source[i] == '_' || source[i] >= 'a' && source[i] <= 'z' || source[i] >= 'A' && source[i] <= 'Z' || source[i] >= '0' && source[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenName, text: source[start:i]})
+		default:
+			symbol := source[i : i+1]
+			for _, long := range []string{"...", "..", "==", "~=", "<=", ">=", "::"} {
+				if strings.HasPrefix(source[i:], long) {
+					symbol = long
+					break
+				}
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenSymbol, text: symbol})
+			i += len(symbol)
+		}
+	}
+
+	return tokens
+}
+
+// luaLongBracket returns the level of the long bracket "[==[" at the start of the source
+func luaLongBracket(source string) (int, bool) {
+	if !strings.HasPrefix(source, "[") {
+		return 0, false
+	}
+	level := 1
+	for level < len(source) && source[level] == '=' {
+		level++
+	}
+	if level < len(source) && source[level] == '[' {
+		return level - 1, true
+	}
+	return 0, false
+}
+
+// luaLongBracketEnd returns the length of the long string or comment including its brackets,
+// unterminated ones end with the source
+func luaLongBracketEnd(source string, level int) int {
+	closing := "]" + strings.Repeat("=", level) + "]"
+	index := strings.Index(source[level+2:], closing)
+	if index < 0 {
+		return len(source)
+	}
+	return level + 2 + index + len(closing)
+}
+
+type luaParser struct {
+	tokens []luaToken
+	pos    int
+	tables []*luaTable
+}
+
+func (p *luaParser) peek(offset int) luaToken {
+	if p.pos+offset >= len(p.tokens) {
+		return luaToken{kind: luaTokenSymbol}
+	}
+	return p.tokens[p.pos+offset]
+}
+
+func (p *luaParser) isSymbol(offset int, symbols ...string) bool {
+	if p.pos+offset >= len(p.tokens) {
+		return false
+	}
+	token := p.tokens[p.pos+offset]
+	if token.kind != luaTokenSymbol {
+		return false
+	}
+	for _, symbol := range symbols {
+		if token.text == symbol {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTable parses the table constructor starting at the current "{"
+func (p *luaParser) parseTable() *luaTable {
+	table := &luaTable{fields: make(map[string]interface{})}
+	p.tables = append(p.tables, table)
+	p.pos++
+
+	for p.pos < len(p.tokens) && !p.isSymbol(0, "}") {
+		start := p.pos
+		switch {
+		case p.peek(0).kind == luaTokenName && p.isSymbol(1, "="):
+			key := p.peek(0).text
+			p.pos += 2
+			table.fields[key] = p.parseValue()
+		case p.isSymbol(0, "["):
+			p.pos++
+			key := p.parseValue()
+			if p.isSymbol(0, "]") && p.isSymbol(1, "=") {
+				p.pos += 2
+			}
+			value := p.parseValue()
+			if name, ok := key.(string); ok {
+				table.fields[name] = value
+			}
+		default:
+			table.items = append(table.items, p.parseValue())
+		}
+
+		if p.isSymbol(0, ",", ";") || p.pos == start {
+			p.pos++
+		}
+	}
+	p.pos++
+
+	return table
+}
+
+// parseValue parses a literal or a table, other expressions are skipped
+func (p *luaParser) parseValue() interface{} {
+	var value interface{} = luaExpression{}
+	token := p.peek(0)
+
+	switch {
+	case p.isSymbol(0, "{"):
+		value = p.parseTable()
+	case token.kind == luaTokenString:
+		value = token.text
+		p.pos++
+	case token.kind == luaTokenNumber:
+		value = token.number
+		p.pos++
+	case p.isSymbol(0, "-") && p.peek(1).kind == luaTokenNumber:
+		value = -p.peek(1).number
+		p.pos += 2
+	case token.kind == luaTokenName && (token.text == "true" || token.text == "false"):
+		value = token.text == "true"
+		p.pos++
+	case token.kind == luaTokenName && token.text == "nil":
+		value = nil
+		p.pos++
+	}
+
+	if p.pos >= len(p.tokens) || p.isSymbol(0, ",", ";", "}", "]") {
+		return value
+	}
+
+	// the value is part of an expression, tables in it are still collected
+	depth := 0
+	for p.pos < len(p.tokens) {
+		switch {
+		case p.isSymbol(0, "{"):
+			p.parseTable()
+			continue
+		case p.isSymbol(0, "(", "["):
+			depth++
+		case p.isSymbol(0, ")", "]") && depth > 0:
+			depth--
+		case depth == 0 && p.isSymbol(0, ",", ";", "}", "]", ")"):
+			return luaExpression{}
+		}
+		p.pos++
+	}
+	return luaExpression{}
+}
+
+// parseModSettingPrototypes returns the setting prototypes written as table literals in the lua source
+func parseModSettingPrototypes(modName string, source string) []ModSettingPrototype {
+	parser := luaParser{tokens: tokenizeLua(source)}
+	for parser.pos < len(parser.tokens) {
+		if parser.isSymbol(0, "{") {
+			parser.parseTable()
+		} else {
+			parser.pos++
+		}
+	}
+
+	var prototypes []ModSettingPrototype
+	for _, table := range parser.tables {
+		settingKind, _ := table.fields["type"].(string)
+		name, _ := table.fields["name"].(string)
+		if !strings.HasSuffix(settingKind, "-setting") || name == "" {
+			continue
+		}
+
+		prototype := ModSettingPrototype{Mod: modName, Name: name, Type: settingKind}
+		prototype.SettingType, _ = table.fields["setting_type"].(string)
+		prototype.DefaultValue = luaLiteral(table.fields["default_value"])
+		if minimum, ok := table.fields["minimum_value"].(float64); ok {
+			prototype.MinimumValue = &minimum
+		}
+		if maximum, ok := table.fields["maximum_value"].(float64); ok {
+			prototype.MaximumValue = &maximum
+		}
+		if allowed, ok := table.fields["allowed_values"].(*luaTable); ok {
+			for _, item := range allowed.items {
+				if value := luaLiteral(item); value != nil {
+					prototype.AllowedValues = append(prototype.AllowedValues, value)
+				}
+			}
+		}
+		prototype.AllowBlank, _ = table.fields["allow_blank"].(bool)
+		prototype.Hidden, _ = table.fields["hidden"].(bool)
+
+		prototypes = append(prototypes, prototype)
+	}
+
+	return prototypes
+}
+
+// luaLiteral converts the parsed value to the json types, colors are returned as map
+func luaLiteral(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bool, float64, string:
+		return v
+	case *luaTable:
+		color := make(map[string]interface{})
+		for i, key := range []string{"r", "g", "b", "a"} {
+			if component, ok := v.fields[key].(float64); ok {
+				color[key] = component
+			} else if i < len(v.items) {
+				if component, ok := v.items[i].(float64); ok {
+					color[key] = component
+				}
+			}
+		}
+		if len(color) > 0 {
+			return color
+		}
+	}
+	return nil
+}
+
+// readModSettingPrototypes reads the setting prototypes from the settings.lua in the root of the mod zip
+func readModSettingPrototypes(modName string, zipPath string) ([]ModSettingPrototype, error) {
+	zipFile, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zipFile.Close()
+
+	for _, file := range zipFile.File {
+		// the files of a mod are in a single folder inside the zip
+		if path.Base(file.Name) != "settings.lua" || strings.Count(strings.Trim(file.Name, "/"), "/") != 1 {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		source, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return parseModSettingPrototypes(modName, string(source)), nil
+	}
+
+	return nil, nil
+}
+
+// loadModSettingPrototypes returns the setting prototypes of all installed mods by setting name
+func loadModSettingPrototypes(mods *Mods) map[string]ModSettingPrototype {
+	prototypes := make(map[string]ModSettingPrototype)
+
+	for _, modInfo := range mods.ModInfoList.Mods {
+		modPrototypes, err := readModSettingPrototypes(modInfo.Name, filepath.Join(mods.ModInfoList.Destination, modInfo.FileName))
+		if err != nil {
+			log.Printf("error reading the settings of mod %s: %s", modInfo.Name, err)
+			continue
+		}
+		for _, prototype := range modPrototypes {
+			prototypes[prototype.Name] = prototype
+		}
+	}
+
+	return prototypes
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// kinds of mod sources, which can be configured with "mod_source"
+const (
+	modSourcePortal    = "portal"
+	modSourceMirror    = "mirror"
+	modSourceDirectory = "directory"
+)
+
+const (
+	factorioModPortalURL = "https://mods.factorio.com"
+	factorioAuthURL      = "https://auth.factorio.com"
+)
+
+// modSourceIndexFile lists the mods of a directory mirror
+const modSourceIndexFile = "index.json"
+
+// ModSource provides the mods to install, it is the official mod portal or a mirror of it.
+// Search and Details return the responses in the format of the mod portal API.
+type ModSource interface {
+	// Login checks the account and returns the token needed to download mods
+	Login(username string, password string) (string, error, int)
+	// RequiresLogin returns false, if mods can be downloaded without an account
+	RequiresLogin() bool
+	Search(keyword string) (string, error, int)
+	Details(modId string) (string, error, int)
+	// Download returns the content of the mod file of a release
+	Download(ctx context.Context, downloadURL string, credentials FactorioCredentials) (io.ReadCloser, error)
+}
+
+// ModSourceStatusError is returned, when the mod source answers a download with an unexpected status
+type ModSourceStatusError struct {
+	StatusCode int
+}
+
+func (e *ModSourceStatusError) Error() string {
+	return "Statuscode not 200: " + fmt.Sprint(e.StatusCode)
+}
+
+// newModSource returns the configured mod source
+func newModSource() (ModSource, error) {
+	switch config.ModSource {
+	case "", modSourcePortal:
+		return &PortalModSource{ModsURL: factorioModPortalURL, AuthURL: factorioAuthURL}, nil
+	case modSourceMirror:
+		if config.ModSourceURL == "" {
+			return nil, errors.New("mod source mirror needs mod_source_url")
+		}
+		return &PortalModSource{ModsURL: strings.TrimSuffix(config.ModSourceURL, "/"), AuthURL: strings.TrimSuffix(config.ModSourceAuthURL, "/")}, nil
+	case modSourceDirectory:
+		if config.ModSourceDir == "" {
+			return nil, errors.New("mod source directory needs mod_source_dir")
+		}
+		return &DirectoryModSource{Dir: config.ModSourceDir}, nil
+	}
+
+	return nil, fmt.Errorf("unknown mod source %q, use %s, %s or %s", config.ModSource, modSourcePortal, modSourceMirror, modSourceDirectory)
+}
+
+// PortalModSource talks to the official mod portal or a self-hosted mirror implementing its API.
+// Mirrors without AuthURL are used without login.
+type PortalModSource struct {
+	ModsURL string
+	AuthURL string
+}
+
+func (source *PortalModSource) RequiresLogin() bool {
+	return source.AuthURL != ""
+}
+
+func (source *PortalModSource) Login(username string, password string) (string, error, int) {
+	if !source.RequiresLogin() {
+		return "", errors.New("the mod source doesn't need a login"), http.StatusBadRequest
+	}
+
+	resp, err := http.PostForm(source.AuthURL+"/api-login",
+		url.Values{"require_game_ownership": {"true"}, "username": {username}, "password": {password}})
+	if err != nil {
+		log.Printf("error on logging in: %s", err)
+		return "", err, http.StatusInternalServerError
+	}
+
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("error on reading resp.Body: %s", err)
+		return "", err, http.StatusInternalServerError
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Println("error Statuscode not 200")
+		return "", errors.New(string(bodyBytes)), resp.StatusCode
+	}
+
+	var successResponse []string
+	err = json.Unmarshal(bodyBytes, &successResponse)
+	if err == nil && len(successResponse) == 0 {
+		err = errors.New("login response contains no token")
+	}
+	if err != nil {
+		log.Printf("error on unmarshal body: %s", err)
+		return "", err, http.StatusInternalServerError
+	}
+
+	return successResponse[0], nil, http.StatusOK
+}
+
+func (source *PortalModSource) Search(keyword string) (string, error, int) {
+	req, err := http.NewRequest(http.MethodGet, source.ModsURL+"/api/mods", nil)
+	if err != nil {
+		return "error", err, 500
+	}
+
+	query := req.URL.Query()
+	query.Add("q", keyword)
+	req.URL.RawQuery = query.Encode()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "error", err, 500
+	}
+
+	text, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "error", err, 500
+	}
+
+	return string(text), nil, resp.StatusCode
+}
+
+func (source *PortalModSource) Details(modId string) (string, error, int) {
+	// the full details contain the dependencies of the releases
+	resp, err := http.Get(source.ModsURL + "/api/mods/" + url.PathEscape(modId) + "/full")
+	if err != nil {
+		return "error", err, http.StatusInternalServerError
+	}
+
+	text, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		log.Printf("error reading mod details: %s", err)
+		return "error", err, resp.StatusCode
+	}
+
+	return string(text), nil, resp.StatusCode
+}
+
+func (source *PortalModSource) Download(ctx context.Context, downloadURL string, credentials FactorioCredentials) (io.ReadCloser, error) {
+	completeUrl := source.ModsURL + downloadURL
+	if source.RequiresLogin() {
+		completeUrl += "?username=" + url.QueryEscape(credentials.Username) + "&token=" + url.QueryEscape(credentials.Userkey)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, completeUrl, nil)
+	if err != nil {
+		log.Printf("error on creating mod download request: %s", err)
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, &ModSourceStatusError{StatusCode: response.StatusCode}
+	}
+
+	return response.Body, nil
+}
+
+// ModSourceIndex lists the mods of a directory mirror in the format of the full mod details of the mod portal.
+// The download_url of a release is the path of the file relative to the directory, the file_name is used if it's missing.
+type ModSourceIndex struct {
+	Mods []ModPortalStruct `json:"mods"`
+}
+
+// modSourceSearchResult is the answer to a search in the format of the mod portal
+type modSourceSearchResult struct {
+	Pagination struct {
+		Count     int `json:"count"`
+		Page      int `json:"page"`
+		PageCount int `json:"page_count"`
+		PageSize  int `json:"page_size"`
+	} `json:"pagination"`
+	Results []ModPortalStruct `json:"results"`
+}
+
+// DirectoryModSource serves the mods from a local directory, e.g. for servers without internet
+type DirectoryModSource struct {
+	Dir string
+}
+
+func (source *DirectoryModSource) RequiresLogin() bool {
+	return false
+}
+
+func (source *DirectoryModSource) Login(username string, password string) (string, error, int) {
+	return "", errors.New("the mod source doesn't need a login"), http.StatusBadRequest
+}
+
+func (source *DirectoryModSource) index() (ModSourceIndex, error) {
+	var index ModSourceIndex
+
+	data, err := ioutil.ReadFile(filepath.Join(source.Dir, modSourceIndexFile))
+	if err != nil {
+		log.Printf("error reading the mod source index: %s", err)
+		return index, err
+	}
+
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		log.Printf("error decoding the mod source index: %s", err)
+		return index, err
+	}
+
+	for _, mod := range index.Mods {
+		for i := range mod.Releases {
+			// the downloads are verified against the checksum
+			if mod.Releases[i].Sha1 == "" {
+				err = fmt.Errorf("release %s of mod %s in the mod source index has no sha1", mod.Releases[i].FileName, mod.Name)
+				log.Printf("error in the mod source index: %s", err)
+				return index, err
+			}
+			if mod.Releases[i].DownloadURL == "" {
+				mod.Releases[i].DownloadURL = "/" + mod.Releases[i].FileName
+			}
+		}
+	}
+
+	return index, nil
+}
+
+func (source *DirectoryModSource) Search(keyword string) (string, error, int) {
+	index, err := source.index()
+	if err != nil {
+		return "error", err, http.StatusInternalServerError
+	}
+
+	result := modSourceSearchResult{Results: []ModPortalStruct{}}
+	keyword = strings.ToLower(keyword)
+	for _, mod := range index.Mods {
+		if strings.Contains(strings.ToLower(mod.Name), keyword) || strings.Contains(strings.ToLower(mod.Title), keyword) ||
+			strings.Contains(strings.ToLower(mod.Summary), keyword) {
+			result.Results = append(result.Results, mod)
+		}
+	}
+	result.Pagination.Count = len(result.Results)
+	result.Pagination.Page = 1
+	result.Pagination.PageCount = 1
+	result.Pagination.PageSize = len(result.Results)
+
+	text, err := json.Marshal(result)
+	if err != nil {
+		return "error", err, http.StatusInternalServerError
+	}
+
+	return string(text), nil, http.StatusOK
+}
+
+func (source *DirectoryModSource) Details(modId string) (string, error, int) {
+	index, err := source.index()
+	if err != nil {
+		return "error", err, http.StatusInternalServerError
+	}
+
+	for _, mod := range index.Mods {
+		if mod.Name == modId {
+			text, err := json.Marshal(mod)
+			if err != nil {
+				return "error", err, http.StatusInternalServerError
+			}
+			return string(text), nil, http.StatusOK
+		}
+	}
+
+	return `{"message": "Mod not found"}`, nil, http.StatusNotFound
+}
+
+func (source *DirectoryModSource) Download(ctx context.Context, downloadURL string, credentials FactorioCredentials) (io.ReadCloser, error) {
+	// the url must not point outside of the directory
+	filePath := filepath.Join(source.Dir, filepath.FromSlash(path.Clean("/"+downloadURL)))
+
+	return os.Open(filePath)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// actions done for a single mod while syncing the mods to a save
+const (
+	modSyncInstall = "install"
+	modSyncReplace = "replace"
+	modSyncEnable  = "enable"
+	modSyncDisable = "disable"
+)
+
+// states of the single mods of a sync
+const (
+	modSyncPending = "pending"
+	modSyncRunning = "running"
+	modSyncDone    = "done"
+	modSyncFailed  = "failed"
+)
+
+// ModSyncStep is the change of a single mod needed to match the save
+type ModSyncStep struct {
+	Name    string  `json:"name"`
+	Version Version `json:"version"`
+	Action  string  `json:"action"`
+	Status  string  `json:"status"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// ModSync makes the mods directory match the mods of a save, it is the result of the mod sync job
+type ModSync struct {
+	Save     string        `json:"save"`
+	Snapshot string        `json:"snapshot,omitempty"`
+	Steps    []ModSyncStep `json:"steps"`
+}
+
+// planModSync returns the steps needed to get from the installed mods to the ones of the save
+func planModSync(header SaveHeader, mods *Mods) []ModSyncStep {
+	preflight := compareSaveMods(header, mods)
+	saveVersions := make(map[string]Version)
+	for _, mod := range header.Mods {
+		saveVersions[mod.Name] = mod.Version
+	}
+
+	steps := []ModSyncStep{}
+	for _, diff := range preflight.Missing {
+		step := ModSyncStep{Name: diff.Name, Version: saveVersions[diff.Name], Status: modSyncPending}
+		switch {
+		case !diff.Installed:
+			step.Action = modSyncInstall
+		case builtinMods[diff.Name] || diff.InstalledVersion == diff.SaveVersion:
+			step.Action = modSyncEnable
+		default:
+			step.Action = modSyncReplace
+		}
+		steps = append(steps, step)
+	}
+	for _, diff := range preflight.VersionMismatch {
+		steps = append(steps, ModSyncStep{Name: diff.Name, Version: saveVersions[diff.Name], Action: modSyncReplace, Status: modSyncPending})
+	}
+	for _, diff := range preflight.Extra {
+		steps = append(steps, ModSyncStep{Name: diff.Name, Action: modSyncDisable, Status: modSyncPending})
+	}
+
+	// versions not allowed by the pins are reported as failed right away
+	for index, step := range steps {
+		if (step.Action == modSyncInstall || step.Action == modSyncReplace) && !mods.ModPinList.allows(step.Name, step.Version) {
+			pin, _ := mods.ModPinList.find(step.Name)
+			steps[index].Status = modSyncFailed
+			steps[index].Error = fmt.Sprintf("version %d.%d.%d is not allowed by the pin %s", step.Version[0], step.Version[1], step.Version[2], pin.Version)
+		}
+	}
+
+	return steps
+}
+
+// startModSync runs the sync of the mods to the save as background job.
+// The sync is planned, once the job holds the mods dir lock, so no other job can change the mods in between.
+func startModSync(saveName string, snapshot string) (Job, error) {
+	header, err := readSaveHeader(filepath.Join(config.FactorioSavesDir, filepath.Base(saveName)))
+	if err != nil {
+		return Job{}, err
+	}
+
+	return jobs.submit("mod-sync", fmt.Sprintf("Sync mods to save %s", saveName), withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		mods, err := newMods(config.FactorioModsDir)
+		if err != nil {
+			return nil, err
+		}
+
+		modSync := &ModSync{
+			Save:     saveName,
+			Snapshot: snapshot,
+			Steps:    planModSync(header, &mods),
+		}
+		return modSync.run(jc, &mods)
+	}))
+}
+
+// setStep updates the state of a step and publishes the progress of the sync
+func (modSync *ModSync) setStep(jc *JobContext, index int, status string, err error) {
+	modSync.Steps[index].Status = status
+	if err != nil {
+		modSync.Steps[index].Error = err.Error()
+	}
+
+	finished := 0
+	for _, step := range modSync.Steps {
+		if step.Status == modSyncDone || step.Status == modSyncFailed {
+			finished++
+		}
+	}
+	jc.SetProgress(float64(finished) * 100 / float64(len(modSync.Steps)))
+	jc.SetResult(modSync.copy())
+}
+
+// copy returns a copy, which isn't changed by the running sync
+func (modSync *ModSync) copy() ModSync {
+	result := *modSync
+	result.Steps = append([]ModSyncStep(nil), modSync.Steps...)
+	return result
+}
+
+func (modSync *ModSync) run(jc *JobContext, mods *Mods) (ModSync, error) {
+	jc.SetResult(modSync.copy())
+
+	if modSync.Snapshot != "" {
+		jc.Logf("creating snapshot %s of the installed mods", modSync.Snapshot)
+		modPackMap, err := newModPackMap()
+		if err == nil {
+			err = modPackMap.createModPack(modSync.Snapshot)
+		}
+		if err != nil {
+			log.Printf("error creating snapshot of the mods before syncing them to %s: %s", modSync.Save, err)
+			return modSync.copy(), fmt.Errorf("snapshot of the mods failed: %v", err)
+		}
+	}
+
+	failed := 0
+	enabled := make(map[string]bool)
+
+	for index, step := range modSync.Steps {
+		if jc.Err() != nil {
+			return modSync.copy(), jc.Err()
+		}
+		if step.Status == modSyncFailed {
+			jc.Logf("skipping %s: %s", step.Name, step.Error)
+			failed++
+			continue
+		}
+		modSync.setStep(jc, index, modSyncRunning, nil)
+
+		var err error
+		switch step.Action {
+		case modSyncInstall, modSyncReplace:
+			jc.Logf("downloading %s %s", step.Name, step.Version)
+			var release ModPortalRelease
+			release, err = findModPortalRelease(step.Name, step.Version)
+			if err == nil {
+				err = mods.downloadMod(jc, release.DownloadURL, release.FileName, step.Name, release.Sha1)
+			}
+		case modSyncEnable:
+			enabled[step.Name] = true
+		case modSyncDisable:
+			enabled[step.Name] = false
+		}
+
+		if err != nil {
+			log.Printf("error syncing mod %s to save %s: %s", step.Name, modSync.Save, err)
+			jc.Logf("syncing %s failed: %s", step.Name, err)
+			failed++
+			modSync.setStep(jc, index, modSyncFailed, err)
+			continue
+		}
+		// enabling and disabling is done at once after all downloads
+		if step.Action == modSyncInstall || step.Action == modSyncReplace {
+			modSync.setStep(jc, index, modSyncDone, nil)
+		}
+	}
+
+	var err error
+	if len(enabled) > 0 {
+		jc.Logf("enabling and disabling %d mods", len(enabled))
+		err = mods.ModSimpleList.setModsEnabled(enabled)
+	}
+	for index, step := range modSync.Steps {
+		if step.Action == modSyncEnable || step.Action == modSyncDisable {
+			if err != nil {
+				modSync.setStep(jc, index, modSyncFailed, err)
+			} else {
+				modSync.setStep(jc, index, modSyncDone, nil)
+			}
+		}
+	}
+
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d mods failed to sync", failed, len(modSync.Steps))
+	}
+	if err != nil {
+		log.Printf("error syncing mods to save %s: %s", modSync.Save, err)
+	}
+	return modSync.copy(), err
+}
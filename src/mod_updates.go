@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModUpdate is an installed mod with a newer release on the mod portal, which is compatible with the server
+type ModUpdate struct {
+	Name             string    `json:"name"`
+	InstalledVersion string    `json:"installed_version"`
+	Version          Version   `json:"version"`
+	FileName         string    `json:"file_name"`
+	DownloadURL      string    `json:"download_url"`
+	Sha1             string    `json:"sha1"`
+	ReleasedAt       time.Time `json:"released_at"`
+}
+
+// ModUpdateError is a mod, whose releases couldn't be checked
+type ModUpdateError struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// ModUpdateCheck is the result of a check for mod updates
+type ModUpdateCheck struct {
+	CheckedAt       time.Time   `json:"checked_at"`
+	FactorioVersion Version     `json:"factorio_version"`
+	Updates         []ModUpdate `json:"updates"`
+	// Pinned are newer releases, which are not installed because of the pin of the mod
+	Pinned []ModUpdate      `json:"pinned"`
+	Failed []ModUpdateError `json:"failed"`
+}
+
+// modUpdates holds the result of the last check and the websocket clients waiting for new ones
+var modUpdates = struct {
+	sync.Mutex
+	check          ModUpdateCheck
+	subscribers    map[int]chan ModUpdateCheck
+	nextSubscriber int
+}{
+	check:       ModUpdateCheck{Updates: []ModUpdate{}, Pinned: []ModUpdate{}, Failed: []ModUpdateError{}},
+	subscribers: make(map[int]chan ModUpdateCheck),
+}
+
+// latestModUpdate returns the newest release, which is newer than the installed mod, can be loaded by the server and is allowed
+func latestModUpdate(modInfo ModInfo, releases []ModPortalRelease, factorioVersion Version, allowed func(Version) bool) (ModUpdate, bool) {
+	var installed Version
+	if err := installed.UnmarshalText([]byte(modInfo.Version)); err != nil {
+		return ModUpdate{}, false
+	}
+
+	var latest *ModPortalRelease
+	for i, release := range releases {
+		if !release.Version.Greater(installed) || !factorioVersionCompatible(factorioVersion, release.InfoJSON.FactorioVersion) || !allowed(release.Version) {
+			continue
+		}
+		if latest == nil || release.Version.Greater(latest.Version) {
+			latest = &releases[i]
+		}
+	}
+	if latest == nil {
+		return ModUpdate{}, false
+	}
+
+	return ModUpdate{
+		Name:             modInfo.Name,
+		InstalledVersion: modInfo.Version,
+		Version:          latest.Version,
+		FileName:         latest.FileName,
+		DownloadURL:      latest.DownloadURL,
+		Sha1:             latest.Sha1,
+		ReleasedAt:       latest.ReleasedAt,
+	}, true
+}
+
+// findModUpdates checks the installed mods for updates, only the given names are checked, if any are given
+func findModUpdates(jc *JobContext, mods *Mods, names []string, lookup modReleaseLookup, factorioVersion Version) (ModUpdateCheck, error) {
+	check := ModUpdateCheck{
+		FactorioVersion: factorioVersion,
+		Updates:         []ModUpdate{},
+		Pinned:          []ModUpdate{},
+		Failed:          []ModUpdateError{},
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	// mods installed in multiple versions are checked against the newest one
+	newest := make(map[string]ModInfo)
+	var order []string
+	for _, modInfo := range mods.ModInfoList.Mods {
+		if builtinMods[modInfo.Name] || (len(selected) > 0 && !selected[modInfo.Name]) {
+			continue
+		}
+
+		current, ok := newest[modInfo.Name]
+		if !ok {
+			order = append(order, modInfo.Name)
+		}
+
+		var version, currentVersion Version
+		version.UnmarshalText([]byte(modInfo.Version))
+		currentVersion.UnmarshalText([]byte(current.Version))
+		if !ok || version.Greater(currentVersion) {
+			newest[modInfo.Name] = modInfo
+		}
+	}
+
+	for index, name := range order {
+		if jc != nil && jc.Err() != nil {
+			return check, jc.Err()
+		}
+
+		releases, err := lookup(name)
+		if err != nil {
+			log.Printf("error checking mod %s for updates: %s", name, err)
+			check.Failed = append(check.Failed, ModUpdateError{Name: name, Error: err.Error()})
+			continue
+		}
+
+		anyVersion := func(Version) bool { return true }
+		update, ok := latestModUpdate(newest[name], releases, factorioVersion, anyVersion)
+		if pin, pinned := mods.ModPinList.find(name); ok && pinned && !pin.allows(update.Version) {
+			check.Pinned = append(check.Pinned, update)
+			update, ok = latestModUpdate(newest[name], releases, factorioVersion, pin.allows)
+		}
+		if ok {
+			check.Updates = append(check.Updates, update)
+		}
+
+		if jc != nil {
+			jc.SetProgress(float64(index+1) * 100 / float64(len(order)))
+		}
+	}
+
+	check.CheckedAt = time.Now()
+	return check, nil
+}
+
+// checkModUpdates checks all installed mods for updates and publishes the result, it is run as job
+func checkModUpdates(jc *JobContext) (ModUpdateCheck, error) {
+	mods, err := newMods(config.FactorioModsDir)
+	if err != nil {
+		return ModUpdateCheck{}, err
+	}
+
+	jc.Logf("checking %d mods for updates", len(mods.ModInfoList.Mods))
+	check, err := findModUpdates(jc, &mods, nil, modPortalReleases, FactorioServ.Version)
+	if err != nil {
+		return check, err
+	}
+	jc.Logf("found %d updates", len(check.Updates))
+
+	modUpdates.Lock()
+	defer modUpdates.Unlock()
+
+	modUpdates.check = check
+	for _, subscriber := range modUpdates.subscribers {
+		// never block on slow subscribers, they can always ask for the last check
+		select {
+		case subscriber <- check:
+		default:
+		}
+	}
+
+	return check, nil
+}
+
+// lastModUpdateCheck returns the result of the last check for updates
+func lastModUpdateCheck() ModUpdateCheck {
+	modUpdates.Lock()
+	defer modUpdates.Unlock()
+
+	return modUpdates.check
+}
+
+// subscribeModUpdates returns a channel receiving the result of every following check and a function to cancel the subscription
+func subscribeModUpdates() (<-chan ModUpdateCheck, func()) {
+	modUpdates.Lock()
+	defer modUpdates.Unlock()
+
+	id := modUpdates.nextSubscriber
+	modUpdates.nextSubscriber++
+
+	ch := make(chan ModUpdateCheck, 4)
+	modUpdates.subscribers[id] = ch
+
+	return ch, func() {
+		modUpdates.Lock()
+		defer modUpdates.Unlock()
+
+		if _, ok := modUpdates.subscribers[id]; ok {
+			delete(modUpdates.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// submitModUpdateCheck queues a job checking for mod updates
+func submitModUpdateCheck() (Job, error) {
+	return jobs.submit("mod-update-check", "Check mods for updates", func(jc *JobContext) (interface{}, error) {
+		return checkModUpdates(jc)
+	})
+}
+
+// scheduleModUpdateChecks checks for mod updates in the given interval
+func scheduleModUpdateChecks(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		if _, err := submitModUpdateCheck(); err != nil {
+			log.Printf("error queueing mod update check: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// updateMods installs the newest compatible releases of the mods, all installed mods are updated, if no names are given.
+// The enabled state of the updated mods is kept.
+func updateMods(jc *JobContext, names []string) ([]ModUpdate, error) {
+	mods, err := newMods(config.FactorioModsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	jc.Logf("checking for updates")
+	check, err := findModUpdates(nil, &mods, names, modPortalReleases, FactorioServ.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pinned := range check.Pinned {
+		jc.Logf("%s %s is not installed, it is not allowed by the pin of the mod", pinned.Name, pinned.Version)
+	}
+
+	enabled := make(map[string]bool)
+	var updated []ModUpdate
+	var failed []string
+	for _, problem := range check.Failed {
+		failed = append(failed, fmt.Sprintf("%s: %s", problem.Name, problem.Error))
+	}
+
+	for index, update := range check.Updates {
+		if jc.Err() != nil {
+			return updated, jc.Err()
+		}
+
+		jc.Logf("updating %s from %s to %s", update.Name, update.InstalledVersion, update.Version)
+		enabled[update.Name] = isModEnabled(&mods, update.Name)
+
+		err = mods.downloadMod(jc, update.DownloadURL, update.FileName, update.Name, update.Sha1)
+		if err != nil {
+			log.Printf("error updating mod %s: %s", update.Name, err)
+			jc.Logf("updating %s failed: %s", update.Name, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", update.Name, err))
+		} else {
+			updated = append(updated, update)
+		}
+
+		jc.SetProgress(float64(index+1) * 100 / float64(len(check.Updates)+1))
+	}
+
+	if len(enabled) > 0 {
+		err = mods.ModSimpleList.setModsEnabled(enabled)
+		if err != nil {
+			return updated, err
+		}
+	}
+
+	removeModUpdates(updated)
+
+	if len(failed) > 0 {
+		return updated, fmt.Errorf("%d mods failed to update: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return updated, nil
+}
+
+// removeModUpdates drops the installed updates from the result of the last check
+func removeModUpdates(installed []ModUpdate) {
+	modUpdates.Lock()
+	defer modUpdates.Unlock()
+
+	done := make(map[string]bool)
+	for _, update := range installed {
+		done[update.Name] = true
+	}
+
+	remaining := []ModUpdate{}
+	for _, update := range modUpdates.check.Updates {
+		if !done[update.Name] {
+			remaining = append(remaining, update)
+		}
+	}
+	modUpdates.check.Updates = remaining
+}
@@ -5,10 +5,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -89,39 +89,21 @@ func (credentials *FactorioCredentials) del() error {
 func factorioLogin(username string, password string) (string, error, int) {
 	var err error
 
-	resp, err := http.PostForm("https://auth.factorio.com/api-login",
-		url.Values{"require_game_ownership": {"true"}, "username": {username}, "password": {password}})
-
-	if err != nil {
-		log.Printf("error on logging in: %s", err)
-		return "", err, resp.StatusCode
-	}
-
-	defer resp.Body.Close()
-
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	source, err := newModSource()
 	if err != nil {
-		log.Printf("error on reading resp.Body: %s", err)
-		return "", err, http.StatusInternalServerError
-	}
-
-	bodyString := string(bodyBytes)
-
-	if resp.StatusCode != http.StatusOK {
-		log.Println("error Statuscode not 200")
-		return bodyString, errors.New(bodyString), resp.StatusCode
+		log.Printf("error on getting the mod source: %s", err)
+		return err.Error(), err, http.StatusInternalServerError
 	}
 
-	var successResponse []string
-	err = json.Unmarshal(bodyBytes, &successResponse)
+	userKey, err, statusCode := source.Login(username, password)
 	if err != nil {
-		log.Printf("error on unmarshal body: %s", err)
-		return err.Error(), err, http.StatusInternalServerError
+		log.Printf("error on logging in: %s", err)
+		return err.Error(), err, statusCode
 	}
 
 	credentials := FactorioCredentials{
 		Username: username,
-		Userkey:  successResponse[0],
+		Userkey:  userKey,
 	}
 
 	err = credentials.save()
@@ -135,52 +117,58 @@ func factorioLogin(username string, password string) (string, error, int) {
 
 //Search inside the factorio mod portal
 func searchModPortal(keyword string) (string, error, int) {
-	req, err := http.NewRequest(http.MethodGet, "https://mods.factorio.com/api/mods", nil)
+	source, err := newModSource()
 	if err != nil {
 		return "error", err, 500
 	}
 
-	query := req.URL.Query()
-	query.Add("q", keyword)
-	req.URL.RawQuery = query.Encode()
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "error", err, 500
-	}
+	return source.Search(keyword)
+}
 
-	text, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+func getModDetails(modId string) (string, error, int) {
+	source, err := newModSource()
 	if err != nil {
-		return "error", err, 500
+		return "error", err, http.StatusInternalServerError
 	}
 
-	textString := string(text)
-
-	return textString, nil, resp.StatusCode
+	return source.Details(modId)
 }
 
-func getModDetails(modId string) (string, error, int) {
-	var err error
-	newLink := "https://mods.factorio.com/api/mods/" + modId
-	resp, err := http.Get(newLink)
+// getModPortalDetails fetches the details of the mod including all its releases
+func getModPortalDetails(modId string) (ModPortalStruct, error) {
+	var details ModPortalStruct
 
+	text, err, statusCode := getModDetails(modId)
 	if err != nil {
-		return "error", err, http.StatusInternalServerError
+		return details, err
+	}
+	if statusCode != http.StatusOK {
+		return details, fmt.Errorf("mod portal returned status %d for mod %s", statusCode, modId)
 	}
 
-	//get the response-text
-	text, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	err = json.Unmarshal([]byte(text), &details)
+	if err != nil {
+		log.Printf("error reading modPortalDetails: %s", err)
+		return details, err
+	}
 
-	textString := string(text)
+	return details, nil
+}
 
+// findModPortalRelease returns the release of the mod with exactly the given version
+func findModPortalRelease(modId string, version Version) (ModPortalRelease, error) {
+	details, err := getModPortalDetails(modId)
 	if err != nil {
-		log.Fatal(err)
-		return "error", err, resp.StatusCode
+		return ModPortalRelease{}, err
+	}
+
+	for _, release := range details.Releases {
+		if release.Version.Equals(version) {
+			return release, nil
+		}
 	}
 
-	return textString, nil, resp.StatusCode
+	return ModPortalRelease{}, fmt.Errorf("mod %s has no release %s on the mod portal", modId, version)
 }
 
 func deleteAllMods() error {
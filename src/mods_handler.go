@@ -2,36 +2,43 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/mroote/factorio-server-manager/lockfile"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type ModPortalStruct struct {
-	DownloadsCount int    `json:"downloads_count"`
-	Name           string `json:"name"`
-	Owner          string `json:"owner"`
-	Releases       []struct {
-		DownloadURL string `json:"download_url"`
-		FileName    string `json:"file_name"`
-		InfoJSON    struct {
-			FactorioVersion string `json:"factorio_version"`
-		} `json:"info_json"`
-		ReleasedAt time.Time `json:"released_at"`
-		Sha1       string    `json:"sha1"`
-		Version    Version   `json:"version"`
-	} `json:"releases"`
-	Summary string `json:"summary"`
-	Title   string `json:"title"`
+	DownloadsCount int                `json:"downloads_count"`
+	Name           string             `json:"name"`
+	Owner          string             `json:"owner"`
+	Releases       []ModPortalRelease `json:"releases"`
+	Summary        string             `json:"summary"`
+	Title          string             `json:"title"`
+}
+
+type ModPortalRelease struct {
+	DownloadURL string `json:"download_url"`
+	FileName    string `json:"file_name"`
+	InfoJSON    struct {
+		FactorioVersion string   `json:"factorio_version"`
+		Dependencies    []string `json:"dependencies"`
+	} `json:"info_json"`
+	ReleasedAt time.Time `json:"released_at"`
+	Sha1       string    `json:"sha1"`
+	Version    Version   `json:"version"`
 }
 
 // Returns JSON response of all mods installed in factorio/mods
@@ -105,6 +112,11 @@ func LoginstatusFactorioModPortal(w http.ResponseWriter, r *http.Request) {
 	var credentials FactorioCredentials
 	resp.Data, err = credentials.load()
 
+	// mirrors without login are always usable
+	if source, sourceErr := newModSource(); sourceErr == nil && !source.RequiresLogin() {
+		resp.Data, err = true, nil
+	}
+
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		resp.Data = fmt.Sprintf("Error getting the factorio credentials: %s", err)
@@ -225,9 +237,21 @@ func ModPortalInstallHandler(w http.ResponseWriter, r *http.Request) {
 	filename := r.FormValue("filename")
 	modName := r.FormValue("modName")
 
+	job, ok := submitJob(w, r, "mod-install", fmt.Sprintf("Install mod %s", modName), withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		mods, err := newMods(config.FactorioModsDir)
+		if err != nil {
+			return nil, err
+		}
+		jc.Logf("downloading %s", filename)
+		return nil, mods.downloadMod(jc, downloadUrl, filename, modName, "")
+	}))
+	if !ok {
+		return
+	}
+
 	mods, err := newMods(config.FactorioModsDir)
-	if err == nil {
-		err = mods.downloadMod(downloadUrl, filename, modName)
+	if err == nil && job.Status != jobDone {
+		err = errors.New(job.Error)
 	}
 
 	if err != nil {
@@ -274,68 +298,198 @@ func ModPortalInstallMultipleHandler(w http.ResponseWriter, r *http.Request) {
 					if err := json.NewEncoder(w).Encode(resp); err != nil {
 						log.Printf("Error in searchModPortal: %s", err)
 					}
+					return
 				}
 				versionsList = append(versionsList, v)
 			}
 		}
 	}
 
+	if len(versionsList) != len(modsList) {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = "Error installing mods: a version is required for every mod"
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModPortalInstallMultipleHandler: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "mod-install", fmt.Sprintf("Install %d mods", len(modsList)), withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		mods, err := newMods(config.FactorioModsDir)
+		if err != nil {
+			log.Printf("error creating mods: %s", err)
+			return nil, err
+		}
+
+		var failed []string
+		for modIndex, mod := range modsList {
+			if jc.Err() != nil {
+				return nil, jc.Err()
+			}
+			jc.Logf("installing %s %s", mod, versionsList[modIndex])
+
+			release, err := findModPortalRelease(mod, versionsList[modIndex])
+			if err == nil {
+				err = mods.downloadMod(jc, release.DownloadURL, release.FileName, mod, release.Sha1)
+			}
+			if err != nil {
+				log.Printf("error installing mod %s: %s", mod, err)
+				jc.Logf("installing %s failed: %s", mod, err)
+				failed = append(failed, fmt.Sprintf("%s: %s", mod, err))
+			}
+			jc.SetProgress(float64(modIndex+1) * 100 / float64(len(modsList)))
+		}
+
+		if len(failed) > 0 {
+			return nil, errors.New(strings.Join(failed, "; "))
+		}
+		return nil, nil
+	}))
+	if !ok {
+		return
+	}
+
+	if job.Status != jobDone {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error installing mods: %s", job.Error)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModPortalInstallMultipleHandler: %s", err)
+		}
+		return
+	}
+
 	mods, err := newMods(config.FactorioModsDir)
 	if err != nil {
 		log.Printf("error creating mods: %s", err)
 
 		w.WriteHeader(http.StatusInternalServerError)
-		resp.Data = fmt.Sprintf("Error in searchModPortal: %s", err)
+		resp.Data = fmt.Sprintf("Error listing mods: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error in searchModPortal: %s", err)
+			log.Printf("Error in ModPortalInstallMultipleHandler: %s", err)
 		}
 		return
 	}
 
-	for modIndex, mod := range modsList {
-		var err error
+	resp.Data = mods.listInstalledMods()
 
-		//get details of mod
-		modDetails, err, statusCode := getModDetails(mod)
-		if err != nil {
-			w.WriteHeader(statusCode)
-			resp.Data = fmt.Sprintf("Error in searchModPortal: %s", err)
-			if err := json.NewEncoder(w).Encode(resp); err != nil {
-				log.Printf("Error in searchModPortal: %s", err)
-			}
-			return
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in ToggleModHandler: %s", err)
+	}
+}
+
+// decodeModInstallRequest reads the requested mods from the JSON body
+func decodeModInstallRequest(r *http.Request) (ModInstallRequest, error) {
+	var request ModInstallRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return request, err
+	}
+	if len(request.Mods) == 0 {
+		return request, errors.New("no mods requested")
+	}
+	for _, mod := range request.Mods {
+		if mod.Name == "" {
+			return request, errors.New("mod name missing")
+		}
+	}
+	return request, nil
+}
+
+// ModInstallPlanHandler returns the mods, which have to be downloaded or enabled
+// to install the requested mods with all their dependencies
+func ModInstallPlanHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	request, err := decodeModInstallRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error in ModInstallPlan: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModInstallPlan: %s", err)
+		}
+		return
+	}
+
+	mods, err := newMods(config.FactorioModsDir)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error in ModInstallPlan: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModInstallPlan: %s", err)
 		}
+		return
+	}
+
+	resp.Data = resolveModInstall(request.Mods, &mods, modPortalReleases, FactorioServ.Version)
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in ModInstallPlan: %s", err)
+	}
+}
+
+// ModInstallWithDependenciesHandler installs the requested mods with all their dependencies in one job.
+// Nothing is installed, if the plan has conflicts.
+func ModInstallWithDependenciesHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-		modDetailsArray := []byte(modDetails)
-		var modDetailsStruct ModPortalStruct
+	request, err := decodeModInstallRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error installing mods: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModInstallWithDependencies: %s", err)
+		}
+		return
+	}
 
-		//read mod-data into Struct
-		err = json.Unmarshal(modDetailsArray, &modDetailsStruct)
+	job, ok := submitJob(w, r, "mod-install", fmt.Sprintf("Install %d mods with dependencies", len(request.Mods)), withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		mods, err := newMods(config.FactorioModsDir)
 		if err != nil {
-			log.Printf("error reading modPortalDetails: %s", err)
+			return nil, err
+		}
 
-			w.WriteHeader(http.StatusInternalServerError)
-			resp.Data = fmt.Sprintf("Error in searchModPortal: %s", err)
-			if err := json.NewEncoder(w).Encode(resp); err != nil {
-				log.Printf("Error in searchModPortal: %s", err)
-			}
-			return
+		jc.Logf("resolving dependencies")
+		plan := resolveModInstall(request.Mods, &mods, modPortalReleases, FactorioServ.Version)
+		jc.SetResult(plan)
+
+		return plan, installModPlan(jc, plan, &mods)
+	}))
+	if !ok {
+		return
+	}
+
+	if job.Status != jobDone {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error installing mods: %s", job.Error)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModInstallWithDependencies: %s", err)
 		}
+		return
+	}
 
-		//find correct mod-version
-		for _, release := range modDetailsStruct.Releases {
-			if release.Version.Equals(versionsList[modIndex]) {
-				mods.downloadMod(release.DownloadURL, release.FileName, modDetailsStruct.Name)
-				break
-			}
+	mods, err := newMods(config.FactorioModsDir)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error listing mods: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModInstallWithDependencies: %s", err)
 		}
+		return
 	}
 
 	resp.Data = mods.listInstalledMods()
-
 	resp.Success = true
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error in ToggleModHandler: %s", err)
+		log.Printf("Error in ModInstallWithDependencies: %s", err)
 	}
 }
 
@@ -347,6 +501,12 @@ func ToggleModHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
 	//Get Data out of the request
 	modName := r.FormValue("modName")
 
@@ -379,6 +539,12 @@ func DeleteModHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
 	//Get Data out of the request
 	modName := r.FormValue("modName")
 
@@ -412,6 +578,12 @@ func DeleteAllModsHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
 	//delete mods folder
 	err = deleteAllMods()
 
@@ -447,13 +619,20 @@ func UpdateModHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("--------------------------------------------------------------")
 
+	// a pinned version is refused right away, the job checks again in case the pins changed meanwhile
 	mods, err := newMods(config.FactorioModsDir)
 	if err == nil {
-		err = mods.updateMod(modName, downloadUrl, fileName)
+		err = checkModUpdatePin(&mods, modName, fileName)
 	}
-
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		var conflictErr *PinConflictError
+		if errors.As(err, &conflictErr) {
+			w.WriteHeader(http.StatusConflict)
+		} else if errors.Is(err, ErrModFileVersion) {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		resp.Data = fmt.Sprintf("Error in deleteMod: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			log.Printf("Error in DeleteModHandler: %s", err)
@@ -461,177 +640,635 @@ func UpdateModHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	installedMods := mods.listInstalledMods().ModsResult
-	for _, mod := range installedMods {
-		if mod.Name == modName {
-			resp.Data = mod
-			break
+	job, ok := submitJob(w, r, "mod-update", fmt.Sprintf("Update %s", modName), withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		mods, err := newMods(config.FactorioModsDir)
+		if err != nil {
+			return nil, err
+		}
+		err = checkModUpdatePin(&mods, modName, fileName)
+		if err != nil {
+			return nil, err
 		}
-	}
-	resp.Success = true
-
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error in DeleteModHandler: %s", err)
-	}
-}
-
-func UploadModHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	resp := JSONResponseFileInput{
-		Success: false,
-	}
-
-	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	r.ParseMultipartForm(32 << 20)
+		jc.Logf("downloading %s", fileName)
+		err = mods.updateMod(modName, downloadUrl, fileName)
+		if err != nil {
+			return nil, err
+		}
 
-	mods, err := newMods(config.FactorioModsDir)
-	if err == nil {
-		for fileKey, modFile := range r.MultipartForm.File["mod_file"] {
-			err = mods.uploadMod(modFile)
-			if err != nil {
-				resp.ErrorKeys = append(resp.ErrorKeys, fileKey)
-				resp.Error = "An error occurred during upload or saving, pls check manually, if all went well and delete invalid files. (This program also could be crashed)"
+		// the updated mod is the result, so it can replace the old one in the list
+		for _, mod := range mods.listInstalledMods().ModsResult {
+			if mod.Name == modName {
+				return mod, nil
 			}
 		}
+		return nil, nil
+	}))
+	if !ok {
+		return
 	}
 
-	if err != nil {
-		w.WriteHeader(500)
-		resp.Data = fmt.Sprintf("Error in uploadMod, listing mods wasn't successful: %s", err)
+	if job.Status != jobDone {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error in deleteMod: %s", job.Error)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error in uploadMod, listing mods wasn't successful: %s", err)
+			log.Printf("Error in DeleteModHandler: %s", err)
 		}
 		return
 	}
 
-	resp.Data = mods.listInstalledMods()
+	resp.Data = job.Result
 	resp.Success = true
 
-	if err = json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error in UploadModHandler: %s", err)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in DeleteModHandler: %s", err)
 	}
 }
 
-func DownloadModsHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-
-	zipWriter := zip.NewWriter(w)
-	defer zipWriter.Close()
+// ErrModFileVersion is returned, if the version of a mod update can't be read from its file name
+var ErrModFileVersion = errors.New("the version of the mod can't be read from the file name")
 
-	//iterate over folder and create everything in the zip
-	err = filepath.Walk(config.FactorioModsDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() == false {
-			//Lock the file, that we are want to read
-			err := fileLock.RLock(path)
-			if err != nil {
-				log.Printf("error locking file for reading, something else has locked it")
-				return err
-			}
-			defer fileLock.RUnlock(path)
+// checkModUpdatePin returns a PinConflictError, if the file is a version of the mod, which its pin doesn't allow.
+// Files without a version are refused, as the pin couldn't be checked.
+func checkModUpdatePin(mods *Mods, modName string, fileName string) error {
+	version, ok := modFileVersion(fileName)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrModFileVersion, fileName)
+	}
+	if mods.ModPinList.allows(modName, version) {
+		return nil
+	}
 
-			writer, err := zipWriter.Create(info.Name())
-			if err != nil {
-				log.Printf("error on creating new file inside zip: %s", err)
-				return err
-			}
+	pin, _ := mods.ModPinList.find(modName)
+	return &PinConflictError{Conflicts: []ModPinConflict{{Name: modName, Version: fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2]), Pin: pin.Version}}}
+}
 
-			file, err := os.Open(path)
-			if err != nil {
-				log.Printf("error on opening modfile: %s", err)
-				return err
-			}
-			defer file.Close()
+// ModUpdatesHandler returns the result of the last check for mod updates, refresh=true checks again
+func ModUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
 
-			_, err = io.Copy(writer, file)
-			if err != nil {
-				log.Printf("error on copying file into zip: %s", err)
-				return err
-			}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-			err = file.Close()
-			if err != nil {
-				log.Printf("error closing file: %s", err)
-				return err
-			}
+	refresh, _ := strconv.ParseBool(r.FormValue("refresh"))
+	if !refresh {
+		resp.Data = lastModUpdateCheck()
+		resp.Success = true
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModUpdates: %s", err)
 		}
+		return
+	}
 
-		return nil
+	job, ok := submitJob(w, r, "mod-update-check", "Check mods for updates", func(jc *JobContext) (interface{}, error) {
+		return checkModUpdates(jc)
 	})
-	if err == lockfile.ErrorAlreadyLocked {
-		w.WriteHeader(http.StatusLocked)
+	if !ok {
 		return
 	}
-	if err != nil {
-		log.Printf("error on walking over the mods: %s", err)
+
+	if job.Status != jobDone {
 		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error checking mods for updates: %s", job.Error)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModUpdates: %s", err)
+		}
 		return
 	}
 
-	writerHeader := w.Header()
-	writerHeader.Set("Content-Type", "application/zip;charset=UTF-8")
-	writerHeader.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", "all_installed_mods.zip"))
+	resp.Data = job.Result
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in ModUpdates: %s", err)
+	}
 }
 
-//LoadModsFromSaveHandler returns JSON response with the found mods
-func LoadModsFromSaveHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// InstallModUpdatesHandler updates the mods given as "mod_name" to their newest compatible release.
+// Without names all installed mods are updated.
+func InstallModUpdatesHandler(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	r.ParseForm()
 
-	//Get Data out of the request
-	SaveFile := r.FormValue("saveFile")
+	names := r.PostForm["mod_name"]
+	description := "Update all mods"
+	if len(names) > 0 {
+		description = fmt.Sprintf("Update %s", strings.Join(names, ", "))
+	}
 
-	path := filepath.Join(config.FactorioSavesDir, SaveFile)
-	f, err := OpenArchiveFile(path, "level.dat")
-	if err != nil {
+	job, ok := submitJob(w, r, "mod-update", description, withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		return updateMods(jc, names)
+	}))
+	if !ok {
+		return
+	}
+
+	if job.Status != jobDone {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("cannot open save level file: %v", err)
-		resp.Data = "Error opening save file"
+		resp.Data = fmt.Sprintf("Error updating mods: %s", job.Error)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error in loadModsFromSave: %s", err)
+			log.Printf("Error in InstallModUpdates: %s", err)
 		}
 		return
 	}
-	defer f.Close()
 
-	var header SaveHeader
-	err = header.ReadFrom(f)
+	mods, err := newMods(config.FactorioModsDir)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("cannot read save header: %v", err)
-		resp.Data = "Error reading save file"
+		resp.Data = fmt.Sprintf("Error listing mods: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error in loadModsFromSave: %s", err)
+			log.Printf("Error in InstallModUpdates: %s", err)
 		}
 		return
 	}
 
-	resp.Data = header
+	resp.Data = mods.listInstalledMods()
 	resp.Success = true
-
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error in LoadModsFromSave: %s", err)
+		log.Printf("Error in InstallModUpdates: %s", err)
 	}
 }
 
-func ListModPacksHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// ListModPinsHandler returns the pinned mod versions
+func ListModPinsHandler(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	modPackMap, err := newModPackMap()
-
+	pins, err := newModPinList(config.FactorioModsDir)
 	if err != nil {
-		w.WriteHeader(500)
 		w.WriteHeader(http.StatusInternalServerError)
-		resp.Data = fmt.Sprintf("Error listing modpack files: %s", err)
+		resp.Data = fmt.Sprintf("Error listing mod pins: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ListModPins: %s", err)
+		}
+		return
+	}
+
+	resp.Data = pins.Pins
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in ListModPins: %s", err)
+	}
+}
+
+// SetModPinHandler pins "modName" to "version", which is an exact version or a range like ">= 1.1.0, < 1.2.0"
+func SetModPinHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
+	pin := ModPin{
+		Name:    r.FormValue("modName"),
+		Version: r.FormValue("version"),
+		Reason:  r.FormValue("reason"),
+	}
+
+	pins, err := newModPinList(config.FactorioModsDir)
+	if err == nil {
+		err = pins.setPin(pin)
+	}
+	if err != nil {
+		log.Printf("Error pinning mod %s: %s", pin.Name, err)
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error pinning mod: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in SetModPin: %s", err)
+		}
+		return
+	}
+
+	resp.Data = pins.Pins
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in SetModPin: %s", err)
+	}
+}
+
+// RemoveModPinHandler allows all versions of "modName" again
+func RemoveModPinHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
+	modName := r.FormValue("modName")
+
+	pins, err := newModPinList(config.FactorioModsDir)
+	if err == nil {
+		err = pins.removePin(modName)
+	}
+	if err != nil {
+		log.Printf("Error removing pin of mod %s: %s", modName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error removing mod pin: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in RemoveModPin: %s", err)
+		}
+		return
+	}
+
+	resp.Data = pins.Pins
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in RemoveModPin: %s", err)
+	}
+}
+
+// ListModCacheHandler returns the mod files in the mod cache
+func ListModCacheHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	modCache, err := newModCache(config.FactorioModCacheDir)
+	var entries []ModCacheEntry
+	if err == nil {
+		entries, err = modCache.list()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error listing mod cache: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ListModCache: %s", err)
+		}
+		return
+	}
+
+	resp.Data = entries
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in ListModCache: %s", err)
+	}
+}
+
+// ModCacheGarbageCollectHandler removes the cached mod files, which are neither installed nor part of a modpack
+func ModCacheGarbageCollectHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	job, ok := submitJob(w, r, "mod-cache-gc", "Remove unused mods from the mod cache", withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		modCache, err := newModCache(config.FactorioModCacheDir)
+		if err != nil {
+			return nil, err
+		}
+		dirs, err := modCacheReferences()
+		if err != nil {
+			return nil, err
+		}
+
+		removed, err := modCache.collectGarbage(dirs)
+		for _, entry := range removed {
+			jc.Logf("removed %s", entry.FileName)
+		}
+		return removed, err
+	}))
+	if !ok {
+		return
+	}
+
+	if job.Status != jobDone {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error cleaning mod cache: %s", job.Error)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModCacheGarbageCollect: %s", err)
+		}
+		return
+	}
+
+	resp.Data = job.Result
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in ModCacheGarbageCollect: %s", err)
+	}
+}
+
+// ModSettingsHandler returns the settings stored in the mod-settings.dat and the settings of the installed mods
+func ModSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	mods, err := newMods(config.FactorioModsDir)
+	var modSettings ModSettings
+	if err == nil {
+		modSettings, err = newModSettings(config.FactorioModsDir)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error reading mod settings: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModSettings: %s", err)
+		}
+		return
+	}
+
+	resp.Data = ModSettingsResult{
+		Version:  modSettings.Version,
+		Settings: modSettings.list(loadModSettingPrototypes(&mods)),
+	}
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in ModSettings: %s", err)
+	}
+}
+
+// UpdateModSettingsHandler changes the settings in the mod-settings.dat, a backup is taken before it is written.
+// The body is JSON like {"settings": [{"scope": "startup", "name": "setting", "value": 10}]}.
+func UpdateModSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	var request ModSettingsRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error decoding mod settings: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in UpdateModSettings: %s", err)
+		}
+		return
+	}
+
+	// a server start takes the lock as well, so it can't start until the settings are written
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
+	// the running server writes its settings on exit
+	if state := FactorioServ.State(); state != ServerStopped && state != ServerCrashed {
+		w.WriteHeader(http.StatusConflict)
+		resp.Data = "Mod settings can't be changed while the server is running"
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in UpdateModSettings: %s", err)
+		}
+		return
+	}
+
+	mods, err := newMods(config.FactorioModsDir)
+	var modSettings ModSettings
+	if err == nil {
+		modSettings, err = newModSettings(config.FactorioModsDir)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error reading mod settings: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in UpdateModSettings: %s", err)
+		}
+		return
+	}
+
+	prototypes := loadModSettingPrototypes(&mods)
+	for _, change := range request.Settings {
+		var prototype *ModSettingPrototype
+		if p, ok := prototypes[change.Name]; ok {
+			prototype = &p
+		}
+
+		err = modSettings.set(change, prototype)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			resp.Data = fmt.Sprintf("Error changing mod settings: %s", err)
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				log.Printf("Error in UpdateModSettings: %s", err)
+			}
+			return
+		}
+	}
+
+	err = modSettings.save()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error saving mod settings: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in UpdateModSettings: %s", err)
+		}
+		return
+	}
+
+	resp.Data = ModSettingsResult{
+		Version:  modSettings.Version,
+		Settings: modSettings.list(prototypes),
+	}
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in UpdateModSettings: %s", err)
+	}
+}
+
+func UploadModHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponseFileInput{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	r.ParseMultipartForm(32 << 20)
+
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
+	mods, err := newMods(config.FactorioModsDir)
+	if err == nil {
+		for fileKey, modFile := range r.MultipartForm.File["mod_file"] {
+			err = mods.uploadMod(modFile)
+			if err != nil {
+				resp.ErrorKeys = append(resp.ErrorKeys, fileKey)
+				resp.Error = "An error occurred during upload or saving, pls check manually, if all went well and delete invalid files. (This program also could be crashed)"
+			}
+		}
+	}
+
+	if err != nil {
+		w.WriteHeader(500)
+		resp.Data = fmt.Sprintf("Error in uploadMod, listing mods wasn't successful: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in uploadMod, listing mods wasn't successful: %s", err)
+		}
+		return
+	}
+
+	resp.Data = mods.listInstalledMods()
+	resp.Success = true
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in UploadModHandler: %s", err)
+	}
+}
+
+func DownloadModsHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	zipWriter := zip.NewWriter(w)
+	defer zipWriter.Close()
+
+	//iterate over folder and create everything in the zip
+	err = filepath.Walk(config.FactorioModsDir, func(path string, info os.FileInfo, err error) error {
+		if info.IsDir() == false && !isModSwapFile(info.Name()) {
+			//Lock the file, that we are want to read
+			err := fileLock.RLock(path)
+			if err != nil {
+				log.Printf("error locking file for reading, something else has locked it")
+				return err
+			}
+			defer fileLock.RUnlock(path)
+
+			writer, err := zipWriter.Create(info.Name())
+			if err != nil {
+				log.Printf("error on creating new file inside zip: %s", err)
+				return err
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				log.Printf("error on opening modfile: %s", err)
+				return err
+			}
+			defer file.Close()
+
+			_, err = io.Copy(writer, file)
+			if err != nil {
+				log.Printf("error on copying file into zip: %s", err)
+				return err
+			}
+
+			err = file.Close()
+			if err != nil {
+				log.Printf("error closing file: %s", err)
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err == lockfile.ErrorAlreadyLocked {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	if err != nil {
+		log.Printf("error on walking over the mods: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writerHeader := w.Header()
+	writerHeader.Set("Content-Type", "application/zip;charset=UTF-8")
+	writerHeader.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", "all_installed_mods.zip"))
+}
+
+//LoadModsFromSaveHandler returns JSON response with the found mods
+func LoadModsFromSaveHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	//Get Data out of the request
+	SaveFile := r.FormValue("saveFile")
+
+	path := filepath.Join(config.FactorioSavesDir, SaveFile)
+	header, err := readSaveHeader(path)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("%v", err)
+		resp.Data = "Error reading save file"
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in loadModsFromSave: %s", err)
+		}
+		return
+	}
+
+	resp.Data = header
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in LoadModsFromSave: %s", err)
+	}
+}
+
+// SyncModsToSaveHandler starts a job, which makes the installed mods match the mods of the save.
+// If "snapshot" is set, the current mods are stored as modpack with this name first.
+func SyncModsToSaveHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	saveFile := r.FormValue("saveFile")
+
+	job, err := startModSync(saveFile, r.FormValue("snapshot"))
+	if err != nil {
+		log.Printf("Error syncing mods to save %s: %s", saveFile, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error syncing mods to save: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in SyncModsToSave: %s", err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	resp.Data = job
+	resp.Success = true
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in SyncModsToSave: %s", err)
+	}
+}
+
+func ListModPacksHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	modPackMap, err := newModPackMap()
+
+	if err != nil {
+		w.WriteHeader(500)
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error listing modpack files: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			log.Printf("Error listing modpacks: %s", err)
 		}
@@ -642,282 +1279,837 @@ func ListModPacksHandler(w http.ResponseWriter, r *http.Request) {
 	resp.Success = true
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error listing saves: %s", err)
+		log.Printf("Error listing saves: %s", err)
+	}
+}
+
+func CreateModPackHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	name := r.FormValue("name")
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
+	modPackMap, err := newModPackMap()
+	if err == nil {
+		err = modPackMap.createModPack(name)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error creating modpack file: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error creating modpack: %s", err)
+		}
+		return
+	}
+
+	resp.Data = modPackMap.listInstalledModPacks()
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error creating modpack response: %s", err)
+	}
+}
+
+func DownloadModPackHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	vars := mux.Vars(r)
+	modpack := vars["modpack"]
+
+	modPackMap, err := newModPackMap()
+	if err != nil {
+		log.Printf("error on loading modPacks: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if modPackMap.checkModPackExists(modpack) {
+		zipWriter := zip.NewWriter(w)
+		defer zipWriter.Close()
+
+		//iterate over folder and create everything in the zip
+		err = filepath.Walk(filepath.Join(config.FactorioModPackDir, modpack), func(path string, info os.FileInfo, err error) error {
+			if info.IsDir() == false {
+				writer, err := zipWriter.Create(info.Name())
+				if err != nil {
+					log.Printf("error on creating new file inside zip: %s", err)
+					return err
+				}
+
+				file, err := os.Open(path)
+				if err != nil {
+					log.Printf("error on opening modfile: %s", err)
+					return err
+				}
+				// Close file, when function returns
+				defer func() {
+					err2 := file.Close()
+					if err == nil && err2 != nil {
+						log.Printf("Error closing file: %s", err2)
+						err = err2
+					}
+				}()
+
+				_, err = io.Copy(writer, file)
+				if err != nil {
+					log.Printf("error on copying file into zip: %s", err)
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			log.Printf("error on walking over the modpack: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else {
+		log.Printf("requested modPack doesnt exist")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writerHeader := w.Header()
+	writerHeader.Set("Content-Type", "application/zip;charset=UTF-8")
+	writerHeader.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", modpack+".zip"))
+}
+
+func DeleteModPackHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.FormValue("name")
+
+	modPackMap, err := newModPackMap()
+	if err == nil {
+		err = modPackMap.deleteModPack(name)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error deleting modpack file: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error deleting modpack: %s", err)
+		}
+		return
+	}
+
+	resp.Data = name
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error creating delete modpack response: %s", err)
+	}
+}
+
+func LoadModPackHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.FormValue("name")
+	// with restart a running server is stopped for the load and started again afterwards
+	restart, _ := strconv.ParseBool(r.FormValue("restart"))
+
+	if state := FactorioServ.State(); !restart && state != ServerStopped && state != ServerCrashed {
+		w.WriteHeader(http.StatusConflict)
+		resp.Data = fmt.Sprintf("Error loading modpack file: %s", &ModsInUseError{State: state})
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error loading modpack: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "modpack-load", fmt.Sprintf("Load modpack %s", name), withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		modPackMap, err := newModPackMap()
+		if err != nil {
+			return nil, err
+		}
+		modPack, ok := modPackMap[name]
+		if !ok {
+			return nil, fmt.Errorf("modpack %s not found", name)
+		}
+		err = withServerStopped(jc, restart, func() error {
+			jc.Logf("loading modpack %s", name)
+			return modPack.loadModPack()
+		})
+		var conflictErr *PinConflictError
+		if errors.As(err, &conflictErr) {
+			return conflictErr.Conflicts, err
+		}
+		return nil, err
+	}))
+	if !ok {
+		return
+	}
+
+	mods, err := newMods(config.FactorioModsDir)
+	if err == nil && job.Status != jobDone {
+		err = errors.New(job.Error)
+	}
+
+	if err != nil {
+		if _, conflict := job.Result.([]ModPinConflict); conflict {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		resp.Data = fmt.Sprintf("Error loading modpack file: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error loading modpack: %s", err)
+		}
+		return
+	}
+
+	resp.Data = mods.listInstalledMods()
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error creating loading modpack response: %s", err)
+	}
+}
+
+func ModPackToggleModHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	modName := r.FormValue("modName")
+	modPackName := r.FormValue("modPack")
+
+	modPackMap, err := newModPackMap()
+	if err == nil {
+		err, resp.Data = modPackMap[modPackName].Mods.ModSimpleList.toggleMod(modName)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error loading modpack file: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error loading modpack: %s", err)
+		}
+		return
+	}
+
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error creating loading modpack response: %s", err)
+	}
+}
+
+func ModPackDeleteModHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	modName := r.FormValue("modName")
+	modPackName := r.FormValue("modPackName")
+
+	modPackMap, err := newModPackMap()
+	if err == nil {
+		if modPackMap.checkModPackExists(modPackName) {
+			err = modPackMap[modPackName].Mods.deleteMod(modName)
+		} else {
+			err = errors.New("ModPack " + modPackName + " does not exist")
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error loading modpack file: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error loading modpack: %s", err)
+		}
+		return
+	}
+
+	resp.Data = true
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error creating loading modpack response: %s", err)
+	}
+
+	return
+}
+
+func ModPackUpdateModHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
+	//Get Data out of the request
+	modName := r.FormValue("modName")
+	downloadUrl := r.FormValue("downloadUrl")
+	fileName := r.FormValue("filename")
+	modPackName := r.FormValue("modPackName")
+
+	modPackMap, err := newModPackMap()
+	if err == nil {
+		if modPackMap.checkModPackExists(modPackName) {
+			err = modPackMap[modPackName].Mods.updateMod(modName, downloadUrl, fileName)
+		} else {
+			err = errors.New("ModPack " + modPackName + "does not exist")
+		}
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error in deleteMod: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in DeleteModHandler: %s", err)
+		}
+		return
+	}
+
+	installedMods := modPackMap[modPackName].Mods.listInstalledMods().ModsResult
+	for _, mod := range installedMods {
+		if mod.Name == modName {
+			resp.Data = mod
+			break
+		}
+	}
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in DeleteModHandler: %s", err)
+	}
+}
+
+// ExportModPackHandler returns the manifest of the modpack, with format=bundle the manifest is returned together with the mod files as zip
+func ExportModPackHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	vars := mux.Vars(r)
+	modpack := vars["modpack"]
+	format := r.URL.Query().Get("format")
+
+	status := http.StatusInternalServerError
+	modPackMap, err := newModPackMap()
+	var manifest ModPackManifest
+	if err == nil {
+		if modPack, ok := modPackMap[modpack]; ok {
+			manifest, err = createModPackManifest(modpack, &modPack.Mods)
+		} else {
+			status = http.StatusNotFound
+			err = fmt.Errorf("modpack %s does not exist", modpack)
+		}
+	}
+	if err == nil && format != "" && format != "manifest" && format != "bundle" {
+		status = http.StatusBadRequest
+		err = fmt.Errorf("unknown export format %q, use manifest or bundle", format)
+	}
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(status)
+		resp.Data = fmt.Sprintf("Error exporting modpack: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ExportModPack: %s", err)
+		}
+		return
+	}
+
+	if format == "bundle" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", modpack+".zip"))
+		err = writeModPackBundle(w, filepath.Join(config.FactorioModPackDir, modpack), manifest)
+		if err != nil {
+			log.Printf("Error in ExportModPack: %s", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", modpack+".json"))
+	if err := json.NewEncoder(w).Encode(manifest); err != nil {
+		log.Printf("Error in ExportModPack: %s", err)
+	}
+}
+
+// ImportModPackHandler creates a modpack from the request body, which is a manifest or a bundle zip.
+// The name of the modpack is taken from the manifest, if it isn't given as parameter.
+func ImportModPackHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	name := r.URL.Query().Get("name")
+
+	// the body is kept in a file, so the job can read it after the request is answered
+	upload, err := ioutil.TempFile("", "fsm-modpack-*")
+	if err == nil {
+		_, err = io.Copy(upload, http.MaxBytesReader(w, r.Body, config.MaxUploadSize))
+		upload.Close()
+	}
+	if err != nil {
+		if upload != nil {
+			os.Remove(upload.Name())
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error reading modpack: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ImportModPack: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "modpack-import", "Import modpack", func(jc *JobContext) (interface{}, error) {
+		defer os.Remove(upload.Name())
+		return withModsDirLock(func(jc *JobContext) (interface{}, error) {
+			return importModPackUpload(jc, upload.Name(), name)
+		})(jc)
+	})
+	if !ok {
+		if job.ID == "" {
+			os.Remove(upload.Name())
+		}
+		return
+	}
+
+	modPackMap, err := newModPackMap()
+	if err == nil && job.Status != jobDone {
+		err = errors.New(job.Error)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error importing modpack: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ImportModPack: %s", err)
+		}
+		return
+	}
+
+	resp.Data = modPackMap.listInstalledModPacks()
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in ImportModPack: %s", err)
 	}
 }
 
-func CreateModPackHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// importModPackUpload imports the modpack manifest or bundle stored at uploadPath as modpack name,
+// the name of the manifest is used if name is empty
+func importModPackUpload(jc *JobContext, uploadPath string, name string) (interface{}, error) {
+	modCache, err := newModCache(config.FactorioModCacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(uploadPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest ModPackManifest
+	if bytes.HasPrefix(data, []byte("PK")) {
+		jc.Logf("reading modpack bundle")
+		bundle, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid modpack bundle: %v", err)
+		}
+		manifest, err = readModPackBundle(bundle, &modCache)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		manifest, err = parseModPackManifest(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	modPackName := name
+	if modPackName == "" {
+		modPackName = manifest.Name
+	}
+	jc.Logf("importing %d mods into modpack %s", len(manifest.Mods), modPackName)
+	return modPackName, importModPack(jc, modPackName, manifest, &modCache, modPortalReleases)
+}
+
+// DiffModPacksHandler compares the mods of base and target, which are modpacks, the installed mods or saves
+func DiffModPacksHandler(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
-	name := r.FormValue("name")
-
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	modPackMap, err := newModPackMap()
+	query := r.URL.Query()
+	base, _, err := loadModPackRef(query.Get("base"))
+	var target ModPackManifest
 	if err == nil {
-		err = modPackMap.createModPack(name)
+		target, _, err = loadModPackRef(query.Get("target"))
 	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		resp.Data = fmt.Sprintf("Error creating modpack file: %s", err)
+		resp.Data = fmt.Sprintf("Error comparing modpacks: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error creating modpack: %s", err)
+			log.Printf("Error in DiffModPacks: %s", err)
 		}
 		return
 	}
 
-	resp.Data = modPackMap.listInstalledModPacks()
+	resp.Data = diffModPacks(base, target)
 	resp.Success = true
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error creating modpack response: %s", err)
+		log.Printf("Error in DiffModPacks: %s", err)
 	}
 }
 
-func DownloadModPackHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// MergeModPacksHandler creates a new modpack from the base and the changes of the selected mods in the target
+func MergeModPacksHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
 
-	vars := mux.Vars(r)
-	modpack := vars["modpack"]
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	var request ModPackMergeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err == nil && (request.Name == "" || request.Base == "" || request.Target == "") {
+		err = errors.New("name, base and target are required")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error decoding merge request: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in MergeModPacks: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "modpack-merge", fmt.Sprintf("Merge %s into modpack %s", request.Target, request.Name), withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		return request.Name, mergeModPackRefs(jc, request)
+	}))
+	if !ok {
+		return
+	}
 
 	modPackMap, err := newModPackMap()
+	if err == nil && job.Status != jobDone {
+		err = errors.New(job.Error)
+	}
+
 	if err != nil {
-		log.Printf("error on loading modPacks: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error merging modpacks: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in MergeModPacks: %s", err)
+		}
 		return
 	}
 
-	if modPackMap.checkModPackExists(modpack) {
-		zipWriter := zip.NewWriter(w)
-		defer zipWriter.Close()
+	resp.Data = modPackMap.listInstalledModPacks()
+	resp.Success = true
 
-		//iterate over folder and create everything in the zip
-		err = filepath.Walk(filepath.Join(config.FactorioModPackDir, modpack), func(path string, info os.FileInfo, err error) error {
-			if info.IsDir() == false {
-				writer, err := zipWriter.Create(info.Name())
-				if err != nil {
-					log.Printf("error on creating new file inside zip: %s", err)
-					return err
-				}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in MergeModPacks: %s", err)
+	}
+}
 
-				file, err := os.Open(path)
-				if err != nil {
-					log.Printf("error on opening modfile: %s", err)
-					return err
-				}
-				// Close file, when function returns
-				defer func() {
-					err2 := file.Close()
-					if err == nil && err2 != nil {
-						log.Printf("Error closing file: %s", err2)
-						err = err2
-					}
-				}()
+// CloneModPackHandler copies the modpack "name" to "new_name"
+func CloneModPackHandler(w http.ResponseWriter, r *http.Request) {
+	resp := JSONResponse{
+		Success: false,
+	}
 
-				_, err = io.Copy(writer, file)
-				if err != nil {
-					log.Printf("error on copying file into zip: %s", err)
-					return err
-				}
-			}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-			return nil
-		})
-		if err != nil {
-			log.Printf("error on walking over the modpack: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	// the client went away while waiting for other changes of the mods
+	if err := lockModsDir(r.Context()); err != nil {
+		return
+	}
+	defer unlockModsDir()
+
+	modPackMap, err := newModPackMap()
+	if err == nil {
+		err = modPackMap.cloneModPack(r.FormValue("name"), r.FormValue("new_name"))
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		resp.Data = fmt.Sprintf("Error cloning modpack: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in CloneModPack: %s", err)
 		}
-	} else {
-		log.Printf("requested modPack doesnt exist")
-		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	writerHeader := w.Header()
-	writerHeader.Set("Content-Type", "application/zip;charset=UTF-8")
-	writerHeader.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", modpack+".zip"))
+	resp.Data = modPackMap.listInstalledModPacks()
+	resp.Success = true
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error in CloneModPack: %s", err)
+	}
 }
 
-func DeleteModPackHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// RenameModPackHandler renames the modpack "name" to "new_name"
+func RenameModPackHandler(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	name := r.FormValue("name")
-
 	modPackMap, err := newModPackMap()
 	if err == nil {
-		err = modPackMap.deleteModPack(name)
+		err = modPackMap.renameModPack(r.FormValue("name"), r.FormValue("new_name"))
 	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		resp.Data = fmt.Sprintf("Error deleting modpack file: %s", err)
+		resp.Data = fmt.Sprintf("Error renaming modpack: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error deleting modpack: %s", err)
+			log.Printf("Error in RenameModPack: %s", err)
 		}
 		return
 	}
 
-	resp.Data = name
+	resp.Data = modPackMap.listInstalledModPacks()
 	resp.Success = true
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error creating delete modpack response: %s", err)
+		log.Printf("Error in RenameModPack: %s", err)
 	}
 }
 
-func LoadModPackHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// ModPackInfoHandler sets the description and notes of the modpack
+func ModPackInfoHandler(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	name := r.FormValue("name")
+	info := ModPackInfo{
+		Description: r.FormValue("description"),
+		Notes:       r.FormValue("notes"),
+	}
 
 	modPackMap, err := newModPackMap()
 	if err == nil {
-		modPackMap[name].loadModPack()
+		err = modPackMap.setModPackInfo(r.FormValue("name"), info)
 	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		resp.Data = fmt.Sprintf("Error loading modpack file: %s", err)
+		resp.Data = fmt.Sprintf("Error saving modpack info: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error loading modpack: %s", err)
+			log.Printf("Error in ModPackInfo: %s", err)
 		}
 		return
 	}
 
-	resp.Data = modPackMap[name].Mods.listInstalledMods()
+	resp.Data = modPackMap.listInstalledModPacks()
 	resp.Success = true
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error creating loading modpack response: %s", err)
+		log.Printf("Error in ModPackInfo: %s", err)
 	}
 }
 
-func ModPackToggleModHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// ModPackInstallModsHandler installs mods with their dependencies from the mod source into a modpack,
+// the mods directory is not changed
+func ModPackInstallModsHandler(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	modName := r.FormValue("modName")
-	modPackName := r.FormValue("modPack")
+	var request ModPackInstallRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err == nil && len(request.Mods) == 0 {
+		err = errors.New("no mods requested")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp.Data = fmt.Sprintf("Error installing mods: %s", err)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in ModPackInstallMods: %s", err)
+		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "modpack-mod-install", fmt.Sprintf("Install %d mods into modpack %s", len(request.Mods), request.ModPack), withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		modPackMap, err := newModPackMap()
+		if err != nil {
+			return nil, err
+		}
+		modPack, ok := modPackMap[request.ModPack]
+		if !ok {
+			return nil, fmt.Errorf("modpack %s does not exist", request.ModPack)
+		}
+
+		jc.Logf("resolving dependencies")
+		plan := resolveModInstall(request.Mods, &modPack.Mods, modPortalReleases, FactorioServ.Version)
+		jc.SetResult(plan)
+
+		return plan, installModPlan(jc, plan, &modPack.Mods)
+	}))
+	if !ok {
+		return
+	}
 
 	modPackMap, err := newModPackMap()
-	if err == nil {
-		err, resp.Data = modPackMap[modPackName].Mods.ModSimpleList.toggleMod(modName)
+	if err == nil && job.Status != jobDone {
+		err = errors.New(job.Error)
 	}
+
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		resp.Data = fmt.Sprintf("Error loading modpack file: %s", err)
+		resp.Data = fmt.Sprintf("Error installing mods: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error loading modpack: %s", err)
+			log.Printf("Error in ModPackInstallMods: %s", err)
 		}
 		return
 	}
 
+	resp.Data = modPackMap.listInstalledModPacks()
 	resp.Success = true
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error creating loading modpack response: %s", err)
+		log.Printf("Error in ModPackInstallMods: %s", err)
 	}
 }
 
-func ModPackDeleteModHandler(w http.ResponseWriter, r *http.Request) {
+// ModPackUploadModHandler adds the uploaded mod files to the modpack
+func ModPackUploadModHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
-	resp := JSONResponse{
+	resp := JSONResponseFileInput{
 		Success: false,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	modName := r.FormValue("modName")
-	modPackName := r.FormValue("modPackName")
+	r.ParseMultipartForm(32 << 20)
+	modPackName := r.FormValue("modPack")
 
 	modPackMap, err := newModPackMap()
+	if err == nil && !modPackMap.checkModPackExists(modPackName) {
+		err = fmt.Errorf("modpack %s does not exist", modPackName)
+	}
+	if err == nil && r.MultipartForm == nil {
+		err = errors.New("no mod files uploaded")
+	}
 	if err == nil {
-		if modPackMap.checkModPackExists(modPackName) {
-			err = modPackMap[modPackName].Mods.deleteMod(modName)
-		} else {
-			err = errors.New("ModPack " + modPackName + " does not exist")
+		mods := &modPackMap[modPackName].Mods
+		for fileKey, modFile := range r.MultipartForm.File["mod_file"] {
+			if err := mods.uploadMod(modFile); err != nil {
+				log.Printf("error uploading %s into modpack %s: %s", modFile.Filename, modPackName, err)
+				resp.ErrorKeys = append(resp.ErrorKeys, fileKey)
+				resp.Error = "An error occurred during upload or saving, pls check manually, if all went well and delete invalid files."
+			}
 		}
 	}
+
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		resp.Data = fmt.Sprintf("Error loading modpack file: %s", err)
+		resp.Data = fmt.Sprintf("Error uploading mods into modpack: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error loading modpack: %s", err)
+			log.Printf("Error in ModPackUploadMod: %s", err)
 		}
 		return
 	}
 
-	resp.Data = true
+	resp.Data = modPackMap[modPackName].Mods.listInstalledMods()
 	resp.Success = true
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error creating loading modpack response: %s", err)
+		log.Printf("Error in ModPackUploadMod: %s", err)
 	}
-
-	return
 }
 
-func ModPackUpdateModHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// RollbackModsHandler replaces the mods with the ones replaced by the last modpack load.
+// The rolled back mods become the previous mods, so the rollback can be undone the same way.
+func RollbackModsHandler(w http.ResponseWriter, r *http.Request) {
 	resp := JSONResponse{
 		Success: false,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 
-	//Get Data out of the request
-	modName := r.FormValue("modName")
-	downloadUrl := r.FormValue("downloadUrl")
-	fileName := r.FormValue("filename")
-	modPackName := r.FormValue("modPackName")
+	// with restart a running server is stopped for the rollback and started again afterwards
+	restart, _ := strconv.ParseBool(r.FormValue("restart"))
 
-	modPackMap, err := newModPackMap()
-	if err == nil {
-		if modPackMap.checkModPackExists(modPackName) {
-			err = modPackMap[modPackName].Mods.updateMod(modName, downloadUrl, fileName)
-		} else {
-			err = errors.New("ModPack " + modPackName + "does not exist")
+	if state := FactorioServ.State(); !restart && state != ServerStopped && state != ServerCrashed {
+		w.WriteHeader(http.StatusConflict)
+		resp.Data = fmt.Sprintf("Error rolling back mods: %s", &ModsInUseError{State: state})
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Error in RollbackMods: %s", err)
 		}
+		return
+	}
+
+	job, ok := submitJob(w, r, "mods-rollback", "Roll back to the previous mods", withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		return nil, withServerStopped(jc, restart, func() error {
+			jc.Logf("rolling back to the previous mods")
+			return rollbackMods()
+		})
+	}))
+	if !ok {
+		return
+	}
+
+	mods, err := newMods(config.FactorioModsDir)
+	if err == nil && job.Status != jobDone {
+		err = errors.New(job.Error)
 	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		resp.Data = fmt.Sprintf("Error in deleteMod: %s", err)
+		resp.Data = fmt.Sprintf("Error rolling back mods: %s", err)
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("Error in DeleteModHandler: %s", err)
+			log.Printf("Error in RollbackMods: %s", err)
 		}
 		return
 	}
 
-	installedMods := modPackMap[modPackName].Mods.listInstalledMods().ModsResult
-	for _, mod := range installedMods {
-		if mod.Name == modName {
-			resp.Data = mod
-			break
-		}
-	}
+	resp.Data = mods.listInstalledMods()
 	resp.Success = true
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error in DeleteModHandler: %s", err)
+		log.Printf("Error in RollbackMods: %s", err)
 	}
 }
@@ -0,0 +1,949 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseModDependency(t *testing.T) {
+	dependencies := map[string]ModDependency{
+		"base >= 1.1":               {Kind: modDependencyRequired, Name: "base", Op: ">=", Version: Version{1, 1}},
+		"? Bottleneck":              {Kind: modDependencyOptional, Name: "Bottleneck"},
+		"(?) Factorio Library":      {Kind: modDependencyHiddenOptional, Name: "Factorio Library"},
+		"! bobplates":               {Kind: modDependencyIncompatible, Name: "bobplates"},
+		"~ flib=0.12.4":             {Kind: modDependencyNoLoadOrder, Name: "flib", Op: "=", Version: Version{0, 12, 4}},
+		"?stdlib < 1.4.0":           {Kind: modDependencyOptional, Name: "stdlib", Op: "<", Version: Version{1, 4}},
+		"  Rampant Arsenal <= 1.0 ": {Kind: modDependencyRequired, Name: "Rampant Arsenal", Op: "<=", Version: Version{1, 0}},
+	}
+
+	for text, expected := range dependencies {
+		dep, err := parseModDependency(text)
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", text, err)
+		} else if dep != expected {
+			t.Errorf("Dependency %q not equal: %+v --- %+v", text, dep, expected)
+		}
+	}
+
+	for _, text := range []string{"", "? ", "flib >> 1.0", "! bobplates >= 1.0", "flib = 1"} {
+		if dep, err := parseModDependency(text); err == nil {
+			t.Errorf("Expected error parsing %q, got: %+v", text, dep)
+		}
+	}
+}
+
+func TestResolveModInstall(t *testing.T) {
+	release := func(version Version, factorioVersion string, dependencies ...string) ModPortalRelease {
+		var r ModPortalRelease
+		r.Version = version
+		r.FileName = fmt.Sprintf("mod_%d.%d.%d.zip", version[0], version[1], version[2])
+		r.InfoJSON.FactorioVersion = factorioVersion
+		r.InfoJSON.Dependencies = dependencies
+		return r
+	}
+	portal := map[string][]ModPortalRelease{
+		"LTN": {
+			release(Version{1, 16, 0}, "1.1", "base >= 1.1", "flib >= 0.6.0", "? Bottleneck", "! Warehousing"),
+			release(Version{2, 0, 0}, "2.0", "base >= 2.0", "flib >= 0.15.0"),
+		},
+		"flib": {
+			release(Version{0, 5, 0}, "1.1", "base >= 1.1"),
+			release(Version{0, 6, 2}, "1.1", "base >= 1.1"),
+			release(Version{0, 7, 0}, "1.1", "base >= 1.1"),
+		},
+		"Bottleneck": {
+			release(Version{0, 11, 0}, "1.1"),
+		},
+		"Old": {
+			release(Version{1, 0, 0}, "0.17"),
+		},
+	}
+	lookup := func(name string) ([]ModPortalRelease, error) {
+		releases, ok := portal[name]
+		if !ok {
+			return nil, fmt.Errorf("mod %s not found", name)
+		}
+		return releases, nil
+	}
+
+	mods := Mods{
+		ModSimpleList: ModSimpleList{Mods: []ModSimple{
+			{Name: "base", Enabled: true},
+			{Name: "flib", Enabled: false},
+			{Name: "Warehousing", Enabled: true},
+		}},
+		ModInfoList: ModInfoList{Mods: []ModInfo{
+			{Name: "flib", Version: "0.5.0"},
+			{Name: "Warehousing", Version: "0.5.0"},
+		}},
+	}
+
+	plan := resolveModInstall([]ModRequest{{Name: "LTN"}}, &mods, lookup, Version{1, 1, 110})
+
+	if len(plan.Install) != 2 || plan.Install[0].Name != "LTN" || !plan.Install[0].Version.Equals(Version{1, 16, 0}) ||
+		plan.Install[1].Name != "flib" || !plan.Install[1].Version.Equals(Version{0, 7, 0}) {
+		t.Errorf("Unexpected mods to install: %+v", plan.Install)
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0].Name != "LTN" {
+		t.Errorf("Expected LTN to conflict with the enabled Warehousing: %+v", plan.Conflicts)
+	}
+
+	// the installed version is used, if it matches
+	plan = resolveModInstall([]ModRequest{{Name: "flib", Version: &Version{0, 5, 0}}}, &mods, lookup, Version{1, 1, 110})
+	if len(plan.Install) != 0 || len(plan.Enable) != 1 || plan.Enable[0].Name != "flib" || len(plan.Conflicts) != 0 {
+		t.Errorf("Expected only to enable the installed flib: %+v", plan)
+	}
+
+	plan = resolveModInstall([]ModRequest{{Name: "Old"}, {Name: "Missing"}}, &mods, lookup, Version{1, 1, 110})
+	if len(plan.Install) != 0 || len(plan.Conflicts) != 2 {
+		t.Errorf("Expected conflicts for incompatible and missing mods: %+v", plan)
+	}
+}
+
+func TestFindModUpdates(t *testing.T) {
+	release := func(version Version, factorioVersion string) ModPortalRelease {
+		var r ModPortalRelease
+		r.Version = version
+		r.InfoJSON.FactorioVersion = factorioVersion
+		return r
+	}
+	portal := map[string][]ModPortalRelease{
+		"flib":        {release(Version{0, 6, 0}, "1.1"), release(Version{0, 7, 0}, "1.1"), release(Version{0, 15, 0}, "2.0")},
+		"Warehousing": {release(Version{0, 5, 0}, "1.1")},
+	}
+	lookup := func(name string) ([]ModPortalRelease, error) {
+		releases, ok := portal[name]
+		if !ok {
+			return nil, fmt.Errorf("mod %s not found", name)
+		}
+		return releases, nil
+	}
+
+	mods := Mods{ModInfoList: ModInfoList{Mods: []ModInfo{
+		{Name: "base", Version: "1.1.110"},
+		{Name: "flib", Version: "0.5.0"},
+		{Name: "flib", Version: "0.6.0"},
+		{Name: "Warehousing", Version: "0.5.0"},
+		{Name: "Private", Version: "1.0.0"},
+	}}}
+
+	check, err := findModUpdates(nil, &mods, nil, lookup, Version{1, 1, 110})
+	if err != nil {
+		t.Fatalf("Error checking for updates: %s", err)
+	}
+	if len(check.Updates) != 1 || check.Updates[0].Name != "flib" || check.Updates[0].InstalledVersion != "0.6.0" || !check.Updates[0].Version.Equals(Version{0, 7, 0}) {
+		t.Errorf("Unexpected updates: %+v", check.Updates)
+	}
+	if len(check.Failed) != 1 || check.Failed[0].Name != "Private" {
+		t.Errorf("Unexpected failed checks: %+v", check.Failed)
+	}
+
+	check, err = findModUpdates(nil, &mods, []string{"Warehousing"}, lookup, Version{1, 1, 110})
+	if err != nil || len(check.Updates) != 0 || len(check.Failed) != 0 {
+		t.Errorf("Unexpected result checking only Warehousing: %+v, %v", check, err)
+	}
+}
+
+func TestModPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-pins")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pins, err := newModPinList(dir)
+	if err != nil {
+		t.Fatalf("Error reading missing pins: %s", err)
+	}
+	if err := pins.setPin(ModPin{Name: "flib", Version: "latest"}); err == nil {
+		t.Errorf("Expected error on invalid pin")
+	}
+	if err := pins.setPin(ModPin{Name: "flib", Version: ">= 0.6.0, < 0.7"}); err != nil {
+		t.Fatalf("Error pinning mod: %s", err)
+	}
+
+	pins, err = newModPinList(dir)
+	if err != nil {
+		t.Fatalf("Error reading pins: %s", err)
+	}
+	for version, allowed := range map[Version]bool{{0, 5, 0}: false, {0, 6, 0}: true, {0, 6, 9}: true, {0, 7, 0}: false} {
+		if pins.allows("flib", version) != allowed {
+			t.Errorf("Pin allows %s not equal: %v --- %v", version, !allowed, allowed)
+		}
+	}
+	if !pins.allows("Warehousing", Version{9, 9, 9}) {
+		t.Errorf("Mod without pin not allowed")
+	}
+
+	release := func(version Version) ModPortalRelease {
+		var r ModPortalRelease
+		r.Version = version
+		r.InfoJSON.FactorioVersion = "1.1"
+		return r
+	}
+	lookup := func(name string) ([]ModPortalRelease, error) {
+		return []ModPortalRelease{release(Version{0, 6, 2}), release(Version{0, 7, 0})}, nil
+	}
+	mods := Mods{
+		ModInfoList: ModInfoList{Mods: []ModInfo{{Name: "flib", Version: "0.6.0"}}},
+		ModPinList:  pins,
+	}
+
+	check, err := findModUpdates(nil, &mods, nil, lookup, Version{1, 1, 110})
+	if err != nil {
+		t.Fatalf("Error checking for updates: %s", err)
+	}
+	if len(check.Updates) != 1 || !check.Updates[0].Version.Equals(Version{0, 6, 2}) {
+		t.Errorf("Unexpected updates of pinned mod: %+v", check.Updates)
+	}
+	if len(check.Pinned) != 1 || !check.Pinned[0].Version.Equals(Version{0, 7, 0}) {
+		t.Errorf("Unexpected pinned updates: %+v", check.Pinned)
+	}
+
+	plan := resolveModInstall([]ModRequest{{Name: "flib", Version: &Version{0, 7, 0}}}, &mods, lookup, Version{1, 1, 110})
+	if len(plan.Install) != 0 || len(plan.Conflicts) != 1 {
+		t.Errorf("Expected conflict installing a version not allowed by the pin: %+v", plan)
+	}
+
+	var conflictErr *PinConflictError
+	if err := checkModUpdatePin(&mods, "flib", "flib_0.6.2.zip"); err != nil {
+		t.Errorf("Error checking update allowed by the pin: %s", err)
+	}
+	if err := checkModUpdatePin(&mods, "flib", "flib_0.7.0.zip"); !errors.As(err, &conflictErr) {
+		t.Errorf("Expected PinConflictError updating to a version not allowed by the pin, got: %v", err)
+	}
+	if err := checkModUpdatePin(&mods, "flib", "flib.zip"); !errors.Is(err, ErrModFileVersion) {
+		t.Errorf("Expected ErrModFileVersion updating to a file without version, got: %v", err)
+	}
+}
+
+// withModDirs points the mods, modpack and mod cache dirs into a new temp dir and sets a factorio 1.1 server.
+// The returned func restores the config and the server and removes the temp dir.
+func withModDirs(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "fsm-mods")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+
+	modsDir, modPackDir, cacheDir := config.FactorioModsDir, config.FactorioModPackDir, config.FactorioModCacheDir
+	server := FactorioServ
+	config.FactorioModsDir = filepath.Join(dir, "mods")
+	config.FactorioModPackDir = filepath.Join(dir, "packs")
+	config.FactorioModCacheDir = filepath.Join(dir, "cache")
+	FactorioServ = &FactorioServer{Version: Version{1, 1, 110}}
+
+	return dir, func() {
+		config.FactorioModsDir, config.FactorioModPackDir, config.FactorioModCacheDir = modsDir, modPackDir, cacheDir
+		FactorioServ = server
+		os.RemoveAll(dir)
+	}
+}
+
+// flibModFile returns the zip of flib 0.7.0, which only contains its info.json
+func flibModFile() []byte {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	info, _ := zipWriter.Create("flib_0.7.0/info.json")
+	info.Write([]byte(`{"name": "flib", "version": "0.7.0", "factorio_version": "1.1"}`))
+	zipWriter.Close()
+	return buf.Bytes()
+}
+
+func TestModFileVerification(t *testing.T) {
+	dir, restore := withModDirs(t)
+	defer restore()
+
+	modFile := flibModFile()
+	hash := sha1.Sum(modFile)
+	sha1Sum := hex.EncodeToString(hash[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/truncated" {
+			w.Write(modFile[:len(modFile)/2])
+			return
+		}
+		w.Write(modFile)
+	}))
+	defer server.Close()
+	source := &PortalModSource{ModsURL: server.URL}
+
+	file, _, err := fetchModFile(context.Background(), source, "/mod", FactorioCredentials{}, sha1Sum)
+	if err != nil {
+		t.Fatalf("Error fetching mod: %s", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	if _, retry, err := fetchModFile(context.Background(), source, "/truncated", FactorioCredentials{}, sha1Sum); err == nil || !retry {
+		t.Errorf("Expected retryable error on truncated download, got: %v, %v", err, retry)
+	}
+
+	// a corrupt mod is reported instead of aborting the listing
+	ioutil.WriteFile(filepath.Join(dir, "broken_1.0.0.zip"), modFile[:len(modFile)/2], 0664)
+	modInfoList, err := newModInfoList(dir)
+	if err != nil {
+		t.Fatalf("Error listing mods: %s", err)
+	}
+	if err := modInfoList.createMod("flib", "flib_0.7.0.zip", bytes.NewReader(modFile)); err != nil {
+		t.Fatalf("Error creating mod: %s", err)
+	}
+	if len(modInfoList.Mods) != 1 || modInfoList.Mods[0].Name != "flib" {
+		t.Errorf("Unexpected installed mods: %+v", modInfoList.Mods)
+	}
+	if len(modInfoList.Corrupt) != 1 || modInfoList.Corrupt[0].FileName != "broken_1.0.0.zip" {
+		t.Errorf("Unexpected corrupt mods: %+v", modInfoList.Corrupt)
+	}
+}
+
+func TestModCache(t *testing.T) {
+	_, restore := withModDirs(t)
+	defer restore()
+
+	modsDir := config.FactorioModsDir
+	modPackDir := filepath.Join(config.FactorioModPackDir, "pack")
+	os.Mkdir(modsDir, 0755)
+	os.MkdirAll(modPackDir, 0755)
+	ioutil.WriteFile(filepath.Join(modsDir, "flib_0.7.0.zip"), []byte("flib"), 0664)
+
+	modCache, err := newModCache(config.FactorioModCacheDir)
+	if err != nil {
+		t.Fatalf("Error creating mod cache: %s", err)
+	}
+	err = linkCachedMod(&modCache, filepath.Join(modsDir, "flib_0.7.0.zip"), filepath.Join(modPackDir, "flib_0.7.0.zip"))
+	if err != nil {
+		t.Fatalf("Error linking mod: %s", err)
+	}
+
+	installed, _ := os.Stat(filepath.Join(modsDir, "flib_0.7.0.zip"))
+	packed, _ := os.Stat(filepath.Join(modPackDir, "flib_0.7.0.zip"))
+	if !os.SameFile(installed, packed) {
+		t.Errorf("Mod of the modpack is not linked to the installed mod")
+	}
+
+	entries, err := modCache.list()
+	if err != nil || len(entries) != 1 || entries[0].Name != "flib" || entries[0].Version != "0.7.0" || entries[0].Size != 4 {
+		t.Errorf("Unexpected cache entries: %+v, %v", entries, err)
+	}
+	if _, ok := modCache.lookup(entries[0].Sha1, "flib_0.7.0.zip"); !ok {
+		t.Errorf("Cached mod %s not found", entries[0].Sha1)
+	}
+
+	removed, err := modCache.collectGarbage([]string{modsDir, modPackDir})
+	if err != nil || len(removed) != 0 {
+		t.Errorf("Unexpected removed entries of referenced mod: %+v, %v", removed, err)
+	}
+
+	// the same file under another name shares the directory of the checksum
+	ioutil.WriteFile(filepath.Join(modsDir, "flib_copy.zip"), []byte("flib"), 0664)
+	if _, err := modCache.add(filepath.Join(modsDir, "flib_copy.zip")); err != nil {
+		t.Fatalf("Error adding mod to the cache: %s", err)
+	}
+	os.Remove(filepath.Join(modsDir, "flib_copy.zip"))
+
+	// the replaced mod is kept as previous mod
+	os.Rename(filepath.Join(modsDir, "flib_0.7.0.zip"), filepath.Join(modsDir, "flib_0.7.0.zip"+previousModSuffix))
+	removed, err = modCache.collectGarbage([]string{modsDir, modPackDir})
+	if err != nil || len(removed) != 1 || removed[0].FileName != "flib_copy.zip" {
+		t.Errorf("Expected only the unreferenced copy to be removed: %+v, %v", removed, err)
+	}
+	if _, ok := modCache.lookup(entries[0].Sha1, "flib_0.7.0.zip"); !ok {
+		t.Errorf("Mod in modpack removed with the unreferenced copy")
+	}
+
+	os.Remove(filepath.Join(modPackDir, "flib_0.7.0.zip"))
+	removed, err = modCache.collectGarbage([]string{modsDir, modPackDir})
+	if err != nil || len(removed) != 0 {
+		t.Errorf("Unexpected removed entries of previous mod: %+v, %v", removed, err)
+	}
+
+	os.Remove(filepath.Join(modsDir, "flib_0.7.0.zip"+previousModSuffix))
+	removed, err = modCache.collectGarbage([]string{modsDir, modPackDir})
+	if err != nil || len(removed) != 1 {
+		t.Errorf("Expected the unreferenced mod to be removed: %+v, %v", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(config.FactorioModCacheDir, entries[0].Sha1)); !os.IsNotExist(err) {
+		t.Errorf("Empty directory of the checksum not removed: %v", err)
+	}
+}
+
+func TestLinkModReplacesOldVersion(t *testing.T) {
+	dir, restore := withModDirs(t)
+	defer restore()
+
+	os.Mkdir(config.FactorioModsDir, 0755)
+	var old bytes.Buffer
+	zipWriter := zip.NewWriter(&old)
+	info, _ := zipWriter.Create("flib_0.6.0/info.json")
+	info.Write([]byte(`{"name": "flib", "version": "0.6.0", "factorio_version": "1.1"}`))
+	zipWriter.Close()
+	ioutil.WriteFile(filepath.Join(config.FactorioModsDir, "flib_0.6.0.zip"), old.Bytes(), 0664)
+	ioutil.WriteFile(filepath.Join(dir, "flib_0.7.0.zip"), flibModFile(), 0664)
+
+	mods, err := newMods(config.FactorioModsDir)
+	if err != nil {
+		t.Fatalf("Error listing mods: %s", err)
+	}
+	modCache, _ := newModCache(config.FactorioModCacheDir)
+	entry, err := modCache.add(filepath.Join(dir, "flib_0.7.0.zip"))
+	if err != nil {
+		t.Fatalf("Error adding mod to the cache: %s", err)
+	}
+
+	if err := mods.linkMod("flib", "flib_0.7.0.zip", entry); err != nil {
+		t.Fatalf("Error linking mod: %s", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(config.FactorioModsDir, "flib_*"))
+	if len(files) != 1 || filepath.Base(files[0]) != "flib_0.7.0.zip" {
+		t.Errorf("Installed files not equal: %v --- [flib_0.7.0.zip]", files)
+	}
+	if !mods.ModSimpleList.checkModExists("flib") {
+		t.Errorf("Mod missing in the mod-list.json")
+	}
+
+	// installing the same file again replaces it in place
+	if err := mods.linkMod("flib", "flib_0.7.0.zip", entry); err != nil {
+		t.Fatalf("Error linking mod again: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.FactorioModsDir, "flib_0.7.0.zip")); err != nil {
+		t.Errorf("Mod removed when installed again: %s", err)
+	}
+}
+
+func TestModSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-source")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	index := `{"mods": [{"name": "flib", "title": "Factorio Library", "releases": [
+		{"file_name": "flib_0.7.0.zip", "sha1": "abc", "version": "0.7.0", "info_json": {"factorio_version": "1.1"}}]}]}`
+	ioutil.WriteFile(filepath.Join(dir, modSourceIndexFile), []byte(index), 0664)
+	ioutil.WriteFile(filepath.Join(dir, "flib_0.7.0.zip"), []byte("flib"), 0664)
+
+	// the mirror serves the same mods in the format of the mod portal api
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source := &DirectoryModSource{Dir: dir}
+		switch r.URL.Path {
+		case "/api/mods":
+			text, _, status := source.Search(r.URL.Query().Get("q"))
+			w.WriteHeader(status)
+			w.Write([]byte(text))
+		case "/api/mods/flib/full":
+			text, _, status := source.Details("flib")
+			w.WriteHeader(status)
+			w.Write([]byte(text))
+		default:
+			http.ServeFile(w, r, filepath.Join(dir, filepath.Base(r.URL.Path)))
+		}
+	}))
+	defer server.Close()
+
+	defer func(source, url, sourceDir string) {
+		config.ModSource, config.ModSourceURL, config.ModSourceDir = source, url, sourceDir
+	}(config.ModSource, config.ModSourceURL, config.ModSourceDir)
+	config.ModSourceURL = server.URL
+	config.ModSourceDir = dir
+
+	for _, kind := range []string{modSourceDirectory, modSourceMirror} {
+		config.ModSource = kind
+		source, err := newModSource()
+		if err != nil {
+			t.Fatalf("Error creating mod source %s: %s", kind, err)
+		}
+		if source.RequiresLogin() {
+			t.Errorf("Mod source %s requires login", kind)
+		}
+
+		text, err, _ := searchModPortal("library")
+		if err != nil || !bytes.Contains([]byte(text), []byte(`"name":"flib"`)) {
+			t.Errorf("Unexpected search result of %s: %s, %v", kind, text, err)
+		}
+
+		release, err := findModPortalRelease("flib", Version{0, 7, 0})
+		if err != nil || release.Sha1 != "abc" || release.DownloadURL != "/flib_0.7.0.zip" {
+			t.Errorf("Unexpected release of %s: %+v, %v", kind, release, err)
+		}
+		if _, err := findModPortalRelease("missing", Version{1, 0, 0}); err == nil {
+			t.Errorf("Expected error looking up missing mod from %s", kind)
+		}
+
+		body, err := source.Download(context.Background(), release.DownloadURL, FactorioCredentials{})
+		if err != nil {
+			t.Fatalf("Error downloading from %s: %s", kind, err)
+		}
+		content, _ := ioutil.ReadAll(body)
+		body.Close()
+		if string(content) != "flib" {
+			t.Errorf("Downloaded content of %s not equal: %s --- %s", kind, content, "flib")
+		}
+	}
+
+	// the downloads can't be verified without checksum
+	ioutil.WriteFile(filepath.Join(dir, modSourceIndexFile), []byte(strings.Replace(index, `"sha1": "abc", `, "", 1)), 0664)
+	config.ModSource = modSourceDirectory
+	if _, err, _ := searchModPortal("library"); err == nil || !strings.Contains(err.Error(), "no sha1") {
+		t.Errorf("Expected error on index without sha1, got: %v", err)
+	}
+
+	config.ModSource = "ftp"
+	if _, err := newModSource(); err == nil {
+		t.Errorf("Expected error on unknown mod source")
+	}
+}
+
+func TestModSettings(t *testing.T) {
+	modSettings := ModSettings{
+		Version: Version{1, 1, 110, 0},
+		Settings: map[string]interface{}{
+			modSettingStartup: map[string]interface{}{
+				"ltn-dispatcher-enabled":   map[string]interface{}{"value": true},
+				"ltn-stop-default-network": map[string]interface{}{"value": int64(-1)},
+			},
+			modSettingRuntimeGlobal: map[string]interface{}{
+				"ltn-dispatcher-delivery-timeout": map[string]interface{}{"value": 18000.5},
+				"ltn-interface-console-level":     map[string]interface{}{"value": "2"},
+			},
+			modSettingRuntimePerUser: map[string]interface{}{
+				"flib-color": map[string]interface{}{"value": map[string]interface{}{"r": 1.0, "g": 0.5, "b": 0.0, "a": 1.0}},
+				"flib-list":  map[string]interface{}{"value": []interface{}{uint64(1), nil, ""}},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if _, err := modSettings.WriteTo(&buf); err != nil {
+		t.Fatalf("Error writing mod settings: %s", err)
+	}
+	written := append([]byte(nil), buf.Bytes()...)
+
+	var read ModSettings
+	if _, err := read.ReadFrom(&buf); err != nil {
+		t.Fatalf("Error reading mod settings: %s", err)
+	}
+	if !read.Version.Equals(modSettings.Version) || !reflect.DeepEqual(read.Settings, modSettings.Settings) {
+		t.Errorf("Mod settings not equal: %+v --- %+v", read, modSettings)
+	}
+
+	buf.Reset()
+	read.WriteTo(&buf)
+	if !bytes.Equal(buf.Bytes(), written) {
+		t.Errorf("Written mod settings changed after reading them")
+	}
+
+	lua := `
+-- settings of the mod
+data:extend({
+	{
+		type = "int-setting",
+		name = "ltn-stop-default-network",
+		setting_type = "startup",
+		default_value = -1,
+		minimum_value = -1, maximum_value = 0x7FFFFFFF,
+		order = "a" .. "b",
+	},
+	{ type = "string-setting", name = "ltn-interface-console-level", setting_type = "runtime-global",
+	  default_value = "2", allowed_values = {"0", "1", "2", "3"} },
+	{ type = "bool-setting", name = "ltn-dispatcher-enabled", setting_type = "startup", default_value = util.default() },
+	--[[ { type = "bool-setting", name = "commented-out" } ]]
+})`
+	prototypes := make(map[string]ModSettingPrototype)
+	for _, prototype := range parseModSettingPrototypes("LTN", lua) {
+		prototypes[prototype.Name] = prototype
+	}
+	if len(prototypes) != 3 {
+		t.Fatalf("Unexpected setting prototypes: %+v", prototypes)
+	}
+	network := prototypes["ltn-stop-default-network"]
+	if network.Type != "int-setting" || network.DefaultValue != -1.0 || *network.MinimumValue != -1 || *network.MaximumValue != 0x7FFFFFFF {
+		t.Errorf("Unexpected int setting prototype: %+v", network)
+	}
+	if level := prototypes["ltn-interface-console-level"]; len(level.AllowedValues) != 4 || level.SettingType != modSettingRuntimeGlobal {
+		t.Errorf("Unexpected string setting prototype: %+v", level)
+	}
+	if enabled := prototypes["ltn-dispatcher-enabled"]; enabled.DefaultValue != nil {
+		t.Errorf("Default value of expression not empty: %+v", enabled.DefaultValue)
+	}
+
+	changes := []struct {
+		change ModSettingChange
+		valid  bool
+	}{
+		{ModSettingChange{Scope: modSettingStartup, Name: "ltn-stop-default-network", Value: 5.0}, true},
+		{ModSettingChange{Scope: modSettingStartup, Name: "ltn-stop-default-network", Value: 5.5}, false},
+		{ModSettingChange{Scope: modSettingStartup, Name: "ltn-stop-default-network", Value: -2.0}, false},
+		{ModSettingChange{Scope: modSettingRuntimeGlobal, Name: "ltn-stop-default-network", Value: 1.0}, false},
+		{ModSettingChange{Scope: modSettingRuntimeGlobal, Name: "ltn-interface-console-level", Value: "4"}, false},
+		{ModSettingChange{Scope: modSettingRuntimeGlobal, Name: "ltn-dispatcher-delivery-timeout", Value: "fast"}, false},
+		{ModSettingChange{Scope: modSettingRuntimeGlobal, Name: "ltn-dispatcher-delivery-timeout", Value: nil}, true},
+		{ModSettingChange{Scope: "map", Name: "ltn-dispatcher-enabled", Value: true}, false},
+	}
+	for _, c := range changes {
+		var prototype *ModSettingPrototype
+		if p, ok := prototypes[c.change.Name]; ok {
+			prototype = &p
+		}
+		if err := read.set(c.change, prototype); (err == nil) != c.valid {
+			t.Errorf("Change %+v valid not equal: %v --- %v (%v)", c.change, err == nil, c.valid, err)
+		}
+	}
+
+	startup := read.Settings[modSettingStartup].(map[string]interface{})
+	if value := startup["ltn-stop-default-network"].(map[string]interface{})["value"]; value != int64(5) {
+		t.Errorf("Changed int setting not equal: %#v --- %#v", value, int64(5))
+	}
+	if _, ok := read.Settings[modSettingRuntimeGlobal].(map[string]interface{})["ltn-dispatcher-delivery-timeout"]; ok {
+		t.Errorf("Removed setting still stored")
+	}
+}
+
+func TestUpdateModSettingsLock(t *testing.T) {
+	_, restore := withModDirs(t)
+	defer restore()
+
+	if !tryLockModsDir() {
+		t.Fatalf("Mods dir locked by another test")
+	}
+
+	// the handler waits for the lock, before it checks the state of the server
+	recorder := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		body := strings.NewReader(`{"settings": []}`)
+		UpdateModSettingsHandler(recorder, httptest.NewRequest("POST", "/api/mods/settings", body))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Mod settings changed while the mods dir was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a server start, which got the lock first
+	FactorioServ.transition(ServerStarting, nil)
+	unlockModsDir()
+	<-done
+
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Status not equal: %d --- %d", recorder.Code, http.StatusConflict)
+	}
+}
+
+func TestModPackManifest(t *testing.T) {
+	_, restore := withModDirs(t)
+	defer restore()
+
+	// lists of other tools and the mod-list.json are read as manifest
+	manifests := map[string][]ModPackManifestMod{
+		`{"name": "pack", "mods": [{"name": "flib", "version": "0.7.0", "enabled": false, "sha1": "ABC"}]}`: {
+			{Name: "flib", Version: "0.7.0", Sha1: "abc"}},
+		`["flib", {"name": "LTN", "version": "latest"}]`: {
+			{Name: "flib", Enabled: true}, {Name: "LTN", Enabled: true}},
+		`{"mods": [{"name": "base", "enabled": true}, {"name": "flib", "enabled": false}]}`: {
+			{Name: "base", Enabled: true}, {Name: "flib"}},
+	}
+	for data, expected := range manifests {
+		manifest, err := parseModPackManifest([]byte(data))
+		if err != nil || !reflect.DeepEqual(manifest.Mods, expected) {
+			t.Errorf("Manifest mods not equal: %+v --- %+v (%v)", manifest.Mods, expected, err)
+		}
+	}
+	for _, data := range []string{`["flib", "flib"]`, `[{"name": "flib", "version": "new"}]`, `[{"name": "flib", "file_name": "../flib.zip"}]`} {
+		if _, err := parseModPackManifest([]byte(data)); err == nil {
+			t.Errorf("Expected error parsing manifest %s", data)
+		}
+	}
+
+	modFile := flibModFile()
+
+	sourceDir := filepath.Join(config.FactorioModPackDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	ioutil.WriteFile(filepath.Join(sourceDir, "flib_0.7.0.zip"), modFile, 0664)
+	ioutil.WriteFile(filepath.Join(sourceDir, "mod-list.json"), []byte(`{"mods": [{"name": "base", "enabled": true}, {"name": "flib", "enabled": false}]}`), 0664)
+	mods, err := newMods(sourceDir)
+	if err != nil {
+		t.Fatalf("Error loading modpack: %s", err)
+	}
+	manifest, err := createModPackManifest("source", &mods)
+	if err != nil || len(manifest.Mods) != 2 || manifest.Mods[1].Name != "flib" || manifest.Mods[1].Enabled || manifest.Mods[1].Sha1 == "" {
+		t.Fatalf("Unexpected manifest: %+v, %v", manifest, err)
+	}
+
+	var bundleBuf bytes.Buffer
+	if err := writeModPackBundle(&bundleBuf, sourceDir, manifest); err != nil {
+		t.Fatalf("Error writing bundle: %s", err)
+	}
+	bundle, err := zip.NewReader(bytes.NewReader(bundleBuf.Bytes()), int64(bundleBuf.Len()))
+	if err != nil {
+		t.Fatalf("Error reading bundle: %s", err)
+	}
+
+	// the mods of the bundle are imported through the mod cache, nothing is looked up on the mod source
+	modCache, _ := newModCache(config.FactorioModCacheDir)
+	noLookup := func(name string) ([]ModPortalRelease, error) {
+		t.Errorf("Unexpected lookup of mod %s", name)
+		return nil, fmt.Errorf("mod %s not found", name)
+	}
+	jc := &JobContext{Context: context.Background(), queue: newJobQueue()}
+	imported, err := readModPackBundle(bundle, &modCache)
+	if err != nil || !reflect.DeepEqual(imported.Mods, manifest.Mods) {
+		t.Errorf("Bundle manifest not equal: %+v --- %+v (%v)", imported.Mods, manifest.Mods, err)
+	}
+	if err := importModPack(jc, "imported", imported, &modCache, noLookup); err != nil {
+		t.Fatalf("Error importing modpack: %s", err)
+	}
+	importedMods, err := newMods(filepath.Join(config.FactorioModPackDir, "imported"))
+	if err != nil || len(importedMods.ModInfoList.Mods) != 1 || isModEnabled(&importedMods, "flib") {
+		t.Errorf("Unexpected imported mods: %+v, %v", importedMods, err)
+	}
+	if err := importModPack(jc, "imported", imported, &modCache, noLookup); err == nil {
+		t.Errorf("Expected error importing existing modpack")
+	}
+
+	// the download of a modpack has no manifest, the mods are read from the files
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	file, _ := zipWriter.Create("flib_0.7.0.zip")
+	file.Write(modFile)
+	file, _ = zipWriter.Create("mod-list.json")
+	file.Write([]byte(`{"mods": [{"name": "flib", "enabled": false}]}`))
+	zipWriter.Close()
+	bundle, _ = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	imported, err = readModPackBundle(bundle, &modCache)
+	if err != nil || len(imported.Mods) != 1 || imported.Mods[0].Version != "0.7.0" || imported.Mods[0].Sha1 != manifest.Mods[1].Sha1 || imported.Mods[0].Enabled {
+		t.Errorf("Unexpected manifest of bundle without manifest: %+v, %v", imported.Mods, err)
+	}
+
+	// a release on the mod source with another checksum is rejected and the modpack removed again
+	mismatch := ModPackManifest{Mods: []ModPackManifestMod{{Name: "LTN", Version: "1.0.0", Sha1: "abc"}}}
+	lookup := func(name string) ([]ModPortalRelease, error) {
+		return []ModPortalRelease{{Version: Version{1, 0, 0}, Sha1: "def", FileName: "LTN_1.0.0.zip"}}, nil
+	}
+	if err := importModPack(jc, "mismatch", mismatch, &modCache, lookup); err == nil {
+		t.Errorf("Expected error importing mod with another checksum")
+	}
+	if _, err := os.Stat(filepath.Join(config.FactorioModPackDir, "mismatch")); !os.IsNotExist(err) {
+		t.Errorf("Modpack of failed import not removed: %v", err)
+	}
+	if err := importModPack(jc, "../outside", mismatch, &modCache, lookup); err == nil {
+		t.Errorf("Expected error importing modpack with invalid name")
+	}
+}
+
+func TestModPackDiff(t *testing.T) {
+	base := ModPackManifest{Name: "base", Mods: []ModPackManifestMod{
+		{Name: "base", Enabled: true},
+		{Name: "flib", Version: "0.7.0", Enabled: true},
+		{Name: "LTN", Version: "1.0.0", Enabled: true},
+		{Name: "Squeak", Version: "1.8.0", Enabled: false},
+	}}
+	// a save lists the game version for the builtin mods
+	target := ModPackManifest{Name: "save:world", Mods: []ModPackManifestMod{
+		{Name: "base", Version: "1.1.110", Enabled: true},
+		{Name: "flib", Version: "0.8.0", Enabled: true},
+		{Name: "Squeak", Version: "1.8.0", Enabled: true},
+		{Name: "RateCalculator", Version: "3.0.0", Enabled: true},
+	}}
+
+	diff := diffModPacks(base, target)
+	if len(diff.Added) != 1 || diff.Added[0].Name != "RateCalculator" {
+		t.Errorf("Unexpected added mods: %+v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].Name != "LTN" {
+		t.Errorf("Unexpected removed mods: %+v", diff.Removed)
+	}
+	expected := []ModPackModChange{{Name: "flib", BaseVersion: "0.7.0", TargetVersion: "0.8.0", BaseEnabled: true, TargetEnabled: true}}
+	if !reflect.DeepEqual(diff.VersionChanged, expected) {
+		t.Errorf("Version changes not equal: %+v --- %+v", diff.VersionChanged, expected)
+	}
+	if len(diff.EnabledChanged) != 1 || diff.EnabledChanged[0].Name != "Squeak" || !diff.EnabledChanged[0].TargetEnabled {
+		t.Errorf("Unexpected enabled changes: %+v", diff.EnabledChanged)
+	}
+
+	merged, err := mergeModPacks("merged", base, target, []string{"flib", "LTN"})
+	if err != nil {
+		t.Fatalf("Error merging modpacks: %s", err)
+	}
+	expectedMods := []ModPackManifestMod{
+		{Name: "Squeak", Version: "1.8.0", Enabled: false},
+		{Name: "base", Enabled: true},
+		{Name: "flib", Version: "0.8.0", Enabled: true},
+	}
+	if merged.Name != "merged" || !reflect.DeepEqual(merged.Mods, expectedMods) {
+		t.Errorf("Merged mods not equal: %+v --- %+v", merged.Mods, expectedMods)
+	}
+	if _, err := mergeModPacks("merged", base, target, []string{"missing"}); err == nil {
+		t.Errorf("Expected error merging unknown mod")
+	}
+}
+
+func TestModPackCloneRename(t *testing.T) {
+	_, restore := withModDirs(t)
+	defer restore()
+
+	sourceDir := filepath.Join(config.FactorioModPackDir, "vanilla")
+	os.MkdirAll(sourceDir, 0755)
+	ioutil.WriteFile(filepath.Join(sourceDir, "flib_0.7.0.zip"), []byte("flib"), 0664)
+	ioutil.WriteFile(filepath.Join(sourceDir, "mod-list.json"), []byte(`{"mods": [{"name": "base", "enabled": true}]}`), 0664)
+
+	modPackMap, err := newModPackMap()
+	if err != nil {
+		t.Fatalf("Error loading modpacks: %s", err)
+	}
+	info := ModPackInfo{Description: "Vanilla plus", Notes: "for the weekend server"}
+	if err := modPackMap.setModPackInfo("vanilla", info); err != nil {
+		t.Fatalf("Error saving modpack info: %s", err)
+	}
+
+	if err := modPackMap.cloneModPack("vanilla", "copy"); err != nil {
+		t.Fatalf("Error cloning modpack: %s", err)
+	}
+	if modPackMap["copy"] == nil || modPackMap["copy"].Info != info {
+		t.Errorf("Cloned modpack info not equal: %+v --- %+v", modPackMap["copy"], info)
+	}
+	original, _ := os.Stat(filepath.Join(sourceDir, "flib_0.7.0.zip"))
+	cloned, _ := os.Stat(filepath.Join(config.FactorioModPackDir, "copy", "flib_0.7.0.zip"))
+	if !os.SameFile(original, cloned) {
+		t.Errorf("Mod of the cloned modpack is not linked to the original")
+	}
+	if err := modPackMap.cloneModPack("vanilla", "copy"); err == nil {
+		t.Errorf("Expected error cloning into existing modpack")
+	}
+
+	if err := modPackMap.renameModPack("copy", "renamed"); err != nil {
+		t.Fatalf("Error renaming modpack: %s", err)
+	}
+	if modPackMap.checkModPackExists("copy") || !modPackMap.checkModPackExists("renamed") {
+		t.Errorf("Unexpected modpacks after rename: %v", modPackMap)
+	}
+	for _, name := range []string{"", "..", "a/b"} {
+		if err := modPackMap.renameModPack("renamed", name); err == nil {
+			t.Errorf("Expected error renaming modpack to %q", name)
+		}
+	}
+
+	for _, result := range modPackMap.listInstalledModPacks().ModPacks {
+		if result.Description != info.Description || result.Notes != info.Notes {
+			t.Errorf("Modpack result info not equal: %+v --- %+v", result, info)
+		}
+	}
+}
+
+func TestLoadModPack(t *testing.T) {
+	dir, restore := withModDirs(t)
+	defer restore()
+
+	os.MkdirAll(config.FactorioModsDir, 0755)
+	ioutil.WriteFile(filepath.Join(config.FactorioModsDir, "old_1.0.0.zip"), []byte("old"), 0664)
+	packDir := filepath.Join(config.FactorioModPackDir, "pack")
+	os.MkdirAll(packDir, 0755)
+	ioutil.WriteFile(filepath.Join(packDir, "flib_0.7.0.zip"), flibModFile(), 0664)
+	ioutil.WriteFile(filepath.Join(packDir, modPackInfoFile), []byte(`{"description": "pack"}`), 0664)
+
+	// the mods dir may be a mount point, which can't be renamed
+	modsDirInfo, _ := os.Stat(config.FactorioModsDir)
+	var failRename string
+	defer func() { renameModFile = os.Rename }()
+	renameModFile = func(from string, to string) error {
+		if filepath.Clean(from) == filepath.Clean(config.FactorioModsDir) || from == failRename {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EBUSY}
+		}
+		return os.Rename(from, to)
+	}
+
+	modFiles := func(suffix string) []string {
+		files, err := listModFiles(suffix)
+		if err != nil {
+			t.Fatalf("Error listing mod files: %s", err)
+		}
+		return files
+	}
+	checkModFiles := func(state string, installed []string, previous []string) {
+		if files := modFiles(""); !reflect.DeepEqual(files, installed) {
+			t.Errorf("Installed mods %s not equal: %v --- %v", state, files, installed)
+		}
+		if files := modFiles(previousModSuffix); !reflect.DeepEqual(files, previous) {
+			t.Errorf("Previous mods %s not equal: %v --- %v", state, files, previous)
+		}
+		if files := append(modFiles(stagedModSuffix), modFiles(replacedModSuffix)...); len(files) != 0 {
+			t.Errorf("Swap left files behind %s: %v", state, files)
+		}
+		if info, err := os.Stat(config.FactorioModsDir); err != nil || !os.SameFile(info, modsDirInfo) {
+			t.Errorf("Mods dir replaced %s: %v", state, err)
+		}
+	}
+
+	// a failing copy leaves the installed mods untouched
+	os.Symlink(filepath.Join(dir, "missing"), filepath.Join(packDir, "broken.zip"))
+	modPack := &ModPack{Mods: Mods{ModInfoList: ModInfoList{Destination: packDir}}}
+	if err := modPack.loadModPack(); err == nil {
+		t.Errorf("Expected error loading modpack with broken file")
+	}
+	checkModFiles("after failed load", []string{"old_1.0.0.zip"}, nil)
+	os.Remove(filepath.Join(packDir, "broken.zip"))
+
+	if err := modPack.loadModPack(); err != nil {
+		t.Fatalf("Error loading modpack: %s", err)
+	}
+	checkModFiles("after load", []string{"flib_0.7.0.zip"}, []string{"old_1.0.0.zip"})
+	if mods, err := newModInfoList(config.FactorioModsDir); err != nil || len(mods.Mods) != 1 || len(mods.Corrupt) != 0 {
+		t.Errorf("Previous mods listed as installed mods: %+v %+v, %v", mods.Mods, mods.Corrupt, err)
+	}
+
+	if err := rollbackMods(); err != nil {
+		t.Fatalf("Error rolling back mods: %s", err)
+	}
+	checkModFiles("after rollback", []string{"old_1.0.0.zip"}, []string{"flib_0.7.0.zip"})
+
+	// a failing swap keeps the installed and the previous mods
+	failRename = filepath.Join(config.FactorioModsDir, "flib_0.7.0.zip"+stagedModSuffix)
+	if err := modPack.loadModPack(); err == nil {
+		t.Errorf("Expected error loading modpack with failing rename")
+	}
+	checkModFiles("after failed swap", []string{"old_1.0.0.zip"}, []string{"flib_0.7.0.zip"})
+	failRename = ""
+
+	removeModFiles(previousModSuffix)
+	if err := rollbackMods(); err == nil {
+		t.Errorf("Expected error rolling back without previous mods")
+	}
+
+	// the mods are not replaced under a running server
+	FactorioServ.transition(ServerStarting, nil)
+	FactorioServ.transition(ServerRunning, nil)
+	jc := &JobContext{Context: context.Background(), queue: newJobQueue()}
+	err := withServerStopped(jc, false, func() error {
+		t.Errorf("Mods changed while the server is running")
+		return nil
+	})
+	if _, ok := err.(*ModsInUseError); !ok {
+		t.Errorf("Expected ModsInUseError, got: %v", err)
+	}
+
+	// while the mods are changed by a job, the server can't be started
+	FactorioServ = &FactorioServer{Version: Version{1, 1, 110}}
+	_, err = withModsDirLock(func(jc *JobContext) (interface{}, error) {
+		return nil, withServerStopped(jc, false, func() error {
+			return FactorioServ.Start(ServerStartOptions{Savefile: "save.zip"})
+		})
+	})(jc)
+	if err != ErrModsChanging {
+		t.Errorf("Expected ErrModsChanging, got: %v", err)
+	}
+}
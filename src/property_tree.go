@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// types of the nodes of a factorio property tree
+const (
+	propertyTreeNone       = 0
+	propertyTreeBool       = 1
+	propertyTreeNumber     = 2
+	propertyTreeString     = 3
+	propertyTreeList       = 4
+	propertyTreeDictionary = 5
+	propertyTreeSigned     = 6
+	propertyTreeUnsigned   = 7
+)
+
+// maxPropertyTreeDepth limits the nesting of property trees, so malformed data can't exhaust the stack
+const maxPropertyTreeDepth = 64
+
+// readPropertyTree reads a property tree, the generic data structure factorio uses for mod settings.
+// Dictionaries are returned as map[string]interface{}, lists as []interface{},
+// numbers as float64, int64 or uint64 depending on their stored type.
+func (d *saveDecoder) readPropertyTree(field string) interface{} {
+	return d.readPropertyTreeNode(field, 0)
+}
+
+func (d *saveDecoder) readPropertyTreeNode(field string, depth int) interface{} {
+	if depth > maxPropertyTreeDepth {
+		d.fail(field, fmt.Errorf("property tree nested deeper than %d levels", maxPropertyTreeDepth))
+		return nil
+	}
+
+	nodeType := d.readUint8(field + " type")
+	// the any-type flag is only relevant for factorio itself
+	d.readBool(field + " any-type flag")
+	if d.err != nil {
+		return nil
+	}
+
+	switch nodeType {
+	case propertyTreeNone:
+		return nil
+	case propertyTreeBool:
+		return d.readBool(field)
+	case propertyTreeNumber:
+		return math.Float64frombits(d.readUint64(field))
+	case propertyTreeString:
+		return d.readPropertyTreeString(field)
+	case propertyTreeList:
+		count := d.readCount(field+" length", false, maxSaveModCount)
+		list := make([]interface{}, 0, count)
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			// list items have keys, which are ignored by factorio
+			d.readPropertyTreeString(fmt.Sprintf("%s[%d] key", field, i))
+			list = append(list, d.readPropertyTreeNode(fmt.Sprintf("%s[%d]", field, i), depth+1))
+		}
+		return list
+	case propertyTreeDictionary:
+		count := d.readCount(field+" length", false, maxSaveModCount)
+		dict := make(map[string]interface{}, count)
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			key := d.readPropertyTreeString(fmt.Sprintf("%s key %d", field, i))
+			dict[key] = d.readPropertyTreeNode(field+"."+key, depth+1)
+		}
+		return dict
+	case propertyTreeSigned:
+		return int64(d.readUint64(field))
+	case propertyTreeUnsigned:
+		return d.readUint64(field)
+	default:
+		d.fail(field, fmt.Errorf("unknown property tree type %d", nodeType))
+		return nil
+	}
+}
+
+// readPropertyTreeString reads a string, which is prefixed by a flag whether it is empty
+func (d *saveDecoder) readPropertyTreeString(field string) string {
+	if empty := d.readBool(field + " empty flag"); empty {
+		return ""
+	}
+	return d.readString(field, true)
+}
+
+// writePropertyTree writes a property tree in the structure returned by readPropertyTree.
+// Dictionary keys are written in sorted order, the any-type flag is always cleared.
+func (e *saveEncoder) writePropertyTree(field string, value interface{}) {
+	e.writePropertyTreeNode(field, value, 0)
+}
+
+func (e *saveEncoder) writePropertyTreeNode(field string, value interface{}, depth int) {
+	if depth > maxPropertyTreeDepth {
+		e.fail(field, fmt.Errorf("property tree nested deeper than %d levels", maxPropertyTreeDepth))
+		return
+	}
+
+	writeType := func(nodeType uint8) {
+		e.writeUint8(field+" type", nodeType)
+		e.writeBool(field+" any-type flag", false)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		writeType(propertyTreeNone)
+	case bool:
+		writeType(propertyTreeBool)
+		e.writeBool(field, v)
+	case float64:
+		writeType(propertyTreeNumber)
+		e.writeUint64(field, math.Float64bits(v))
+	case string:
+		writeType(propertyTreeString)
+		e.writePropertyTreeString(field, v)
+	case []interface{}:
+		writeType(propertyTreeList)
+		e.writeUint32(field+" length", uint32(len(v)))
+		for i, item := range v {
+			e.writePropertyTreeString(fmt.Sprintf("%s[%d] key", field, i), "")
+			e.writePropertyTreeNode(fmt.Sprintf("%s[%d]", field, i), item, depth+1)
+		}
+	case map[string]interface{}:
+		writeType(propertyTreeDictionary)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		e.writeUint32(field+" length", uint32(len(keys)))
+		for _, key := range keys {
+			e.writePropertyTreeString(field+" key "+key, key)
+			e.writePropertyTreeNode(field+"."+key, v[key], depth+1)
+		}
+	case int64:
+		writeType(propertyTreeSigned)
+		e.writeUint64(field, uint64(v))
+	case uint64:
+		writeType(propertyTreeUnsigned)
+		e.writeUint64(field, v)
+	default:
+		e.fail(field, fmt.Errorf("unsupported property tree value %T", value))
+	}
+}
+
+// writePropertyTreeString writes a string, which is prefixed by a flag whether it is empty
+func (e *saveEncoder) writePropertyTreeString(field string, s string) {
+	e.writeBool(field+" empty flag", s == "")
+	if s != "" {
+		e.writeString(field, s, true)
+	}
+}
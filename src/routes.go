@@ -60,6 +60,9 @@ func NewRouter() *mux.Router {
 		Handler(AuthorizeHandler(ws))
 	ws.Handle("command send", commandSend)
 	ws.Handle("log subscribe", logSubscribe)
+	ws.Handle("server status subscribe", serverStatusSubscribe)
+	ws.Handle("jobs subscribe", jobsSubscribe)
+	ws.Handle("mod updates subscribe", modUpdatesSubscribe)
 
 	// Serves the frontend application from the app directory
 	// Uses basic file server to serve index.html and Javascript application
@@ -188,6 +191,16 @@ var apiRoutes = Routes{
 		"POST",
 		"/mods/install/multiple",
 		ModPortalInstallMultipleHandler,
+	}, {
+		"ModInstallPlan",
+		"POST",
+		"/mods/install/plan",
+		ModInstallPlanHandler,
+	}, {
+		"ModInstallWithDependencies",
+		"POST",
+		"/mods/install/dependencies",
+		ModInstallWithDependenciesHandler,
 	}, {
 		"ToggleMod",
 		"POST",
@@ -208,6 +221,51 @@ var apiRoutes = Routes{
 		"POST",
 		"/mods/update",
 		UpdateModHandler,
+	}, {
+		"ModUpdates",
+		"GET",
+		"/mods/updates",
+		ModUpdatesHandler,
+	}, {
+		"InstallModUpdates",
+		"POST",
+		"/mods/updates/install",
+		InstallModUpdatesHandler,
+	}, {
+		"ListModPins",
+		"GET",
+		"/mods/pins",
+		ListModPinsHandler,
+	}, {
+		"SetModPin",
+		"POST",
+		"/mods/pins/set",
+		SetModPinHandler,
+	}, {
+		"RemoveModPin",
+		"POST",
+		"/mods/pins/remove",
+		RemoveModPinHandler,
+	}, {
+		"ListModCache",
+		"GET",
+		"/mods/cache",
+		ListModCacheHandler,
+	}, {
+		"ModCacheGarbageCollect",
+		"POST",
+		"/mods/cache/gc",
+		ModCacheGarbageCollectHandler,
+	}, {
+		"ModSettings",
+		"GET",
+		"/mods/settings",
+		ModSettingsHandler,
+	}, {
+		"UpdateModSettings",
+		"POST",
+		"/mods/settings",
+		UpdateModSettingsHandler,
 	}, {
 		"UploadMod",
 		"POST",
@@ -223,6 +281,11 @@ var apiRoutes = Routes{
 		"POST",
 		"/mods/save/load",
 		LoadModsFromSaveHandler,
+	}, {
+		"SyncModsToSave",
+		"POST",
+		"/mods/save/sync",
+		SyncModsToSaveHandler,
 	}, {
 		"ListSaves",
 		"GET",
@@ -238,16 +301,126 @@ var apiRoutes = Routes{
 		"POST",
 		"/saves/upload",
 		UploadSave,
+	}, {
+		"ListJobs",
+		"GET",
+		"/jobs",
+		ListJobs,
+	}, {
+		"GetJob",
+		"GET",
+		"/jobs/{id}",
+		GetJob,
+	}, {
+		"CancelJob",
+		"POST",
+		"/jobs/{id}/cancel",
+		CancelJob,
+	}, {
+		"CreateUploadSession",
+		"POST",
+		"/uploads/create",
+		CreateUploadSession,
+	}, {
+		"UploadSessionStatus",
+		"GET",
+		"/uploads/{id}",
+		UploadSessionStatus,
+	}, {
+		"UploadChunk",
+		"PUT",
+		"/uploads/{id}",
+		UploadChunk,
+	}, {
+		"FinalizeUploadSession",
+		"POST",
+		"/uploads/{id}/finalize",
+		FinalizeUploadSession,
+	}, {
+		"CancelUploadSession",
+		"POST",
+		"/uploads/{id}/cancel",
+		CancelUploadSession,
 	}, {
 		"RemoveSave",
 		"GET",
 		"/saves/rm/{save}",
 		RemoveSave,
+	}, {
+		"RenameSave",
+		"POST",
+		"/saves/rename",
+		RenameSave,
+	}, {
+		"CopySave",
+		"POST",
+		"/saves/copy",
+		CopySave,
+	}, {
+		"ArchiveSave",
+		"POST",
+		"/saves/archive",
+		ArchiveSave,
+	}, {
+		"RestoreArchivedSave",
+		"POST",
+		"/saves/archive/restore",
+		RestoreArchivedSave,
+	}, {
+		"ListArchivedSaves",
+		"GET",
+		"/saves/archive/list",
+		ListArchivedSaves,
 	}, {
 		"CreateSave",
 		"GET",
 		"/saves/create/{save}",
 		CreateSaveHandler,
+	}, {
+		"CreateMap",
+		"POST",
+		"/saves/create",
+		CreateMapHandler,
+	}, {
+		"SaveMapSettings",
+		"GET",
+		"/saves/settings/{save}",
+		GetSaveMapSettings,
+	}, {
+		"MapPreview",
+		"POST",
+		"/saves/preview",
+		MapPreviewHandler,
+	}, {
+		"SaveMapPreview",
+		"GET",
+		"/saves/preview/{save}",
+		SaveMapPreviewHandler,
+	}, {
+		"MapPreviewImage",
+		"GET",
+		"/saves/preview/cache/{preview}",
+		MapPreviewImageHandler,
+	}, {
+		"SavePreflight",
+		"GET",
+		"/saves/{save}/preflight",
+		SavePreflightHandler,
+	}, {
+		"ListMapPresets",
+		"GET",
+		"/saves/presets",
+		ListMapPresets,
+	}, {
+		"SaveMapPreset",
+		"POST",
+		"/saves/presets/save",
+		SaveMapPreset,
+	}, {
+		"DeleteMapPreset",
+		"POST",
+		"/saves/presets/delete",
+		DeleteMapPreset,
 	}, {
 		"LogTail",
 		"GET",
@@ -288,6 +461,21 @@ var apiRoutes = Routes{
 		"GET",
 		"/server/facVersion",
 		FactorioVersion,
+	}, {
+		"ListLaunchProfiles",
+		"GET",
+		"/server/profiles",
+		ListLaunchProfiles,
+	}, {
+		"SaveLaunchProfile",
+		"POST",
+		"/server/profiles/save",
+		SaveLaunchProfile,
+	}, {
+		"DeleteLaunchProfile",
+		"POST",
+		"/server/profiles/delete",
+		DeleteLaunchProfile,
 	}, {
 		"LogoutUser",
 		"GET",
@@ -313,6 +501,11 @@ var apiRoutes = Routes{
 		"POST",
 		"/user/remove",
 		RemoveUser,
+	}, {
+		"RollbackMods",
+		"POST",
+		"/mods/rollback",
+		RollbackModsHandler,
 	}, {
 		"ListModPacks",
 		"GET",
@@ -323,6 +516,41 @@ var apiRoutes = Routes{
 		"GET",
 		"/mods/packs/download/{modpack}",
 		DownloadModPackHandler,
+	}, {
+		"ExportModPack",
+		"GET",
+		"/mods/packs/export/{modpack}",
+		ExportModPackHandler,
+	}, {
+		"ImportModPack",
+		"POST",
+		"/mods/packs/import",
+		ImportModPackHandler,
+	}, {
+		"DiffModPacks",
+		"GET",
+		"/mods/packs/diff",
+		DiffModPacksHandler,
+	}, {
+		"MergeModPacks",
+		"POST",
+		"/mods/packs/merge",
+		MergeModPacksHandler,
+	}, {
+		"CloneModPack",
+		"POST",
+		"/mods/packs/clone",
+		CloneModPackHandler,
+	}, {
+		"RenameModPack",
+		"POST",
+		"/mods/packs/rename",
+		RenameModPackHandler,
+	}, {
+		"ModPackInfo",
+		"POST",
+		"/mods/packs/info",
+		ModPackInfoHandler,
 	}, {
 		"DeleteModPack",
 		"POST",
@@ -348,6 +576,16 @@ var apiRoutes = Routes{
 		"POST",
 		"/mods/packs/mod/delete",
 		ModPackDeleteModHandler,
+	}, {
+		"ModPackInstallMods",
+		"POST",
+		"/mods/packs/mod/install",
+		ModPackInstallModsHandler,
+	}, {
+		"ModPackUploadMod",
+		"POST",
+		"/mods/packs/mod/upload",
+		ModPackUploadModHandler,
 	}, {
 		"ModPackUpdateMod",
 		"POST",
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// preflight modes of the server start
+const (
+	preflightWarn  = "warn"
+	preflightBlock = "block"
+	preflightFix   = "fix"
+	preflightSkip  = "skip"
+)
+
+// builtinMods are shipped with the game, they have the version of the game and no zip in the mods directory.
+// Since 2.0 the expansion is shipped as the mods space-age, quality and elevated-rails.
+var builtinMods = map[string]bool{
+	"base":           true,
+	"space-age":      true,
+	"quality":        true,
+	"elevated-rails": true,
+}
+
+// SaveModDiff describes a mod, whose state differs between the save and the mods directory.
+// The CRC of the save is reported for reference only, factorio doesn't store the CRC in the mod files.
+type SaveModDiff struct {
+	Name             string `json:"name"`
+	SaveVersion      string `json:"save_version,omitempty"`
+	SaveCRC          uint32 `json:"save_crc,omitempty"`
+	InstalledVersion string `json:"installed_version,omitempty"`
+	Installed        bool   `json:"installed"`
+	Enabled          bool   `json:"enabled"`
+}
+
+// SavePreflight is the result of the comparison of a save with the server
+type SavePreflight struct {
+	Save          string  `json:"save"`
+	SaveVersion   Version `json:"save_version"`
+	ServerVersion Version `json:"server_version"`
+	VersionError  string  `json:"version_error,omitempty"`
+	// Missing are the mods of the save, which are not installed or disabled
+	Missing []SaveModDiff `json:"missing"`
+	// Extra are the enabled mods, which are not used by the save
+	Extra []SaveModDiff `json:"extra"`
+	// VersionMismatch are the mods, which are installed with another version than used by the save
+	VersionMismatch []SaveModDiff `json:"version_mismatch"`
+	Compatible      bool          `json:"compatible"`
+}
+
+// PreflightError is returned, when the server start is blocked by an incompatible save
+type PreflightError struct {
+	Preflight SavePreflight
+}
+
+func (e *PreflightError) Error() string {
+	var problems []string
+	if e.Preflight.VersionError != "" {
+		problems = append(problems, e.Preflight.VersionError)
+	}
+	if len(e.Preflight.Missing) > 0 {
+		problems = append(problems, fmt.Sprintf("%d missing mods", len(e.Preflight.Missing)))
+	}
+	if len(e.Preflight.Extra) > 0 {
+		problems = append(problems, fmt.Sprintf("%d extra mods", len(e.Preflight.Extra)))
+	}
+	if len(e.Preflight.VersionMismatch) > 0 {
+		problems = append(problems, fmt.Sprintf("%d mods with another version", len(e.Preflight.VersionMismatch)))
+	}
+	return fmt.Sprintf("save %s is not compatible with the server: %s", e.Preflight.Save, strings.Join(problems, ", "))
+}
+
+// findInstalledMod returns the installed mod with the name, preferring the given version if multiple are installed
+func findInstalledMod(mods *Mods, name string, version Version) (ModInfo, bool) {
+	var found ModInfo
+	ok := false
+	for _, modInfo := range mods.ModInfoList.Mods {
+		if modInfo.Name != name {
+			continue
+		}
+
+		var installed Version
+		if err := installed.UnmarshalText([]byte(modInfo.Version)); err == nil && installed.Equals(version) {
+			return modInfo, true
+		}
+		found, ok = modInfo, true
+	}
+	return found, ok
+}
+
+// isModEnabled returns the state in the mod-list.json, mods missing in it are enabled by factorio
+func isModEnabled(mods *Mods, name string) bool {
+	for _, mod := range mods.ModSimpleList.Mods {
+		if mod.Name == name {
+			return mod.Enabled
+		}
+	}
+	return true
+}
+
+// compareSaveMods compares the mods used by the save with the ones enabled in the mods directory
+func compareSaveMods(header SaveHeader, mods *Mods) SavePreflight {
+	preflight := SavePreflight{
+		SaveVersion:     header.FactorioVersion,
+		ServerVersion:   FactorioServ.Version,
+		Missing:         []SaveModDiff{},
+		Extra:           []SaveModDiff{},
+		VersionMismatch: []SaveModDiff{},
+	}
+
+	if err := checkSaveCompatibility(header); err != nil {
+		preflight.VersionError = err.Error()
+	}
+
+	inSave := make(map[string]bool)
+	for _, mod := range header.Mods {
+		inSave[mod.Name] = true
+
+		diff := SaveModDiff{
+			Name:        mod.Name,
+			SaveVersion: fmt.Sprintf("%d.%d.%d", mod.Version[0], mod.Version[1], mod.Version[2]),
+			SaveCRC:     mod.CRC,
+			Enabled:     isModEnabled(mods, mod.Name),
+		}
+
+		// builtin mods are migrated by the game itself
+		if builtinMods[mod.Name] {
+			diff.Installed = true
+			if !diff.Enabled {
+				preflight.Missing = append(preflight.Missing, diff)
+			}
+			continue
+		}
+
+		modInfo, installed := findInstalledMod(mods, mod.Name, mod.Version)
+		diff.Installed = installed
+		diff.InstalledVersion = modInfo.Version
+
+		switch {
+		case !installed || !diff.Enabled:
+			preflight.Missing = append(preflight.Missing, diff)
+		case diff.InstalledVersion != diff.SaveVersion:
+			preflight.VersionMismatch = append(preflight.VersionMismatch, diff)
+		}
+	}
+
+	for _, modInfo := range mods.ModInfoList.Mods {
+		if inSave[modInfo.Name] || !isModEnabled(mods, modInfo.Name) {
+			continue
+		}
+		// a mod installed in multiple versions is only reported once
+		inSave[modInfo.Name] = true
+
+		preflight.Extra = append(preflight.Extra, SaveModDiff{
+			Name:             modInfo.Name,
+			InstalledVersion: modInfo.Version,
+			Installed:        true,
+			Enabled:          true,
+		})
+	}
+
+	preflight.Compatible = preflight.VersionError == "" &&
+		len(preflight.Missing) == 0 &&
+		len(preflight.Extra) == 0 &&
+		len(preflight.VersionMismatch) == 0
+
+	return preflight
+}
+
+// checkSavePreflight compares the save with the installed factorio and mods
+func checkSavePreflight(saveName string) (SavePreflight, *Mods, error) {
+	header, err := readSaveHeader(filepath.Join(config.FactorioSavesDir, filepath.Base(saveName)))
+	if err != nil {
+		return SavePreflight{}, nil, err
+	}
+
+	mods, err := newMods(config.FactorioModsDir)
+	if err != nil {
+		return SavePreflight{}, nil, err
+	}
+
+	preflight := compareSaveMods(header, &mods)
+	preflight.Save = saveName
+
+	return preflight, &mods, nil
+}
+
+// fixMods enables the installed mods missing for the save and disables the extra ones.
+// Mods, which are not installed or have another version, are left as they are.
+func (preflight *SavePreflight) fixMods(mods *Mods) error {
+	enabled := make(map[string]bool)
+	for _, diff := range preflight.Missing {
+		if diff.Installed {
+			enabled[diff.Name] = true
+		}
+	}
+	for _, diff := range preflight.Extra {
+		enabled[diff.Name] = false
+	}
+
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	return mods.ModSimpleList.setModsEnabled(enabled)
+}
+
+// runSavePreflight checks the save before the server is started, depending on the mode
+// the result is only logged, blocks the start or the mod states are fixed.
+// The fix mode only enables and disables installed mods, missing mods and versions have to be installed
+// by syncing the mods to the save. The CRCs of the mods aren't compared, the mod files don't contain them.
+func runSavePreflight(saveName string, mode string) error {
+	if mode == preflightSkip {
+		return nil
+	}
+
+	resolved, err := resolveSaveName(saveName)
+	if err != nil {
+		// factorio reports the missing save itself
+		log.Printf("error on preflight check of save %s: %s", saveName, err)
+		return nil
+	}
+	saveName = resolved
+
+	preflight, mods, err := checkSavePreflight(saveName)
+	if err != nil {
+		// saves, whose header can't be read, are left to factorio
+		log.Printf("error on preflight check of save %s: %s", saveName, err)
+		return nil
+	}
+	if preflight.Compatible {
+		return nil
+	}
+
+	switch mode {
+	case preflightBlock:
+		return &PreflightError{Preflight: preflight}
+	case preflightFix:
+		err = preflight.fixMods(mods)
+		if err != nil {
+			return err
+		}
+
+		preflight, _, err = checkSavePreflight(saveName)
+		if err == nil && !preflight.Compatible {
+			log.Printf("save %s is still not compatible after fixing the enabled mods: %s", saveName, (&PreflightError{preflight}).Error())
+		}
+		return nil
+	default:
+		log.Printf("starting incompatible save: %s", (&PreflightError{preflight}).Error())
+		return nil
+	}
+}
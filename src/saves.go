@@ -1,42 +1,267 @@
 package main
 
 import (
+	"archive/zip"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Save struct {
-	Name    string    `json:"name"`
-	LastMod time.Time `json:"last_mod"`
-	Size    int64     `json:"size"`
+	Name        string      `json:"name"`
+	LastMod     time.Time   `json:"last_mod"`
+	Size        int64       `json:"size"`
+	Header      *SaveHeader `json:"header,omitempty"`
+	HeaderError string      `json:"header_error,omitempty"`
 }
 
+// SaveFilter limits the listed saves to the ones matching all set fields
+type SaveFilter struct {
+	Version    string
+	Mod        string
+	ModVersion string
+}
+
+type saveHeaderCacheEntry struct {
+	lastMod time.Time
+	size    int64
+	header  SaveHeader
+	err     error
+}
+
+// saveHeaderCache holds the parsed headers of saves, so they don't have to be read on every listing.
+// Entries are invalidated, when modification time or size of the save changes.
+var saveHeaderCache = struct {
+	sync.Mutex
+	entries map[string]saveHeaderCacheEntry
+}{entries: make(map[string]saveHeaderCacheEntry)}
+
 func (s Save) String() string {
 	return s.Name
 }
 
 // Lists save files in factorio/saves
+// Subdirectories like the archive and the files recorded next to the saves are skipped.
 func listSaves(saveDir string) (saves []Save, err error) {
 	saves = []Save{}
-	err = filepath.Walk(saveDir, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() && info.Name() == "saves" {
-			return nil
+
+	files, err := ioutil.ReadDir(saveDir)
+	if err != nil {
+		return
+	}
+
+	for _, info := range files {
+		// hidden files are saves being created or uploaded
+		if info.IsDir() || filepath.Ext(info.Name()) != ".zip" || strings.HasPrefix(info.Name(), ".") {
+			continue
 		}
 		saves = append(saves, Save{
-			info.Name(),
-			info.ModTime(),
-			info.Size(),
+			Name:    info.Name(),
+			LastMod: info.ModTime(),
+			Size:    info.Size(),
 		})
-		return nil
-	})
+	}
+
 	return
 }
 
+// readSaveHeader parses the header of the level.dat inside the save
+func readSaveHeader(path string) (SaveHeader, error) {
+	var header SaveHeader
+
+	f, err := OpenSaveHeaderFile(path)
+	if err != nil {
+		return header, fmt.Errorf("cannot open save level file: %v", err)
+	}
+	defer f.Close()
+
+	err = header.ReadFrom(f)
+	if err != nil {
+		return header, fmt.Errorf("cannot read save header: %w", err)
+	}
+
+	return header, nil
+}
+
+// cachedSaveHeader returns the header of the save, reading it only if the save has changed since the last call
+func cachedSaveHeader(path string, lastMod time.Time, size int64) (SaveHeader, error) {
+	saveHeaderCache.Lock()
+	entry, found := saveHeaderCache.entries[path]
+	saveHeaderCache.Unlock()
+
+	if found && entry.lastMod.Equal(lastMod) && entry.size == size {
+		return entry.header, entry.err
+	}
+
+	header, err := readSaveHeader(path)
+
+	saveHeaderCache.Lock()
+	saveHeaderCache.entries[path] = saveHeaderCacheEntry{
+		lastMod: lastMod,
+		size:    size,
+		header:  header,
+		err:     err,
+	}
+	saveHeaderCache.Unlock()
+
+	return header, err
+}
+
+// loadHeaders adds the parsed header data to all saves.
+// The cached headers of the saves, which are no longer in the directory, are dropped.
+func loadHeaders(saveDir string, saves []Save) {
+	pruneSaveHeaderCache(saveDir, saves)
+
+	for i := range saves {
+		header, err := cachedSaveHeader(filepath.Join(saveDir, saves[i].Name), saves[i].LastMod, saves[i].Size)
+		if err != nil {
+			log.Printf("error reading header of save %s: %s", saves[i].Name, err)
+			saves[i].HeaderError = err.Error()
+			continue
+		}
+		saves[i].Header = &header
+	}
+}
+
+// pruneSaveHeaderCache removes the entries of the directory, which don't belong to one of the saves
+func pruneSaveHeaderCache(saveDir string, saves []Save) {
+	existing := make(map[string]bool)
+	for _, save := range saves {
+		existing[filepath.Join(saveDir, save.Name)] = true
+	}
+
+	saveHeaderCache.Lock()
+	defer saveHeaderCache.Unlock()
+
+	for path := range saveHeaderCache.entries {
+		if filepath.Dir(path) == filepath.Clean(saveDir) && !existing[path] {
+			delete(saveHeaderCache.entries, path)
+		}
+	}
+}
+
+// versionMatches checks if the version starts with all parts given in the filter, e.g. "0.17" matches "0.17.79.0"
+func versionMatches(v Version, filter string) bool {
+	if filter == "" {
+		return true
+	}
+
+	for i, part := range strings.SplitN(filter, ".", 4) {
+		p, err := strconv.ParseUint(part, 10, 32)
+		if err != nil || v[i] != uint(p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validate checks, that the versions are given as up to four numbers and the mod version belongs to a mod
+func (filter SaveFilter) validate() error {
+	if filter.ModVersion != "" && filter.Mod == "" {
+		return errors.New("mod_version requires mod")
+	}
+
+	for _, version := range []string{filter.Version, filter.ModVersion} {
+		if version == "" {
+			continue
+		}
+		for _, part := range strings.SplitN(version, ".", 4) {
+			if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+				return fmt.Errorf("invalid version: %s", version)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (filter SaveFilter) isEmpty() bool {
+	return filter.Version == "" && filter.Mod == "" && filter.ModVersion == ""
+}
+
+func (filter SaveFilter) matches(save Save) bool {
+	if save.Header == nil {
+		return false
+	}
+
+	if !versionMatches(save.Header.FactorioVersion, filter.Version) {
+		return false
+	}
+
+	if filter.Mod == "" {
+		return true
+	}
+	for _, mod := range save.Header.Mods {
+		if mod.Name == filter.Mod && versionMatches(mod.Version, filter.ModVersion) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterSaves returns the saves matching the filter, the headers of the saves have to be loaded already
+func filterSaves(saves []Save, filter SaveFilter) []Save {
+	if filter.isEmpty() {
+		return saves
+	}
+
+	filtered := []Save{}
+	for _, save := range saves {
+		if filter.matches(save) {
+			filtered = append(filtered, save)
+		}
+	}
+
+	return filtered
+}
+
+// loadLatestSave is the save name, which starts the server with the save changed last
+const loadLatestSave = "Load Latest"
+
+// latestSave returns the save factorio loads for "Load Latest", the one changed last
+func latestSave() (*Save, error) {
+	saves, err := listSaves(config.FactorioSavesDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing saves: %v", err)
+	}
+
+	var latest *Save
+	for i := range saves {
+		if latest == nil || saves[i].LastMod.After(latest.LastMod) {
+			latest = &saves[i]
+		}
+	}
+	if latest == nil {
+		return nil, errors.New("save not found")
+	}
+
+	return latest, nil
+}
+
+// resolveSaveName returns the name of the save, the server loads when it is started with the given name
+func resolveSaveName(name string) (string, error) {
+	if name != loadLatestSave {
+		return name, nil
+	}
+
+	latest, err := latestSave()
+	if err != nil {
+		return "", err
+	}
+	return latest.Name, nil
+}
+
 func findSave(name string) (*Save, error) {
 	saves, err := listSaves(config.FactorioSavesDir)
 	if err != nil {
@@ -52,30 +277,443 @@ func findSave(name string) (*Save, error) {
 	return nil, errors.New("save not found")
 }
 
+// saveSidecarPaths returns the files stored next to the save, which belong to it
+func saveSidecarPaths(savePath string) []string {
+	return []string{mapSettingsPath(savePath)}
+}
+
 func (s *Save) remove() error {
 	if s.Name == "" {
 		return errors.New("save name cannot be blank")
 	}
 
-	return os.Remove(filepath.Join(config.FactorioSavesDir, s.Name))
+	saveFilesLock.Lock()
+	defer saveFilesLock.Unlock()
+
+	if saveInUse(s.Name) {
+		return fmt.Errorf("cannot remove %s: %w", s.Name, ErrSaveInUse)
+	}
+
+	savePath := filepath.Join(config.FactorioSavesDir, s.Name)
+
+	for _, path := range saveSidecarPaths(savePath) {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Remove(savePath)
+}
+
+// conflict handling, when a save with the same name already exists
+const (
+	saveConflictError     = "error"
+	saveConflictOverwrite = "overwrite"
+	saveConflictRename    = "rename"
+)
+
+// ErrSaveExists is returned, when a save should be stored under a name, which is already taken
+var ErrSaveExists = errors.New("save already exists")
+
+// ErrSaveInUse is returned for changes to the save loaded by the server
+var ErrSaveInUse = errors.New("save is used by the running server")
+
+// saveFilesLock serializes changes to the files in the saves directory
+var saveFilesLock sync.Mutex
+
+// saveInUse returns true, if the server is not stopped and loaded the save.
+// The caller has to hold saveFilesLock, so the server can't start with the save meanwhile.
+func saveInUse(name string) bool {
+	state := FactorioServ.State()
+	return state != ServerStopped && state != ServerCrashed && FactorioServ.loadedSave == name
+}
+
+// sanitizeSaveName strips all directories and unusable characters from the client supplied name
+func sanitizeSaveName(name string) (string, error) {
+	// windows clients may send the full path of the file
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	if strings.EqualFold(filepath.Ext(name), ".zip") {
+		name = name[:len(name)-len(".zip")]
+	}
+	name = strings.TrimSpace(strings.TrimLeft(name, "."))
+	if name == "" {
+		return "", errors.New("save name is empty")
+	}
+
+	return name + ".zip", nil
+}
+
+// checkSaveCompatibility makes sure the installed factorio is able to load the save
+func checkSaveCompatibility(header SaveHeader) error {
+	// the installed version is not known before the first version check
+	if FactorioServ.Version.Equals(NilVersion) {
+		return nil
+	}
+
+	// the installed version has no build number
+	saveVersion := header.FactorioVersion
+	saveVersion[3] = 0
+	if saveVersion.Greater(FactorioServ.Version) {
+		return fmt.Errorf("save was created with factorio %s, installed is %s", header.FactorioVersion, FactorioServ.Version)
+	}
+
+	return nil
+}
+
+// validateSaveFile checks that the file is a factorio save, that can be loaded by the installed factorio
+func validateSaveFile(path string) (SaveHeader, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return SaveHeader{}, fmt.Errorf("file is not a zip archive: %v", err)
+	}
+	archive.Close()
+
+	header, err := readSaveHeader(path)
+	if err != nil {
+		return header, err
+	}
+
+	return header, checkSaveCompatibility(header)
+}
+
+// availableSaveName returns the first name with a counter appended, which is not used yet
+func availableSaveName(name string) string {
+	base := strings.TrimSuffix(name, ".zip")
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d).zip", base, i)
+		if _, err := os.Stat(filepath.Join(config.FactorioSavesDir, candidate)); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// storeSave moves the validated file at tmpPath into the saves directory and returns the name it is stored with
+func storeSave(tmpPath string, name string, onConflict string) (string, error) {
+	saveFilesLock.Lock()
+	defer saveFilesLock.Unlock()
+
+	savePath := filepath.Join(config.FactorioSavesDir, name)
+
+	_, err := os.Stat(savePath)
+	if err == nil {
+		switch onConflict {
+		case saveConflictOverwrite:
+			if saveInUse(name) {
+				return "", fmt.Errorf("cannot overwrite %s: %w", name, ErrSaveInUse)
+			}
+			// the recorded data belongs to the replaced save
+			for _, path := range saveSidecarPaths(savePath) {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return "", err
+				}
+			}
+		case saveConflictRename:
+			name = availableSaveName(name)
+			savePath = filepath.Join(config.FactorioSavesDir, name)
+		default:
+			return "", fmt.Errorf("%s: %w", name, ErrSaveExists)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	err = os.Rename(tmpPath, savePath)
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// uploadSave stages the uploaded file next to the saves, validates it and stores it under the sanitized name
+func uploadSave(file io.Reader, filename string, onConflict string) (string, error) {
+	name, err := sanitizeSaveName(filename)
+	if err != nil {
+		return "", err
+	}
+
+	// staging in the saves directory makes sure the final rename is atomic
+	tmp, err := ioutil.TempFile(config.FactorioSavesDir, ".upload-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, file)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = validateSaveFile(tmp.Name())
+	if err != nil {
+		return "", fmt.Errorf("invalid save %s: %w", name, err)
+	}
+
+	return storeSave(tmp.Name(), name, onConflict)
 }
 
 // Create savefiles for Factorio
-func createSave(filePath string) (string, error) {
-	err := os.MkdirAll(filepath.Base(filePath), 0755)
+// If settings are given, they are passed to factorio and recorded next to the save.
+// Factorio is killed, when the context is cancelled.
+func createSave(ctx context.Context, filePath string, settings *SaveMapSettings) (string, error) {
+	// factorio overwrites an existing save without asking
+	err := checkNewSavePath(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
 	if err != nil {
 		log.Printf("Error in creating Factorio save: %s", err)
 		return "", err
 	}
 
-	args := []string{"--create", filePath}
-	cmdOutput, err := exec.Command(config.FactorioBinary, args...).Output()
+	// the save is created next to its final path and only moved there, if the name is still free
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), ".create-*.zip")
 	if err != nil {
 		log.Printf("Error in creating Factorio save: %s", err)
 		return "", err
 	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	args := []string{"--create", tmp.Name()}
+
+	if settings != nil {
+		mapGenFile, err := writeTempJson("map-gen-settings-*.json", settings.MapGenSettings)
+		if err != nil {
+			log.Printf("Error writing map-gen-settings: %s", err)
+			return "", err
+		}
+		defer os.Remove(mapGenFile)
+
+		mapSettingsFile, err := writeTempJson("map-settings-*.json", settings.MapSettings)
+		if err != nil {
+			log.Printf("Error writing map-settings: %s", err)
+			return "", err
+		}
+		defer os.Remove(mapSettingsFile)
+
+		args = append(args, "--map-gen-settings", mapGenFile, "--map-settings", mapSettingsFile)
+	}
+
+	cmdOutput, err := factorioCommandContext(ctx, args...).Output()
+	if err != nil {
+		log.Printf("Error in creating Factorio save: %s", err)
+		return "", err
+	}
+
+	err = storeCreatedSave(tmp.Name(), filePath, settings)
+	if err != nil {
+		log.Printf("Error storing the created save: %s", err)
+		return "", err
+	}
 
 	result := string(cmdOutput)
 
 	return result, nil
 }
+
+// storeCreatedSave moves the save created at tmpPath to the path and records its settings.
+// The path is checked again, a save may have been stored there while factorio created it.
+func storeCreatedSave(tmpPath string, filePath string, settings *SaveMapSettings) error {
+	saveFilesLock.Lock()
+	defer saveFilesLock.Unlock()
+
+	err := checkNewSavePath(filePath)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Ext(filePath) != ".zip" {
+		filePath += ".zip"
+	}
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		return err
+	}
+
+	if settings != nil {
+		err = settings.save(filePath)
+		if err != nil {
+			log.Printf("Error recording map settings of the save: %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkNewSavePath returns ErrSaveExists, if a save is already stored at the path.
+// Factorio adds the .zip extension to the created save, if it is missing.
+func checkNewSavePath(filePath string) error {
+	paths := []string{filePath}
+	if filepath.Ext(filePath) != ".zip" {
+		paths = append(paths, filePath+".zip")
+	}
+
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), ErrSaveExists)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveArchiveDir is the subdirectory of the saves, archived saves are moved to.
+// Saves in it are not listed, so they can't be started.
+func saveArchiveDir() string {
+	return filepath.Join(config.FactorioSavesDir, "archive")
+}
+
+// moveSaveFiles moves the save and the files recorded next to it, it fails if the destination exists
+func moveSaveFiles(fromPath string, toPath string) error {
+	if _, err := os.Stat(toPath); err == nil {
+		return fmt.Errorf("%s: %w", filepath.Base(toPath), ErrSaveExists)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	err := os.Rename(fromPath, toPath)
+	if err != nil {
+		return err
+	}
+
+	toSidecars := saveSidecarPaths(toPath)
+	for i, path := range saveSidecarPaths(fromPath) {
+		err := os.Rename(path, toSidecars[i])
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("error moving %s along with its save: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies the file, it fails if the destination exists
+func copyFile(fromPath string, toPath string) error {
+	from, err := os.Open(fromPath)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := os.OpenFile(toPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(to, from)
+	if closeErr := to.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(toPath)
+		return err
+	}
+
+	return nil
+}
+
+// rename gives the save a new name, the recorded map settings are kept
+func (s *Save) rename(newName string) (string, error) {
+	newName, err := sanitizeSaveName(newName)
+	if err != nil {
+		return "", err
+	}
+
+	saveFilesLock.Lock()
+	defer saveFilesLock.Unlock()
+
+	if saveInUse(s.Name) {
+		return "", fmt.Errorf("cannot rename %s: %w", s.Name, ErrSaveInUse)
+	}
+
+	err = moveSaveFiles(filepath.Join(config.FactorioSavesDir, s.Name), filepath.Join(config.FactorioSavesDir, newName))
+	if err != nil {
+		return "", err
+	}
+
+	return newName, nil
+}
+
+// duplicate copies the save and its recorded map settings to a new name
+func (s *Save) duplicate(newName string) (string, error) {
+	newName, err := sanitizeSaveName(newName)
+	if err != nil {
+		return "", err
+	}
+
+	saveFilesLock.Lock()
+	defer saveFilesLock.Unlock()
+
+	if saveInUse(s.Name) {
+		return "", fmt.Errorf("cannot copy %s: %w", s.Name, ErrSaveInUse)
+	}
+
+	savePath := filepath.Join(config.FactorioSavesDir, s.Name)
+	newPath := filepath.Join(config.FactorioSavesDir, newName)
+
+	err = copyFile(savePath, newPath)
+	if os.IsExist(err) {
+		return "", fmt.Errorf("%s: %w", newName, ErrSaveExists)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = copyFile(mapSettingsPath(savePath), mapSettingsPath(newPath))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("error copying map settings of save %s: %s", s.Name, err)
+	}
+
+	return newName, nil
+}
+
+// archive moves the save into the archive directory
+func (s *Save) archive() error {
+	saveFilesLock.Lock()
+	defer saveFilesLock.Unlock()
+
+	if saveInUse(s.Name) {
+		return fmt.Errorf("cannot archive %s: %w", s.Name, ErrSaveInUse)
+	}
+
+	err := os.MkdirAll(saveArchiveDir(), 0755)
+	if err != nil {
+		return err
+	}
+
+	return moveSaveFiles(filepath.Join(config.FactorioSavesDir, s.Name), filepath.Join(saveArchiveDir(), s.Name))
+}
+
+// restoreArchivedSave moves the save from the archive back to the saves
+func restoreArchivedSave(name string) error {
+	if name == "" || filepath.Base(name) != name {
+		return fmt.Errorf("invalid save name: %s", name)
+	}
+
+	saveFilesLock.Lock()
+	defer saveFilesLock.Unlock()
+
+	archivePath := filepath.Join(saveArchiveDir(), name)
+	if _, err := os.Stat(archivePath); err != nil {
+		return errors.New("save not found in archive")
+	}
+
+	return moveSaveFiles(archivePath, filepath.Join(config.FactorioSavesDir, name))
+}
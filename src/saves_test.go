@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSanitizeSaveName(t *testing.T) {
+	names := map[string]string{
+		"my save.zip":             "my save.zip",
+		"my save":                 "my save.zip",
+		"MEGABASE.ZIP":            "MEGABASE.zip",
+		"../../etc/passwd":        "passwd.zip",
+		"..\\..\\server.zip":      "server.zip",
+		"C:\\Users\\me\\save.zip": "save.zip",
+		".hidden.zip":             "hidden.zip",
+		"a<b>c:d.zip":             "abcd.zip",
+	}
+
+	for name, expected := range names {
+		sanitized, err := sanitizeSaveName(name)
+		if err != nil {
+			t.Errorf("Error sanitizing %q: %s", name, err)
+		} else if sanitized != expected {
+			t.Errorf("Sanitized name of %q not equal: %s --- %s", name, sanitized, expected)
+		}
+	}
+
+	for _, name := range []string{"", "..", "/", ".zip", "\x00\x01"} {
+		if sanitized, err := sanitizeSaveName(name); err == nil {
+			t.Errorf("Expected error sanitizing %q, got: %s", name, sanitized)
+		}
+	}
+}
+
+func TestCheckNewSavePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-saves")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "taken.zip"), []byte("save"), 0644); err != nil {
+		t.Fatalf("Error writing save: %s", err)
+	}
+
+	paths := map[string]bool{
+		"taken.zip": true,
+		"taken":     true,
+		"free.zip":  false,
+		"free":      false,
+	}
+	for name, exists := range paths {
+		err := checkNewSavePath(filepath.Join(dir, name))
+		if errors.Is(err, ErrSaveExists) != exists {
+			t.Errorf("Unexpected result for %s: %v", name, err)
+		}
+	}
+}
+
+func TestCreateSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-saves")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// factorio writes the save given with --create, a save named "raced" is stored by someone else meanwhile
+	binary := filepath.Join(dir, "factorio")
+	script := "#!/bin/sh\necho created > \"$2\"\ncase \"$2\" in */.create-*) ;; *) exit 1;; esac\n" +
+		"[ -n \"$RACE\" ] && echo other > \"$RACE\"\nexit 0\n"
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatalf("Error writing factorio script: %s", err)
+	}
+	factorioBinary := config.FactorioBinary
+	defer func() { config.FactorioBinary = factorioBinary }()
+	config.FactorioBinary = binary
+
+	seed := uint32(1)
+	settings := &SaveMapSettings{MapGenSettings: MapGenSettings{Seed: &seed}}
+	if _, err := createSave(context.Background(), filepath.Join(dir, "new"), settings); err != nil {
+		t.Fatalf("Error creating save: %s", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "new.zip")); err != nil || string(data) != "created\n" {
+		t.Errorf("Created save not stored: %q, %v", data, err)
+	}
+	if _, err := loadSaveMapSettings(filepath.Join(dir, "new.zip")); err != nil {
+		t.Errorf("Map settings not recorded: %s", err)
+	}
+
+	os.Setenv("RACE", filepath.Join(dir, "raced.zip"))
+	defer os.Unsetenv("RACE")
+	if _, err := createSave(context.Background(), filepath.Join(dir, "raced.zip"), nil); !errors.Is(err, ErrSaveExists) {
+		t.Errorf("Expected ErrSaveExists, got: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "raced.zip")); string(data) != "other\n" {
+		t.Errorf("Save stored meanwhile overwritten: %q", data)
+	}
+
+	saves, _ := listSaves(dir)
+	if len(saves) != 2 {
+		t.Errorf("Listed saves not equal: %+v --- [new.zip raced.zip]", saves)
+	}
+}
+
+func TestResolveSaveName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-saves")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savesDir := config.FactorioSavesDir
+	defer func() { config.FactorioSavesDir = savesDir }()
+	config.FactorioSavesDir = dir
+
+	if _, err := resolveSaveName(loadLatestSave); err == nil {
+		t.Errorf("Expected error resolving the latest save without saves")
+	}
+
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"old.zip": time.Hour, "new.zip": time.Minute, "older.zip": 2 * time.Hour} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("save"), 0644); err != nil {
+			t.Fatalf("Error writing save: %s", err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatalf("Error changing time of save: %s", err)
+		}
+	}
+
+	if name, err := resolveSaveName(loadLatestSave); err != nil || name != "new.zip" {
+		t.Errorf("Latest save not equal: %s %v --- new.zip", name, err)
+	}
+	if name, err := resolveSaveName("old.zip"); err != nil || name != "old.zip" {
+		t.Errorf("Resolved save not equal: %s %v --- old.zip", name, err)
+	}
+}
+
+func TestChunkedSaveUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-upload")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.UploadSessionDir = filepath.Join(dir, "uploads")
+	config.FactorioSavesDir = filepath.Join(dir, "saves")
+	config.MaxChunkedUploadSize = 1 << 20
+	FactorioServ = &FactorioServer{}
+	if err := os.MkdirAll(config.FactorioSavesDir, 0755); err != nil {
+		t.Fatalf("Error creating saves dir: %s", err)
+	}
+
+	data, err := ioutil.ReadFile("factorio_save_testfiles/test_0_17.zip")
+	if err != nil {
+		t.Fatalf("Error reading test save: %s", err)
+	}
+	sum := sha256.Sum256(data)
+
+	session, err := newUploadSession(uploadKindSave, "../megabase.zip", int64(len(data)), "")
+	if err != nil {
+		t.Fatalf("Error creating upload session: %s", err)
+	}
+
+	half := int64(len(data) / 2)
+	if err := session.writeChunk(0, bytes.NewReader(data[:half])); err != nil {
+		t.Fatalf("Error writing first chunk: %s", err)
+	}
+	if err := session.writeChunk(0, bytes.NewReader(data[:half])); !errors.Is(err, ErrUploadOffset) {
+		t.Fatalf("Expected offset error on resent chunk, got: %v", err)
+	}
+
+	// resume from the stored state
+	session, err = loadUploadSession(session.ID)
+	if err != nil {
+		t.Fatalf("Error loading upload session: %s", err)
+	}
+	if session.Received != half {
+		t.Fatalf("Received size not equal: %d --- %d", session.Received, half)
+	}
+	if err := session.writeChunk(half, bytes.NewReader(append(data[half:], 0))); err == nil {
+		t.Fatalf("Expected error on chunk exceeding the upload size")
+	}
+	if err := session.writeChunk(half, bytes.NewReader(data[half:])); err != nil {
+		t.Fatalf("Error writing second chunk: %s", err)
+	}
+
+	if _, err := session.finalize(context.Background(), "0000"); err == nil {
+		t.Fatalf("Expected error on wrong checksum")
+	}
+	unlock, err := lockUploadSession(session.ID)
+	if err != nil {
+		t.Fatalf("Error locking upload session: %s", err)
+	}
+	name, err := session.finalize(context.Background(), hex.EncodeToString(sum[:]))
+	unlock()
+	if err != nil {
+		t.Fatalf("Error finalizing upload: %s", err)
+	}
+	if name != "megabase.zip" {
+		t.Errorf("Name of uploaded save not equal: %s --- megabase.zip", name)
+	}
+	if _, err := os.Stat(filepath.Join(config.FactorioSavesDir, name)); err != nil {
+		t.Errorf("Uploaded save not stored: %s", err)
+	}
+	if _, err := loadUploadSession(session.ID); err == nil {
+		t.Errorf("Upload session not removed after finalizing")
+	}
+
+	// locks are neither kept for finished nor created for unknown sessions
+	for _, id := range []string{session.ID, "0123abcd", "../uploads"} {
+		if _, err := lockUploadSession(id); err == nil {
+			t.Errorf("Expected error locking upload session %s", id)
+		}
+	}
+	uploadSessionLocks.Lock()
+	locks := len(uploadSessionLocks.locks)
+	uploadSessionLocks.Unlock()
+	if locks != 0 {
+		t.Errorf("Upload session locks not removed: %d", locks)
+	}
+}
+
+func TestArchiveSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-saves")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.FactorioSavesDir = dir
+	FactorioServ = &FactorioServer{}
+
+	for _, name := range []string{"a.zip", "a.settings.json", "b.zip"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Error writing %s: %s", name, err)
+		}
+	}
+
+	save := Save{Name: "a.zip"}
+	if err := save.archive(); err != nil {
+		t.Fatalf("Error archiving save: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(saveArchiveDir(), "a.settings.json")); err != nil {
+		t.Errorf("Map settings not archived with the save: %s", err)
+	}
+
+	saves, err := listSaves(dir)
+	if err != nil {
+		t.Fatalf("Error listing saves: %s", err)
+	}
+	if len(saves) != 1 || saves[0].Name != "b.zip" {
+		t.Errorf("Expected only b.zip to be listed, got: %v", saves)
+	}
+
+	if err := restoreArchivedSave("a.zip"); err != nil {
+		t.Fatalf("Error restoring save: %s", err)
+	}
+	if _, err := save.rename("b"); !errors.Is(err, ErrSaveExists) {
+		t.Errorf("Expected rename onto existing save to fail, got: %v", err)
+	}
+	if _, err := save.duplicate("c"); err != nil {
+		t.Errorf("Error copying save: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.settings.json")); err != nil {
+		t.Errorf("Map settings not copied with the save: %s", err)
+	}
+
+	// the newest save is in use, if the server loaded the latest save
+	now := time.Now()
+	for _, name := range []string{"a.zip", "c.zip"} {
+		os.Chtimes(filepath.Join(dir, name), now.Add(-time.Hour), now.Add(-time.Hour))
+	}
+	os.Chtimes(filepath.Join(dir, "b.zip"), now, now)
+	if err := FactorioServ.loadSave(loadLatestSave); err != nil {
+		t.Fatalf("Error loading save: %s", err)
+	}
+	if _, err := (&Save{Name: "b.zip"}).rename("d"); !errors.Is(err, ErrSaveInUse) {
+		t.Errorf("Expected rename of the loaded save to fail, got: %v", err)
+	}
+	if err := (&Save{Name: "b.zip"}).archive(); !errors.Is(err, ErrSaveInUse) {
+		t.Errorf("Expected archive of the loaded save to fail, got: %v", err)
+	}
+	if err := (&Save{Name: "b.zip"}).remove(); !errors.Is(err, ErrSaveInUse) {
+		t.Errorf("Expected removal of the loaded save to fail, got: %v", err)
+	}
+	if _, err := save.rename("d"); err != nil {
+		t.Errorf("Error renaming save not in use: %s", err)
+	}
+}
+
+func TestCompareSaveMods(t *testing.T) {
+	FactorioServ = &FactorioServer{Version: Version{1, 1, 100}}
+
+	header := SaveHeader{
+		FactorioVersion: Version{1, 1, 110, 0},
+		Mods: []Mod{
+			{Name: "base", Version: Version{1, 1, 110}},
+			{Name: "Warehousing", Version: Version{0, 5, 0}},
+			{Name: "FNEI", Version: Version{0, 4, 1}},
+			{Name: "LTN", Version: Version{1, 16, 0}},
+		},
+	}
+	mods := Mods{
+		ModSimpleList: ModSimpleList{Mods: []ModSimple{
+			{Name: "base", Enabled: true},
+			{Name: "Warehousing", Enabled: true},
+			{Name: "FNEI", Enabled: false},
+			{Name: "Bottleneck", Enabled: true},
+		}},
+		ModInfoList: ModInfoList{Mods: []ModInfo{
+			{Name: "Warehousing", Version: "0.5.1"},
+			{Name: "FNEI", Version: "0.4.1"},
+			{Name: "Bottleneck", Version: "0.11.0"},
+		}},
+	}
+
+	preflight := compareSaveMods(header, &mods)
+
+	if preflight.Compatible || preflight.VersionError == "" {
+		t.Errorf("Save of a newer factorio version reported as compatible")
+	}
+	if len(preflight.Missing) != 2 || preflight.Missing[0].Name != "FNEI" || !preflight.Missing[0].Installed || preflight.Missing[1].Name != "LTN" || preflight.Missing[1].Installed {
+		t.Errorf("Unexpected missing mods: %+v", preflight.Missing)
+	}
+	if len(preflight.Extra) != 1 || preflight.Extra[0].Name != "Bottleneck" {
+		t.Errorf("Unexpected extra mods: %+v", preflight.Extra)
+	}
+	if len(preflight.VersionMismatch) != 1 || preflight.VersionMismatch[0].InstalledVersion != "0.5.1" || preflight.VersionMismatch[0].SaveVersion != "0.5.0" {
+		t.Errorf("Unexpected version mismatches: %+v", preflight.VersionMismatch)
+	}
+}
+
+func TestPlanModSync(t *testing.T) {
+	FactorioServ = &FactorioServer{Version: Version{1, 1, 110}}
+
+	header := SaveHeader{
+		FactorioVersion: Version{1, 1, 110, 0},
+		Mods: []Mod{
+			{Name: "base", Version: Version{1, 1, 110}},
+			{Name: "Warehousing", Version: Version{0, 5, 0}},
+			{Name: "FNEI", Version: Version{0, 4, 1}},
+			{Name: "LTN", Version: Version{1, 16, 0}},
+		},
+	}
+	mods := Mods{
+		ModSimpleList: ModSimpleList{Mods: []ModSimple{
+			{Name: "base", Enabled: false},
+			{Name: "FNEI", Enabled: false},
+			{Name: "Bottleneck", Enabled: true},
+		}},
+		ModInfoList: ModInfoList{Mods: []ModInfo{
+			{Name: "Warehousing", Version: "0.5.1"},
+			{Name: "FNEI", Version: "0.4.1"},
+			{Name: "Bottleneck", Version: "0.11.0"},
+		}},
+	}
+
+	expected := map[string]string{
+		"base":        modSyncEnable,
+		"FNEI":        modSyncEnable,
+		"LTN":         modSyncInstall,
+		"Warehousing": modSyncReplace,
+		"Bottleneck":  modSyncDisable,
+	}
+
+	steps := planModSync(header, &mods)
+	if len(steps) != len(expected) {
+		t.Fatalf("Unexpected number of steps: %+v", steps)
+	}
+	for _, step := range steps {
+		if expected[step.Name] != step.Action {
+			t.Errorf("Action of %s not equal: %s --- %s", step.Name, step.Action, expected[step.Name])
+		}
+	}
+}
+
+func TestSaveFilter(t *testing.T) {
+	save := Save{Name: "a.zip", Header: &SaveHeader{
+		FactorioVersion: Version{1, 1, 110, 0},
+		Mods: []Mod{
+			{Name: "base", Version: Version{1, 1, 110}},
+			{Name: "flib", Version: Version{0, 7, 0}},
+		},
+	}}
+
+	tests := []struct {
+		filter  SaveFilter
+		valid   bool
+		matches bool
+	}{
+		{SaveFilter{}, true, true},
+		{SaveFilter{Version: "1.1"}, true, true},
+		{SaveFilter{Version: "1.1.110.0"}, true, true},
+		{SaveFilter{Version: "1.0"}, true, false},
+		{SaveFilter{Mod: "flib"}, true, true},
+		{SaveFilter{Mod: "flib", ModVersion: "0.7"}, true, true},
+		{SaveFilter{Mod: "flib", ModVersion: "0.6"}, true, false},
+		{SaveFilter{Version: "1.1", Mod: "Krastorio2"}, true, false},
+		{SaveFilter{ModVersion: "0.7"}, false, false},
+		{SaveFilter{Version: "latest"}, false, false},
+		{SaveFilter{Version: "1.1.110.0.1"}, false, false},
+		{SaveFilter{Mod: "flib", ModVersion: "0.x"}, false, false},
+	}
+	for _, test := range tests {
+		err := test.filter.validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Filter %+v valid not equal: %v --- %v", test.filter, err == nil, test.valid)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if filtered := filterSaves([]Save{save}, test.filter); (len(filtered) == 1) != test.matches {
+			t.Errorf("Filter %+v matches not equal: %v --- %v", test.filter, len(filtered) == 1, test.matches)
+		}
+	}
+
+	// saves, whose header couldn't be read, only match the empty filter
+	if filtered := filterSaves([]Save{{Name: "b.zip"}}, SaveFilter{Version: "1.1"}); len(filtered) != 0 {
+		t.Errorf("Save without header matched: %v", filtered)
+	}
+}
+
+func TestSaveHeaderCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-saves")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saveData, err := ioutil.ReadFile(filepath.Join("factorio_save_testfiles", "test_0_17.zip"))
+	if err != nil {
+		t.Fatalf("Error reading test save: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.zip"), saveData, 0644); err != nil {
+		t.Fatalf("Error writing save: %s", err)
+	}
+
+	saves, err := listSaves(dir)
+	if err != nil {
+		t.Fatalf("Error listing saves: %s", err)
+	}
+	loadHeaders(dir, saves)
+	if saves[0].Header == nil {
+		t.Fatalf("Header of save not loaded: %s", saves[0].HeaderError)
+	}
+
+	// an unchanged save is served from the cache
+	path := filepath.Join(dir, "a.zip")
+	saveHeaderCache.Lock()
+	entry := saveHeaderCache.entries[path]
+	entry.header.Name = "cached"
+	saveHeaderCache.entries[path] = entry
+	saveHeaderCache.Unlock()
+	if header, err := cachedSaveHeader(path, saves[0].LastMod, saves[0].Size); err != nil || header.Name != "cached" {
+		t.Errorf("Header not served from cache: %s %v", header.Name, err)
+	}
+	// a changed save is read again
+	if header, err := cachedSaveHeader(path, saves[0].LastMod.Add(time.Second), saves[0].Size); err != nil || header.Name == "cached" {
+		t.Errorf("Header of changed save served from cache: %s %v", header.Name, err)
+	}
+
+	// entries of deleted saves are dropped on the next listing, other directories are kept
+	otherPath := filepath.Join(dir, "other", "b.zip")
+	saveHeaderCache.Lock()
+	saveHeaderCache.entries[otherPath] = saveHeaderCacheEntry{}
+	saveHeaderCache.Unlock()
+	defer func() {
+		saveHeaderCache.Lock()
+		delete(saveHeaderCache.entries, otherPath)
+		saveHeaderCache.Unlock()
+	}()
+
+	os.Remove(path)
+	saves, err = listSaves(dir)
+	if err != nil {
+		t.Fatalf("Error listing saves: %s", err)
+	}
+	loadHeaders(dir, saves)
+
+	saveHeaderCache.Lock()
+	_, found := saveHeaderCache.entries[path]
+	_, otherFound := saveHeaderCache.entries[otherPath]
+	saveHeaderCache.Unlock()
+	if found {
+		t.Errorf("Header of deleted save still cached")
+	}
+	if !otherFound {
+		t.Errorf("Header of save in other directory dropped")
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kinds of files, that can be uploaded in chunks
+const (
+	uploadKindSave = "save"
+	uploadKindMod  = "mod"
+)
+
+// uploadSessionTimeout is the time after the last received chunk, after which a session is removed
+const uploadSessionTimeout = 24 * time.Hour
+
+// ErrUploadOffset is returned, when a chunk doesn't start at the end of the already received data
+var ErrUploadOffset = errors.New("chunk offset does not match the received size")
+
+// UploadSession is a resumable upload of a single file, which is sent in multiple chunks.
+// The received data is appended to a part file, its size is the offset for the next chunk.
+type UploadSession struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Filename   string    `json:"filename"`
+	Size       int64     `json:"size"`
+	OnConflict string    `json:"on_conflict,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	Received   int64     `json:"received"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// uploadSessionLocks makes sure only one request at a time writes to a session.
+// A lock only exists, while requests hold or wait for it.
+var uploadSessionLocks = struct {
+	sync.Mutex
+	locks map[string]*uploadSessionLock
+}{locks: make(map[string]*uploadSessionLock)}
+
+type uploadSessionLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockUploadSession waits for the lock of the existing session and returns the func releasing it
+func lockUploadSession(id string) (func(), error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, fmt.Errorf("invalid upload session id: %s", id)
+	}
+
+	uploadSessionLocks.Lock()
+	lock, ok := uploadSessionLocks.locks[id]
+	if !ok {
+		if _, err := os.Stat(filepath.Join(config.UploadSessionDir, id+".json")); err != nil {
+			uploadSessionLocks.Unlock()
+			return nil, err
+		}
+		lock = &uploadSessionLock{}
+		uploadSessionLocks.locks[id] = lock
+	}
+	lock.refs++
+	uploadSessionLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		uploadSessionLocks.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(uploadSessionLocks.locks, id)
+		}
+		uploadSessionLocks.Unlock()
+	}, nil
+}
+
+func (session *UploadSession) metaPath() string {
+	return filepath.Join(config.UploadSessionDir, session.ID+".json")
+}
+
+func (session *UploadSession) partPath() string {
+	return filepath.Join(config.UploadSessionDir, session.ID+".part")
+}
+
+func newUploadSession(kind string, filename string, size int64, onConflict string) (UploadSession, error) {
+	var err error
+	session := UploadSession{
+		Kind:       kind,
+		Filename:   filepath.Base(filename),
+		Size:       size,
+		OnConflict: onConflict,
+		CreatedAt:  time.Now(),
+	}
+
+	if kind != uploadKindSave && kind != uploadKindMod {
+		return session, fmt.Errorf("unknown upload kind: %s", kind)
+	}
+	if filepath.Ext(session.Filename) != ".zip" {
+		return session, errors.New("only zip files can be uploaded")
+	}
+	if size <= 0 || size > config.MaxChunkedUploadSize {
+		return session, fmt.Errorf("upload size has to be between 1 and %d bytes", config.MaxChunkedUploadSize)
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return session, err
+	}
+	session.ID = hex.EncodeToString(id)
+
+	err = os.MkdirAll(config.UploadSessionDir, 0755)
+	if err != nil {
+		log.Printf("error creating upload session dir: %s", err)
+		return session, err
+	}
+
+	err = ioutil.WriteFile(session.partPath(), nil, 0644)
+	if err != nil {
+		log.Printf("error creating upload part file: %s", err)
+		return session, err
+	}
+
+	data, err := json.MarshalIndent(session, "", "    ")
+	if err != nil {
+		return session, err
+	}
+	err = ioutil.WriteFile(session.metaPath(), data, 0644)
+	if err != nil {
+		log.Printf("error writing upload session: %s", err)
+		os.Remove(session.partPath())
+		return session, err
+	}
+
+	session.UpdatedAt = session.CreatedAt
+	return session, nil
+}
+
+// loadUploadSession reads the session and the state of its part file
+func loadUploadSession(id string) (UploadSession, error) {
+	var session UploadSession
+
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return session, fmt.Errorf("invalid upload session id: %s", id)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(config.UploadSessionDir, id+".json"))
+	if err != nil {
+		return session, err
+	}
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return session, err
+	}
+	session.ID = id
+
+	info, err := os.Stat(session.partPath())
+	if err != nil {
+		return session, err
+	}
+	session.Received = info.Size()
+	session.UpdatedAt = info.ModTime()
+
+	return session, nil
+}
+
+// writeChunk appends the chunk to the received data.
+// The offset has to match the received size, so chunks are neither lost nor written twice.
+func (session *UploadSession) writeChunk(offset int64, chunk io.Reader) error {
+	if offset != session.Received {
+		return fmt.Errorf("%w: got %d, received %d", ErrUploadOffset, offset, session.Received)
+	}
+
+	part, err := os.OpenFile(session.partPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	// read one byte more than allowed to detect chunks exceeding the announced size
+	n, err := io.Copy(part, io.LimitReader(chunk, session.Size-session.Received+1))
+	if err == nil && session.Received+n > session.Size {
+		err = fmt.Errorf("chunk exceeds the upload size of %d bytes", session.Size)
+	}
+	if err != nil {
+		// drop incomplete chunks, so the client can resend them from the last offset
+		if truncErr := part.Truncate(session.Received); truncErr != nil {
+			log.Printf("error truncating upload part file: %s", truncErr)
+		}
+		return err
+	}
+
+	session.Received += n
+	session.UpdatedAt = time.Now()
+	return nil
+}
+
+// finalize verifies the checksum of the complete upload and installs the file as save or mod.
+// It returns the name the file is installed with.
+func (session *UploadSession) finalize(ctx context.Context, checksum string) (string, error) {
+	if session.Received != session.Size {
+		return "", fmt.Errorf("upload incomplete: received %d of %d bytes", session.Received, session.Size)
+	}
+
+	part, err := os.Open(session.partPath())
+	if err != nil {
+		return "", err
+	}
+	defer part.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, part)
+	if err != nil {
+		return "", err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, checksum) {
+		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, sum)
+	}
+
+	var name string
+	switch session.Kind {
+	case uploadKindSave:
+		_, err = part.Seek(0, io.SeekStart)
+		if err == nil {
+			name, err = uploadSave(part, session.Filename, session.OnConflict)
+		}
+	case uploadKindMod:
+		name, err = installUploadedMod(ctx, session.Filename, part, session.Size)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	part.Close()
+	session.remove()
+
+	return name, nil
+}
+
+// installUploadedMod installs the uploaded mod file, once no job changes the mods
+func installUploadedMod(ctx context.Context, filename string, file io.ReaderAt, size int64) (string, error) {
+	err := lockModsDir(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer unlockModsDir()
+
+	mods, err := newMods(config.FactorioModsDir)
+	if err != nil {
+		return "", err
+	}
+	return filename, mods.installModFile(filename, file, size)
+}
+
+func (session *UploadSession) remove() {
+	for _, path := range []string{session.partPath(), session.metaPath()} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing upload session file %s: %s", path, err)
+		}
+	}
+}
+
+// removeStaleUploadSessions removes all sessions, which didn't receive data within the timeout
+func removeStaleUploadSessions() {
+	files, err := filepath.Glob(filepath.Join(config.UploadSessionDir, "*.json"))
+	if err != nil {
+		log.Printf("error listing upload sessions: %s", err)
+		return
+	}
+
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+
+		unlock, err := lockUploadSession(id)
+		if err != nil {
+			// the session was removed meanwhile
+			continue
+		}
+		session, err := loadUploadSession(id)
+		if err != nil {
+			// sessions, which can't be loaded, can't be resumed either
+			log.Printf("error loading upload session %s, removing it: %s", id, err)
+			session.ID = id
+			session.remove()
+		} else if time.Since(session.UpdatedAt) > uploadSessionTimeout {
+			log.Printf("removing stale upload session %s of %s", id, session.Filename)
+			session.remove()
+		}
+		unlock()
+	}
+}
+
+// cleanUploadSessions periodically removes stale upload sessions
+func cleanUploadSessions() {
+	for {
+		removeStaleUploadSessions()
+		time.Sleep(time.Hour)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"strconv"
 	"strings"
 )
@@ -103,20 +102,6 @@ func (v *version24) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
-// version24 is a 48-bit (16, 16, 16) optimized version structure
-type version48 Version
-
-func (v *version48) ReadFrom(r io.Reader, game Version) error {
-	for i := 0; i < 3; i++ {
-		n, err := readOptimUint(r, game, 16)
-		if err != nil {
-			return fmt.Errorf("read part %d of version: %v", i, err)
-		}
-		v[i] = uint(n)
-	}
-	return nil
-}
-
 // version64 is the 64-bit (16, 16, 16, 16) version structure with build component.
 type version64 Version
 
@@ -12,11 +12,13 @@ type Message struct {
 type FindHandler func(string) (Handler, bool)
 
 type Client struct {
-	send         chan Message
-	socket       *websocket.Conn
-	findHandler  FindHandler
-	stopChannels map[int]chan bool
-	id           string
+	send          chan Message
+	socket        *websocket.Conn
+	findHandler   FindHandler
+	stopChannels  map[int]chan bool
+	subscriptions map[string]bool
+	done          chan bool
+	id            string
 }
 
 func (client *Client) Read() {
@@ -33,26 +35,58 @@ func (client *Client) Read() {
 }
 
 func (client *Client) Write() {
-	for msg := range client.send {
-		if err := client.socket.WriteJSON(msg); err != nil {
-			break
+	defer client.socket.Close()
+	for {
+		select {
+		case msg := <-client.send:
+			if err := client.socket.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-client.done:
+			return
 		}
 	}
-	client.socket.Close()
 }
 
+// Close stops the subscriptions and the writer of the client.
+// The channels are closed instead of sent to, so it doesn't block on subscriptions, which already stopped.
 func (client *Client) Close() {
 	for _, ch := range client.stopChannels {
-		ch <- true
+		close(ch)
+	}
+	close(client.done)
+}
+
+// subscribe registers the subscription with the name and returns the channel, which is closed when the client goes away.
+// ok is false, if the client already subscribed under the name.
+func (client *Client) subscribe(name string) (stop chan bool, ok bool) {
+	if client.subscriptions[name] {
+		return nil, false
+	}
+	client.subscriptions[name] = true
+
+	stop = make(chan bool)
+	client.stopChannels[len(client.stopChannels)] = stop
+	return stop, true
+}
+
+// sendUntil sends the message to the client, unless stop is closed before the writer takes it
+func (client *Client) sendUntil(msg Message, stop <-chan bool) bool {
+	select {
+	case client.send <- msg:
+		return true
+	case <-stop:
+		return false
 	}
-	close(client.send)
 }
 
 func NewClient(socket *websocket.Conn, findHandler FindHandler) *Client {
 	return &Client{
-		send:         make(chan Message),
-		socket:       socket,
-		findHandler:  findHandler,
-		stopChannels: make(map[int]chan bool),
+		send:          make(chan Message),
+		socket:        socket,
+		findHandler:   findHandler,
+		stopChannels:  make(map[int]chan bool),
+		subscriptions: make(map[string]bool),
+		done:          make(chan bool),
 	}
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// closeClient closes the client and fails, if that blocks
+func closeClient(t *testing.T, client *Client) {
+	closed := make(chan bool)
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close blocked by a subscription")
+	}
+}
+
+func TestServerStatusSubscribe(t *testing.T) {
+	server := FactorioServ
+	defer func() { FactorioServ = server }()
+	FactorioServ = &FactorioServer{}
+
+	// without writer, as if it quit on a socket error
+	client := NewClient(nil, nil)
+	serverStatusSubscribe(client, nil)
+	serverStatusSubscribe(client, nil)
+	if len(client.stopChannels) != 1 {
+		t.Errorf("Subscriptions not equal: %d --- 1", len(client.stopChannels))
+	}
+
+	closeClient(t, client)
+}
+
+func TestJobsSubscribe(t *testing.T) {
+	client := NewClient(nil, nil)
+	jobsSubscribe(client, nil)
+	jobsSubscribe(client, nil)
+	if len(client.stopChannels) != 1 {
+		t.Errorf("Subscriptions not equal: %d --- 1", len(client.stopChannels))
+	}
+
+	closeClient(t, client)
+}
+
+func TestModUpdatesSubscribe(t *testing.T) {
+	client := NewClient(nil, nil)
+	modUpdatesSubscribe(client, nil)
+	modUpdatesSubscribe(client, nil)
+	if len(client.stopChannels) != 1 {
+		t.Errorf("Subscriptions not equal: %d --- 1", len(client.stopChannels))
+	}
+
+	closeClient(t, client)
+}
@@ -23,7 +23,7 @@ func logSubscribe(client *Client, data interface{}) {
 }
 
 func commandSend(client *Client, data interface{}) {
-	if FactorioServ.Running {
+	if FactorioServ.State() == ServerRunning {
 		go func() {
 			log.Printf("Received command: %v", data)
 
@@ -39,3 +39,86 @@ func commandSend(client *Client, data interface{}) {
 		}()
 	}
 }
+
+func serverStatusSubscribe(client *Client, data interface{}) {
+	stop, ok := client.subscribe("server status")
+	if !ok {
+		return
+	}
+	changes, unsubscribe := FactorioServ.Subscribe()
+
+	go func() {
+		defer unsubscribe()
+
+		if !client.sendUntil(Message{"server status", FactorioServ.State()}, stop) {
+			return
+		}
+
+		for {
+			select {
+			case change := <-changes:
+				if !client.sendUntil(Message{"server status", change}, stop) {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// jobsSubscribe sends the current jobs and every following change of a job to the client
+func jobsSubscribe(client *Client, data interface{}) {
+	stop, ok := client.subscribe("jobs")
+	if !ok {
+		return
+	}
+	updates, unsubscribe := jobs.subscribe()
+
+	go func() {
+		defer unsubscribe()
+
+		if !client.sendUntil(Message{"jobs", jobs.list()}, stop) {
+			return
+		}
+
+		for {
+			select {
+			case job := <-updates:
+				if !client.sendUntil(Message{"job update", job}, stop) {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// modUpdatesSubscribe sends the last check for mod updates and the result of every following check to the client
+func modUpdatesSubscribe(client *Client, data interface{}) {
+	stop, ok := client.subscribe("mod updates")
+	if !ok {
+		return
+	}
+	checks, unsubscribe := subscribeModUpdates()
+
+	go func() {
+		defer unsubscribe()
+
+		if !client.sendUntil(Message{"mod updates", lastModUpdateCheck()}, stop) {
+			return
+		}
+
+		for {
+			select {
+			case check := <-checks:
+				if !client.sendUntil(Message{"mod updates", check}, stop) {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -2,6 +2,7 @@ import React from 'react';
 import {instanceOfModsContent} from "./ModsPropTypes";
 import PropTypes from "prop-types";
 import {ReactSwalNormal} from 'Utilities/customSwal';
+import {followJob} from 'Utilities/jobs';
 
 class ModLoadSave extends React.Component {
     constructor(props) {
@@ -102,13 +103,20 @@ class ModLoadSave extends React.Component {
             dataType: "JSON",
             data: $("#swalForm").serialize(),
             success: (data) => {
-                ReactSwalNormal.fire({
-                    title: "All Mods installed successfully!",
-                    type: "success"
-                });
+                followJob(data.data).then(() => {
+                    ReactSwalNormal.fire({
+                        title: "All Mods installed successfully!",
+                        type: "success"
+                    });
+
+                    this.props.modContentClass.loadModList();
+                }, (err) => {
+                    ReactSwalNormal.fire({
+                        title: err,
+                        type: "error",
+                    });
 
-                this.props.modContentClass.setState({
-                    installedMods: data.data.mods
+                    this.props.modContentClass.loadModList();
                 });
             },
             error: (jqXHR) => {
@@ -5,6 +5,7 @@ import {instanceOfModsContent} from "../ModsPropTypes.js";
 import locks from "locks";
 import PropTypes from "prop-types";
 import {ReactSwalNormal, ReactSwalDanger} from 'Utilities/customSwal';
+import {followJob} from 'Utilities/jobs';
 import FontAwesomeIcon from "../../FontAwesomeIcon";
 
 class ModPackOverview extends React.Component {
@@ -189,13 +190,19 @@ class ModPackOverview extends React.Component {
                     data: {name: name},
                     dataType: "JSON",
                     success: (data) => {
-                        ReactSwalNormal.fire({
-                            title: "ModPack loaded!",
-                            type: "success"
-                        });
+                        followJob(data.data).then(() => {
+                            ReactSwalNormal.fire({
+                                title: "ModPack loaded!",
+                                type: "success"
+                            });
 
-                        this.props.modContentClass.setState({
-                            installedMods: data.data.mods
+                            this.props.modContentClass.loadModList();
+                        }, (err) => {
+                            ReactSwalNormal.fire({
+                                title: "Error on loading ModPack",
+                                text: err,
+                                type: "error"
+                            });
                         });
                     },
                     error: (jqXHR, status, err) => {
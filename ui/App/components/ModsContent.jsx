@@ -5,6 +5,7 @@ import ModOverview from './Mods/ModOverview.jsx';
 import locks from "locks";
 import SemVer from 'semver';
 import {ReactSwalNormal, ReactSwalDanger} from 'Utilities/customSwal';
+import {followJob} from 'Utilities/jobs';
 import FontAwesomeIcon from "./FontAwesomeIcon";
 
 class ModsContent extends React.Component {
@@ -141,13 +142,19 @@ class ModsContent extends React.Component {
                 modName: modName
             },
             success: (data) => {
-                this.setState({
-                    installedMods: data.data.mods
-                });
+                followJob(data.data).then(() => {
+                    this.loadModList();
 
-                ReactSwalNormal.fire({
-                    title: "Mod installed",
-                    type: "success"
+                    ReactSwalNormal.fire({
+                        title: "Mod installed",
+                        type: "success"
+                    });
+                }, (err) => {
+                    ReactSwalNormal.fire({
+                        title: "An error occurred",
+                        text: err,
+                        type: "error"
+                    });
                 });
             },
             error: (jqXHR, status, err) => {
@@ -457,12 +464,12 @@ class ModsContent extends React.Component {
                     modName: modName,
                 },
                 success: (data) => {
-                    toggleUpdateStatus();
-                    removeVersionAvailableStatus();
+                    followJob(data.data).then((mod) => {
+                        toggleUpdateStatus();
+                        removeVersionAvailableStatus();
 
-                    this.updateCountSubtract();
+                        this.updateCountSubtract();
 
-                    if(data.success) {
                         this.mutex.lock(() => {
                             ReactSwalNormal.fire({
                                 title: <p>Update of mod {modName} successful</p>,
@@ -472,7 +479,7 @@ class ModsContent extends React.Component {
 
                             installedMods.forEach((v, k) => {
                                 if(v.name == modName) {
-                                    installedMods[k] = data.data;
+                                    installedMods[k] = mod;
                                 }
                             });
 
@@ -482,7 +489,15 @@ class ModsContent extends React.Component {
 
                             this.mutex.unlock();
                         });
-                    }
+                    }, (err) => {
+                        toggleUpdateStatus();
+
+                        ReactSwalNormal.fire({
+                            title: "Update Mod went wrong",
+                            text: err,
+                            type: "error"
+                        });
+                    });
                 },
                 error: (jqXHR, status, err) => {
                     console.log('api/mods/delete', status, err.toString());
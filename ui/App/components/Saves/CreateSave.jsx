@@ -1,6 +1,7 @@
 import React from 'react';
 import PropTypes from 'prop-types';
 import FontAwesomeIcon from "../FontAwesomeIcon";
+import {followJob} from 'Utilities/jobs';
 
 class CreateSave extends React.Component {
     constructor(props) {
@@ -24,13 +25,23 @@ class CreateSave extends React.Component {
             success: (data) => {
                 console.log(data);
                 if (data.success === true) {
-                    alert(data.data)
-                    this.updateSavesList();
-                    this.setState({loading: false});
+                    followJob(data.data).then((output) => {
+                        alert("Save created successfully. Command output: \n" + output)
+                        this.updateSavesList();
+                        this.setState({loading: false});
+                    }, (err) => {
+                        alert("Error creating savefile: " + err)
+                        this.setState({loading: false});
+                    });
                 } else {
                     alert(data.data)
                     this.setState({loading: false});
                 }
+            },
+            error: (jqXHR) => {
+                let jsonResponse = jqXHR.responseJSON || {};
+                alert(jsonResponse.data || "Error creating savefile.")
+                this.setState({loading: false});
             }
         })
     }
@@ -0,0 +1,32 @@
+// Long running api calls answer with status 202 and the queued job.
+// followJob polls the job until it is finished and resolves with its result or rejects with its error.
+const pollInterval = 1000;
+
+export function followJob(job) {
+    return new Promise((resolve, reject) => {
+        const poll = () => {
+            $.ajax({
+                url: "/api/jobs/" + job.id,
+                dataType: "JSON",
+                success: (data) => {
+                    let current = data.data;
+                    switch (current.status) {
+                        case "done":
+                            resolve(current.result);
+                            break;
+                        case "failed":
+                        case "cancelled":
+                            reject(current.error || "Job " + current.status);
+                            break;
+                        default:
+                            setTimeout(poll, pollInterval);
+                    }
+                },
+                error: (jqXHR, status, err) => {
+                    reject(err.toString());
+                }
+            });
+        };
+        poll();
+    });
+}